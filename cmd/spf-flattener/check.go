@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dean-jl/spf-flattener/internal/config"
+	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Evaluate SPF for a client IP against the original and flattened records.",
+	Long: `Evaluate a domain's SPF record for a connecting client, as a receiving mail server would
+(the check_host() function of RFC 7208).
+
+The check runs twice: against the domain's current record and against the records the
+flatten command would publish for it (the flattened record split into spfN records).
+Each result is one of pass, fail, softfail, neutral, none, permerror or temperror and is
+reported with the matching term and the include/redirect path that led to it.
+
+DNS servers from the config file are used when it can be loaded, along with the
+domain's flattening settings (policy, max_lookups, keep_includes, always_flatten);
+otherwise the system resolver is used. With --dns-zone-dir or --replay-dns, lookups are
+answered from the zone files or DNS fixture instead. With --spf-unflat the spf-unflat.<domain> record is evaluated
+as the domain's original record.
+
+Examples:
+  # Will this IP pass SPF for example.com?
+  spf-flattener check --domain example.com --ip 203.0.113.5
+
+  # Include the sender and HELO name for records using macros
+  spf-flattener check --domain example.com --ip 2001:db8::25 --sender user@example.com --helo mx.example.org`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		ipFlag, _ := cmd.Flags().GetString("ip")
+		sender, _ := cmd.Flags().GetString("sender")
+		helo, _ := cmd.Flags().GetString("helo")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		ip := net.ParseIP(ipFlag)
+		if domain == "" || ip == nil {
+			cmd.PrintErrf("Error: --domain and a valid --ip are required\n")
+			return
+		}
+
+		domainConfig := config.Domain{Name: domain}
+		var dnsProvider spf.DNSProvider
+		cfg, err := config.LoadConfig(cliConfig.ConfigPath)
+		if err != nil {
+			verbosePrintlnf("[VERBOSE] Config not loaded (%v); using the default DNS resolver.\n", err)
+			dnsProvider = defaultDNSProvider()
+		} else if dnsProvider, err = setupDNSProvider(cfg); err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		} else {
+			for _, d := range cfg.Domains {
+				if d.Name == domain {
+					domainConfig = d
+				}
+			}
+		}
+		defer dnsProvider.Close()
+
+		ctx := context.Background()
+		req := spf.CheckRequest{IP: ip, Domain: domain, Sender: sender, HELO: helo}
+		var out strings.Builder
+
+		out.WriteString("SPF check for ")
+		out.WriteString(ip.String())
+		out.WriteString(" at ")
+		out.WriteString(domain)
+		if sender != "" {
+			out.WriteString(" (sender ")
+			out.WriteString(sender)
+			out.WriteString(")")
+		}
+		if helo != "" {
+			out.WriteString(" (HELO ")
+			out.WriteString(helo)
+			out.WriteString(")")
+		}
+		out.WriteString("\n\n")
+
+		spfLookupName := domain
+		if cliConfig.SpfUnflat {
+			spfLookupName = "spf-unflat." + domain
+		}
+		debugPrintlnf("[DEBUG] Flattening SPF from %s for comparison\n", spfLookupName)
+		flattenResult, flattenErr := spf.FlattenSPFWithOptions(ctx, spfLookupName, dnsProvider, flattenOptions(domainConfig, true))
+
+		var original *spf.CheckResult
+		if cliConfig.SpfUnflat && flattenErr == nil {
+			original = spf.CheckHostWithRecords(ctx, dnsProvider, req, map[string]string{domain: flattenResult.Original})
+		} else {
+			original = spf.CheckHost(ctx, dnsProvider, req)
+		}
+		out.WriteString("--- Original Record ---\n\n")
+		writeCheckResult(&out, domain, original)
+
+		out.WriteString("--- Flattened Records ---\n\n")
+		var chained map[string]string
+		if flattenErr == nil {
+			chained, flattenErr = spf.SplitAndChainSPFWithOptions(flattenResult.Flattened, domain, splitOptions(domainConfig))
+		}
+		if flattenErr != nil {
+			out.WriteString("Flattening failed: ")
+			out.WriteString(flattenErr.Error())
+			out.WriteString("\n")
+			handleOutput(cmd, outputFile, &out)
+			return
+		}
+		flattened := spf.CheckHostWithRecords(ctx, dnsProvider, req, chained)
+		writeCheckResult(&out, domain, flattened)
+
+		if original.Result == flattened.Result {
+			out.WriteString("Results match: ")
+			out.WriteString(string(original.Result))
+		} else {
+			out.WriteString("WARNING: results differ (original ")
+			out.WriteString(string(original.Result))
+			out.WriteString(", flattened ")
+			out.WriteString(string(flattened.Result))
+			out.WriteString(")")
+		}
+		out.WriteString("\n")
+		handleOutput(cmd, outputFile, &out)
+	},
+}
+
+// writeCheckResult formats one check_host() result for the check report.
+func writeCheckResult(out *strings.Builder, domain string, result *spf.CheckResult) {
+	out.WriteString("Result: ")
+	out.WriteString(string(result.Result))
+	out.WriteString("\n")
+	if result.Term != "" {
+		out.WriteString("Matched Term: ")
+		out.WriteString(result.Term)
+		out.WriteString("\n")
+	}
+	out.WriteString("Path: ")
+	out.WriteString(strings.Join(append([]string{domain}, result.Path...), " -> "))
+	if result.Domain != domain && result.Domain != "" {
+		out.WriteString(" (record of ")
+		out.WriteString(result.Domain)
+		out.WriteString(")")
+	}
+	out.WriteString("\n")
+	if result.Reason != "" {
+		out.WriteString("Reason: ")
+		out.WriteString(result.Reason)
+		out.WriteString("\n")
+	}
+	if result.Explanation != "" {
+		out.WriteString("Explanation: ")
+		out.WriteString(result.Explanation)
+		out.WriteString("\n")
+	}
+	fmt.Fprintf(out, "DNS Lookups: %d (void: %d)\n\n", result.Lookups, result.VoidLookups)
+}
+
+func init() {
+	checkCmd.Flags().String("domain", "", "Domain whose SPF record is evaluated")
+	checkCmd.Flags().String("ip", "", "IPv4 or IPv6 address of the connecting client")
+	checkCmd.Flags().String("sender", "", "MAIL FROM address (used by macros; defaults to postmaster@<helo>)")
+	checkCmd.Flags().String("helo", "", "HELO/EHLO name of the connecting client")
+	checkCmd.Flags().String("output", "", "Write output to a specified file instead of stdout")
+}
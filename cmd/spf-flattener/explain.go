@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/dean-jl/spf-flattener/internal/config"
+	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/spf13/cobra"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "Show which includes and records authorize a client IP.",
+	Long: `Answer "why is this IP allowed?" for a domain: list every path through the include tree
+whose terms cover the address, with the covering CIDR and the term's qualifier.
+
+Each path shows the include: and redirect= terms followed from the domain's record, the
+record holding the covering term, and what a match yields for the domain. An include
+matches only when the result inside it is pass, so a covering ~ip4: or -ip4: term inside
+an include yields nothing by itself; such paths are shown with "no match". The all
+mechanism is shown only where it decides the domain's result. Terms evaluated for each
+message (exists:, ptr and macros) and failed lookups are listed as notes.
+
+The domain's current records are explained first, followed by the records the flatten
+command would publish for it (the flattened record split into spfN records). Each
+section ends with the check_host() result, which is decided by the first matching term.
+
+DNS servers from the config file are used when it can be loaded, along with the
+domain's flattening settings; otherwise the system resolver is used. With
+--dns-zone-dir or --replay-dns, lookups are answered from the zone files or DNS fixture
+instead. With --spf-unflat the spf-unflat.<domain> record is explained as the domain's original record.
+
+Examples:
+  # Why is this IP allowed to send for example.com?
+  spf-flattener explain --domain example.com --ip 198.51.100.7`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		ipFlag, _ := cmd.Flags().GetString("ip")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		ip, err := netip.ParseAddr(ipFlag)
+		if domain == "" || err != nil {
+			cmd.PrintErrf("Error: --domain and a valid --ip are required\n")
+			return
+		}
+		ip = ip.Unmap()
+
+		domainConfig := config.Domain{Name: domain}
+		var dnsProvider spf.DNSProvider
+		cfg, err := config.LoadConfig(cliConfig.ConfigPath)
+		if err != nil {
+			verbosePrintlnf("[VERBOSE] Config not loaded (%v); using the default DNS resolver.\n", err)
+			dnsProvider = defaultDNSProvider()
+		} else if dnsProvider, err = setupDNSProvider(cfg); err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		} else {
+			for _, d := range cfg.Domains {
+				if d.Name == domain {
+					domainConfig = d
+				}
+			}
+		}
+		defer dnsProvider.Close()
+
+		ctx := context.Background()
+		req := spf.CheckRequest{IP: net.IP(ip.AsSlice()), Domain: domain}
+		var out strings.Builder
+		out.WriteString("SPF explanation for ")
+		out.WriteString(ip.String())
+		out.WriteString(" at ")
+		out.WriteString(domain)
+		out.WriteString("\n\n")
+
+		spfLookupName := domain
+		if cliConfig.SpfUnflat {
+			spfLookupName = "spf-unflat." + domain
+		}
+		debugPrintlnf("[DEBUG] Flattening SPF from %s for comparison\n", spfLookupName)
+		flattenResult, flattenErr := spf.FlattenSPFWithOptions(ctx, spfLookupName, dnsProvider, flattenOptions(domainConfig, true))
+
+		var originalRecords map[string]string
+		if cliConfig.SpfUnflat && flattenErr == nil {
+			originalRecords = map[string]string{domain: flattenResult.Original}
+		}
+		out.WriteString("--- Original Record ---\n\n")
+		explanation, err := spf.ExplainIPWithRecords(ctx, dnsProvider, domain, ip, originalRecords)
+		writeExplanation(&out, explanation, err, spf.CheckHostWithRecords(ctx, dnsProvider, req, originalRecords))
+
+		out.WriteString("--- Flattened Records ---\n\n")
+		var chained map[string]string
+		if flattenErr == nil {
+			chained, flattenErr = spf.SplitAndChainSPFWithOptions(flattenResult.Flattened, domain, splitOptions(domainConfig))
+		}
+		if flattenErr != nil {
+			out.WriteString("Flattening failed: ")
+			out.WriteString(flattenErr.Error())
+			out.WriteString("\n")
+			handleOutput(cmd, outputFile, &out)
+			return
+		}
+		explanation, err = spf.ExplainIPWithRecords(ctx, dnsProvider, domain, ip, chained)
+		writeExplanation(&out, explanation, err, spf.CheckHostWithRecords(ctx, dnsProvider, req, chained))
+		handleOutput(cmd, outputFile, &out)
+	},
+}
+
+// writeExplanation formats the covering paths of one set of records for the explain
+// report, followed by the check_host() result they produce.
+func writeExplanation(out *strings.Builder, explanation *spf.Explanation, err error, result *spf.CheckResult) {
+	if err != nil {
+		out.WriteString("Error: ")
+		out.WriteString(err.Error())
+		out.WriteString("\n\n")
+		return
+	}
+
+	if len(explanation.Coverage) == 0 {
+		out.WriteString("No term covers this address.\n")
+	}
+	for i, c := range explanation.Coverage {
+		path := strings.Join(append([]string{explanation.Domain}, c.Path...), " -> ")
+		out.WriteString(path)
+		out.WriteString(" -> ")
+		out.WriteString(c.Term)
+		out.WriteString("\n")
+		out.WriteString("  Record: ")
+		out.WriteString(c.Domain)
+		if c.Host != "" {
+			out.WriteString(" (via ")
+			out.WriteString(c.Host)
+			out.WriteString(")")
+		}
+		out.WriteString("\n")
+		out.WriteString("  Covering CIDR: ")
+		out.WriteString(c.Prefix.String())
+		out.WriteString("\n")
+		out.WriteString("  Qualifier: ")
+		out.WriteString(c.Qualifier.String())
+		out.WriteString("\n")
+		out.WriteString("  Yields: ")
+		if c.Result == "" {
+			out.WriteString("no match (an include on the path only matches on pass)")
+		} else {
+			out.WriteString(string(c.Result))
+		}
+		out.WriteString("\n")
+		if i < len(explanation.Coverage)-1 {
+			out.WriteString("\n")
+		}
+	}
+
+	if len(explanation.Notes) > 0 {
+		out.WriteString("\nNot evaluated:\n")
+		for _, note := range explanation.Notes {
+			out.WriteString("  - ")
+			out.WriteString(note)
+			out.WriteString("\n")
+		}
+	}
+
+	out.WriteString("\nResult: ")
+	out.WriteString(string(result.Result))
+	if result.Term != "" {
+		out.WriteString(" (first match: ")
+		out.WriteString(strings.Join(append(append([]string{explanation.Domain}, result.Path...), result.Term), " -> "))
+		out.WriteString(")")
+	}
+	out.WriteString("\n\n")
+}
+
+func init() {
+	explainCmd.Flags().String("domain", "", "Domain whose SPF record is explained")
+	explainCmd.Flags().String("ip", "", "IPv4 or IPv6 address of the connecting client")
+	explainCmd.Flags().String("output", "", "Write output to a specified file instead of stdout")
+}
@@ -5,16 +5,20 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dean-jl/spf-flattener/internal/config"
 	"github.com/dean-jl/spf-flattener/internal/porkbun"
 	"github.com/dean-jl/spf-flattener/internal/processor"
 	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/dean-jl/spf-flattener/internal/state"
+	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
@@ -27,6 +31,9 @@ func processConfig(cmd *cobra.Command) (*config.Config, string, bool, bool, erro
 	forceFlatten, _ := cmd.Flags().GetBool("force-flatten")
 
 	if cliConfig.Production {
+		if flag := offlineDNSFlag(); flag != "" {
+			return nil, "", false, false, fmt.Errorf("--production cannot be used with %s", flag)
+		}
 		cliConfig.DryRun = false
 	}
 
@@ -55,30 +62,244 @@ func printStatusMessages() {
 	debugPrintln("[DEBUG] Debug output enabled.")
 }
 
-func setupDNSProvider(cfg *config.Config) spf.DNSProvider {
-	if len(cfg.DNSServers) > 0 {
-		verbosePrintln("[VERBOSE] DNS servers being used:")
-		debugPrintlnf("[DEBUG] Setting up custom DNS provider with %d servers\n", len(cfg.DNSServers))
-		for i, s := range cfg.DNSServers {
-			verbosePrintlnf("  - %s (%s)\n", s.Name, s.IP)
-			debugPrintlnf("[DEBUG] DNS server %d: %s -> %s\n", i+1, s.Name, s.IP)
-		}
-		var servers []string
-		for _, s := range cfg.DNSServers {
-			ip := s.IP
-			if !strings.Contains(ip, ":") {
-				ip = ip + ":53"
+// setupDNSProvider returns the DNS provider configured by cfg, behind the persistent
+// dns_cache when one is set. Closing it writes the cache file. With --dns-zone-dir or
+// --replay-dns those answer instead, ignoring the DNS settings of cfg. With --record-dns
+// the answers are recorded.
+func setupDNSProvider(cfg *config.Config) (spf.DNSProvider, error) {
+	if offlineDNSFlag() != "" {
+		return defaultDNSProvider(), nil
+	}
+	provider, err := setupCachedResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return recordDNS(provider), nil
+}
+
+// setupCachedResolver returns the provider of setupResolver, behind the dns_cache.
+func setupCachedResolver(cfg *config.Config) (spf.DNSProvider, error) {
+	provider, err := setupResolver(cfg)
+	if err != nil || cfg.DNSCache == "" {
+		return provider, err
+	}
+	cache, err := spf.NewDiskCacheDNSProvider(provider, cfg.DNSCache)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: DNS cache disabled: %v\n", err)
+		return provider, nil
+	}
+	verbosePrintlnf("[VERBOSE] Using DNS cache file: %s\n", cache.Path())
+	return cache, nil
+}
+
+// defaultDNSProvider returns the provider used without a config file: the --dns-zone-dir
+// zone files or --replay-dns fixture when set, otherwise the system resolver. With
+// --record-dns the answers are recorded.
+func defaultDNSProvider() spf.DNSProvider {
+	switch {
+	case zoneFiles != nil:
+		verbosePrintlnf("[VERBOSE] Answering DNS lookups from the zone files in %s (zones: %s)\n",
+			cliConfig.DNSZoneDir, strings.Join(zoneFiles.Zones(), ", "))
+		return recordDNS(zoneFiles)
+	case dnsReplay != nil:
+		verbosePrintlnf("[VERBOSE] Replaying DNS answers recorded at %s from %s\n",
+			dnsReplay.RecordedAt().Format(time.RFC3339), cliConfig.ReplayDNS)
+		return recordDNS(dnsReplay)
+	}
+	return recordDNS(&spf.DefaultDNSProvider{})
+}
+
+// recordDNS wraps provider to record its answers when --record-dns is set.
+func recordDNS(provider spf.DNSProvider) spf.DNSProvider {
+	if cliConfig.RecordDNS == "" {
+		return provider
+	}
+	verbosePrintlnf("[VERBOSE] Recording DNS answers to %s\n", cliConfig.RecordDNS)
+	dnsRecorder = spf.NewRecordingDNSProvider(provider, cliConfig.RecordDNS)
+	return dnsRecorder
+}
+
+// retrieveExistingRecords returns the records published for domain. Offline they are
+// the TXT records of the --dns-zone-dir zone files or those recorded in the --replay-dns
+// fixture; otherwise they are retrieved from Porkbun. With --record-dns the TXT records
+// are recorded.
+func retrieveExistingRecords(client *porkbun.Client, domain string) (*porkbun.RetrieveRecordsResponse, error) {
+	resp := &porkbun.RetrieveRecordsResponse{Status: "SUCCESS"}
+	switch {
+	case zoneFiles != nil:
+		for _, name := range zoneFiles.TXTNames(domain) {
+			for _, content := range zoneFiles.TXTRecords(name) {
+				resp.Records = append(resp.Records, porkbun.Record{Name: name, Type: "TXT", Content: content})
+			}
+		}
+	case dnsReplay != nil:
+		published, ok := dnsReplay.Published(domain)
+		if !ok {
+			return nil, fmt.Errorf("no published records for %s were recorded in %s", domain, cliConfig.ReplayDNS)
+		}
+		for _, record := range published {
+			resp.Records = append(resp.Records, porkbun.Record{Name: record.Name, Type: "TXT", Content: record.Content})
+		}
+	default:
+		var err error
+		if resp, err = client.RetrieveRecords(domain); err != nil {
+			return nil, err
+		}
+	}
+	if dnsRecorder != nil {
+		var published []spf.PublishedRecord
+		for _, record := range resp.Records {
+			if record.Type == "TXT" {
+				published = append(published, spf.PublishedRecord{Name: record.Name, Content: record.Content})
+			}
+		}
+		dnsRecorder.RecordPublished(domain, published)
+	}
+	return resp, nil
+}
+
+// setupResolver returns the provider querying the configured DNS servers in order, or
+// the system resolver when none are configured. Lists of plain DNS servers are queried
+// by CustomDNSProvider. The system resolver is only asked after the servers with
+// dns_system_fallback. With dns_consensus every server is queried and the answers are
+// compared instead, and failing to set that up is an error. With DNSSEC validation
+// enabled the answers are validated, and failing to set that up is an error too.
+func setupResolver(cfg *config.Config) (spf.DNSProvider, error) {
+	if cfg.ValidatesDNSSEC() {
+		provider, err := setupValidatingResolver(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("DNSSEC validation: %w", err)
+		}
+		return provider, nil
+	}
+	if len(cfg.DNSServers) == 0 {
+		verbosePrintln("[VERBOSE] Using system DNS resolver.")
+		debugPrintln("[DEBUG] Using default system DNS provider.")
+		return &spf.DefaultDNSProvider{}, nil
+	}
+
+	verbosePrintln("[VERBOSE] DNS servers being used:")
+	debugPrintlnf("[DEBUG] Setting up custom DNS provider with %d servers\n", len(cfg.DNSServers))
+	var providers []spf.DNSProvider
+	var plain []*spf.PlainDNSProvider
+	var servers []spf.ConsensusServer
+	for i, s := range cfg.DNSServers {
+		verbosePrintlnf("  - %s (%s, %s)\n", s.Name, s.Address(), s.GetProtocol())
+		debugPrintlnf("[DEBUG] DNS server %d: %s -> %s over %s, timeout %q, %d retries\n",
+			i+1, s.Name, s.Address(), s.GetProtocol(), s.Timeout, s.Retries)
+		provider, err := newServerProvider(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: DNS server %s skipped: %v\n", s.Name, err)
+			continue
+		}
+		providers = append(providers, provider)
+		if p, ok := provider.(*spf.PlainDNSProvider); ok {
+			plain = append(plain, p)
+		}
+		name := s.Name
+		if name == "" {
+			name = s.Address()
+		}
+		servers = append(servers, spf.ConsensusServer{Name: name, Provider: provider})
+	}
+
+	if cfg.DNSConsensus != nil {
+		consensus, err := spf.NewConsensusDNSProvider(spf.ConsensusPolicy(cfg.DNSConsensus.Policy), servers)
+		if err != nil {
+			for _, provider := range providers {
+				provider.Close()
 			}
-			servers = append(servers, ip)
+			return nil, fmt.Errorf("dns_consensus: %w", err)
+		}
+		verbosePrintlnf("[VERBOSE] Comparing the answers of all DNS servers (consensus policy %s).\n", consensus.Policy)
+		return consensus, nil
+	}
+	if cfg.DNSSystemFallback {
+		verbosePrintln("[VERBOSE] Falling back to the system DNS resolver when no server answers.")
+	}
+
+	if len(plain) == len(providers) {
+		return spf.NewCustomDNSProviderWithServers(plain, cfg.DNSSystemFallback), nil
+	}
+	if cfg.DNSSystemFallback {
+		providers = append(providers, &spf.DefaultDNSProvider{})
+	}
+	if len(providers) == 1 {
+		return providers[0], nil
+	}
+	return &spf.FailoverDNSProvider{Providers: providers}, nil
+}
+
+// setupValidatingResolver returns the provider validating answers with DNSSEC from the
+// configured trust anchors, querying the DNS servers in order. Without configured
+// servers the system's name servers from /etc/resolv.conf are queried directly, since
+// the system resolver does not return signatures.
+func setupValidatingResolver(cfg *config.Config) (spf.DNSProvider, error) {
+	anchors := spf.RootTrustAnchors()
+	if cfg.DNSSECTrustAnchor != "" {
+		var err error
+		if anchors, err = spf.LoadTrustAnchors(cfg.DNSSECTrustAnchor); err != nil {
+			return nil, err
+		}
+	}
+
+	var exchangers []spf.MessageExchanger
+	for _, s := range cfg.DNSServers {
+		provider, err := newServerProvider(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: DNS server %s skipped: %v\n", s.Name, err)
+			continue
+		}
+		exchanger, ok := provider.(spf.MessageExchanger)
+		if !ok {
+			provider.Close()
+			fmt.Fprintf(os.Stderr, "Warning: DNS server %s skipped: it does not return DNS messages to validate\n", s.Name)
+			continue
+		}
+		exchangers = append(exchangers, exchanger)
+	}
+	if len(cfg.DNSServers) == 0 {
+		system, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("no dns servers configured and the system name servers are unknown: %w", err)
+		}
+		for _, server := range system.Servers {
+			exchangers = append(exchangers, spf.NewPlainDNSProvider(net.JoinHostPort(server, system.Port)))
 		}
-		verbosePrintlnf("[VERBOSE] Using custom DNS servers: %v\n", servers)
-		debugPrintlnf("[DEBUG] Custom DNS provider created with servers: %+v\n", servers)
-		return spf.NewCustomDNSProvider(servers)
 	}
 
-	verbosePrintln("[VERBOSE] Using system DNS resolver.")
-	debugPrintln("[DEBUG] Using default system DNS provider.")
-	return &spf.DefaultDNSProvider{}
+	provider, err := spf.NewValidatingDNSProvider(exchangers, anchors)
+	if err != nil {
+		return nil, err
+	}
+	verbosePrintlnf("[VERBOSE] Validating DNS answers with DNSSEC (%d servers, %d trust anchors).\n", len(exchangers), len(anchors))
+	return provider, nil
+}
+
+// newServerProvider returns the provider querying one configured DNS server.
+func newServerProvider(s config.DNSServer) (spf.DNSProvider, error) {
+	timeout, _ := s.TimeoutDuration() // validated when the config was loaded
+	switch s.GetProtocol() {
+	case config.DNSProtocolTLS:
+		provider := spf.NewDoTDNSProvider(s.Address())
+		provider.Timeout, provider.Retries = timeout, s.Retries
+		return provider, nil
+	case config.DNSProtocolHTTPS, config.DNSProtocolHTTPSJSON:
+		format := spf.DoHWireFormat
+		if s.GetProtocol() == config.DNSProtocolHTTPSJSON {
+			format = spf.DoHJSONFormat
+		}
+		provider, err := spf.NewDoHDNSProvider(s.Address(), format)
+		if err != nil {
+			return nil, err
+		}
+		provider.Timeout, provider.Retries = timeout, s.Retries
+		return provider, nil
+	default:
+		provider := spf.NewPlainDNSProvider(s.Address())
+		provider.Timeout, provider.Retries = timeout, s.Retries
+		return provider, nil
+	}
 }
 
 func handleOutput(cmd *cobra.Command, outputFile string, finalOutput *strings.Builder) {
@@ -98,18 +319,75 @@ var flattenCmd = &cobra.Command{
 	Short: "Flatten SPF records for all configured domains.",
 	Long: `Flatten SPF records for all configured domains by resolving include:, a:, and mx: mechanisms into IP addresses.
 
-This command performs DNS lookup counting to determine if SPF flattening is necessary:
-- SPF records requiring >10 DNS lookups exceed RFC 7208 limits and will be automatically flattened
-- SPF records requiring ≤10 DNS lookups are RFC 7208 compliant and will NOT be flattened (unless --force-flatten is used)
+This command counts DNS lookups as specified by RFC 7208 section 4.6.4 to determine if SPF
+flattening is necessary:
+- SPF records exceeding a processing limit will be automatically flattened: more than 10 DNS
+  lookups, more than 2 void lookups (names returning no records), or more than 10 MX hosts
+  for a single mx mechanism
+- SPF records within the limits are RFC 7208 compliant and will NOT be flattened (unless --force-flatten is used)
 - The --force-flatten flag bypasses this threshold check and always performs flattening
 
 DNS lookup counting includes:
 - Each include: mechanism (including duplicates)
-- Each a: and mx: mechanism
-- The initial TXT lookup for the domain
+- Each a, mx, ptr and exists mechanism
+- Each redirect= modifier that applies (records without an all mechanism)
+
+The all, ip4 and ip6 mechanisms, terms after all, and the initial TXT lookup for the domain
+are not counted. Use --verbose to include a per-term breakdown in the report.
+
+redirect= modifiers are followed when flattening, and exp= modifiers are kept on the
+published root record. Terms that cannot be resolved ahead of time (exists:, ptr and
+mechanisms using macros such as %{i}) are kept verbatim in their original position and
+still count towards the lookup limit of the published records.
+
+Per-domain max_lookups, keep_includes and always_flatten settings enable partial
+flattening: includes are kept as include: terms while the published records fit the
+lookup budget, and the report shows the chosen plan.
+
+a/mx terms whose DNS lookups fail are listed under Resolution Failures and handled per
+the domain's resolution_policy: strict skips the domain, keep-previous reuses addresses
+from the currently published records, and lenient (the default) leaves them out.
+
+With retain_removed_for set, addresses that stop resolving (for example rotating
+round-robin answers) stay published until the grace period ends and are reported as
+pending removal. When they were last seen is kept in the state_file, which is only
+updated in production mode.
+
+Added addresses in the change summary name the term of the original record that
+authorizes them (see the tree command); removed addresses name their source when the
+state_file recorded it.
+
+With dns_consensus, every DNS server is queried and disagreements between their answers
+are reported per query; in strict mode they also stop production updates.
+
+With --dns-zone-dir, lookups are answered from the zone files in the directory and the
+current records are read from them instead of the Porkbun API, so flattening can be
+tried offline. --record-dns writes the DNS answers and current records of the run to a
+fixture file, and --replay-dns repeats a run from such a file alone. Production mode is
+not available offline.
+
+With DNSSEC validation (dnssec_validation or require_dnssec_for), the report lists whether
+the answer for each term of the include tree is secure, insecure or bogus. A domain fails
+rather than publish addresses from answers for its require_dnssec_for zones that are not
+secure.
+
+When the DNS servers report TTLs, the report lists the lowest upstream TTL feeding each
+published record and the next recommended refresh time; the output ends with the earliest
+refresh time across all domains. With cap_ttl_to_upstream, records are published with a TTL
+no longer than their upstream TTL.
+
+Records longer than 255 bytes are split into as few chained spfN records as possible;
+the report shows the bytes each record uses. A domain fails rather than cut a term that
+does not fit. With record_layout: tree, the root record includes each spfN record
+directly instead, and record_prefix renames them. With max_record_bytes, records up to
+that length are published as several 255-byte strings before any splitting.
+
+Before publishing, the address space authorized by the flattened records is compared
+with the original include tree (see the verify command). In production mode, records
+are not updated when they differ outside the domain's verify_allowance ranges.
 
 Examples:
-  # Flatten only domains that exceed 10 DNS lookups
+  # Flatten only domains that exceed the RFC 7208 lookup limits
   spf-flattener flatten --config config.yaml
 
   # Force flattening even for compliant records
@@ -127,10 +405,28 @@ Examples:
 		logger := setupLogger()
 		printStatusMessages()
 
-		dnsProvider := setupDNSProvider(cfg)
+		// One cache for every domain, so shared includes are resolved once per run
+		resolver, err := setupDNSProvider(cfg)
+		if err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		}
+		dnsProvider := spf.NewCachingDNSProvider(resolver)
+		defer func() {
+			if err := dnsProvider.Close(); err != nil {
+				cmd.PrintErrf("Error: %v\n", err)
+			}
+		}()
+
+		resolutionState, err := loadResolutionState(cfg)
+		if err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		}
+		now := time.Now()
 
 		// Create domain processor with business logic (available for future refactoring)
-		_ = processor.NewDomainProcessor(dnsProvider, cliConfig.Debug, cliConfig.DryRun, cliConfig.SpfUnflat, cliConfig.Aggregate)
+		_ = processor.NewDomainProcessor(dnsProvider, resolutionState, cliConfig.Debug, cliConfig.DryRun, cliConfig.SpfUnflat, cliConfig.Aggregate)
 
 		// --- Main Processing Logic ---
 		// Create worker pool with maximum of 5 concurrent domain processors
@@ -141,6 +437,11 @@ Examples:
 		var wg sync.WaitGroup
 		domainResults := make(chan string, len(cfg.Domains))
 
+		// The earliest time an upstream answer of any domain may change
+		var refreshMu sync.Mutex
+		var nextRefresh time.Time
+		var nextRefreshDomain string
+
 		for i, domain := range cfg.Domains {
 			verbosePrintlnf("[VERBOSE] [%d/%d] Starting processing for domain: %s\n", i+1, len(cfg.Domains), domain.Name)
 			debugPrintlnf("[DEBUG] Domain %s config: Provider=%s, TTL=%d, SpfUnflat=%v\n",
@@ -168,7 +469,56 @@ Examples:
 					spfLookupName = "spf-unflat." + d.Name
 				}
 
-				originalSPF, flattenedSPF, lookupCount, wasFlattened, err := spf.FlattenSPFWithThreshold(ctx, spfLookupName, dnsProvider, cliConfig.Aggregate, forceFlatten)
+				existingRecordsResp, err := retrieveExistingRecords(client, d.Name)
+				if err != nil {
+					resultBuf.WriteString("\n===== Error processing domain: ")
+					resultBuf.WriteString(d.Name)
+					resultBuf.WriteString(" \n\n")
+					resultBuf.WriteString("Error retrieving existing records: ")
+					resultBuf.WriteString(err.Error())
+					resultBuf.WriteString("\n")
+					domainResults <- resultBuf.String()
+					return
+				}
+
+				existingSPFTXTRecords := make(map[string]string)
+				for _, record := range existingRecordsResp.Records {
+					if record.Type != "TXT" {
+						continue
+					}
+					recordName := strings.TrimSuffix(record.Name, ".")
+					content := spf.ParseTXTRecord(record.Content) // joins multi-string records
+					if recordName == d.Name {
+						if spf.IsSPFRecord(content) {
+							existingSPFTXTRecords[recordName] = content
+						}
+					} else if strings.HasPrefix(recordName, "spf") || isSplitRecord(recordName, d) {
+						existingSPFTXTRecords[recordName] = content
+					}
+				}
+
+				// The published records supply the addresses reused for failed terms
+				// under the keep-previous resolution policy.
+				opts := flattenOptions(d, forceFlatten)
+				opts.Previous = make(map[string]string, len(existingSPFTXTRecords))
+				for name, content := range existingSPFTXTRecords {
+					opts.Previous[name] = content
+				}
+				opts.Previous[spfLookupName] = existingSPFTXTRecords[d.Name]
+				// The state file says which term each published address came from, so only
+				// the failed terms' own addresses are reused
+				if resolutionState != nil {
+					opts.Sources = make(map[string]string)
+					for term, entry := range resolutionState.Entries(d.Name) {
+						opts.Sources[term] = entry.Source
+					}
+				}
+				// Addresses that stopped resolving stay published for retain_removed_for
+				retainFor, _ := d.RetainRemovedDuration() // validated when the config was loaded
+				if retainFor > 0 {
+					opts.Retained = resolutionState.Retained(d.Name, now, retainFor)
+				}
+				flattenResult, err := spf.FlattenSPFWithOptions(ctx, spfLookupName, dnsProvider, opts)
 				if err != nil {
 					resultBuf.WriteString("\n===== Error processing domain: ")
 					resultBuf.WriteString(d.Name)
@@ -180,30 +530,54 @@ Examples:
 					return
 				}
 
-				existingRecordsResp, err := client.RetrieveRecords(d.Name)
+				originalSPF := flattenResult.Original
+				flattenedSPF := flattenResult.Flattened
+				lookups := flattenResult.Lookups
+				wasFlattened := flattenResult.WasFlattened
+
+				// The records that would be published, split to fit TXT strings
+				published, err := spf.SplitAndChainSPFWithOptions(flattenedSPF, d.Name, opts.Split)
 				if err != nil {
 					resultBuf.WriteString("\n===== Error processing domain: ")
 					resultBuf.WriteString(d.Name)
 					resultBuf.WriteString(" \n\n")
-					resultBuf.WriteString("Error retrieving existing records: ")
+					resultBuf.WriteString("Error: ")
 					resultBuf.WriteString(err.Error())
 					resultBuf.WriteString("\n")
 					domainResults <- resultBuf.String()
 					return
 				}
 
-				existingSPFTXTRecords := make(map[string]string)
-				for _, record := range existingRecordsResp.Records {
-					if record.Type != "TXT" {
-						continue
+				// Attribute address changes to the terms of the record that caused them
+				var provenance *spf.ProvenanceNode
+				if wasFlattened {
+					if provenance, err = spf.BuildProvenanceFromRecord(ctx, spfLookupName, originalSPF, dnsProvider); err != nil {
+						verbosePrintlnf("[VERBOSE] Could not attribute changes for %s: %v\n", d.Name, err)
+						provenance = nil
 					}
-					recordName := strings.TrimSuffix(record.Name, ".")
-					if recordName == d.Name {
-						if strings.HasPrefix(record.Content, "v=spf1") {
-							existingSPFTXTRecords[recordName] = record.Content
-						}
-					} else if strings.HasPrefix(recordName, "spf") {
-						existingSPFTXTRecords[recordName] = record.Content
+				}
+
+				// Disagreements between the DNS servers on names this domain depends on
+				var disagreements []spf.Disagreement
+				if consensus, ok := spf.FindConsensusProvider(dnsProvider); ok && len(consensus.Disagreements()) > 0 {
+					tree := provenance
+					if tree == nil {
+						tree, _ = spf.BuildProvenanceFromRecord(ctx, spfLookupName, originalSPF, dnsProvider)
+					}
+					names := []string{spfLookupName}
+					if tree != nil {
+						names = append(names, tree.Names()...)
+					}
+					disagreements = consensus.DisagreementsFor(names)
+				}
+				consensusOK := len(disagreements) == 0 || !cfg.DNSConsensus.Strict
+
+				// The DNSSEC status of the answers for the domain's include tree
+				var dnssecTree *spf.ProvenanceNode
+				if cfg.ValidatesDNSSEC() {
+					dnssecTree = provenance
+					if dnssecTree == nil {
+						dnssecTree, _ = spf.BuildProvenanceFromRecord(ctx, spfLookupName, originalSPF, dnsProvider)
 					}
 				}
 
@@ -217,7 +591,7 @@ Examples:
 
 				if currentAggregate == "(No valid SPF record found on root)" {
 					recordsChanged = true
-					chainedRecords = spf.SplitAndChainSPF(flattenedSPF, d.Name) // Assigned here
+					chainedRecords = published
 					newSet := spf.ExtractMechanismSet(flattenedSPF)
 					var added []string
 					for mech := range newSet {
@@ -225,14 +599,14 @@ Examples:
 					}
 					sort.Strings(added)
 					if len(added) > 0 {
-						changeSummary = "Added: " + strings.Join(added, ", ") + ". "
+						changeSummary = "Added: " + strings.Join(describeAdded(added, provenance), ", ") + ". "
 					}
 				} else {
 					normalizedOld, _ := spf.NormalizeSPF(currentAggregate)
 					normalizedNew, _ := spf.NormalizeSPF(flattenedSPF)
 					if normalizedOld != normalizedNew {
 						recordsChanged = true
-						chainedRecords = spf.SplitAndChainSPF(flattenedSPF, d.Name) // Assigned here
+						chainedRecords = published
 						oldSet := spf.ExtractMechanismSet(currentAggregate)
 						newSet := spf.ExtractMechanismSet(flattenedSPF)
 						var added, removed []string
@@ -249,23 +623,65 @@ Examples:
 						sort.Strings(added)
 						sort.Strings(removed)
 						if len(added) > 0 {
-							changeSummary += "Added: " + strings.Join(added, ", ") + ". "
+							changeSummary += "Added: " + strings.Join(describeAdded(added, provenance), ", ") + ". "
 						}
 						if len(removed) > 0 {
-							changeSummary += "Removed: " + strings.Join(removed, ", ") + ". "
+							changeSummary += "Removed: " + strings.Join(describeRemoved(removed, resolutionState, d.Name), ", ") + ". "
+						}
+					}
+				}
+
+				if len(flattenResult.PendingRemoval) > 0 {
+					// Still published, but no longer resolved: removed once the grace period ends
+					var pending []string
+					for _, term := range flattenResult.PendingRemoval {
+						entry, _ := resolutionState.Lookup(d.Name, term)
+						pending = append(pending, term+" (until "+entry.LastSeen.Add(retainFor).Format("2006-01-02 15:04 MST")+")")
+					}
+					changeSummary += "Pending removal: " + strings.Join(pending, ", ") + ". "
+				}
+
+				// Record what was resolved, and from where, once removals have been attributed
+				if wasFlattened && resolutionState != nil {
+					sources := make(map[string]string, len(flattenResult.Resolved))
+					for _, term := range flattenResult.Resolved {
+						if provenance != nil {
+							sources[term] = strings.Join(provenance.Attribute(term), ", ")
+						} else {
+							sources[term] = ""
 						}
 					}
+					resolutionState.Observe(d.Name, sources, now, retainFor)
 				}
 
 				// Force flag overrides change detection
 				if force && !recordsChanged {
 					recordsChanged = true
-					chainedRecords = spf.SplitAndChainSPF(flattenedSPF, d.Name)
+					chainedRecords = published
 					changeSummary = "No functional change to SPF mechanisms (forced update)."
 				} else if changeSummary == "" {
 					changeSummary = "No functional change to SPF mechanisms."
 				}
 
+				// --- Equivalence Verification ---
+				// Prove the records to be published authorize the same addresses as the
+				// original include tree before any production update.
+				verified := true
+				var verifyReport strings.Builder
+				var recordTTLs map[string]uint32 // Lowest upstream TTL feeding each published record
+				if wasFlattened {
+					allowance, _ := d.VerifyAllowancePrefixes() // validated when the config was loaded
+					// Addresses reused for failed terms or retained after they stopped
+					// resolving cannot be confirmed against DNS
+					for _, t := range flattenResult.FailedTerms {
+						allowance = append(allowance, t.ReusedPrefixes()...)
+					}
+					allowance = append(allowance, spf.AddressTermPrefixes(flattenResult.PendingRemoval)...)
+					recordTTLs = flattenResult.RecordTTLs(published)
+					verification, err := spf.VerifyFlatteningWithFailures(ctx, d.Name, originalSPF, published, dnsProvider, flattenResult.FailedTerms)
+					verified = writeVerification(&verifyReport, verification, err, allowance)
+				}
+
 				// --- Report Generation ---
 				resultBuf.WriteString("\n===== Processing domain: ")
 				resultBuf.WriteString(d.Name)
@@ -274,16 +690,40 @@ Examples:
 				resultBuf.WriteString(" SPF Summary ---")
 				resultBuf.WriteString("\n\n")
 				resultBuf.WriteString("DNS Lookups Required: ")
-				resultBuf.WriteString(strconv.Itoa(lookupCount))
-				if lookupCount > 10 {
+				resultBuf.WriteString(strconv.Itoa(lookups.Total))
+				if lookups.ExceedsLimits() {
 					resultBuf.WriteString(" (EXCEEDS RFC 7208 LIMIT)")
 				} else {
 					resultBuf.WriteString(" (RFC 7208 compliant)")
 				}
 				resultBuf.WriteString("\n")
+				resultBuf.WriteString("Void Lookups: ")
+				resultBuf.WriteString(strconv.Itoa(lookups.VoidLookups))
+				resultBuf.WriteString("\n")
+				if cliConfig.Verbose && len(lookups.Terms) > 0 {
+					resultBuf.WriteString("Lookup Breakdown:\n")
+					writeLookupBreakdown(&resultBuf, lookups)
+				}
+				if len(lookups.PermErrors) > 0 {
+					resultBuf.WriteString("PermError Conditions:\n")
+					for _, permErr := range lookups.PermErrors {
+						resultBuf.WriteString("  - ")
+						resultBuf.WriteString(permErr)
+						resultBuf.WriteString("\n")
+					}
+				}
+				if len(flattenResult.FailedTerms) > 0 {
+					writeResolutionFailures(&resultBuf, d.ResolutionPolicy, flattenResult.FailedTerms)
+				}
+				if len(disagreements) > 0 {
+					writeDisagreements(&resultBuf, disagreements, cfg.DNSConsensus.Strict)
+				}
+				if dnssecTree != nil {
+					writeDNSSECStatus(&resultBuf, dnssecTree)
+				}
 				resultBuf.WriteString("Flattening Performed: ")
 				if wasFlattened {
-					if forceFlatten && lookupCount <= 10 {
+					if forceFlatten && !lookups.ExceedsLimits() {
 						resultBuf.WriteString("Yes (forced)")
 					} else {
 						resultBuf.WriteString("Yes (required)")
@@ -291,7 +731,37 @@ Examples:
 				} else {
 					resultBuf.WriteString("No (not needed)")
 				}
-				resultBuf.WriteString("\n\n")
+				resultBuf.WriteString("\n")
+				if wasFlattened {
+					// Lookups a receiver performs against the published records: kept
+					// terms and includes plus the includes linking any split spfN records.
+					plan := flattenResult.Plan
+					resultBuf.WriteString("DNS Lookups After Flattening: ")
+					resultBuf.WriteString(strconv.Itoa(plan.Lookups))
+					if plan.Lookups > spf.MaxDNSLookups {
+						resultBuf.WriteString(" (EXCEEDS RFC 7208 LIMIT)")
+					} else if plan.MaxLookups > 0 && plan.Lookups > plan.MaxLookups {
+						resultBuf.WriteString(" (EXCEEDS max_lookups BUDGET)")
+					}
+					resultBuf.WriteString("\n")
+					if len(plan.Kept()) > 0 || plan.MaxLookups > 0 {
+						writeFlattenPlan(&resultBuf, plan)
+					}
+					if len(recordTTLs) > 0 {
+						refresh := writeUpstreamTTLs(&resultBuf, d, recordTTLs, now)
+						refreshMu.Lock()
+						if nextRefresh.IsZero() || refresh.Before(nextRefresh) {
+							nextRefresh, nextRefreshDomain = refresh, d.Name
+						}
+						refreshMu.Unlock()
+					}
+				}
+				if len(flattenResult.KeptTerms) > 0 {
+					resultBuf.WriteString("Terms Kept Verbatim: ")
+					resultBuf.WriteString(strings.Join(flattenResult.KeptTerms, " "))
+					resultBuf.WriteString("\n")
+				}
+				resultBuf.WriteString("\n")
 				resultBuf.WriteString("Current Aggregate SPF:\n")
 				resultBuf.WriteString(currentAggregate)
 				resultBuf.WriteString("\n\n")
@@ -301,6 +771,16 @@ Examples:
 				resultBuf.WriteString("Original SPF (unflattened):\n")
 				resultBuf.WriteString(originalSPF)
 				resultBuf.WriteString("\n\n")
+				if len(flattenResult.Warnings) > 0 {
+					resultBuf.WriteString("Warnings:\n")
+					for _, warning := range flattenResult.Warnings {
+						resultBuf.WriteString("  - ")
+						resultBuf.WriteString(warning)
+						resultBuf.WriteString("\n")
+					}
+					resultBuf.WriteString("\n")
+				}
+				resultBuf.WriteString(verifyReport.String())
 				resultBuf.WriteString("---")
 				resultBuf.WriteString(" Aggregate SPF Changes ---")
 				resultBuf.WriteString("\n\n")
@@ -312,67 +792,43 @@ Examples:
 					resultBuf.WriteString("---")
 					resultBuf.WriteString(" DNS TXT Records To Be Added/Changed ---")
 					resultBuf.WriteString("\n\n")
-					var sortedKeys []string
-					// Add root domain first if it exists
-					if _, ok := chainedRecords[d.Name]; ok {
-						sortedKeys = append(sortedKeys, d.Name)
-					}
-					// Then add sorted spfN records
-					var spfKeys []string
-					for k := range chainedRecords {
-						if k != d.Name {
-							spfKeys = append(spfKeys, k)
-						}
-					}
-					sort.Strings(spfKeys)
-					sortedKeys = append(sortedKeys, spfKeys...)
-
-					for _, key := range sortedKeys {
+					// The root record first, then the spfN records, with their share of the
+					// TXT record limit
+					for _, usage := range opts.Split.RecordUtilization(chainedRecords, d.Name) {
 						resultBuf.WriteString("Record: ")
-						resultBuf.WriteString(key)
-						resultBuf.WriteString("\nValue: ")
-						resultBuf.WriteString(chainedRecords[key])
+						resultBuf.WriteString(usage.Name)
+						resultBuf.WriteString(" (")
+						resultBuf.WriteString(usage.String())
+						resultBuf.WriteString(")\nValue: ")
+						resultBuf.WriteString(spf.FormatTXTRecord(chainedRecords[usage.Name]))
 						resultBuf.WriteString("\n\n")
 					}
 				}
 
-				if !cliConfig.DryRun && recordsChanged {
+				publish, outcome := updateOutcome(cliConfig.DryRun, recordsChanged, verified, consensusOK)
+				if !publish && !cliConfig.DryRun && recordsChanged {
+					domainLogger.Error("Not updating DNS records", "reason", strings.TrimSpace(outcome))
+				}
+
+				if publish {
 					domainLogger.Info("SPF record changes detected, updating DNS records.")
 
-					// Delete old, obsolete spfN records
+					// Delete old, obsolete split records, including those named with the
+					// default prefix after record_prefix changed
 					for name := range existingSPFTXTRecords {
-						if strings.HasPrefix(name, "spf") && strings.Contains(name, d.Name) {
-							if cliConfig.SpfUnflat && name == "spf-unflat."+d.Name {
-								continue // Skip deletion of the spf-unflat source record
-							}
-							isStale := true
-							for i := 0; ; i++ {
-								spfName := "spf" + strconv.Itoa(i) + "." + d.Name
-								if _, ok := chainedRecords[spfName]; !ok && name != spfName {
-									continue
-								}
-								if name == spfName {
-									isStale = false
-									break
-								}
-								if _, ok := chainedRecords[spfName]; !ok {
-									break
-								}
-							}
-
-							if isStale {
-								for _, rec := range existingRecordsResp.Records {
-									if strings.TrimSuffix(rec.Name, ".") == name {
-										limiter.Wait(ctx) // Rate limiting
-										_, err := client.DeleteRecord(d.Name, rec.ID)
-										if err != nil {
-											domainLogger.Error("Failed to delete stale SPF record", "record", name, "error", err)
-										} else {
-											domainLogger.Info("Deleted stale SPF record", "record", name)
-										}
-										break
-									}
+						if _, current := chainedRecords[name]; current || !isSplitRecord(name, d) {
+							continue
+						}
+						for _, rec := range existingRecordsResp.Records {
+							if strings.TrimSuffix(rec.Name, ".") == name {
+								limiter.Wait(ctx) // Rate limiting
+								_, err := client.DeleteRecord(d.Name, rec.ID)
+								if err != nil {
+									domainLogger.Error("Failed to delete stale SPF record", "record", name, "error", err)
+								} else {
+									domainLogger.Info("Deleted stale SPF record", "record", name)
 								}
+								break
 							}
 						}
 					}
@@ -422,7 +878,7 @@ Examples:
 									fmt.Printf("[DEBUG] Updating record: domain=%s, recordID=%s, hostName='%s', content='%s'\n", d.Name, existingID, hostName, content)
 								}
 								limiter.Wait(ctx) // Rate limiting
-								_, err := client.UpdateRecordWithDetails(d.Name, existingID, hostName, "TXT", content, strconv.Itoa(d.TTL), "", "")
+								_, err := client.UpdateRecordWithDetails(d.Name, existingID, hostName, "TXT", spf.FormatTXTRecord(content), strconv.Itoa(d.PublishedTTL(recordTTLs[name])), "", "")
 								if err != nil {
 									if name == d.Name {
 										domainLogger.Error("Failed to update main SPF record", "error", err)
@@ -454,7 +910,7 @@ Examples:
 									fmt.Printf("[DEBUG] Creating new record: domain=%s, hostName='%s', content='%s'\n", d.Name, hostName, content)
 								}
 								limiter.Wait(ctx) // Rate limiting
-								_, err = client.CreateRecord(d.Name, hostName, "TXT", content, d.TTL)
+								_, err = client.CreateRecord(d.Name, hostName, "TXT", spf.FormatTXTRecord(content), d.PublishedTTL(recordTTLs[name]))
 								if err != nil {
 									if name == d.Name {
 										domainLogger.Error("Failed to create main SPF record", "error", err)
@@ -474,7 +930,7 @@ Examples:
 								fmt.Printf("[DEBUG] Creating record: domain=%s, hostName='%s', content='%s'\n", d.Name, hostName, content)
 							}
 							limiter.Wait(ctx) // Rate limiting
-							_, err := client.CreateRecord(d.Name, hostName, "TXT", content, d.TTL)
+							_, err := client.CreateRecord(d.Name, hostName, "TXT", spf.FormatTXTRecord(content), d.PublishedTTL(recordTTLs[name]))
 							if err != nil {
 								if name == d.Name {
 									domainLogger.Error("Failed to create main SPF record", "error", err)
@@ -490,16 +946,14 @@ Examples:
 							}
 						}
 					}
-					resultBuf.WriteString("\nSPF records updated in production mode.\n")
-				} else if cliConfig.DryRun && recordsChanged {
-					resultBuf.WriteString("\nSPF records would be updated in production mode.\n")
-				} else {
-					resultBuf.WriteString("\nSPF records are already up to date. No changes needed.\n")
 				}
+				resultBuf.WriteString(outcome)
 
-				resultBuf.WriteString("\n---")
-				resultBuf.WriteString("\n" + client.Attribution())
-				resultBuf.WriteString("\n---\n")
+				if offlineDNSFlag() == "" { // No Porkbun data is used offline
+					resultBuf.WriteString("\n---")
+					resultBuf.WriteString("\n" + client.Attribution())
+					resultBuf.WriteString("\n---\n")
+				}
 
 				domainResults <- resultBuf.String()
 			}(domain, logger)
@@ -507,52 +961,100 @@ Examples:
 
 		wg.Wait()
 		close(domainResults)
+		verbosePrintlnf("[VERBOSE] DNS cache: %s\n", dnsProvider.Stats())
+
+		if resolutionState != nil {
+			if cliConfig.DryRun {
+				verbosePrintln("[VERBOSE] Dry run: resolution state file not updated.")
+			} else if err := resolutionState.Save(); err != nil {
+				cmd.PrintErrf("Error: %v\n", err)
+			}
+		}
 
 		// --- Output Handling ---
 		var finalOutput strings.Builder
 		for result := range domainResults {
 			finalOutput.WriteString(result)
 		}
+		if !nextRefresh.IsZero() {
+			finalOutput.WriteString("\nNext recommended refresh: ")
+			finalOutput.WriteString(nextRefresh.Format(time.RFC3339))
+			finalOutput.WriteString(" (")
+			finalOutput.WriteString(nextRefreshDomain)
+			finalOutput.WriteString(")\n")
+		}
 
 		handleOutput(cmd, outputFile, &finalOutput)
 	},
 }
 
+// aggregateCurrentSPF reassembles the record currently published for domain by
+// following its includes into the spfN chain records. Terms reached through a
+// qualified include take that include's qualifier, and the root's all mechanism
+// is kept, so the result can be compared with a newly flattened record.
 func aggregateCurrentSPF(records map[string]string, domain string) string {
 	var aggregatedMechanisms []string
+	var allMechanism string
 	seenIncludes := make(map[string]bool)
 
-	var processRecord func(string)
-	processRecord = func(recordContent string) {
+	var processRecord func(recordContent string, qualifier spf.Qualifier, isRoot bool)
+	processRecord = func(recordContent string, qualifier spf.Qualifier, isRoot bool) {
 		parts := strings.Fields(recordContent)
-		for _, part := range parts {
-			if strings.HasPrefix(part, "v=spf1") || strings.HasSuffix(part, "all") {
+		for i, part := range parts {
+			if i == 0 && spf.IsSPFRecord(part) {
+				continue
+			}
+			term, err := spf.ParseTerm(part)
+			if err != nil {
+				aggregatedMechanisms = append(aggregatedMechanisms, part)
+				continue
+			}
+			if term.Kind == spf.KindAll {
+				if isRoot {
+					allMechanism = term.String()
+				}
 				continue
 			}
 
-			if strings.HasPrefix(part, "include:") {
-				includeDomain := strings.TrimPrefix(part, "include:")
-				if !seenIncludes[includeDomain] {
-					seenIncludes[includeDomain] = true
-					if nextRecord, ok := records[includeDomain]; ok {
-						processRecord(nextRecord)
-					} else {
-						aggregatedMechanisms = append(aggregatedMechanisms, part)
+			termQualifier := term.Qualifier
+			if !isRoot && term.IsMechanism() {
+				if term.Qualifier != spf.QualifierPass {
+					// A non-pass term inside an include never matches; keep it
+					// as written so the difference is still visible.
+					aggregatedMechanisms = append(aggregatedMechanisms, part)
+					continue
+				}
+				termQualifier = qualifier
+			}
+
+			if term.Kind == spf.KindInclude {
+				includeDomain := term.DomainSpec
+				if nextRecord, ok := records[includeDomain]; ok {
+					if !seenIncludes[includeDomain] {
+						seenIncludes[includeDomain] = true
+						processRecord(nextRecord, termQualifier, false)
 					}
+					continue
 				}
-			} else {
-				aggregatedMechanisms = append(aggregatedMechanisms, part)
 			}
+			if term.IsMechanism() {
+				term.Qualifier = termQualifier
+			}
+			aggregatedMechanisms = append(aggregatedMechanisms, term.String())
 		}
 	}
 
 	if rootSPF, ok := records[domain]; ok {
-		processRecord(rootSPF)
+		processRecord(rootSPF, spf.QualifierPass, true)
 	} else {
 		return "(No valid SPF record found on root)"
 	}
 
-	normalized, err := spf.NormalizeSPF("v=spf1 " + strings.Join(aggregatedMechanisms, " ") + " ~all")
+	parts := append([]string{"v=spf1"}, aggregatedMechanisms...)
+	if allMechanism != "" {
+		parts = append(parts, allMechanism)
+	}
+	normalized, err := spf.NormalizeSPF(strings.Join(parts, " "))
 	if err != nil {
 		return "(Could not normalize existing record)"
 	}
@@ -567,3 +1069,269 @@ func init() {
 	flattenCmd.Flags().Bool("force-flatten", false, "Force SPF flattening even if DNS lookups are ≤10 (RFC 7208 compliant)")
 	flattenCmd.Flags().Bool("aggregate", false, "Perform CIDR aggregation on IP addresses before creating SPF records")
 }
+
+// loadResolutionState loads the state file recording when resolved addresses were last
+// seen and where they came from, or returns nil when state_file is not set and no
+// domain sets retain_removed_for.
+func loadResolutionState(cfg *config.Config) (*state.State, error) {
+	needed := cfg.StateFile != ""
+	for _, d := range cfg.Domains {
+		if retainFor, _ := d.RetainRemovedDuration(); retainFor > 0 {
+			needed = true
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+	path := cfg.StateFile
+	if path == "" {
+		path = state.DefaultPath
+	}
+	verbosePrintlnf("[VERBOSE] Using resolution state file: %s\n", path)
+	return state.Load(path)
+}
+
+// describeAdded labels each added mechanism with the terms of the original record that
+// authorize it, e.g. "ip4:192.0.2.0/24 (from include:_spf.vendor.example)".
+func describeAdded(added []string, provenance *spf.ProvenanceNode) []string {
+	if provenance == nil {
+		return added
+	}
+	described := make([]string, 0, len(added))
+	for _, mech := range added {
+		if sources := provenance.Attribute(mech); len(sources) > 0 {
+			mech += " (from " + strings.Join(sources, ", ") + ")"
+		}
+		described = append(described, mech)
+	}
+	return described
+}
+
+// describeRemoved labels each removed mechanism with the terms the state file recorded
+// its addresses as coming from, e.g. "ip4:192.0.2.7 (was from include:_spf.vendor.example)".
+func describeRemoved(removed []string, resolutionState *state.State, domain string) []string {
+	if resolutionState == nil {
+		return removed
+	}
+	entries := resolutionState.Entries(domain)
+	described := make([]string, 0, len(removed))
+	for _, mech := range removed {
+		set := &spf.IPSet{}
+		for _, p := range spf.AddressTermPrefixes([]string{mech}) {
+			set.AddPrefix(p)
+		}
+		seen := make(map[string]bool)
+		var sources []string
+		for term, entry := range entries {
+			for _, p := range spf.AddressTermPrefixes([]string{term}) {
+				if entry.Source != "" && !seen[entry.Source] && set.Overlaps(p) {
+					seen[entry.Source] = true
+					sources = append(sources, entry.Source)
+				}
+			}
+		}
+		if len(sources) > 0 {
+			sort.Strings(sources)
+			mech += " (was from " + strings.Join(sources, ", ") + ")"
+		}
+		described = append(described, mech)
+	}
+	return described
+}
+
+// updateOutcome returns whether a domain's records are published and the line reporting
+// what happens to them, exactly one per domain: changed records are published in
+// production mode once verified and, under dns_consensus strict, agreed on by the DNS
+// servers; otherwise they are skipped or only reported.
+func updateOutcome(dryRun, changed, verified, consensusOK bool) (bool, string) {
+	if !dryRun && changed && !verified {
+		return false, "DNS update skipped: equivalence verification failed.\n"
+	} else if !dryRun && changed && !consensusOK {
+		return false, "DNS update skipped: DNS servers disagreed on lookups for this domain (dns_consensus strict).\n"
+	} else if !dryRun && changed {
+		return true, "\nSPF records updated in production mode.\n"
+	} else if changed {
+		return false, "\nSPF records would be updated in production mode.\n"
+	}
+	return false, "\nSPF records are already up to date. No changes needed.\n"
+}
+
+// flattenOptions returns the flattening settings configured for a domain.
+func flattenOptions(d config.Domain, forceFlatten bool) spf.FlattenOptions {
+	return spf.FlattenOptions{
+		Aggregate:     cliConfig.Aggregate,
+		ForceFlatten:  forceFlatten,
+		Policy:        d.Policy,
+		MaxLookups:    d.MaxLookups,
+		KeepIncludes:  d.KeepIncludes,
+		AlwaysFlatten: d.AlwaysFlatten,
+		Resolution:    spf.ResolutionPolicy(d.ResolutionPolicy),
+		RequireDNSSEC: d.RequireDNSSECFor,
+		Split:         splitOptions(d),
+	}
+}
+
+// splitOptions returns how a domain's flattened record is split into TXT records.
+func splitOptions(d config.Domain) spf.SplitOptions {
+	return spf.SplitOptions{
+		Layout:         spf.SplitLayout(d.RecordLayout),
+		Prefix:         d.RecordPrefix,
+		MaxRecordBytes: d.MaxRecordBytes,
+	}
+}
+
+// isSplitRecord reports whether name is one of a domain's split records, named with
+// its record_prefix or the default prefix.
+func isSplitRecord(name string, d config.Domain) bool {
+	return splitOptions(d).IsSplitRecord(name, d.Name) || spf.SplitOptions{}.IsSplitRecord(name, d.Name)
+}
+
+// writeResolutionFailures lists the a/mx terms whose lookups failed and how the
+// domain's resolution policy handled them.
+func writeResolutionFailures(buf *strings.Builder, policy string, failed []spf.FailedTerm) {
+	if policy == "" {
+		policy = string(spf.ResolutionLenient)
+	}
+	fmt.Fprintf(buf, "WARNING - Resolution Failures (resolution_policy: %s):\n", policy)
+	for _, t := range failed {
+		buf.WriteString("  - ")
+		buf.WriteString(t.String())
+		buf.WriteString("\n")
+		switch {
+		case len(t.Reused) > 0:
+			buf.WriteString("    reused previously published: ")
+			buf.WriteString(strings.Join(t.Reused, " "))
+			buf.WriteString("\n")
+		case policy == string(spf.ResolutionKeepPrevious):
+			buf.WriteString("    no previously published addresses to reuse; the term's addresses are missing\n")
+		default:
+			buf.WriteString("    the term's addresses are missing from the flattened record\n")
+		}
+	}
+}
+
+// writeFlattenPlan lists which of the domain's includes were kept or flattened.
+func writeFlattenPlan(buf *strings.Builder, plan *spf.FlattenPlan) {
+	buf.WriteString("Flatten Plan")
+	if plan.MaxLookups > 0 {
+		buf.WriteString(" (max_lookups: ")
+		buf.WriteString(strconv.Itoa(plan.MaxLookups))
+		buf.WriteString(")")
+	}
+	buf.WriteString(":\n")
+	for _, decision := range plan.Includes {
+		action := "keep   "
+		if decision.Flatten {
+			action = "flatten"
+		}
+		fmt.Fprintf(buf, "  %s %s (%d lookups, %s)\n", action, decision.Term, decision.Lookups, decision.Reason)
+	}
+}
+
+// writeDisagreements lists the queries on which the DNS servers gave different
+// answers, with each server's answer and the answer used.
+func writeDisagreements(buf *strings.Builder, disagreements []spf.Disagreement, strict bool) {
+	buf.WriteString("DNS Server Disagreements")
+	if strict {
+		buf.WriteString(" (strict: production updates are skipped)")
+	}
+	buf.WriteString(":\n")
+	for _, d := range disagreements {
+		buf.WriteString("  - ")
+		buf.WriteString(d.Query)
+		buf.WriteString(": ")
+		buf.WriteString(d.Resolution)
+		buf.WriteString("\n")
+		for _, answer := range d.Answers {
+			buf.WriteString("      ")
+			buf.WriteString(answer.Server)
+			buf.WriteString(": ")
+			buf.WriteString(answer.Answer)
+			buf.WriteString("\n")
+		}
+	}
+}
+
+// writeDNSSECStatus lists the validation status of the answers for the terms of the
+// domain's include tree.
+func writeDNSSECStatus(buf *strings.Builder, tree *spf.ProvenanceNode) {
+	buf.WriteString("DNSSEC Status:\n")
+	var write func(node *spf.ProvenanceNode, depth int)
+	write = func(node *spf.ProvenanceNode, depth int) {
+		if node.DNSSEC != "" {
+			buf.WriteString(strings.Repeat("  ", depth+1))
+			buf.WriteString("- ")
+			buf.WriteString(node.Term)
+			buf.WriteString(": ")
+			buf.WriteString(string(node.DNSSEC))
+			buf.WriteString("\n")
+		}
+		for _, child := range node.Children {
+			write(child, depth+1)
+		}
+	}
+	for _, child := range tree.Children {
+		write(child, 0)
+	}
+}
+
+// writeUpstreamTTLs lists the lowest upstream TTL feeding each published record and the
+// TTL it is published with, and returns when the first of those answers expires.
+func writeUpstreamTTLs(buf *strings.Builder, d config.Domain, ttls map[string]uint32, now time.Time) time.Time {
+	names := make([]string, 0, len(ttls))
+	lowest := uint32(0)
+	for name, ttl := range ttls {
+		names = append(names, name)
+		if lowest == 0 || ttl < lowest {
+			lowest = ttl
+		}
+	}
+	sort.Strings(names)
+
+	buf.WriteString("Upstream TTLs:\n")
+	for _, name := range names {
+		buf.WriteString("  - ")
+		buf.WriteString(name)
+		buf.WriteString(": ")
+		buf.WriteString(strconv.FormatUint(uint64(ttls[name]), 10))
+		buf.WriteString("s (published with TTL ")
+		buf.WriteString(strconv.Itoa(d.PublishedTTL(ttls[name])))
+		buf.WriteString(")\n")
+	}
+	refresh := now.Add(time.Duration(lowest) * time.Second)
+	buf.WriteString("Next Recommended Refresh: ")
+	buf.WriteString(refresh.Format("2006-01-02 15:04:05 MST"))
+	buf.WriteString("\n")
+	return refresh
+}
+
+// writeLookupBreakdown lists every lookup-costing term, indented by include depth.
+func writeLookupBreakdown(buf *strings.Builder, lookups *spf.LookupReport) {
+	for _, term := range lookups.Terms {
+		buf.WriteString("  ")
+		buf.WriteString(strings.Repeat("  ", term.Depth))
+		buf.WriteString(term.Term)
+		buf.WriteString(" (")
+		buf.WriteString(term.Domain)
+		buf.WriteString(")")
+		var notes []string
+		if term.MXHosts > 0 {
+			notes = append(notes, strconv.Itoa(term.MXHosts)+" MX hosts")
+		}
+		if term.Void {
+			notes = append(notes, "void")
+		}
+		if term.Unresolved {
+			notes = append(notes, "resolved at check time")
+		}
+		if term.Err != "" {
+			notes = append(notes, "error: "+term.Err)
+		}
+		if len(notes) > 0 {
+			buf.WriteString(" [")
+			buf.WriteString(strings.Join(notes, ", "))
+			buf.WriteString("]")
+		}
+		buf.WriteString("\n")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUpdateOutcome(t *testing.T) {
+	testCases := []struct {
+		name      string
+		dryRun    bool
+		changed   bool
+		verified  bool
+		consensus bool
+		publish   bool
+		expected  string
+	}{
+		{"verification failed", false, true, false, true, false, "DNS update skipped: equivalence verification failed."},
+		{"servers disagreed", false, true, true, false, false, "DNS update skipped: DNS servers disagreed on lookups for this domain (dns_consensus strict)."},
+		{"production update", false, true, true, true, true, "SPF records updated in production mode."},
+		{"dry run", true, true, false, false, false, "SPF records would be updated in production mode."},
+		{"unchanged", false, false, true, true, false, "SPF records are already up to date. No changes needed."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			publish, outcome := updateOutcome(tc.dryRun, tc.changed, tc.verified, tc.consensus)
+			if publish != tc.publish {
+				t.Errorf("Expected publish %v, got %v", tc.publish, publish)
+			}
+			if strings.TrimSpace(outcome) != tc.expected {
+				t.Errorf("Expected outcome %q, got %q", tc.expected, outcome)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/dean-jl/spf-flattener/internal/config"
+	"github.com/dean-jl/spf-flattener/internal/spf"
 	"github.com/spf13/cobra"
 )
 
@@ -19,15 +20,34 @@ type CLIConfig struct {
 	Production bool
 	DryRun     bool
 	Aggregate  bool
+	DNSZoneDir string
+	RecordDNS  string
+	ReplayDNS  string
 }
 
 var cliConfig = &CLIConfig{}
 
+// DNS providers selected by the global flags.
+var (
+	zoneFiles   *spf.ZoneFileDNSProvider  // --dns-zone-dir
+	dnsReplay   *spf.ReplayDNSProvider    // --replay-dns
+	dnsRecorder *spf.RecordingDNSProvider // --record-dns, once setupDNSProvider wrapped a provider
+)
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "spf-flattener",
 	Short: "SPF Flattener is a CLI tool to flatten SPF records.",
 	Long:  "A command-line tool to flatten SPF DNS records for multiple domains using the Porkbun API.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := loadOfflineDNS(); err != nil {
+			// Execute reports the error
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			return err
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		// Main CLI logic goes here (currently empty for root command)
 	},
@@ -38,8 +58,15 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cliConfig.ConfigPath, "config", "config.yaml", "Path to configuration file")
 	rootCmd.PersistentFlags().BoolVar(&cliConfig.Debug, "debug", false, "Enable debug output")
 	rootCmd.PersistentFlags().BoolVar(&cliConfig.Verbose, "verbose", false, "Enable verbose output")
+	rootCmd.PersistentFlags().StringVar(&cliConfig.DNSZoneDir, "dns-zone-dir", "", "Answer DNS lookups from the zone files in this directory instead of DNS servers")
+	rootCmd.PersistentFlags().StringVar(&cliConfig.RecordDNS, "record-dns", "", "Record every DNS answer of the run to this fixture file")
+	rootCmd.PersistentFlags().StringVar(&cliConfig.ReplayDNS, "replay-dns", "", "Answer DNS lookups only from this fixture file, written by --record-dns")
 	rootCmd.AddCommand(pingCmd)
 	rootCmd.AddCommand(flattenCmd)
+	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(treeCmd)
+	rootCmd.AddCommand(explainCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(importCmd)
 
@@ -66,6 +93,39 @@ func logEvent(logger *log.Logger, level, message string, data map[string]string)
 	logger.Println(string(jsonEvent))
 }
 
+// loadOfflineDNS loads the zone files of --dns-zone-dir or the fixture of --replay-dns.
+func loadOfflineDNS() error {
+	if cliConfig.DNSZoneDir != "" && cliConfig.ReplayDNS != "" {
+		return fmt.Errorf("--dns-zone-dir and --replay-dns cannot be used together")
+	}
+	if cliConfig.DNSZoneDir != "" {
+		z, err := spf.LoadZoneDir(cliConfig.DNSZoneDir)
+		if err != nil {
+			return fmt.Errorf("failed to load --dns-zone-dir: %w", err)
+		}
+		zoneFiles = z
+	}
+	if cliConfig.ReplayDNS != "" {
+		r, err := spf.NewReplayDNSProvider(cliConfig.ReplayDNS)
+		if err != nil {
+			return fmt.Errorf("failed to load --replay-dns: %w", err)
+		}
+		dnsReplay = r
+	}
+	return nil
+}
+
+// offlineDNSFlag returns the flag answering DNS lookups without DNS servers, if any.
+func offlineDNSFlag() string {
+	switch {
+	case zoneFiles != nil:
+		return "--dns-zone-dir"
+	case dnsReplay != nil:
+		return "--replay-dns"
+	}
+	return ""
+}
+
 // populateConfigFromFlags updates cliConfig with current flag values
 func populateConfigFromFlags(cmd *cobra.Command) {
 	if dryRun, err := cmd.Flags().GetBool("dry-run"); err == nil {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dean-jl/spf-flattener/internal/config"
+	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/spf13/cobra"
+)
+
+var treeCmd = &cobra.Command{
+	Use:   "tree",
+	Short: "Show the include tree of a domain's SPF record and where each address comes from.",
+	Long: `Resolve a domain's SPF record into its include tree: every include, redirect, a and mx
+term evaluated from it, the addresses each one authorizes, the DNS lookups each costs and,
+when the configured DNS servers report them, the TTLs of the answers. With DNSSEC
+validation configured, each answer's status (secure, insecure or bogus) is shown too.
+
+Output formats:
+  text  Indented tree (default)
+  json  The tree as JSON, for scripts
+  dot   A Graphviz digraph, e.g. spf-flattener tree --domain example.com --format dot | dot -Tsvg
+
+DNS servers from the config file are used when it can be loaded; otherwise the system
+resolver is used. With --dns-zone-dir or --replay-dns, lookups are answered from the
+zone files or DNS fixture instead. With --spf-unflat the spf-unflat.<domain> record is shown.
+
+Examples:
+  # Show the include tree of example.com
+  spf-flattener tree --domain example.com
+
+  # Render the tree as an image
+  spf-flattener tree --domain example.com --format dot --output tree.dot`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		format, _ := cmd.Flags().GetString("format")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		if domain == "" {
+			cmd.PrintErrf("Error: --domain is required\n")
+			return
+		}
+		if format != "text" && format != "json" && format != "dot" {
+			cmd.PrintErrf("Error: unsupported format %q (use text, json or dot)\n", format)
+			return
+		}
+
+		var dnsProvider spf.DNSProvider
+		cfg, err := config.LoadConfig(cliConfig.ConfigPath)
+		if err != nil {
+			verbosePrintlnf("[VERBOSE] Config not loaded (%v); using the default DNS resolver.\n", err)
+			dnsProvider = defaultDNSProvider()
+		} else if dnsProvider, err = setupDNSProvider(cfg); err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		}
+		defer dnsProvider.Close()
+
+		spfLookupName := domain
+		if cliConfig.SpfUnflat {
+			spfLookupName = "spf-unflat." + domain
+		}
+		root, err := spf.BuildProvenance(context.Background(), spfLookupName, dnsProvider)
+		if err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		}
+
+		var out strings.Builder
+		switch format {
+		case "json":
+			data, err := json.MarshalIndent(root, "", "  ")
+			if err != nil {
+				cmd.PrintErrf("Error: failed to encode tree: %v\n", err)
+				return
+			}
+			out.Write(data)
+			out.WriteString("\n")
+		case "dot":
+			writeTreeDOT(&out, root)
+		default:
+			writeTreeText(&out, root, 0)
+		}
+		handleOutput(cmd, outputFile, &out)
+	},
+}
+
+// writeTreeText writes node and its children as an indented tree.
+func writeTreeText(out *strings.Builder, node *spf.ProvenanceNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	out.WriteString(indent)
+	out.WriteString(node.Term)
+	if details := treeNodeDetails(node); details != "" {
+		out.WriteString(" (")
+		out.WriteString(details)
+		out.WriteString(")")
+	}
+	out.WriteString("\n")
+	for _, addr := range node.Addresses {
+		out.WriteString(indent)
+		out.WriteString("  - ")
+		out.WriteString(addr)
+		out.WriteString("\n")
+	}
+	for _, child := range node.Children {
+		writeTreeText(out, child, depth+1)
+	}
+}
+
+// treeNodeDetails summarizes a node's cost, TTL, DNSSEC status and problems for the text and DOT output.
+func treeNodeDetails(node *spf.ProvenanceNode) string {
+	var details []string
+	if node.Lookups > 0 {
+		if node.Lookups == 1 {
+			details = append(details, "1 lookup")
+		} else {
+			details = append(details, strconv.Itoa(node.Lookups)+" lookups")
+		}
+	}
+	if node.TTL > 0 {
+		details = append(details, "TTL "+strconv.FormatUint(uint64(node.TTL), 10)+"s")
+	}
+	if node.DNSSEC != "" {
+		details = append(details, "DNSSEC "+string(node.DNSSEC))
+	}
+	if node.Note != "" {
+		details = append(details, node.Note)
+	}
+	if node.Error != "" {
+		details = append(details, "error: "+node.Error)
+	}
+	return strings.Join(details, ", ")
+}
+
+// writeTreeDOT writes the tree as a Graphviz digraph. Addresses are listed in the
+// label of the node that authorizes them.
+func writeTreeDOT(out *strings.Builder, root *spf.ProvenanceNode) {
+	out.WriteString("digraph spf {\n")
+	out.WriteString("  rankdir=LR;\n")
+	out.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+	next := 0
+	var write func(node *spf.ProvenanceNode) string
+	write = func(node *spf.ProvenanceNode) string {
+		id := "n" + strconv.Itoa(next)
+		next++
+		label := []string{node.Term}
+		if details := treeNodeDetails(node); details != "" {
+			label = append(label, details)
+		}
+		label = append(label, node.Addresses...)
+		fmt.Fprintf(out, "  %s [label=%s];\n", id, strconv.Quote(strings.Join(label, "\n")))
+		for _, child := range node.Children {
+			fmt.Fprintf(out, "  %s -> %s;\n", id, write(child))
+		}
+		return id
+	}
+	write(root)
+	out.WriteString("}\n")
+}
+
+func init() {
+	treeCmd.Flags().String("domain", "", "Domain whose SPF include tree is shown")
+	treeCmd.Flags().String("format", "text", "Output format: text, json or dot")
+	treeCmd.Flags().String("output", "", "Write output to a specified file instead of stdout")
+}
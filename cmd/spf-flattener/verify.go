@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/dean-jl/spf-flattener/internal/config"
+	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify that flattened SPF records authorize the same addresses as the originals.",
+	Long: `Verify that flattening preserves each configured domain's SPF policy.
+
+For every domain, the original include tree and the records flatten would publish (the
+flattened record split into spfN records) are both evaluated into the set of client
+addresses that receive a pass result. Any address ranges gained or lost by flattening
+are reported as CIDR prefixes.
+
+Differences inside a domain's verify_allowance ranges are accepted. Any other difference
+makes verification fail; flatten runs the same check and refuses to apply a production
+update that fails it. Terms that depend on the connecting client (exists:, ptr and
+macros) cannot be expressed as address ranges; they are kept verbatim on both sides and
+listed as not evaluated.
+
+With --dns-zone-dir or --replay-dns, lookups are answered from the zone files or DNS
+fixture instead of DNS servers.
+
+Examples:
+  # Verify every configured domain
+  spf-flattener verify --config config.yaml
+
+  # Verify one domain, with the same aggregation flatten would use
+  spf-flattener verify --domain example.com --aggregate
+
+  # Verify offline against local zone files
+  spf-flattener verify --dns-zone-dir ./zones`,
+	Run: func(cmd *cobra.Command, args []string) {
+		populateConfigFromFlags(cmd)
+		domainFilter, _ := cmd.Flags().GetString("domain")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		cfg, err := config.LoadConfig(cliConfig.ConfigPath)
+		if err != nil {
+			cmd.PrintErrf("Error: failed to load config at %s: %v\n", cliConfig.ConfigPath, err)
+			return
+		}
+
+		resolver, err := setupDNSProvider(cfg)
+		if err != nil {
+			cmd.PrintErrf("Error: %v\n", err)
+			return
+		}
+		dnsProvider := spf.NewCachingDNSProvider(resolver)
+		defer func() {
+			if err := dnsProvider.Close(); err != nil {
+				cmd.PrintErrf("Error: %v\n", err)
+			}
+		}()
+		ctx := context.Background()
+
+		var out strings.Builder
+		checked, failed := 0, 0
+		for _, d := range cfg.Domains {
+			if domainFilter != "" && d.Name != domainFilter {
+				continue
+			}
+			checked++
+			verbosePrintlnf("[VERBOSE] Verifying domain: %s\n", d.Name)
+
+			out.WriteString("\n===== Verifying domain: ")
+			out.WriteString(d.Name)
+			out.WriteString(" \n\n")
+
+			spfLookupName := d.Name
+			if cliConfig.SpfUnflat {
+				spfLookupName = "spf-unflat." + d.Name
+			}
+			flattenResult, err := spf.FlattenSPFWithOptions(ctx, spfLookupName, dnsProvider, flattenOptions(d, true))
+			if err != nil {
+				out.WriteString("Error: ")
+				out.WriteString(err.Error())
+				out.WriteString("\n")
+				failed++
+				continue
+			}
+
+			allowance, _ := d.VerifyAllowancePrefixes() // validated when the config was loaded
+			published, err := spf.SplitAndChainSPFWithOptions(flattenResult.Flattened, d.Name, splitOptions(d))
+			if err != nil {
+				out.WriteString("Error: ")
+				out.WriteString(err.Error())
+				out.WriteString("\n")
+				failed++
+				continue
+			}
+			verification, err := spf.VerifyFlattening(ctx, d.Name, flattenResult.Original, published, dnsProvider)
+			if !writeVerification(&out, verification, err, allowance) {
+				failed++
+			}
+		}
+
+		if domainFilter != "" && checked == 0 {
+			cmd.PrintErrf("Error: domain %s is not in the config file\n", domainFilter)
+			return
+		}
+
+		out.WriteString("\n=== Verification Summary ===\n")
+		fmt.Fprintf(&out, "Domains Verified: %d\n", checked)
+		fmt.Fprintf(&out, "Passed: %d\n", checked-failed)
+		fmt.Fprintf(&out, "Failed: %d\n", failed)
+		verbosePrintlnf("[VERBOSE] DNS cache: %s\n", dnsProvider.Stats())
+		handleOutput(cmd, outputFile, &out)
+	},
+}
+
+// writeVerification reports the outcome of spf.VerifyFlattening and returns whether
+// the flattened records may be published: the verification succeeded and every
+// difference lies within allowance.
+func writeVerification(buf *strings.Builder, result *spf.VerifyResult, err error, allowance []netip.Prefix) bool {
+	buf.WriteString("--- Equivalence Verification ---\n\n")
+	if err != nil {
+		buf.WriteString("Verification: FAILED\n")
+		buf.WriteString("Error: ")
+		buf.WriteString(err.Error())
+		buf.WriteString("\n\n")
+		return false
+	}
+
+	writePrefixes := func(label string, prefixes []netip.Prefix) {
+		if len(prefixes) == 0 {
+			return
+		}
+		buf.WriteString(label)
+		buf.WriteString(":\n")
+		for _, p := range prefixes {
+			buf.WriteString("  - ")
+			buf.WriteString(p.String())
+			buf.WriteString("\n")
+		}
+	}
+
+	gained, lost := result.Unexplained(allowance)
+	ok := len(gained) == 0 && len(lost) == 0
+	switch {
+	case result.Equivalent():
+		buf.WriteString("Verification: PASSED (identical address space)\n")
+	case ok:
+		buf.WriteString("Verification: PASSED (differences within verify_allowance)\n")
+	default:
+		buf.WriteString("Verification: FAILED (address space differs)\n")
+	}
+	writePrefixes("Addresses Gained", result.Gained)
+	writePrefixes("Addresses Lost", result.Lost)
+	if len(result.Unevaluated) > 0 {
+		buf.WriteString("Not Evaluated (depend on the client): ")
+		buf.WriteString(strings.Join(result.Unevaluated, ", "))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return ok
+}
+
+func init() {
+	verifyCmd.Flags().String("domain", "", "Verify only this configured domain")
+	verifyCmd.Flags().Bool("aggregate", false, "Perform CIDR aggregation, as flatten --aggregate does")
+	verifyCmd.Flags().String("output", "", "Write output to a specified file instead of stdout")
+}
@@ -34,9 +34,13 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -51,6 +55,9 @@ const (
 // Domain name validation regex - matches valid DNS domain names
 var domainNameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?)*$`)
 
+// Record prefix validation regex - a label prefix leaving room for the record index
+var recordPrefixRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]{0,55}$`)
+
 // isValidDomainName validates a domain name according to DNS standards
 func isValidDomainName(domain string) bool {
 	// Basic checks
@@ -82,17 +89,166 @@ func isValidDomainName(domain string) bool {
 	return true
 }
 
+// isValidIncludeDomain checks the target of an SPF include. Unlike host names, SPF
+// record names commonly contain underscores (e.g. _spf.google.com).
+func isValidIncludeDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DNS server protocols.
+const (
+	DNSProtocolUDP       = "udp"        // Plain DNS (the default)
+	DNSProtocolTLS       = "tls"        // DNS-over-TLS (RFC 7858)
+	DNSProtocolHTTPS     = "https"      // DNS-over-HTTPS in the RFC 8484 wire format
+	DNSProtocolHTTPSJSON = "https-json" // DNS-over-HTTPS with the JSON API
+)
+
 type DNSServer struct {
-	Name string `yaml:"name"`
-	IP   string `yaml:"ip"`
+	Name     string `yaml:"name"`
+	IP       string `yaml:"ip"`
+	Protocol string `yaml:"protocol,omitempty"` // udp (default), tls, https or https-json
+	URL      string `yaml:"url,omitempty"`      // DoH endpoint (https://...) or DoT server (tls://host:port)
+	Timeout  string `yaml:"timeout,omitempty"`  // Per query attempt (e.g. 2s); 5s when empty
+	Retries  int    `yaml:"retries,omitempty"`  // Further attempts after a timeout or SERVFAIL
+}
+
+// MaxDNSRetries bounds the retries of a DNS server.
+const MaxDNSRetries = 5
+
+// TimeoutDuration parses timeout; 0 means the default.
+func (s *DNSServer) TimeoutDuration() (time.Duration, error) {
+	if s.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(s.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must be a positive duration such as 2s", s.Timeout)
+	}
+	return timeout, nil
+}
+
+// GetProtocol returns the server's protocol, udp when none is set.
+func (s *DNSServer) GetProtocol() string {
+	if s.Protocol == "" {
+		return DNSProtocolUDP
+	}
+	return s.Protocol
+}
+
+// Address returns what the server is queried at: host:port for udp (port 53 by default)
+// and tls (port 853 by default), or the URL for DoH.
+func (s *DNSServer) Address() string {
+	switch s.GetProtocol() {
+	case DNSProtocolHTTPS, DNSProtocolHTTPSJSON:
+		return s.URL
+	case DNSProtocolTLS:
+		if s.URL != "" {
+			u, _ := url.Parse(s.URL) // validated when the config was loaded
+			if u.Port() == "" {
+				return net.JoinHostPort(u.Hostname(), "853")
+			}
+			return u.Host
+		}
+		if !strings.Contains(s.IP, ":") {
+			return s.IP + ":853"
+		}
+		return s.IP
+	default:
+		if !strings.Contains(s.IP, ":") {
+			return s.IP + ":53"
+		}
+		return s.IP
+	}
+}
+
+// validate checks that the server has what its protocol needs.
+func (s *DNSServer) validate() error {
+	if _, err := s.TimeoutDuration(); err != nil {
+		return err
+	}
+	if s.Retries < 0 || s.Retries > MaxDNSRetries {
+		return fmt.Errorf("invalid retries %d: must be between 0 and %d", s.Retries, MaxDNSRetries)
+	}
+	switch s.GetProtocol() {
+	case DNSProtocolUDP:
+		if s.IP == "" {
+			return fmt.Errorf("ip is required")
+		}
+	case DNSProtocolTLS:
+		if s.URL == "" {
+			if s.IP == "" {
+				return fmt.Errorf("ip or url is required for protocol tls")
+			}
+			return nil
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil || u.Scheme != "tls" || u.Hostname() == "" {
+			return fmt.Errorf("invalid url %q: must be tls://host or tls://host:port for protocol tls", s.URL)
+		}
+	case DNSProtocolHTTPS, DNSProtocolHTTPSJSON:
+		u, err := url.Parse(s.URL)
+		if s.URL == "" || err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("an https:// url is required for protocol %s", s.Protocol)
+		}
+	default:
+		return fmt.Errorf("invalid protocol %q: must be udp, tls, https or https-json", s.Protocol)
+	}
+	return nil
 }
 
 type Config struct {
-	Provider   string      `yaml:"provider" validate:"required"`
-	Domains    []Domain    `yaml:"domains" validate:"required,dive"`
-	Logging    bool        `yaml:"logging"`
-	DryRun     bool        `yaml:"dry_run"`
-	DNSServers []DNSServer `yaml:"dns"`
+	Provider          string      `yaml:"provider" validate:"required"`
+	Domains           []Domain    `yaml:"domains" validate:"required,dive"`
+	Logging           bool        `yaml:"logging"`
+	DryRun            bool        `yaml:"dry_run"`
+	DNSServers        []DNSServer `yaml:"dns"`
+	StateFile         string      `yaml:"state_file,omitempty"`          // Where resolution history is kept for retain_removed_for
+	DNSCache          string      `yaml:"dns_cache,omitempty"`           // File or directory persisting DNS answers between runs
+	DNSSystemFallback bool        `yaml:"dns_system_fallback,omitempty"` // Ask the system resolver when none of the dns servers answers
+	DNSConsensus      *Consensus  `yaml:"dns_consensus,omitempty"`       // Query every dns server and compare the answers
+	DNSSECValidation  bool        `yaml:"dnssec_validation,omitempty"`   // Validate answers with DNSSEC and report their status
+	DNSSECTrustAnchor string      `yaml:"dnssec_trust_anchor,omitempty"` // File of DS or DNSKEY trust anchors; the root zone's keys by default
+}
+
+// ValidatesDNSSEC reports whether answers are validated with DNSSEC: with
+// dnssec_validation, or when a domain lists require_dnssec_for.
+func (c *Config) ValidatesDNSSEC() bool {
+	if c.DNSSECValidation {
+		return true
+	}
+	for _, d := range c.Domains {
+		if len(d.RequireDNSSECFor) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Consensus policies.
+const (
+	ConsensusUnanimous = "unanimous"
+	ConsensusQuorum    = "quorum"
+	ConsensusUnion     = "union"
+)
+
+// Consensus configures comparing the answers of the dns servers.
+type Consensus struct {
+	Policy string `yaml:"policy"`           // unanimous, quorum or union
+	Strict bool   `yaml:"strict,omitempty"` // Skip production updates of domains whose lookups the servers disagreed on
 }
 
 type Domain struct {
@@ -106,6 +262,18 @@ type Domain struct {
 	Logging           *bool              `yaml:"logging,omitempty"`
 	DryRun            *bool              `yaml:"dry_run,omitempty"`
 	Aggregation       *AggregationConfig `yaml:"aggregation,omitempty"`
+	Policy            string             `yaml:"policy,omitempty"`              // Override for the flattened record's all mechanism (-all, ~all or ?all)
+	VerifyAllowance   []string           `yaml:"verify_allowance,omitempty"`    // CIDR ranges that may differ between the original and flattened records
+	MaxLookups        int                `yaml:"max_lookups,omitempty"`         // Lookup budget for partial flattening (0-10); 0 flattens every include
+	KeepIncludes      []string           `yaml:"keep_includes,omitempty"`       // Include domains never flattened
+	AlwaysFlatten     []string           `yaml:"always_flatten,omitempty"`      // Include domains always flattened
+	ResolutionPolicy  string             `yaml:"resolution_policy,omitempty"`   // Handling of failed a/mx lookups: strict, keep-previous or lenient (default)
+	RetainRemovedFor  string             `yaml:"retain_removed_for,omitempty"`  // Grace period before addresses that stopped resolving are unpublished (e.g. 72h)
+	CapTTLToUpstream  bool               `yaml:"cap_ttl_to_upstream,omitempty"` // Publish records with a TTL no longer than the answers they were resolved from
+	RequireDNSSECFor  []string           `yaml:"require_dnssec_for,omitempty"`  // Domains whose answers must validate as DNSSEC secure before publishing
+	RecordLayout      string             `yaml:"record_layout,omitempty"`       // How split records link: chain (default) or tree
+	RecordPrefix      string             `yaml:"record_prefix,omitempty"`       // Label prefix of the split records (default spf, giving spf0, spf1, ...)
+	MaxRecordBytes    int                `yaml:"max_record_bytes,omitempty"`    // Longest TXT record, published as several 255-byte strings (255-512); 0 keeps one string per record
 }
 
 // AggregationConfig contains per-domain CIDR aggregation settings
@@ -132,6 +300,34 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for i, server := range c.DNSServers {
+		if err := server.validate(); err != nil {
+			return fmt.Errorf("dns[%d]: %w", i, err)
+		}
+	}
+
+	if c.DNSConsensus != nil {
+		switch c.DNSConsensus.Policy {
+		case ConsensusUnanimous, ConsensusQuorum, ConsensusUnion:
+		default:
+			return fmt.Errorf("invalid dns_consensus policy %q: must be unanimous, quorum or union", c.DNSConsensus.Policy)
+		}
+		if len(c.DNSServers) < 2 {
+			return fmt.Errorf("dns_consensus needs at least 2 dns servers")
+		}
+	}
+
+	if c.ValidatesDNSSEC() {
+		if c.DNSConsensus != nil {
+			return fmt.Errorf("dnssec validation cannot be combined with dns_consensus")
+		}
+		for i, server := range c.DNSServers {
+			if server.GetProtocol() == DNSProtocolHTTPSJSON {
+				return fmt.Errorf("dns[%d]: dnssec validation needs DNS messages, which protocol %s does not carry", i, DNSProtocolHTTPSJSON)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -149,9 +345,101 @@ func (d *Domain) validate() error {
 	if d.SecretKey == "" {
 		return fmt.Errorf("secret key is required")
 	}
+	switch d.Policy {
+	case "", "-all", "~all", "?all":
+	default:
+		return fmt.Errorf("invalid policy %q: must be -all, ~all or ?all", d.Policy)
+	}
+	if _, err := d.VerifyAllowancePrefixes(); err != nil {
+		return err
+	}
+	if _, err := d.RetainRemovedDuration(); err != nil {
+		return err
+	}
+	switch d.ResolutionPolicy {
+	case "", "strict", "keep-previous", "lenient":
+	default:
+		return fmt.Errorf("invalid resolution_policy %q: must be strict, keep-previous or lenient", d.ResolutionPolicy)
+	}
+	if d.MaxLookups < 0 || d.MaxLookups > 10 {
+		return fmt.Errorf("invalid max_lookups %d: must be between 0 and 10 (0 flattens every include)", d.MaxLookups)
+	}
+	keep := make(map[string]bool)
+	for _, include := range d.KeepIncludes {
+		if !isValidIncludeDomain(include) {
+			return fmt.Errorf("invalid keep_includes domain: %s", include)
+		}
+		keep[strings.ToLower(include)] = true
+	}
+	for _, include := range d.AlwaysFlatten {
+		if !isValidIncludeDomain(include) {
+			return fmt.Errorf("invalid always_flatten domain: %s", include)
+		}
+		if keep[strings.ToLower(include)] {
+			return fmt.Errorf("%s is listed in both keep_includes and always_flatten", include)
+		}
+	}
+	for _, domain := range d.RequireDNSSECFor {
+		if !isValidIncludeDomain(domain) {
+			return fmt.Errorf("invalid require_dnssec_for domain: %s", domain)
+		}
+	}
+	switch d.RecordLayout {
+	case "", "chain", "tree":
+	default:
+		return fmt.Errorf("invalid record_layout %q: must be chain or tree", d.RecordLayout)
+	}
+	if d.RecordPrefix != "" && !recordPrefixRegex.MatchString(d.RecordPrefix) {
+		return fmt.Errorf("invalid record_prefix %q: must be letters, digits, hyphens or underscores, starting with a letter or underscore", d.RecordPrefix)
+	}
+	if d.MaxRecordBytes != 0 && (d.MaxRecordBytes < 255 || d.MaxRecordBytes > 512) {
+		return fmt.Errorf("invalid max_record_bytes %d: must be between 255 and 512", d.MaxRecordBytes)
+	}
 	return nil
 }
 
+// RetainRemovedDuration parses retain_removed_for; 0 means addresses are removed as
+// soon as they stop resolving.
+func (d *Domain) RetainRemovedDuration() (time.Duration, error) {
+	if d.RetainRemovedFor == "" {
+		return 0, nil
+	}
+	retain, err := time.ParseDuration(d.RetainRemovedFor)
+	if err != nil || retain < 0 {
+		return 0, fmt.Errorf("invalid retain_removed_for %q: must be a duration such as 72h", d.RetainRemovedFor)
+	}
+	return retain, nil
+}
+
+// MinPublishedTTL is the lowest TTL cap_ttl_to_upstream publishes a record with.
+const MinPublishedTTL = 60
+
+// PublishedTTL returns the TTL to publish a record with, given the lowest TTL of the
+// upstream answers it was resolved from (0 when unknown). With cap_ttl_to_upstream the
+// domain's ttl is lowered to the upstream TTL, but not below MinPublishedTTL.
+func (d *Domain) PublishedTTL(upstream uint32) int {
+	if !d.CapTTLToUpstream || upstream == 0 || int64(upstream) >= int64(d.TTL) {
+		return d.TTL
+	}
+	if upstream < MinPublishedTTL {
+		return min(d.TTL, MinPublishedTTL)
+	}
+	return int(upstream)
+}
+
+// VerifyAllowancePrefixes parses verify_allowance into CIDR prefixes.
+func (d *Domain) VerifyAllowancePrefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range d.VerifyAllowance {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify_allowance entry %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
 // LoadConfig loads and validates a configuration file from the specified path.
 //
 // This function performs the following operations:
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -276,3 +279,501 @@ domains:
 		}
 	}
 }
+
+func TestLoadConfig_Policy(t *testing.T) {
+	testCases := []struct {
+		policy    string
+		expectErr bool
+	}{
+		{"-all", false},
+		{"~all", false},
+		{"?all", false},
+		{"+all", true},
+		{"fail", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    policy: "` + tc.policy + `"
+`
+			configFile := filepath.Join(t.TempDir(), "config_policy.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for policy %q, got nil", tc.policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if cfg.Domains[0].Policy != tc.policy {
+				t.Errorf("Expected policy %q, got %q", tc.policy, cfg.Domains[0].Policy)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_VerifyAllowance(t *testing.T) {
+	testCases := []struct {
+		name      string
+		allowance string
+		expectErr bool
+	}{
+		{"IPv4 and IPv6 ranges", `["192.0.2.0/24", "2001:db8::/32"]`, false},
+		{"Single address needs a prefix length", `["192.0.2.1"]`, true},
+		{"Not a CIDR", `["mail.example.com"]`, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    verify_allowance: ` + tc.allowance + `
+`
+			configFile := filepath.Join(t.TempDir(), "config_allowance.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for verify_allowance %s, got nil", tc.allowance)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			prefixes, err := cfg.Domains[0].VerifyAllowancePrefixes()
+			if err != nil || len(prefixes) != 2 {
+				t.Errorf("Expected 2 allowance prefixes, got %v (%v)", prefixes, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_PartialFlattening(t *testing.T) {
+	testCases := []struct {
+		name      string
+		settings  string
+		expectErr bool
+	}{
+		{"Budget with include lists", "max_lookups: 8\n    keep_includes: [\"_spf.google.com\"]\n    always_flatten: [\"sendgrid.net\"]", false},
+		{"Budget above the RFC limit", "max_lookups: 11", true},
+		{"Negative budget", "max_lookups: -1", true},
+		{"Invalid include domain", "keep_includes: [\"not a domain\"]", true},
+		{"Include in both lists", "keep_includes: [\"sendgrid.net\"]\n    always_flatten: [\"SendGrid.net\"]", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    ` + tc.settings + `
+`
+			configFile := filepath.Join(t.TempDir(), "config_partial.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for %q, got nil", tc.settings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			d := cfg.Domains[0]
+			if d.MaxLookups != 8 || len(d.KeepIncludes) != 1 || len(d.AlwaysFlatten) != 1 {
+				t.Errorf("Unexpected partial flattening settings: %+v", d)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ResolutionPolicy(t *testing.T) {
+	testCases := []struct {
+		policy    string
+		expectErr bool
+	}{
+		{"strict", false},
+		{"keep-previous", false},
+		{"lenient", false},
+		{"abort", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    resolution_policy: "` + tc.policy + `"
+`
+			configFile := filepath.Join(t.TempDir(), "config_resolution.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for resolution_policy %q, got nil", tc.policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if cfg.Domains[0].ResolutionPolicy != tc.policy {
+				t.Errorf("Expected resolution_policy %q, got %q", tc.policy, cfg.Domains[0].ResolutionPolicy)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_RetainRemovedFor(t *testing.T) {
+	testCases := []struct {
+		value     string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{"72h", 72 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"3 days", 0, true},
+		{"-1h", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+state_file: /var/lib/spf-flattener/state.json
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    retain_removed_for: "` + tc.value + `"
+`
+			configFile := filepath.Join(t.TempDir(), "config_retain.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for retain_removed_for %q, got nil", tc.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			retain, _ := cfg.Domains[0].RetainRemovedDuration()
+			if retain != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, retain)
+			}
+			if cfg.StateFile != "/var/lib/spf-flattener/state.json" {
+				t.Errorf("Unexpected state_file %q", cfg.StateFile)
+			}
+		})
+	}
+}
+
+func TestDomain_PublishedTTL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cap      bool
+		upstream uint32
+		expected int
+	}{
+		{"cap disabled", false, 300, 600},
+		{"upstream unknown", true, 0, 600},
+		{"upstream below ttl", true, 300, 300},
+		{"upstream above ttl", true, 3600, 600},
+		{"upstream below minimum", true, 5, MinPublishedTTL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := Domain{Name: "example.com", TTL: 600, CapTTLToUpstream: tc.cap}
+			if got := d.PublishedTTL(tc.upstream); got != tc.expected {
+				t.Errorf("Expected TTL %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DNSServers(t *testing.T) {
+	testCases := []struct {
+		name      string
+		server    string
+		expected  string
+		expectErr bool
+	}{
+		{"plain", `ip: "1.1.1.1"`, "1.1.1.1:53", false},
+		{"plain with port", `ip: "10.0.0.53:5353"`, "10.0.0.53:5353", false},
+		{"tls by ip", "protocol: tls\n    ip: \"1.1.1.1\"", "1.1.1.1:853", false},
+		{"tls by url", "protocol: tls\n    url: tls://dns.quad9.net", "dns.quad9.net:853", false},
+		{"tls by url with port", "protocol: tls\n    url: tls://dns.quad9.net:8853", "dns.quad9.net:8853", false},
+		{"https", "protocol: https\n    url: https://cloudflare-dns.com/dns-query", "https://cloudflare-dns.com/dns-query", false},
+		{"https-json", "protocol: https-json\n    url: https://dns.google/resolve", "https://dns.google/resolve", false},
+		{"https without url", "protocol: https\n    ip: \"1.1.1.1\"", "", true},
+		{"https with http url", "protocol: https\n    url: http://dns.example/dns-query", "", true},
+		{"tls with https url", "protocol: tls\n    url: https://dns.example", "", true},
+		{"plain without ip", "protocol: udp", "", true},
+		{"unknown protocol", "protocol: quic\n    url: quic://dns.example", "", true},
+		{"timeout and retries", "ip: \"1.1.1.1\"\n    timeout: 2s\n    retries: 2", "1.1.1.1:53", false},
+		{"invalid timeout", "ip: \"1.1.1.1\"\n    timeout: 2", "", true},
+		{"negative timeout", "ip: \"1.1.1.1\"\n    timeout: -1s", "", true},
+		{"too many retries", "ip: \"1.1.1.1\"\n    retries: 10", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+dns:
+  - name: Resolver
+    ` + tc.server + `
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+`
+			configFile := filepath.Join(t.TempDir(), "config_dns.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if got := cfg.DNSServers[0].Address(); got != tc.expected {
+				t.Errorf("Expected address %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DNSConsensus(t *testing.T) {
+	twoServers := `
+dns:
+  - name: Cloudflare
+    ip: "1.1.1.1"
+  - name: Google
+    ip: "8.8.8.8"
+`
+	testCases := []struct {
+		name      string
+		content   string
+		expectErr bool
+	}{
+		{"quorum", twoServers + "dns_consensus:\n  policy: quorum\n  strict: true\n", false},
+		{"unknown policy", twoServers + "dns_consensus:\n  policy: majority\n", true},
+		{"single server", "dns:\n  - name: Cloudflare\n    ip: \"1.1.1.1\"\ndns_consensus:\n  policy: union\n", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+` + tc.content
+			configFile := filepath.Join(t.TempDir(), "config_consensus.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if cfg.DNSConsensus == nil || cfg.DNSConsensus.Policy != ConsensusQuorum || !cfg.DNSConsensus.Strict {
+				t.Errorf("Unexpected dns_consensus %+v", cfg.DNSConsensus)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DNSSEC(t *testing.T) {
+	testCases := []struct {
+		name           string
+		domain         string
+		global         string
+		expectErr      bool
+		expectValidate bool
+	}{
+		{"disabled", "", "", false, false},
+		{"dnssec_validation", "", "dnssec_validation: true\ndnssec_trust_anchor: /etc/unbound/root.key\n", false, true},
+		{"require_dnssec_for enables validation", "    require_dnssec_for: [\"_spf.vendor.example\"]\n", "", false, true},
+		{"invalid require_dnssec_for domain", "    require_dnssec_for: [\"not a domain\"]\n", "", true, false},
+		{"combined with consensus", "", "dnssec_validation: true\ndns:\n  - ip: \"1.1.1.1\"\n  - ip: \"8.8.8.8\"\ndns_consensus:\n  policy: quorum\n", true, false},
+		{"JSON DoH server", "", "dnssec_validation: true\ndns:\n  - protocol: https-json\n    url: https://dns.google/resolve\n", true, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+` + tc.domain + tc.global
+			configFile := filepath.Join(t.TempDir(), "config_dnssec.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if got := cfg.ValidatesDNSSEC(); got != tc.expectValidate {
+				t.Errorf("Expected ValidatesDNSSEC %v, got %v", tc.expectValidate, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_RecordLayout(t *testing.T) {
+	testCases := []struct {
+		name      string
+		layout    string
+		prefix    string
+		expectErr bool
+	}{
+		{"defaults", "", "", false},
+		{"chain", "chain", "spf", false},
+		{"tree with underscore prefix", "tree", "_spf", false},
+		{"short prefix", "tree", "s", false},
+		{"unknown layout", "star", "", true},
+		{"prefix with a dot", "tree", "spf.x", true},
+		{"prefix starting with a digit", "", "1spf", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    record_layout: "` + tc.layout + `"
+    record_prefix: "` + tc.prefix + `"
+`
+			configFile := filepath.Join(t.TempDir(), "config_layout.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for record_layout %q, record_prefix %q, got nil", tc.layout, tc.prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if d := cfg.Domains[0]; d.RecordLayout != tc.layout || d.RecordPrefix != tc.prefix {
+				t.Errorf("Unexpected record settings: %+v", d)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_MaxRecordBytes(t *testing.T) {
+	testCases := []struct {
+		value     int
+		expectErr bool
+	}{
+		{0, false},
+		{255, false},
+		{512, false},
+		{200, true},
+		{1024, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.Itoa(tc.value), func(t *testing.T) {
+			configContent := `
+provider: porkbun
+domains:
+  - name: example.com
+    api_key: "key"
+    secret_key: "secret"
+    max_record_bytes: ` + strconv.Itoa(tc.value) + `
+`
+			configFile := filepath.Join(t.TempDir(), "config_record_bytes.yaml")
+			if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := LoadConfig(configFile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected validation error for max_record_bytes %d, got nil", tc.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if cfg.Domains[0].MaxRecordBytes != tc.value {
+				t.Errorf("Expected max_record_bytes %d, got %d", tc.value, cfg.Domains[0].MaxRecordBytes)
+			}
+		})
+	}
+}
@@ -9,25 +9,28 @@ import (
 	"github.com/dean-jl/spf-flattener/internal/config"
 	"github.com/dean-jl/spf-flattener/internal/porkbun"
 	"github.com/dean-jl/spf-flattener/internal/spf"
+	"github.com/dean-jl/spf-flattener/internal/state"
 )
 
 // DomainProcessor handles the business logic for processing SPF records for domains
 type DomainProcessor struct {
-	dnsProvider spf.DNSProvider
-	debug       bool
-	dryRun      bool
-	spfUnflat   bool
-	aggregate   bool
+	dnsProvider     spf.DNSProvider
+	resolutionState *state.State // When resolved addresses were last seen and where they came from; may be nil
+	debug           bool
+	dryRun          bool
+	spfUnflat       bool
+	aggregate       bool
 }
 
 // NewDomainProcessor creates a new domain processor
-func NewDomainProcessor(dnsProvider spf.DNSProvider, debug, dryRun, spfUnflat, aggregate bool) *DomainProcessor {
+func NewDomainProcessor(dnsProvider spf.DNSProvider, resolutionState *state.State, debug, dryRun, spfUnflat, aggregate bool) *DomainProcessor {
 	return &DomainProcessor{
-		dnsProvider: dnsProvider,
-		debug:       debug,
-		dryRun:      dryRun,
-		spfUnflat:   spfUnflat,
-		aggregate:   aggregate,
+		dnsProvider:     dnsProvider,
+		resolutionState: resolutionState,
+		debug:           debug,
+		dryRun:          dryRun,
+		spfUnflat:       spfUnflat,
+		aggregate:       aggregate,
 	}
 }
 
@@ -60,13 +63,6 @@ func (dp *DomainProcessor) ProcessDomain(ctx context.Context, domain config.Doma
 	// Determine if aggregation should be used for this domain
 	domainAggregateEnabled := domain.GetAggregationEnabled(dp.aggregate)
 
-	// Flatten SPF record
-	originalSPF, flattenedSPF, err := spf.FlattenSPF(ctx, spfLookupName, dp.dnsProvider, domainAggregateEnabled)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to flatten SPF for %s: %w", domain.Name, err)
-		return result
-	}
-
 	// Retrieve existing records
 	existingRecordsResp, err := client.RetrieveRecords(domain.Name)
 	if err != nil {
@@ -84,17 +80,92 @@ func (dp *DomainProcessor) ProcessDomain(ctx context.Context, domain config.Doma
 		if recordName == domain.Name {
 			recordName = "@"
 		}
-		if strings.Contains(record.Content, "v=spf1") {
-			existingSPFTXTRecords[recordName] = record.Content
+		content := spf.ParseTXTRecord(record.Content) // joins multi-string records
+		if strings.Contains(content, "v=spf1") {
+			existingSPFTXTRecords[recordName] = content
 		}
 		// Handle spfX.domain records (split records)
-		if strings.HasPrefix(recordName, "spf") && strings.HasSuffix(recordName, "."+domain.Name) {
-			existingSPFTXTRecords[recordName] = record.Content
+		if strings.HasPrefix(recordName, "spf") && strings.HasSuffix(recordName, "."+domain.Name) ||
+			(spf.SplitOptions{Prefix: domain.RecordPrefix}).IsSplitRecord(recordName, domain.Name) {
+			existingSPFTXTRecords[recordName] = content
+		}
+	}
+
+	// The published records supply the addresses reused for failed terms under the
+	// keep-previous resolution policy
+	previous := make(map[string]string, len(existingSPFTXTRecords))
+	for name, content := range existingSPFTXTRecords {
+		if name == "@" {
+			name = spfLookupName
+		}
+		previous[name] = content
+	}
+
+	// The state file says which term each address came from, and keeps addresses that
+	// stopped resolving published for retain_removed_for
+	var sources map[string]string
+	var retained []string
+	now := time.Now()
+	retainFor, _ := domain.RetainRemovedDuration() // validated when the config was loaded
+	if dp.resolutionState != nil {
+		sources = make(map[string]string)
+		for term, entry := range dp.resolutionState.Entries(domain.Name) {
+			sources[term] = entry.Source
+		}
+		if retainFor > 0 {
+			retained = dp.resolutionState.Retained(domain.Name, now, retainFor)
 		}
 	}
 
+	// Flatten SPF record
+	split := spf.SplitOptions{
+		Layout:         spf.SplitLayout(domain.RecordLayout),
+		Prefix:         domain.RecordPrefix,
+		MaxRecordBytes: domain.MaxRecordBytes,
+	}
+	flattenResult, err := spf.FlattenSPFWithOptions(ctx, spfLookupName, dp.dnsProvider, spf.FlattenOptions{
+		Aggregate:     domainAggregateEnabled,
+		ForceFlatten:  true,
+		Policy:        domain.Policy,
+		MaxLookups:    domain.MaxLookups,
+		KeepIncludes:  domain.KeepIncludes,
+		AlwaysFlatten: domain.AlwaysFlatten,
+		Resolution:    spf.ResolutionPolicy(domain.ResolutionPolicy),
+		Previous:      previous,
+		Sources:       sources,
+		Retained:      retained,
+		RequireDNSSEC: domain.RequireDNSSECFor,
+		Split:         split,
+	})
+	if err != nil {
+		result.Error = fmt.Errorf("failed to flatten SPF for %s: %w", domain.Name, err)
+		return result
+	}
+	originalSPF, flattenedSPF := flattenResult.Original, flattenResult.Flattened
+
+	// Record what was resolved, and from where, so retention and attribution advance
+	if flattenResult.WasFlattened && dp.resolutionState != nil {
+		provenance, err := spf.BuildProvenanceFromRecord(ctx, spfLookupName, originalSPF, dp.dnsProvider)
+		if err != nil {
+			provenance = nil // the terms are still recorded, without their sources
+		}
+		observed := make(map[string]string, len(flattenResult.Resolved))
+		for _, term := range flattenResult.Resolved {
+			if provenance != nil {
+				observed[term] = strings.Join(provenance.Attribute(term), ", ")
+			} else {
+				observed[term] = ""
+			}
+		}
+		dp.resolutionState.Observe(domain.Name, observed, now, retainFor)
+	}
+
 	// Detect changes
-	changes, hasChanges := dp.detectChanges(existingSPFTXTRecords, flattenedSPF, domain.Name, domainAggregateEnabled)
+	changes, hasChanges, err := dp.detectChanges(existingSPFTXTRecords, flattenedSPF, domain.Name, split, domainAggregateEnabled)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to split SPF for %s: %w", domain.Name, err)
+		return result
+	}
 	result.HasChanges = hasChanges
 	result.Changes = changes
 
@@ -106,12 +177,15 @@ func (dp *DomainProcessor) ProcessDomain(ctx context.Context, domain config.Doma
 }
 
 // detectChanges compares existing records with flattened SPF and returns changes needed
-func (dp *DomainProcessor) detectChanges(existingRecords map[string]string, flattenedSPF, domain string, aggregateEnabled bool) ([]string, bool) {
+func (dp *DomainProcessor) detectChanges(existingRecords map[string]string, flattenedSPF, domain string, split spf.SplitOptions, aggregateEnabled bool) ([]string, bool, error) {
 	var changes []string
 	hasChanges := false
 
 	// Handle splitting if needed
-	splitRecords := spf.SplitAndChainSPF(flattenedSPF, domain)
+	splitRecords, err := spf.SplitAndChainSPFWithOptions(flattenedSPF, domain, split)
+	if err != nil {
+		return nil, false, err
+	}
 
 	// Check for changes in each expected record
 	for recordName, expectedContent := range splitRecords {
@@ -162,7 +236,7 @@ func (dp *DomainProcessor) detectChanges(existingRecords map[string]string, flat
 		}
 	}
 
-	return changes, hasChanges
+	return changes, hasChanges, nil
 }
 
 // generateReport creates a formatted report for the domain processing
@@ -0,0 +1,286 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultCacheTTL is how long CachingDNSProvider keeps answers whose TTL the wrapped
+// provider does not report, such as those of the system resolver.
+const DefaultCacheTTL = 5 * time.Minute
+
+// DefaultPrefetchParallelism is how many lookups CachingDNSProvider.Prefetch runs at once.
+const DefaultPrefetchParallelism = 8
+
+// CachingDNSProvider wraps a DNSProvider with a cache shared by every lookup made
+// through it, so a run flattening many domains resolves each include once. Answers are
+// kept for their TTL when the wrapped provider reports it (see TTLReporter) and for
+// DefaultTTL otherwise; answers with a TTL of 0 are not cached. Concurrent lookups of
+// the same name and type are merged into a single query. Errors are not cached.
+type CachingDNSProvider struct {
+	DefaultTTL  time.Duration // Lifetime of answers without a reported TTL
+	Parallelism int           // Lookups Prefetch runs at once
+
+	inner   DNSProvider
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	flights singleflight.Group
+	hits    atomic.Int64
+	misses  atomic.Int64
+	shared  atomic.Int64
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+func (k cacheKey) String() string {
+	return dns.TypeToString[k.qtype] + " " + k.name
+}
+
+type cacheEntry struct {
+	value    interface{} // []string, []net.IP or []*net.MX
+	expires  time.Time
+	reported bool // The wrapped provider reported the answer's TTL
+}
+
+// CacheStats counts the lookups answered by a CachingDNSProvider.
+type CacheStats struct {
+	Hits    int64 // Lookups answered from the cache
+	Misses  int64 // Lookups passed to the wrapped provider
+	Shared  int64 // Lookups that waited for an identical query already in flight
+	Entries int   // Answers currently cached
+}
+
+// String summarizes the statistics for verbose output.
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d hits, %d misses, %d shared in-flight, %d entries", s.Hits, s.Misses, s.Shared, s.Entries)
+}
+
+// NewCachingDNSProvider returns a cache in front of inner with the default TTL and
+// prefetch parallelism.
+func NewCachingDNSProvider(inner DNSProvider) *CachingDNSProvider {
+	return &CachingDNSProvider{
+		DefaultTTL:  DefaultCacheTTL,
+		Parallelism: DefaultPrefetchParallelism,
+		inner:       inner,
+		now:         time.Now,
+		entries:     make(map[cacheKey]cacheEntry),
+	}
+}
+
+// Stats returns the cache statistics so far.
+func (c *CachingDNSProvider) Stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Shared: c.shared.Load(), Entries: entries}
+}
+
+func (c *CachingDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	value, err := c.lookup(ctx, domain, dns.TypeTXT, func() (interface{}, error) {
+		return c.inner.LookupTXT(ctx, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), value.([]string)...), nil
+}
+
+func (c *CachingDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	value, err := c.lookup(ctx, domain, dns.TypeA, func() (interface{}, error) {
+		return c.inner.LookupIP(ctx, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]net.IP(nil), value.([]net.IP)...), nil
+}
+
+func (c *CachingDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	value, err := c.lookup(ctx, domain, dns.TypeMX, func() (interface{}, error) {
+		return c.inner.LookupMX(ctx, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]*net.MX(nil), value.([]*net.MX)...), nil
+}
+
+// DNSSECStatus implements DNSSECReporter with the status the wrapped provider reported
+// when the answer was looked up.
+func (c *CachingDNSProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	return dnssecStatus(c.inner, name, qtype)
+}
+
+// LookupAddr passes PTR lookups through uncached; they depend on the connecting client.
+func (c *CachingDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	resolver, ok := c.inner.(AddrLookupProvider)
+	if !ok {
+		return nil, errors.New("PTR lookups are not supported by the DNS provider")
+	}
+	return resolver.LookupAddr(ctx, addr)
+}
+
+// AnswerTTL implements TTLReporter: the time a cached answer has left, in seconds.
+// Answers cached for DefaultTTL because the wrapped provider reported no TTL report
+// none either.
+func (c *CachingDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	key := newCacheKey(name, qtype)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return answerTTL(c.inner, name, qtype)
+	}
+	if !entry.reported {
+		return 0, false
+	}
+	remaining := entry.expires.Sub(c.now())
+	if remaining <= 0 {
+		return 0, false
+	}
+	return uint32(remaining.Round(time.Second) / time.Second), true
+}
+
+// Unwrap returns the wrapped provider.
+func (c *CachingDNSProvider) Unwrap() DNSProvider {
+	return c.inner
+}
+
+func (c *CachingDNSProvider) Close() error {
+	return c.inner.Close()
+}
+
+func newCacheKey(name string, qtype uint16) cacheKey {
+	return cacheKey{name: strings.ToLower(strings.TrimSuffix(name, ".")), qtype: qtype}
+}
+
+// lookup answers from the cache, or runs query once for all concurrent callers and
+// caches its answer.
+func (c *CachingDNSProvider) lookup(ctx context.Context, name string, qtype uint16, query func() (interface{}, error)) (interface{}, error) {
+	key := newCacheKey(name, qtype)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		c.hits.Add(1)
+		return entry.value, nil
+	}
+
+	ran := false
+	value, err, _ := c.flights.Do(key.String(), func() (interface{}, error) {
+		ran = true
+		c.misses.Add(1)
+		value, err := query()
+		if err != nil {
+			return nil, err
+		}
+		ttl := c.DefaultTTL
+		seconds, reported := answerTTL(c.inner, name, qtype)
+		if reported {
+			ttl = time.Duration(seconds) * time.Second
+		}
+		if ttl > 0 {
+			c.mu.Lock()
+			c.entries[key] = cacheEntry{value: value, expires: c.now().Add(ttl), reported: reported}
+			c.mu.Unlock()
+		}
+		return value, nil
+	})
+	if !ran {
+		c.shared.Add(1)
+	}
+	return value, err
+}
+
+// Prefetch resolves the include tree of domain into the cache, querying sibling
+// include:, redirect=, a and mx terms concurrently (at most Parallelism lookups at a
+// time). Flattening and lookup counting then walk the tree in order from the cache.
+// Lookup errors are left for those walks to report.
+func (c *CachingDNSProvider) Prefetch(ctx context.Context, domain string) {
+	parallelism := c.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	p := &prefetcher{cache: c, slots: make(chan struct{}, parallelism)}
+	p.record(ctx, domain, 0)
+	p.wg.Wait()
+}
+
+type prefetcher struct {
+	cache   *CachingDNSProvider
+	slots   chan struct{} // bounds the lookups in flight
+	wg      sync.WaitGroup
+	visited sync.Map // record names already fetched
+}
+
+// do runs a lookup in its own goroutine once a slot is free.
+func (p *prefetcher) do(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.slots <- struct{}{}
+		fn()
+		<-p.slots
+	}()
+}
+
+// record fetches the SPF record of domain and, once it arrives, the targets of its
+// terms. Only the lookups hold a slot, so waiting for children never blocks them.
+func (p *prefetcher) record(ctx context.Context, domain string, depth int) {
+	const maxDepth = 10
+	if _, seen := p.visited.LoadOrStore(strings.ToLower(domain), true); seen || depth > maxDepth {
+		return
+	}
+	p.do(func() {
+		txts, err := p.cache.LookupTXT(ctx, domain)
+		if err != nil {
+			return
+		}
+		parsed, err := ParseRecord(findSPFRecord(txts))
+		if err != nil {
+			return
+		}
+		for _, term := range parsed.Mechanisms() {
+			if term.HasMacros() {
+				continue
+			}
+			target := targetDomain(term, domain)
+			switch term.Kind {
+			case KindInclude:
+				p.record(ctx, target, depth+1)
+			case KindA:
+				p.do(func() { p.cache.LookupIP(ctx, target) })
+			case KindMX:
+				p.do(func() {
+					mxs, err := p.cache.LookupMX(ctx, target)
+					if err != nil {
+						return
+					}
+					for _, mx := range mxs {
+						host := mx.Host
+						p.do(func() { p.cache.LookupIP(ctx, host) })
+					}
+				})
+			}
+		}
+		if _, hasAll := parsed.All(); hasAll {
+			return // redirect= is ignored
+		}
+		if redirect, ok := parsed.Redirect(); ok && !redirect.HasMacros() {
+			p.record(ctx, redirect.DomainSpec, depth+1)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingDNSProvider counts the queries reaching a mockDNSProvider and reports TTLs.
+type countingDNSProvider struct {
+	mockDNSProvider
+	TTLs    map[string]uint32 // name -> TTL reported for every query type
+	Missing map[string]bool   // names whose lookups fail with NXDOMAIN
+	gate    chan struct{}     // when set, TXT lookups wait for it to be closed
+	started chan struct{}     // receives once per TXT lookup when gate is set
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (p *countingDNSProvider) count(qtype, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queries == nil {
+		p.queries = make(map[string]int)
+	}
+	p.queries[qtype+" "+name]++
+}
+
+func (p *countingDNSProvider) Queries(qtype, name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queries[qtype+" "+name]
+}
+
+func (p *countingDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	p.count("TXT", domain)
+	if p.Missing[domain] {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	if p.gate != nil {
+		p.started <- struct{}{}
+		<-p.gate
+	}
+	return p.mockDNSProvider.LookupTXT(ctx, domain)
+}
+
+func (p *countingDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	p.count("A", domain)
+	return p.mockDNSProvider.LookupIP(ctx, domain)
+}
+
+func (p *countingDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	p.count("MX", domain)
+	return p.mockDNSProvider.LookupMX(ctx, domain)
+}
+
+func (p *countingDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	ttl, ok := p.TTLs[name]
+	return ttl, ok
+}
+
+func TestCachingDNSProvider_SharedAcrossDomains(t *testing.T) {
+	inner := &countingDNSProvider{mockDNSProvider: mockDNSProvider{
+		Records: map[string][]string{
+			"one.example":         {"v=spf1 include:_spf.vendor.example a:mail.one.example -all"},
+			"two.example":         {"v=spf1 include:_spf.vendor.example mx -all"},
+			"_spf.vendor.example": {"v=spf1 include:_a.vendor.example include:_b.vendor.example ~all"},
+			"_a.vendor.example":   {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			"_b.vendor.example":   {"v=spf1 ip6:2001:db8::/32 ~all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.one.example": {net.ParseIP("198.51.100.1")},
+			"mx.two.example":   {net.ParseIP("198.51.100.2")},
+		},
+		MXs: map[string][]*net.MX{
+			"two.example": {{Host: "mx.two.example", Pref: 10}},
+		},
+	}}
+	cache := NewCachingDNSProvider(inner)
+
+	expected := map[string]string{
+		"one.example": "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.1 ip6:2001:db8::/32 -all",
+		"two.example": "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.2 ip6:2001:db8::/32 -all",
+	}
+	var wg sync.WaitGroup
+	for domain, want := range expected {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := FlattenSPFWithOptions(context.Background(), domain, cache, FlattenOptions{ForceFlatten: true})
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %v", domain, err)
+				return
+			}
+			if result.Flattened != want {
+				t.Errorf("Expected %q for %s, got %q", want, domain, result.Flattened)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range []string{"_spf.vendor.example", "_a.vendor.example", "_b.vendor.example", "one.example"} {
+		if got := inner.Queries("TXT", name); got != 1 {
+			t.Errorf("Expected 1 TXT query for %s, got %d", name, got)
+		}
+	}
+	if got := inner.Queries("A", "mx.two.example"); got != 1 {
+		t.Errorf("Expected 1 A query for mx.two.example, got %d", got)
+	}
+	if stats := cache.Stats(); stats.Hits == 0 {
+		t.Errorf("Expected cache hits, got %s", stats)
+	}
+}
+
+func TestCachingDNSProvider_TTL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		ttls      map[string]uint32
+		elapsed   time.Duration
+		expectHit bool
+	}{
+		{"within the reported TTL", map[string]uint32{"example.com": 60}, 59 * time.Second, true},
+		{"after the reported TTL", map[string]uint32{"example.com": 60}, 60 * time.Second, false},
+		{"TTL 0 is not cached", map[string]uint32{"example.com": 0}, 0, false},
+		{"default TTL without a reported TTL", nil, DefaultCacheTTL - time.Second, true},
+		{"after the default TTL", nil, DefaultCacheTTL, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := &countingDNSProvider{
+				mockDNSProvider: mockDNSProvider{Records: map[string][]string{"example.com": {"v=spf1 -all"}}},
+				TTLs:            tc.ttls,
+			}
+			cache := NewCachingDNSProvider(inner)
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			cache.now = func() time.Time { return now }
+
+			if _, err := cache.LookupTXT(context.Background(), "example.com"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			now = now.Add(tc.elapsed)
+			if _, err := cache.LookupTXT(context.Background(), "example.com"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expectedQueries := 2
+			if tc.expectHit {
+				expectedQueries = 1
+			}
+			if got := inner.Queries("TXT", "example.com"); got != expectedQueries {
+				t.Errorf("Expected %d queries, got %d", expectedQueries, got)
+			}
+		})
+	}
+}
+
+func TestCachingDNSProvider_MergesConcurrentLookups(t *testing.T) {
+	inner := &countingDNSProvider{
+		mockDNSProvider: mockDNSProvider{Records: map[string][]string{"example.com": {"v=spf1 -all"}}},
+		TTLs:            map[string]uint32{"example.com": 300},
+		gate:            make(chan struct{}),
+		started:         make(chan struct{}, 1),
+	}
+	cache := NewCachingDNSProvider(inner)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.LookupTXT(context.Background(), "example.com"); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	<-inner.started
+	time.Sleep(20 * time.Millisecond) // let the other callers join the query in flight
+	close(inner.gate)
+	wg.Wait()
+
+	if got := inner.Queries("TXT", "example.com"); got != 1 {
+		t.Errorf("Expected 1 query, got %d", got)
+	}
+	// Callers arriving after the answer was cached are hits rather than shared
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits+stats.Shared != callers-1 {
+		t.Errorf("Unexpected stats: %s", stats)
+	}
+	if ttl, ok := cache.AnswerTTL("example.com", dns.TypeTXT); !ok || ttl == 0 {
+		t.Errorf("Expected the cached answer to report its remaining TTL, got %d (%v)", ttl, ok)
+	}
+}
+
+func TestCachingDNSProvider_AnswerTTLOnlyWhenReported(t *testing.T) {
+	inner := &countingDNSProvider{
+		mockDNSProvider: mockDNSProvider{Records: map[string][]string{
+			"reported.example":   {"v=spf1 -all"},
+			"unreported.example": {"v=spf1 -all"},
+		}},
+		TTLs: map[string]uint32{"reported.example": 300},
+	}
+	dir := t.TempDir()
+	disk, err := NewDiskCacheDNSProvider(inner, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cache := NewCachingDNSProvider(disk)
+	for _, name := range []string{"reported.example", "unreported.example"} {
+		if _, err := cache.LookupTXT(context.Background(), name); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	reloaded, err := NewDiskCacheDNSProvider(&mockDNSProvider{}, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, p := range []TTLReporter{cache, disk, reloaded} {
+		if ttl, ok := p.AnswerTTL("reported.example", dns.TypeTXT); !ok || ttl == 0 || ttl > 300 {
+			t.Errorf("%T: expected the remaining upstream TTL, got %d (%v)", p, ttl, ok)
+		}
+		// Answers cached for DefaultTTL have no upstream TTL to report
+		if ttl, ok := p.AnswerTTL("unreported.example", dns.TypeTXT); ok {
+			t.Errorf("%T: expected no TTL for an answer without one, got %d", p, ttl)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// This file implements the check_host() function of RFC 7208 section 4: evaluating
+// a domain's SPF record for a connecting client address, sender and HELO name. It
+// is used to confirm that a flattened record authorizes the same hosts as the
+// record it was generated from.
+
+// Result is the outcome of an SPF evaluation (RFC 7208 section 2.6).
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultNeutral   Result = "neutral"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// qualifierResult maps a directive qualifier to the result of a match.
+func qualifierResult(q Qualifier) Result {
+	switch q {
+	case QualifierFail:
+		return ResultFail
+	case QualifierSoftFail:
+		return ResultSoftFail
+	case QualifierNeutral:
+		return ResultNeutral
+	}
+	return ResultPass
+}
+
+// AddrLookupProvider is implemented by DNS providers that can resolve PTR records.
+// Without it, ptr mechanisms never match, as if the PTR lookup had failed.
+type AddrLookupProvider interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// CheckRequest holds the check_host() arguments for one evaluation.
+type CheckRequest struct {
+	IP     net.IP // Connecting client address
+	Domain string // Domain whose SPF record is evaluated; defaults to the sender's domain
+	Sender string // MAIL FROM address; empty for bounces, in which case HELO is used
+	HELO   string // HELO/EHLO name given by the client
+}
+
+// CheckResult describes the outcome of check_host() and how it was reached.
+type CheckResult struct {
+	Result      Result
+	Domain      string   // Domain whose record produced the result
+	Term        string   // Matching term, or the term that caused an error; empty otherwise
+	Path        []string // include: and redirect= terms followed to reach Domain
+	Explanation string   // Expanded exp= text for fail results, if the record provides one
+	Reason      string   // Why the result is none, neutral by default, permerror or temperror
+	Lookups     int      // DNS lookups counted against MaxDNSLookups
+	VoidLookups int      // Lookups that returned no records
+}
+
+// CheckHost evaluates the SPF record of req.Domain for the client in req, following
+// RFC 7208: terms are evaluated in order and the first match determines the result,
+// include: matches only when the included record passes, and redirect= is used when
+// nothing matches. DNS errors produce temperror; processing limit violations and
+// malformed records produce permerror.
+func CheckHost(ctx context.Context, dns DNSProvider, req CheckRequest) *CheckResult {
+	return CheckHostWithRecords(ctx, dns, req, nil)
+}
+
+// CheckHostWithRecords is CheckHost with the SPF records of some domains supplied by
+// the caller instead of DNS, for example the output of SplitAndChainSPF before it is
+// published. Names missing from records are resolved through dns.
+func CheckHostWithRecords(ctx context.Context, dns DNSProvider, req CheckRequest, records map[string]string) *CheckResult {
+	domain := req.Domain
+	if domain == "" {
+		if at := strings.LastIndexByte(req.Sender, '@'); at >= 0 {
+			domain = req.Sender[at+1:]
+		} else {
+			domain = req.HELO
+		}
+	}
+
+	c := &checker{dns: dns, req: req, records: records}
+	result := c.checkHost(ctx, strings.TrimSuffix(domain, "."), nil)
+	result.Lookups = c.lookups
+	result.VoidLookups = c.voidLookups
+	return result
+}
+
+type checker struct {
+	dns         DNSProvider
+	req         CheckRequest
+	records     map[string]string
+	lookups     int
+	voidLookups int
+}
+
+// checkError ends an evaluation with a permerror or temperror.
+type checkError struct {
+	result Result
+	reason string
+}
+
+func (e *checkError) Error() string {
+	return string(e.result) + ": " + e.reason
+}
+
+func permErrorf(format string, args ...interface{}) *checkError {
+	return &checkError{result: ResultPermError, reason: fmt.Sprintf(format, args...)}
+}
+
+func tempErrorf(format string, args ...interface{}) *checkError {
+	return &checkError{result: ResultTempError, reason: fmt.Sprintf(format, args...)}
+}
+
+// checkHost fetches and evaluates the SPF record of domain (RFC 7208 section 4.3-4.4).
+func (c *checker) checkHost(ctx context.Context, domain string, path []string) *CheckResult {
+	result := &CheckResult{Domain: domain, Path: path}
+	if !validDomain(domain) {
+		result.Result = ResultNone
+		result.Reason = fmt.Sprintf("%q is not a valid domain name", domain)
+		return result
+	}
+
+	if record, ok := c.records[domain]; ok {
+		return c.evaluate(ctx, domain, record, path)
+	}
+
+	txts, err := c.dns.LookupTXT(ctx, domain)
+	if err != nil && !isVoidLookup(err) {
+		result.Result = ResultTempError
+		result.Reason = fmt.Sprintf("failed to retrieve SPF record for %s: %v", domain, err)
+		return result
+	}
+	var spfRecords []string
+	for _, txt := range txts {
+		if IsSPFRecord(txt) {
+			spfRecords = append(spfRecords, txt)
+		}
+	}
+	switch len(spfRecords) {
+	case 0:
+		result.Result = ResultNone
+		result.Reason = fmt.Sprintf("%s has no SPF record", domain)
+		return result
+	case 1:
+		return c.evaluate(ctx, domain, spfRecords[0], path)
+	default:
+		result.Result = ResultPermError
+		result.Reason = fmt.Sprintf("%s has %d SPF records", domain, len(spfRecords))
+		return result
+	}
+}
+
+// evaluate applies the terms of record, the SPF record of domain (RFC 7208 section 4.6).
+func (c *checker) evaluate(ctx context.Context, domain, record string, path []string) *CheckResult {
+	result := &CheckResult{Domain: domain, Path: path}
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		result.Result = ResultPermError
+		result.Reason = fmt.Sprintf("invalid SPF record for %s: %v", domain, err)
+		return result
+	}
+	macros := &MacroContext{Sender: c.req.Sender, Domain: domain, IP: c.req.IP, HELO: c.req.HELO}
+
+	for _, term := range parsed.Mechanisms() {
+		inner, err := c.match(ctx, term, domain, macros, path)
+		if err != nil {
+			return c.errorResult(err, domain, term, path)
+		}
+		if inner == nil {
+			continue
+		}
+		inner.Result = qualifierResult(term.Qualifier)
+		if inner.Result == ResultFail {
+			inner.Explanation = c.explain(ctx, parsed, macros)
+		}
+		return inner
+	}
+
+	redirect, ok := parsed.Redirect()
+	if !ok {
+		result.Result = ResultNeutral
+		result.Reason = "no mechanism matched"
+		return result
+	}
+	target, err := c.expandTarget(redirect, domain, macros)
+	if err == nil {
+		err = c.countLookup()
+	}
+	if err != nil {
+		return c.errorResult(err, domain, redirect, path)
+	}
+	redirected := c.checkHost(ctx, target, appendPath(path, redirect))
+	if redirected.Result == ResultNone {
+		redirected.Result = ResultPermError
+		redirected.Reason = fmt.Sprintf("redirect target %s has no SPF record", target)
+	}
+	return redirected
+}
+
+// match evaluates a single mechanism. It returns nil when the mechanism does not
+// match, or a result identifying the matching term (for include:, the term that
+// matched inside the included record).
+func (c *checker) match(ctx context.Context, term Term, domain string, macros *MacroContext, path []string) (*CheckResult, error) {
+	matched := &CheckResult{Domain: domain, Term: term.String(), Path: path}
+	ip := c.req.IP
+
+	switch term.Kind {
+	case KindAll:
+		return matched, nil
+	case KindIP4, KindIP6:
+		if prefixContains(term.IP, term.IP4Prefix, term.IP6Prefix, ip) {
+			return matched, nil
+		}
+		return nil, nil
+	}
+
+	if err := c.countLookup(); err != nil {
+		return nil, err
+	}
+	target, err := c.expandTarget(term, domain, macros)
+	if err != nil {
+		return nil, err
+	}
+
+	switch term.Kind {
+	case KindInclude:
+		inner := c.checkHost(ctx, target, appendPath(path, term))
+		switch inner.Result {
+		case ResultPass:
+			return inner, nil
+		case ResultTempError:
+			return nil, tempErrorf("include:%s: %s", target, inner.Reason)
+		case ResultPermError:
+			return nil, permErrorf("include:%s: %s", target, inner.Reason)
+		case ResultNone:
+			return nil, permErrorf("included domain %s has no SPF record", target)
+		}
+		return nil, nil
+	case KindA:
+		ips, err := c.lookupIP(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range ips {
+			if prefixContains(candidate, term.IP4Prefix, term.IP6Prefix, ip) {
+				return matched, nil
+			}
+		}
+	case KindMX:
+		mxs, err := c.dns.LookupMX(ctx, target)
+		if err := c.checkAnswer(target, len(mxs), err); err != nil {
+			return nil, err
+		}
+		if len(mxs) > MaxMXHosts {
+			return nil, permErrorf("%s has %d MX hosts, more than the limit of %d", target, len(mxs), MaxMXHosts)
+		}
+		for _, mx := range mxs {
+			ips, err := c.lookupIP(ctx, strings.TrimSuffix(mx.Host, "."))
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range ips {
+				if prefixContains(candidate, term.IP4Prefix, term.IP6Prefix, ip) {
+					return matched, nil
+				}
+			}
+		}
+	case KindPTR:
+		if c.validatedName(ctx, target) != "" {
+			return matched, nil
+		}
+	case KindExists:
+		ips, err := c.lookupIP(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				return matched, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// validatedName returns a validated domain name of the client that equals target or
+// is a subdomain of it (RFC 7208 section 5.5), or "" if there is none.
+func (c *checker) validatedName(ctx context.Context, target string) string {
+	resolver, ok := c.dns.(AddrLookupProvider)
+	if !ok || c.req.IP == nil {
+		return ""
+	}
+	names, err := resolver.LookupAddr(ctx, c.req.IP.String())
+	if err != nil {
+		return "" // PTR lookup errors make the mechanism fail to match
+	}
+	const maxPTRNames = 10
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+	target = strings.ToLower(target)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := c.dns.LookupIP(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, candidate := range ips {
+			if candidate.Equal(c.req.IP) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// explain returns the expanded exp= explanation of a record, or "" when it has
+// none or it cannot be retrieved (RFC 7208 section 6.2).
+func (c *checker) explain(ctx context.Context, record *Record, macros *MacroContext) string {
+	exp, ok := record.Explanation()
+	if !ok {
+		return ""
+	}
+	target, err := macros.ExpandDomainSpec(exp.DomainSpec)
+	if err != nil {
+		return ""
+	}
+	txts, err := c.dns.LookupTXT(ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := macros.ExpandExplanation(txts[0])
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// countLookup counts a DNS-querying term against MaxDNSLookups.
+func (c *checker) countLookup() error {
+	c.lookups++
+	if c.lookups > MaxDNSLookups {
+		return permErrorf("more than %d DNS lookups", MaxDNSLookups)
+	}
+	return nil
+}
+
+// checkAnswer classifies the outcome of a mechanism's DNS query: empty answers count
+// as void lookups and other failures are temperrors.
+func (c *checker) checkAnswer(name string, answers int, err error) error {
+	if err != nil && !isVoidLookup(err) {
+		return tempErrorf("DNS lookup for %s failed: %v", name, err)
+	}
+	if answers == 0 {
+		c.voidLookups++
+		if c.voidLookups > MaxVoidLookups {
+			return permErrorf("more than %d void lookups", MaxVoidLookups)
+		}
+	}
+	return nil
+}
+
+func (c *checker) lookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips, err := c.dns.LookupIP(ctx, name)
+	if err := c.checkAnswer(name, len(ips), err); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// expandTarget returns the domain a term applies to, expanding any macros.
+func (c *checker) expandTarget(term Term, domain string, macros *MacroContext) (string, error) {
+	if term.DomainSpec == "" {
+		return domain, nil
+	}
+	target, err := macros.ExpandDomainSpec(term.DomainSpec)
+	if err != nil {
+		return "", permErrorf("cannot expand %s: %v", term, err)
+	}
+	return strings.TrimSuffix(target, "."), nil
+}
+
+func (c *checker) errorResult(err error, domain string, term Term, path []string) *CheckResult {
+	result := &CheckResult{Result: ResultPermError, Domain: domain, Term: term.String(), Path: path, Reason: err.Error()}
+	if ce, ok := err.(*checkError); ok {
+		result.Result = ce.result
+		result.Reason = ce.reason
+	}
+	return result
+}
+
+// appendPath returns a copy of path with term appended, so sibling includes don't
+// share backing arrays.
+func appendPath(path []string, term Term) []string {
+	next := make([]string, len(path), len(path)+1)
+	copy(next, path)
+	return append(next, term.String())
+}
+
+// prefixContains reports whether ip lies within network/prefix, using the IPv4 or
+// IPv6 prefix length depending on the network's address family. A negative prefix
+// means the full address length.
+func prefixContains(network net.IP, ip4Prefix, ip6Prefix int, ip net.IP) bool {
+	if network == nil || ip == nil {
+		return false
+	}
+	if v4 := network.To4(); v4 != nil {
+		client := ip.To4()
+		if client == nil {
+			return false
+		}
+		if ip4Prefix < 0 {
+			ip4Prefix = 32
+		}
+		mask := net.CIDRMask(ip4Prefix, 32)
+		return v4.Mask(mask).Equal(client.Mask(mask))
+	}
+	if ip.To4() != nil {
+		return false
+	}
+	if ip6Prefix < 0 {
+		ip6Prefix = 128
+	}
+	mask := net.CIDRMask(ip6Prefix, 128)
+	return network.To16().Mask(mask).Equal(ip.To16().Mask(mask))
+}
+
+// validDomain reports whether domain is a multi-label name with labels of 1-63
+// characters, as check_host() requires (RFC 7208 section 4.3).
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > maxDomainLength {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
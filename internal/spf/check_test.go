@@ -0,0 +1,250 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ptrDNSProvider adds PTR lookups to voidDNSProvider.
+type ptrDNSProvider struct {
+	voidDNSProvider
+	PTRs map[string][]string
+}
+
+func (p *ptrDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := p.PTRs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestCheckHost(t *testing.T) {
+	records := map[string][]string{
+		"example.com":         {"v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.7 include:_spf.example.net a:mail.example.com/30 mx ~all"},
+		"_spf.example.net":    {"v=spf1 include:_blocks.example.net ?ip4:203.0.113.200 -all"},
+		"_blocks.example.net": {"v=spf1 ip4:203.0.113.0/25 ip6:2001:db8::/32 -all"},
+		"redirect.example":    {"v=spf1 ip4:10.0.0.1 redirect=example.com"},
+		"dangling.example":    {"v=spf1 redirect=missing.example"},
+		"broken.example":      {"v=spf1 include:missing.example -all"},
+		"macro.example":       {"v=spf1 exists:%{i}.%{l}._spf.%{d} -all"},
+		"ptr.example":         {"v=spf1 ptr:mail.ptr.example -all exp=explain.ptr.example"},
+		"explain.ptr.example": {"%{i} is not authorized by %{d}"},
+		"double.example":      {"v=spf1 -all", "v=spf1 +all"},
+		"syntax.example":      {"v=spf1 ip4:not-an-ip -all"},
+		"void.example":        {"v=spf1 a:gone1.example a:gone2.example a:gone3.example -all"},
+	}
+	provider := &ptrDNSProvider{
+		voidDNSProvider: voidDNSProvider{mockDNSProvider{
+			Records: records,
+			IPs: map[string][]net.IP{
+				"mail.example.com":                    {net.ParseIP("198.18.0.1")},
+				"mx1.example.com":                     {net.ParseIP("198.18.1.1")},
+				"198.18.2.2.alice._spf.macro.example": {net.ParseIP("127.0.0.2")},
+				"host.mail.ptr.example":               {net.ParseIP("198.18.3.3")},
+			},
+			MXs: map[string][]*net.MX{
+				"example.com": {{Host: "mx1.example.com.", Pref: 10}},
+			},
+		}},
+		PTRs: map[string][]string{
+			"198.18.3.3": {"host.mail.ptr.example."},
+			"198.18.3.4": {"host.mail.ptr.example."}, // forward lookup doesn't confirm
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		req         CheckRequest
+		result      Result
+		domain      string
+		term        string
+		path        []string
+		explanation string
+		reason      string // substring expected in Reason
+	}{
+		{
+			name:   "ip4 match",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "example.com"},
+			result: ResultPass, domain: "example.com", term: "ip4:192.0.2.0/24",
+		},
+		{
+			name:   "qualified ip4 match",
+			req:    CheckRequest{IP: net.ParseIP("198.51.100.7"), Domain: "example.com"},
+			result: ResultFail, domain: "example.com", term: "-ip4:198.51.100.7",
+		},
+		{
+			name:   "nested include match",
+			req:    CheckRequest{IP: net.ParseIP("203.0.113.5"), Domain: "example.com"},
+			result: ResultPass, domain: "_blocks.example.net", term: "ip4:203.0.113.0/25",
+			path: []string{"include:_spf.example.net", "include:_blocks.example.net"},
+		},
+		{
+			name:   "ip6 match through include",
+			req:    CheckRequest{IP: net.ParseIP("2001:db8::25"), Domain: "example.com"},
+			result: ResultPass, domain: "_blocks.example.net", term: "ip6:2001:db8::/32",
+			path: []string{"include:_spf.example.net", "include:_blocks.example.net"},
+		},
+		{
+			name:   "non-pass include result does not match",
+			req:    CheckRequest{IP: net.ParseIP("203.0.113.200"), Domain: "example.com"},
+			result: ResultSoftFail, domain: "example.com", term: "~all",
+		},
+		{
+			name:   "a mechanism with CIDR length",
+			req:    CheckRequest{IP: net.ParseIP("198.18.0.3"), Domain: "example.com"},
+			result: ResultPass, domain: "example.com", term: "a:mail.example.com/30",
+		},
+		{
+			name:   "mx mechanism",
+			req:    CheckRequest{IP: net.ParseIP("198.18.1.1"), Domain: "example.com"},
+			result: ResultPass, domain: "example.com", term: "mx",
+		},
+		{
+			name:   "domain defaults to the sender's domain",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Sender: "user@example.com"},
+			result: ResultPass, domain: "example.com", term: "ip4:192.0.2.0/24",
+		},
+		{
+			name:   "redirect",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "redirect.example"},
+			result: ResultPass, domain: "example.com", term: "ip4:192.0.2.0/24",
+			path: []string{"redirect=example.com"},
+		},
+		{
+			name:   "redirect to a domain without SPF",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "dangling.example"},
+			result: ResultPermError, reason: "no SPF record",
+		},
+		{
+			name:   "include of a domain without SPF",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "broken.example"},
+			result: ResultPermError, domain: "broken.example", term: "include:missing.example",
+			reason: "has no SPF record",
+		},
+		{
+			name:   "exists with macros",
+			req:    CheckRequest{IP: net.ParseIP("198.18.2.2"), Domain: "macro.example", Sender: "alice@macro.example"},
+			result: ResultPass, domain: "macro.example", term: "exists:%{i}.%{l}._spf.%{d}",
+		},
+		{
+			name:   "exists without a record",
+			req:    CheckRequest{IP: net.ParseIP("198.18.2.2"), Domain: "macro.example", Sender: "bob@macro.example"},
+			result: ResultFail, domain: "macro.example", term: "-all",
+		},
+		{
+			name:   "validated ptr",
+			req:    CheckRequest{IP: net.ParseIP("198.18.3.3"), Domain: "ptr.example"},
+			result: ResultPass, domain: "ptr.example", term: "ptr:mail.ptr.example",
+		},
+		{
+			name:   "unvalidated ptr fails with explanation",
+			req:    CheckRequest{IP: net.ParseIP("198.18.3.4"), Domain: "ptr.example"},
+			result: ResultFail, domain: "ptr.example", term: "-all",
+			explanation: "198.18.3.4 is not authorized by ptr.example",
+		},
+		{
+			name:   "no SPF record",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "nospf.example"},
+			result: ResultNone, domain: "nospf.example",
+		},
+		{
+			name:   "multiple SPF records",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "double.example"},
+			result: ResultPermError, domain: "double.example", reason: "2 SPF records",
+		},
+		{
+			name:   "syntax error",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "syntax.example"},
+			result: ResultPermError, domain: "syntax.example", reason: "invalid SPF record",
+		},
+		{
+			name:   "void lookup limit",
+			req:    CheckRequest{IP: net.ParseIP("192.0.2.10"), Domain: "void.example"},
+			result: ResultPermError, domain: "void.example", term: "a:gone3.example",
+			reason: "void lookups",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CheckHost(context.Background(), provider, tc.req)
+			if got.Result != tc.result {
+				t.Fatalf("Expected %s, got %s (%+v)", tc.result, got.Result, got)
+			}
+			if tc.domain != "" && got.Domain != tc.domain {
+				t.Errorf("Expected domain %q, got %q", tc.domain, got.Domain)
+			}
+			if got.Term != tc.term {
+				t.Errorf("Expected term %q, got %q", tc.term, got.Term)
+			}
+			if len(tc.path) > 0 && !reflect.DeepEqual(got.Path, tc.path) {
+				t.Errorf("Expected path %v, got %v", tc.path, got.Path)
+			}
+			if got.Explanation != tc.explanation {
+				t.Errorf("Expected explanation %q, got %q", tc.explanation, got.Explanation)
+			}
+			if !strings.Contains(got.Reason, tc.reason) {
+				t.Errorf("Expected reason containing %q, got %q", tc.reason, got.Reason)
+			}
+		})
+	}
+}
+
+func TestCheckHost_LookupLimit(t *testing.T) {
+	records := map[string][]string{
+		"example.com": {"v=spf1 include:a.example include:b.example include:c.example include:d.example include:e.example include:f.example include:g.example include:h.example include:i.example include:j.example include:k.example -all"},
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"} {
+		records[name+".example"] = []string{"v=spf1 -all"}
+	}
+	provider := &voidDNSProvider{mockDNSProvider{Records: records}}
+
+	got := CheckHost(context.Background(), provider, CheckRequest{IP: net.ParseIP("192.0.2.1"), Domain: "example.com"})
+	if got.Result != ResultPermError || got.Term != "include:k.example" {
+		t.Errorf("Expected permerror at include:k.example, got %s at %q (%s)", got.Result, got.Term, got.Reason)
+	}
+	if got.Lookups != MaxDNSLookups+1 {
+		t.Errorf("Expected %d lookups, got %d", MaxDNSLookups+1, got.Lookups)
+	}
+}
+
+func TestCheckHost_TempError(t *testing.T) {
+	// mockDNSProvider reports missing names with plain errors, which are not void lookups
+	provider := &mockDNSProvider{Records: map[string][]string{
+		"example.com": {"v=spf1 a:unreachable.example -all"},
+	}}
+
+	got := CheckHost(context.Background(), provider, CheckRequest{IP: net.ParseIP("192.0.2.1"), Domain: "example.com"})
+	if got.Result != ResultTempError {
+		t.Errorf("Expected temperror, got %s (%s)", got.Result, got.Reason)
+	}
+}
+
+func TestCheckHostWithRecords_FlattenedChain(t *testing.T) {
+	original := map[string][]string{
+		"example.com":      {"v=spf1 include:_spf.example.net -all"},
+		"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 ~all"},
+	}
+	provider := &voidDNSProvider{mockDNSProvider{Records: original}}
+
+	flattened, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{ForceFlatten: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	chain, err := SplitAndChainSPF(flattened.Flattened, "example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.200", "203.0.113.1"} {
+		req := CheckRequest{IP: net.ParseIP(ip), Domain: "example.com"}
+		before := CheckHost(context.Background(), provider, req)
+		after := CheckHostWithRecords(context.Background(), provider, req, chain)
+		if before.Result != after.Result {
+			t.Errorf("%s: original record gives %s, flattened records give %s", ip, before.Result, after.Result)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ConsensusPolicy decides which answer ConsensusDNSProvider uses when its servers
+// disagree.
+type ConsensusPolicy string
+
+const (
+	// ConsensusUnanimous fails lookups on which the servers disagree, or that any
+	// server fails to answer.
+	ConsensusUnanimous ConsensusPolicy = "unanimous"
+	// ConsensusQuorum uses the answer given by more than half of the servers, and fails
+	// lookups without one.
+	ConsensusQuorum ConsensusPolicy = "quorum"
+	// ConsensusUnion uses every record returned by any server.
+	ConsensusUnion ConsensusPolicy = "union"
+)
+
+// ConsensusDNSProvider queries all of its servers in parallel and compares their
+// answers, so a single misbehaving or poisoned resolver cannot change the flattened
+// record unnoticed. Servers whose lookups fail are left out of the comparison; a server
+// finding no records answers with the empty set. Every disagreement is recorded (see
+// Disagreements), and Policy decides the answer used.
+type ConsensusDNSProvider struct {
+	Policy ConsensusPolicy
+
+	servers       []ConsensusServer
+	ttls          answerTTLs
+	mu            sync.Mutex
+	disagreements map[cacheKey]Disagreement
+}
+
+// ConsensusServer is one server compared by ConsensusDNSProvider.
+type ConsensusServer struct {
+	Name     string // Shown in disagreements
+	Provider DNSProvider
+}
+
+// Disagreement records the differing answers of the servers to one query.
+type Disagreement struct {
+	Query      string         // Query type and name, e.g. "TXT _spf.example.com"
+	Name       string         // The name queried
+	Answers    []ServerAnswer // Each server's answer, in configured order
+	Resolution string         // The answer used, or why the lookup failed
+}
+
+// ServerAnswer is one server's answer to a query.
+type ServerAnswer struct {
+	Server string
+	Answer string // The records returned, "no records", or the lookup error
+}
+
+// NewConsensusDNSProvider compares the answers of servers under policy.
+func NewConsensusDNSProvider(policy ConsensusPolicy, servers []ConsensusServer) (*ConsensusDNSProvider, error) {
+	switch policy {
+	case ConsensusUnanimous, ConsensusQuorum, ConsensusUnion:
+	default:
+		return nil, fmt.Errorf("invalid consensus policy %q: must be %s, %s or %s", policy, ConsensusUnanimous, ConsensusQuorum, ConsensusUnion)
+	}
+	if len(servers) < 2 {
+		return nil, fmt.Errorf("consensus needs at least 2 DNS servers, got %d", len(servers))
+	}
+	return &ConsensusDNSProvider{
+		Policy:        policy,
+		servers:       servers,
+		disagreements: make(map[cacheKey]Disagreement),
+	}, nil
+}
+
+func (c *ConsensusDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	return consensusLookup(c, ctx, domain, dns.TypeTXT, func(p DNSProvider) ([]string, error) {
+		return p.LookupTXT(ctx, domain)
+	}, strconv.Quote)
+}
+
+func (c *ConsensusDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	return consensusLookup(c, ctx, domain, dns.TypeA, func(p DNSProvider) ([]net.IP, error) {
+		return p.LookupIP(ctx, domain)
+	}, net.IP.String)
+}
+
+func (c *ConsensusDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return consensusLookup(c, ctx, domain, dns.TypeMX, func(p DNSProvider) ([]*net.MX, error) {
+		return p.LookupMX(ctx, domain)
+	}, func(mx *net.MX) string {
+		return strconv.Itoa(int(mx.Pref)) + " " + strings.ToLower(dns.Fqdn(mx.Host))
+	})
+}
+
+// LookupAddr compares the PTR names of addr returned by the servers supporting PTR
+// lookups.
+func (c *ConsensusDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return consensusLookup(c, ctx, addr, dns.TypePTR, func(p DNSProvider) ([]string, error) {
+		resolver, ok := p.(AddrLookupProvider)
+		if !ok {
+			return nil, errors.New("PTR lookups are not supported by the DNS provider")
+		}
+		return resolver.LookupAddr(ctx, addr)
+	}, func(name string) string { return strings.ToLower(dns.Fqdn(name)) })
+}
+
+// AnswerTTL implements TTLReporter with the lowest TTL reported by the servers whose
+// answer was used.
+func (c *ConsensusDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	return c.ttls.lookup(name, qtype)
+}
+
+// Close closes every server's provider, returning the first error.
+func (c *ConsensusDNSProvider) Close() error {
+	var first error
+	for _, s := range c.servers {
+		if err := s.Provider.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Disagreements returns the disagreements recorded so far, sorted by query.
+func (c *ConsensusDNSProvider) Disagreements() []Disagreement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var all []Disagreement
+	for _, d := range c.disagreements {
+		all = append(all, d)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Query < all[j].Query })
+	return all
+}
+
+// DisagreementsFor returns the recorded disagreements on queries for names.
+func (c *ConsensusDNSProvider) DisagreementsFor(names []string) []Disagreement {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[newCacheKey(name, 0).name] = true
+	}
+	var matching []Disagreement
+	for _, d := range c.Disagreements() {
+		if wanted[newCacheKey(d.Name, 0).name] {
+			matching = append(matching, d)
+		}
+	}
+	return matching
+}
+
+// Disputed reports whether the servers disagreed on the answer to a query.
+func (c *ConsensusDNSProvider) Disputed(name string, qtype uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.disagreements[newCacheKey(name, qtype)]
+	return ok
+}
+
+// disputed reports whether provider is a ConsensusDNSProvider whose servers disagreed
+// on the answer to a query.
+func disputed(provider DNSProvider, name string, qtype uint16) bool {
+	consensus, ok := provider.(*ConsensusDNSProvider)
+	return ok && consensus.Disputed(name, qtype)
+}
+
+// FindConsensusProvider returns the ConsensusDNSProvider behind provider and the
+// caches wrapping it, if any. Wrapping providers expose what they wrap with an
+// Unwrap() DNSProvider method.
+func FindConsensusProvider(provider DNSProvider) (*ConsensusDNSProvider, bool) {
+	for {
+		switch p := provider.(type) {
+		case *ConsensusDNSProvider:
+			return p, true
+		case interface{ Unwrap() DNSProvider }:
+			provider = p.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// serverResult is one server's answer, with its records keyed for comparison.
+type serverResult[T any] struct {
+	records []T
+	keys    []string // Sorted and deduplicated
+	err     error    // A lookup error other than a void lookup
+}
+
+// consensusLookup queries every server with lookup and applies the policy to the
+// answers, comparing records by key.
+func consensusLookup[T any](c *ConsensusDNSProvider, ctx context.Context, name string, qtype uint16, lookup func(DNSProvider) ([]T, error), key func(T) string) ([]T, error) {
+	results := make([]serverResult[T], len(c.servers))
+	var wg sync.WaitGroup
+	for i, s := range c.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records, err := lookup(s.Provider)
+			if err != nil && !isVoidLookup(err) {
+				results[i].err = err
+				return
+			}
+			results[i].records = records
+			seen := make(map[string]bool)
+			for _, r := range records {
+				if k := key(r); !seen[k] {
+					seen[k] = true
+					results[i].keys = append(results[i].keys, k)
+				}
+			}
+			sort.Strings(results[i].keys)
+		}()
+	}
+	wg.Wait()
+
+	// Group the answering servers by answer
+	groups := make(map[string][]int)
+	var order []string
+	var firstErr error
+	for i, r := range results {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		answer := strings.Join(r.keys, "\n")
+		if _, ok := groups[answer]; !ok {
+			order = append(order, answer)
+		}
+		groups[answer] = append(groups[answer], i)
+	}
+	if len(order) == 0 {
+		return nil, firstErr
+	}
+
+	var used []int // The servers whose answer is used
+	var resolution string
+	var failure error
+	disputed := len(order) > 1
+	switch {
+	case c.Policy == ConsensusQuorum:
+		// A quorum is counted against every server, so failed servers count against it
+		for _, answer := range order {
+			if len(groups[answer])*2 > len(c.servers) {
+				used = groups[answer]
+			}
+		}
+		if used != nil {
+			resolution = fmt.Sprintf("used the answer of %d of %d servers", len(used), len(c.servers))
+		} else {
+			resolution = "failed: no answer was given by a quorum of servers"
+			failure = fmt.Errorf("no answer to %s %s was given by a quorum of the %d DNS servers", dns.TypeToString[qtype], name, len(c.servers))
+		}
+	case c.Policy == ConsensusUnanimous && firstErr != nil:
+		// A server made to fail must not leave the answer of the others unchallenged
+		disputed = true
+		resolution = "failed: servers must agree unanimously, and not all of them answered"
+		failure = fmt.Errorf("not all DNS servers answered %s %s (consensus policy %s): %v", dns.TypeToString[qtype], name, c.Policy, firstErr)
+	case len(order) == 1:
+		used = groups[order[0]]
+	case c.Policy == ConsensusUnion:
+		for _, answer := range order {
+			used = append(used, groups[answer]...)
+		}
+		resolution = "used the union of the answers"
+	default:
+		resolution = "failed: servers must agree unanimously"
+		failure = fmt.Errorf("DNS servers disagree on %s %s (consensus policy %s)", dns.TypeToString[qtype], name, c.Policy)
+	}
+	if disputed {
+		answers := make([]ServerAnswer, len(results))
+		for i, r := range results {
+			answer := "no records"
+			if r.err != nil {
+				answer = "error: " + r.err.Error()
+			} else if len(r.keys) > 0 {
+				answer = strings.Join(r.keys, ", ")
+			}
+			answers[i] = ServerAnswer{Server: c.servers[i].Name, Answer: answer}
+		}
+		c.record(name, qtype, answers, resolution)
+	}
+	if failure != nil {
+		return nil, failure
+	}
+
+	// Merge the records of the servers used, keeping the first of each key
+	var merged []T
+	seen := make(map[string]bool)
+	var ttl uint32
+	for _, i := range used {
+		for _, r := range results[i].records {
+			if k := key(r); !seen[k] {
+				seen[k] = true
+				merged = append(merged, r)
+			}
+		}
+		if serverTTL, ok := answerTTL(c.servers[i].Provider, name, qtype); ok {
+			ttl = minTTL(ttl, serverTTL)
+		}
+	}
+	if len(merged) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if ttl > 0 {
+		c.ttls.set(name, qtype, ttl)
+	}
+	return merged, nil
+}
+
+// record stores the disagreement between the servers' answers to a query.
+func (c *ConsensusDNSProvider) record(name string, qtype uint16, answers []ServerAnswer, resolution string) {
+	key := newCacheKey(name, qtype)
+	d := Disagreement{Query: key.String(), Name: key.name, Answers: answers, Resolution: resolution}
+	c.mu.Lock()
+	c.disagreements[key] = d
+	c.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+package spf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestConsensusDNSProvider(t *testing.T) {
+	txt := func(records ...string) DNSProvider {
+		return &countingDNSProvider{
+			mockDNSProvider: mockDNSProvider{Records: map[string][]string{"example.com": records}},
+			TTLs:            map[string]uint32{"example.com": 300},
+		}
+	}
+	good := "v=spf1 ip4:192.0.2.0/24 -all"
+	poisoned := "v=spf1 ip4:203.0.113.0/24 -all"
+	failing := &mockDNSProvider{}                                            // lookups fail
+	void := &voidDNSProvider{mockDNSProvider: mockDNSProvider{Records: nil}} // NXDOMAIN
+
+	testCases := []struct {
+		name               string
+		policy             ConsensusPolicy
+		servers            []DNSProvider
+		expected           []string
+		expectErr          bool
+		expectDisagreement bool
+	}{
+		{"agreement", ConsensusUnanimous, []DNSProvider{txt(good), txt(good), txt(good)}, []string{good}, false, false},
+		{"answer order is ignored", ConsensusUnanimous, []DNSProvider{txt(good, "other"), txt("other", good)}, []string{good, "other"}, false, false},
+		{"unanimous rejects a divergent server", ConsensusUnanimous, []DNSProvider{txt(good), txt(good), txt(poisoned)}, nil, true, true},
+		{"unanimous rejects failed servers", ConsensusUnanimous, []DNSProvider{txt(good), failing}, nil, true, true},
+		{"quorum outvotes a divergent server", ConsensusQuorum, []DNSProvider{txt(good), txt(poisoned), txt(good)}, []string{good}, false, true},
+		{"quorum without a majority", ConsensusQuorum, []DNSProvider{txt(good), txt(poisoned)}, nil, true, true},
+		{"quorum counts failed servers", ConsensusQuorum, []DNSProvider{txt(good), failing, failing}, nil, true, false},
+		{"union merges the answers", ConsensusUnion, []DNSProvider{txt(good), txt(poisoned)}, []string{good, poisoned}, false, true},
+		{"union over a missing name", ConsensusUnion, []DNSProvider{void, txt(good)}, []string{good}, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var servers []ConsensusServer
+			for i, p := range tc.servers {
+				servers = append(servers, ConsensusServer{Name: string(rune('A' + i)), Provider: p})
+			}
+			c, err := NewConsensusDNSProvider(tc.policy, servers)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			records, err := c.LookupTXT(context.Background(), "example.com")
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", records)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			} else if !reflect.DeepEqual(records, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, records)
+			}
+			if !tc.expectErr && err == nil {
+				if ttl, ok := c.AnswerTTL("example.com", dns.TypeTXT); !ok || ttl != 300 {
+					t.Errorf("Expected TTL 300, got %d (%v)", ttl, ok)
+				}
+			}
+
+			disagreements := c.DisagreementsFor([]string{"Example.com."})
+			if got := len(disagreements) > 0; got != tc.expectDisagreement {
+				t.Fatalf("Expected disagreement %v, got %+v", tc.expectDisagreement, disagreements)
+			}
+			if tc.expectDisagreement {
+				d := disagreements[0]
+				if d.Query != "TXT example.com" || len(d.Answers) != len(tc.servers) || d.Resolution == "" {
+					t.Errorf("Unexpected disagreement %+v", d)
+				}
+			}
+		})
+	}
+}
+
+func TestNewConsensusDNSProvider_Invalid(t *testing.T) {
+	two := []ConsensusServer{{Name: "A", Provider: &mockDNSProvider{}}, {Name: "B", Provider: &mockDNSProvider{}}}
+	if _, err := NewConsensusDNSProvider("majority", two); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+	if _, err := NewConsensusDNSProvider(ConsensusQuorum, two[:1]); err == nil {
+		t.Error("Expected an error for a single server")
+	}
+}
+
+func TestFindConsensusProvider(t *testing.T) {
+	c, err := NewConsensusDNSProvider(ConsensusUnion, []ConsensusServer{
+		{Name: "A", Provider: &mockDNSProvider{}}, {Name: "B", Provider: &mockDNSProvider{}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	disk, err := NewDiskCacheDNSProvider(c, t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found, ok := FindConsensusProvider(NewCachingDNSProvider(disk)); !ok || found != c {
+		t.Error("Expected to find the consensus provider behind the caches")
+	}
+	if _, ok := FindConsensusProvider(NewCachingDNSProvider(&mockDNSProvider{})); ok {
+		t.Error("Expected no consensus provider")
+	}
+}
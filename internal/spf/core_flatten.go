@@ -10,6 +10,7 @@
 //   - Recursion detection and depth limiting
 //   - DNS response caching for performance
 //   - Context support for cancellation and timeouts
+//   - RFC 7208 record parsing and macro expansion
 //
 // Example usage:
 //
@@ -170,6 +171,23 @@ type DNSProvider interface {
 	Close() error
 }
 
+// TTLReporter is implemented by DNS providers that know the TTL of the answers they
+// return. Go's system resolver does not expose TTLs, so callers must treat them as
+// optional.
+type TTLReporter interface {
+	// AnswerTTL returns the TTL in seconds of the last answer for name and query type
+	// (dns.TypeTXT, dns.TypeMX, or dns.TypeA for the A and AAAA answers of LookupIP).
+	AnswerTTL(name string, qtype uint16) (uint32, bool)
+}
+
+// answerTTL returns the TTL provider reported for name, if it reports TTLs.
+func answerTTL(provider DNSProvider, name string, qtype uint16) (uint32, bool) {
+	if reporter, ok := provider.(TTLReporter); ok {
+		return reporter.AnswerTTL(name, qtype)
+	}
+	return 0, false
+}
+
 // DefaultDNSProvider uses Go's net package for lookups.
 type DefaultDNSProvider struct{}
 
@@ -202,252 +220,333 @@ func (d *DefaultDNSProvider) LookupMX(ctx context.Context, domain string) ([]*ne
 	return validateMXRecords(mxs, domain)
 }
 
+// LookupAddr returns the PTR names of addr, for evaluating ptr mechanisms.
+func (d *DefaultDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
 func (d *DefaultDNSProvider) Close() error {
 	return nil // No resources to close for default provider
 }
 
-// CustomDNSProvider uses miekg/dns to query custom DNS servers.
+// CustomDNSProvider queries custom plain DNS servers in the order they are listed and
+// uses the first answer (see FailoverDNSProvider). Each server is queried by a
+// PlainDNSProvider, with its own timeout and retries. The system resolver, which
+// bypasses the configured servers, is only asked after them when requested.
 type CustomDNSProvider struct {
-	Servers []string // List of DNS server IPs
-	client  *dns.Client
+	FailoverDNSProvider
+	Servers []*PlainDNSProvider // The configured servers, in the order they are queried
 }
 
-// NewCustomDNSProvider creates a new CustomDNSProvider with reusable client
+// NewCustomDNSProvider returns a provider querying servers (host:port) with the default
+// timeout and no retries, without falling back to the system resolver.
 func NewCustomDNSProvider(servers []string) *CustomDNSProvider {
-	return &CustomDNSProvider{
-		Servers: servers,
-		client:  &dns.Client{},
+	var plain []*PlainDNSProvider
+	for _, server := range servers {
+		plain = append(plain, NewPlainDNSProvider(server))
 	}
+	return NewCustomDNSProviderWithServers(plain, false)
 }
 
-func (c *CustomDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
-	var results []string
-	for _, server := range c.Servers {
-		m := new(dns.Msg)
-		m.SetQuestion(dns.Fqdn(domain), dns.TypeTXT)
-		resp, _, err := c.client.Exchange(m, server)
-		if err != nil {
-			continue // Try next server
-		}
-		// Validate DNS response
-		if resp == nil || resp.Rcode != dns.RcodeSuccess {
-			continue
-		}
-		for _, ans := range resp.Answer {
-			if txt, ok := ans.(*dns.TXT); ok {
-				results = append(results, strings.Join(txt.Txt, ""))
-			}
-		}
-		if len(results) > 0 {
-			return validateTXTRecords(results, domain) // Validate before returning
-		}
+// NewCustomDNSProviderWithServers returns a provider querying servers in order, followed
+// by the system resolver when systemFallback is set.
+func NewCustomDNSProviderWithServers(servers []*PlainDNSProvider, systemFallback bool) *CustomDNSProvider {
+	c := &CustomDNSProvider{Servers: servers}
+	for _, server := range servers {
+		c.Providers = append(c.Providers, server)
 	}
-	// Fallback to system DNS with validation
-	records, err := net.LookupTXT(domain)
-	if err != nil {
-		return nil, err
+	if systemFallback {
+		c.Providers = append(c.Providers, &DefaultDNSProvider{})
 	}
-	return validateTXTRecords(records, domain)
+	return c
 }
 
-func (c *CustomDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
-	var results []net.IP
-	for _, server := range c.Servers {
-		// Query A records
-		m := new(dns.Msg)
-		m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-		resp, _, err := c.client.Exchange(m, server)
-		if err == nil && resp != nil && resp.Rcode == dns.RcodeSuccess {
-			for _, ans := range resp.Answer {
-				if a, ok := ans.(*dns.A); ok {
-					results = append(results, a.A)
-				}
-			}
-		}
+// answerTTLs remembers the lowest TTL of the last answer for each name and query type.
+type answerTTLs struct {
+	ttls sync.Map // ttlKey -> uint32
+}
 
-		// Query AAAA records
-		m.SetQuestion(dns.Fqdn(domain), dns.TypeAAAA)
-		resp, _, err = c.client.Exchange(m, server)
-		if err == nil && resp != nil && resp.Rcode == dns.RcodeSuccess {
-			for _, ans := range resp.Answer {
-				if aaaa, ok := ans.(*dns.AAAA); ok {
-					results = append(results, aaaa.AAAA)
-				}
-			}
-		}
+type ttlKey struct {
+	name  string
+	qtype uint16
+}
 
-		if len(results) > 0 {
-			return validateIPAddresses(results, domain)
+// record remembers the lowest TTL among answers for name and qtype.
+func (t *answerTTLs) record(name string, qtype uint16, answers []dns.RR) {
+	var ttl uint32
+	for i, rr := range answers {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
 		}
 	}
-	// Fallback to system DNS with validation
-	ips, err := net.LookupIP(domain)
-	if err != nil {
-		return nil, err
+	if len(answers) > 0 {
+		t.set(name, qtype, ttl)
 	}
-	return validateIPAddresses(ips, domain)
 }
 
-func (c *CustomDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
-	var results []*net.MX
-	for _, server := range c.Servers {
-		m := new(dns.Msg)
-		m.SetQuestion(dns.Fqdn(domain), dns.TypeMX)
-		resp, _, err := c.client.Exchange(m, server)
-		if err != nil {
-			continue // Try next server
-		}
-		// Validate DNS response
-		if resp == nil || resp.Rcode != dns.RcodeSuccess {
-			continue
-		}
-		for _, ans := range resp.Answer {
-			if mx, ok := ans.(*dns.MX); ok {
-				results = append(results, &net.MX{Host: mx.Mx, Pref: mx.Preference})
-			}
-		}
-		if len(results) > 0 {
-			return validateMXRecords(results, domain) // Validate before returning
-		}
-	}
-	// Fallback to system DNS with validation
-	mxs, err := net.LookupMX(domain)
-	if err != nil {
-		return nil, err
-	}
-	return validateMXRecords(mxs, domain)
+// set remembers ttl for name and qtype.
+func (t *answerTTLs) set(name string, qtype uint16, ttl uint32) {
+	t.ttls.Store(ttlKey{strings.ToLower(dns.Fqdn(name)), qtype}, ttl)
 }
 
-func (c *CustomDNSProvider) Close() error {
-	return nil // No resources to close for custom DNS provider
+// lookup returns the TTL recorded for name and qtype.
+func (t *answerTTLs) lookup(name string, qtype uint16) (uint32, bool) {
+	ttl, ok := t.ttls.Load(ttlKey{strings.ToLower(dns.Fqdn(name)), qtype})
+	if !ok {
+		return 0, false
+	}
+	return ttl.(uint32), true
 }
 
 type flattener struct {
+	domain         string // The domain whose record is being flattened
 	dns            DNSProvider
 	dnsCache       sync.Map
-	flattenedIPs   map[string]bool
+	terms          []flattenedTerm
+	rootAll        string // The all mechanism that ends evaluation of the domain's own record
+	rootExp        string // The exp= of the record evaluation of the domain's own record ends in
+	warnings       []string
 	recursionStack map[string]bool
 	recursionErr   error
-	lookupCount    int // Track total DNS lookups performed (including duplicates)
+	lookupCount    int             // Track total DNS lookups performed (including duplicates)
+	keepIncludes   map[string]bool // Include domains kept verbatim in the domain's own record
+	failed         []failedTerm    // a/mx terms whose lookups failed, in record order
+	requireDNSSEC  []string        // Names whose answers must validate as secure (FlattenOptions.RequireDNSSEC)
 }
 
-func newFlattener(dns DNSProvider) *flattener {
+// flattenedTerm is a resolved ip4:/ip6: mechanism, or a term kept verbatim,
+// together with the qualifier it carries in the flattened record.
+type flattenedTerm struct {
+	qualifier Qualifier
+	mechanism string
+	kept      bool
+	ttl       uint32 // Lowest TTL of the DNS answers the term was resolved from; 0 when unknown
+}
+
+// includeScope identifies the top-level include whose record is being flattened.
+// The zero value denotes the domain's own record.
+type includeScope struct {
+	qualifier Qualifier // Qualifier of the top-level include
+	term      string    // The top-level include as written, used in messages
+}
+
+func newFlattener(domain string, dns DNSProvider) *flattener {
 	return &flattener{
+		domain:         domain,
 		dns:            dns,
-		flattenedIPs:   make(map[string]bool),
 		recursionStack: make(map[string]bool),
 	}
 }
 
-// CountDNSLookups counts the total number of DNS lookups required to resolve an SPF record.
-// This includes all TXT lookups for includes and any A/MX lookups, counting duplicates as separate lookups
-// since some mail servers don't implement proper caching.
-func CountDNSLookups(ctx context.Context, domain string, dns DNSProvider) (int, error) {
-	counter := &lookupCounter{
-		dns:      dns,
-		visited:  make(map[string]int), // Track how many times each domain is looked up
-		dnsCache: sync.Map{},
-	}
+func (f *flattener) add(qualifier Qualifier, mechanism string, ttl uint32) {
+	f.terms = append(f.terms, flattenedTerm{qualifier: qualifier, mechanism: mechanism, ttl: ttl})
+}
 
-	// Initial TXT lookup for the domain
-	counter.visited[domain]++
+func (f *flattener) keep(qualifier Qualifier, term string) {
+	f.terms = append(f.terms, flattenedTerm{qualifier: qualifier, mechanism: term, kept: true})
+}
 
-	records, err := dns.LookupTXT(ctx, domain)
-	if err != nil {
-		return 0, fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
+// keptTerms returns the terms kept verbatim, as they appear in the flattened record.
+func (f *flattener) keptTerms() []string {
+	var kept []string
+	for _, t := range f.terms {
+		if t.kept {
+			kept = append(kept, t.qualifier.Prefix()+t.mechanism)
+		}
 	}
+	return kept
+}
 
-	var spfRecord string
-	for _, record := range records {
-		if strings.HasPrefix(record, "v=spf1") {
-			spfRecord = record
-			break
+// resolvedTerms returns the distinct address terms resolved so far, with their qualifier.
+func (f *flattener) resolvedTerms() []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, t := range f.terms {
+		term := t.qualifier.Prefix() + t.mechanism
+		if !t.kept && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
 		}
 	}
+	sort.Strings(terms)
+	return terms
+}
 
-	if spfRecord == "" {
-		return 1, nil // Only the initial lookup was needed
+// retain appends the retained terms missing from resolved, so addresses that stopped
+// resolving stay published until their grace period ends, and returns them.
+func (f *flattener) retain(retained, resolved []string) []string {
+	current := make(map[string]bool, len(resolved))
+	for _, term := range resolved {
+		current[term] = true
+	}
+	var pending []string
+	for _, r := range retained {
+		term, err := ParseTerm(r)
+		if err != nil || (term.Kind != KindIP4 && term.Kind != KindIP6) || current[term.String()] {
+			continue
+		}
+		pending = append(pending, term.String())
+		qualifier := term.Qualifier
+		term.Qualifier = QualifierPass
+		f.add(qualifier, term.String(), 0)
 	}
+	return pending
+}
 
-	err = counter.countMechanisms(ctx, spfRecord, domain, 0)
-	if err != nil {
-		return 0, err
+// resolved reports whether any term was resolved to addresses.
+func (f *flattener) resolved() bool {
+	for _, t := range f.terms {
+		if !t.kept {
+			return true
+		}
 	}
+	return false
+}
 
-	// Sum up all lookups (including duplicates)
-	totalLookups := 0
-	for _, count := range counter.visited {
-		totalLookups += count
+// mustKeep reports whether a mechanism has to be published verbatim because it
+// cannot be resolved to addresses ahead of time: exists and ptr depend on the
+// connecting client, and macros are only expanded for each message.
+func mustKeep(term Term) bool {
+	return term.Kind == KindExists || term.Kind == KindPTR || term.HasMacros()
+}
+
+// lookupTXT returns the TXT records of domain, consulting the flattener's cache first.
+func (f *flattener) lookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if cached, ok := f.dnsCache.Load(domain); ok {
+		return cached.([]string), nil
+	}
+	recs, err := f.dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return nil, err
 	}
+	f.dnsCache.Store(domain, recs)
+	return recs, nil
+}
 
-	return totalLookups, nil
+// resolutionFailed records an a/mx lookup error. Void lookups are not failures: the
+// name has no addresses, so the term matches nothing.
+func (f *flattener) resolutionFailed(term Term, domain string, scope includeScope, qualifier Qualifier, err error) {
+	if isVoidLookup(err) {
+		return
+	}
+	source := scope.term
+	if source == "" {
+		source = term.String()
+	}
+	f.failed = append(f.failed, failedTerm{
+		FailedTerm: FailedTerm{Term: term.String(), Domain: domain, Err: err.Error()},
+		qualifier:  qualifier,
+		position:   len(f.terms),
+		source:     source,
+	})
 }
 
-type lookupCounter struct {
-	dns      DNSProvider
-	visited  map[string]int // domain -> count of lookups
-	dnsCache sync.Map
+func (f *flattener) warnf(format string, args ...interface{}) {
+	f.warnings = append(f.warnings, fmt.Sprintf(format, args...))
 }
 
-func (c *lookupCounter) countMechanisms(ctx context.Context, mechanism string, currentDomain string, depth int) error {
-	const maxDepth = 10
-	if depth > maxDepth {
-		return fmt.Errorf("recursion depth exceeded for %s", currentDomain)
+// render assembles the flattened record from the resolved terms. Evaluation order
+// is preserved across qualifiers and kept terms; consecutive resolved terms sharing
+// a qualifier form a run that can be deduplicated, aggregated and sorted without
+// changing any result. Resolved terms already emitted by an earlier run are dropped
+// since they can never match.
+// Non-empty tail terms (modifiers and the all mechanism) are appended in order.
+func (f *flattener) render(aggregate bool, tail ...string) string {
+	parts := []string{spfVersion}
+	emitted := make(map[string]bool)
+	for i := 0; i < len(f.terms); {
+		if f.terms[i].kept {
+			parts = append(parts, f.terms[i].qualifier.Prefix()+f.terms[i].mechanism)
+			i++
+			continue
+		}
+		qualifier := f.terms[i].qualifier
+		var run []string
+		for ; i < len(f.terms) && !f.terms[i].kept && f.terms[i].qualifier == qualifier; i++ {
+			mech := f.terms[i].mechanism
+			if !emitted[mech] {
+				emitted[mech] = true
+				run = append(run, mech)
+			}
+		}
+		if aggregate {
+			run = AggregateCIDRs(run)
+		}
+		sort.Strings(run)
+		for _, mech := range run {
+			emitted[mech] = true
+			parts = append(parts, qualifier.Prefix()+mech)
+		}
 	}
+	for _, term := range tail {
+		if term != "" {
+			parts = append(parts, term)
+		}
+	}
+	return strings.Join(parts, " ")
+}
 
-	parts := strings.Fields(mechanism)
-	for _, part := range parts {
-		if strings.HasPrefix(part, "include:") {
-			includeDomain := strings.TrimPrefix(part, "include:")
+// allPolicy returns the all mechanism for the flattened record: the policy
+// override when set, otherwise the all term that ended evaluation of the
+// domain's record (possibly reached through redirect=), if any.
+func (f *flattener) allPolicy(policy string) (string, error) {
+	if policy != "" {
+		term, err := ParseTerm(policy)
+		if err != nil || term.Kind != KindAll {
+			return "", fmt.Errorf("invalid all policy %q: must be one of -all, ~all, ?all or +all", policy)
+		}
+		return term.String(), nil
+	}
+	return f.rootAll, nil
+}
 
-			// Count this as a DNS lookup (even if it's a duplicate)
-			c.visited[includeDomain]++
+// explanation returns the record's exp= modifier as written, or "" if none.
+func explanation(record *Record) string {
+	if term, ok := record.Explanation(); ok {
+		return term.String()
+	}
+	return ""
+}
 
-			var includeRecords []string
-			if cached, ok := c.dnsCache.Load(includeDomain); ok {
-				includeRecords = cached.([]string)
-			} else {
-				recs, err := c.dns.LookupTXT(ctx, includeDomain)
-				if err != nil {
-					return fmt.Errorf("failed to lookup included SPF for %s: %v", includeDomain, err)
-				}
-				includeRecords = recs
-				c.dnsCache.Store(includeDomain, recs)
-			}
+// findSPFRecord returns the first SPF version 1 record among TXT strings, or "" if none.
+func findSPFRecord(records []string) string {
+	for _, record := range records {
+		if IsSPFRecord(record) {
+			return record
+		}
+	}
+	return ""
+}
 
-			for _, rec := range includeRecords {
-				if strings.HasPrefix(rec, "v=spf1") {
-					if err := c.countMechanisms(ctx, rec, includeDomain, depth+1); err != nil {
-						return err
-					}
-				}
-			}
-		} else if strings.HasPrefix(part, "a") {
-			domainToLookup := currentDomain
-			if strings.Contains(part, ":") {
-				domainToLookup = strings.Split(part, ":")[1]
-			}
-			// A mechanism requires a DNS lookup
-			c.visited[domainToLookup]++
-		} else if strings.HasPrefix(part, "mx") {
-			domainToLookup := currentDomain
-			if strings.Contains(part, ":") {
-				domainToLookup = strings.Split(part, ":")[1]
-			}
-			// MX mechanism requires a DNS lookup
-			c.visited[domainToLookup]++
+// targetDomain returns the domain a mechanism applies to: its domain-spec, or the
+// domain currently being evaluated when the domain-spec is omitted.
+func targetDomain(term Term, currentDomain string) string {
+	if term.DomainSpec != "" {
+		return term.DomainSpec
+	}
+	return currentDomain
+}
 
-			// For accurate counting, we should also consider that MX records
-			// require additional A record lookups for each MX host, but this
-			// would require actually performing the lookups. For now, we'll
-			// count just the MX lookup itself.
+// ipMechanism converts a resolved address into an ip4:/ip6: mechanism string,
+// applying the CIDR length of the a/mx term that produced it.
+func ipMechanism(ip net.IP, ip4Prefix, ip6Prefix int) string {
+	if v4 := ip.To4(); v4 != nil {
+		if ip4Prefix < 0 || ip4Prefix == 32 {
+			return "ip4:" + v4.String()
 		}
-		// ip4: and ip6: don't require DNS lookups
+		network := v4.Mask(net.CIDRMask(ip4Prefix, 32))
+		return fmt.Sprintf("ip4:%s/%d", network, ip4Prefix)
 	}
-	return nil
+	if ip6Prefix < 0 || ip6Prefix == 128 {
+		return "ip6:" + ip.String()
+	}
+	network := ip.Mask(net.CIDRMask(ip6Prefix, 128))
+	return fmt.Sprintf("ip6:%s/%d", network, ip6Prefix)
 }
 
-func (f *flattener) processMechanism(ctx context.Context, mechanism string, currentDomain string, depth int) error {
+// processMechanism flattens the terms of record, the SPF record of currentDomain. ttl is
+// the lowest TTL of the records followed to reach it, or 0 when unknown.
+func (f *flattener) processMechanism(ctx context.Context, record string, currentDomain string, scope includeScope, depth int, ttl uint32) error {
 	const maxDepth = 10
 	if depth > maxDepth {
 		f.recursionErr = fmt.Errorf("recursion depth exceeded for %s", currentDomain)
@@ -460,83 +559,208 @@ func (f *flattener) processMechanism(ctx context.Context, mechanism string, curr
 	f.recursionStack[currentDomain] = true
 	defer func() { delete(f.recursionStack, currentDomain) }()
 
-	parts := strings.Fields(mechanism)
-	for _, part := range parts {
-		if strings.HasPrefix(part, "include:") {
-			includeDomain := strings.TrimPrefix(part, "include:")
-			var includeRecords []string
-			if cached, ok := f.dnsCache.Load(includeDomain); ok {
-				includeRecords = cached.([]string)
-			} else {
-				recs, err := f.dns.LookupTXT(ctx, includeDomain)
-				if err != nil {
-					return fmt.Errorf("failed to lookup included SPF for %s: %v", includeDomain, err)
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return fmt.Errorf("failed to parse SPF record for %s: %w", currentDomain, err)
+	}
+	if scope.term == "" {
+		// A redirect target's record replaces this one, exp= included (RFC 7208 section 6.2).
+		f.rootExp = explanation(parsed)
+	}
+
+	for _, term := range parsed.Mechanisms() {
+		qualifier := term.Qualifier
+		if scope.term == "" {
+			if term.Kind == KindAll {
+				f.rootAll = term.String()
+				return nil // terms after "all" are never evaluated
+			}
+		} else {
+			// Within an included record only a pass result makes the include match,
+			// and a match takes the qualifier of the top-level include.
+			if term.Kind == KindAll {
+				if term.Qualifier == QualifierPass {
+					return fmt.Errorf("cannot flatten %s: %s ends in +all, which authorizes every sender", scope.term, currentDomain)
 				}
-				includeRecords = recs
-				f.dnsCache.Store(includeDomain, recs)
+				return nil
 			}
-			for _, rec := range includeRecords {
-				if strings.HasPrefix(rec, "v=spf1") {
-					if err := f.processMechanism(ctx, rec, includeDomain, depth+1); err != nil {
-						return err
-					}
+			if term.Qualifier != QualifierPass {
+				if scope.qualifier != QualifierPass {
+					return fmt.Errorf("cannot flatten %s faithfully: %s contains the non-pass term %s", scope.term, currentDomain, term)
 				}
+				f.warnf("%s: non-pass term %s in %s cannot be represented in a flattened record and was ignored", scope.term, term, currentDomain)
+				continue
 			}
-		} else if strings.HasPrefix(part, "ip4:") || strings.HasPrefix(part, "ip6:") {
-			f.flattenedIPs[part] = true
-		} else if strings.HasPrefix(part, "a") {
-			domainToLookup := currentDomain
-			if strings.Contains(part, ":") {
-				domainToLookup = strings.Split(part, ":")[1]
+			qualifier = scope.qualifier
+		}
+
+		if mustKeep(term) {
+			// Terms moved into the flattened record are evaluated against its
+			// domain, so those referring to their own domain must stay where they are.
+			if currentDomain != f.domain && term.DependsOnDomain() {
+				return fmt.Errorf("cannot keep %s from %s: it depends on the domain of the record containing it", term, currentDomain)
 			}
-			ips, err := f.dns.LookupIP(ctx, domainToLookup)
-			if err != nil {
-				// In strict mode, this could be an error. For now, we just continue.
+			term.Qualifier = QualifierPass
+			f.keep(qualifier, term.String())
+			continue
+		}
+
+		switch term.Kind {
+		case KindInclude:
+			if scope.term == "" && f.keepIncludes[normalizeIncludeDomain(term.DomainSpec)] {
+				term.Qualifier = QualifierPass
+				f.keep(qualifier, term.String())
 				continue
 			}
-			for _, ip := range ips {
-				if ip.To4() != nil {
-					f.flattenedIPs["ip4:"+ip.String()] = true
-				} else {
-					f.flattenedIPs["ip6:"+ip.String()] = true
+			includeDomain := term.DomainSpec
+			includeRecords, err := f.lookupTXT(ctx, includeDomain)
+			if err != nil {
+				return fmt.Errorf("failed to lookup included SPF for %s: %v", includeDomain, err)
+			}
+			if err := f.checkDNSSEC(includeDomain, dns.TypeTXT); err != nil {
+				return err
+			}
+			includeScope := scope
+			if includeScope.term == "" {
+				includeScope.qualifier = term.Qualifier
+				includeScope.term = term.String()
+			}
+			if rec := findSPFRecord(includeRecords); rec != "" {
+				includeTTL := minTTL(ttl, f.answerTTL(includeDomain, dns.TypeTXT))
+				if err := f.processMechanism(ctx, rec, includeDomain, includeScope, depth+1, includeTTL); err != nil {
+					return err
 				}
 			}
-		} else if strings.HasPrefix(part, "mx") {
-			domainToLookup := currentDomain
-			if strings.Contains(part, ":") {
-				domainToLookup = strings.Split(part, ":")[1]
+		case KindIP4, KindIP6:
+			term.Qualifier = QualifierPass
+			f.add(qualifier, term.String(), ttl)
+		case KindA:
+			target := targetDomain(term, currentDomain)
+			ips, err := f.dns.LookupIP(ctx, target)
+			if err != nil {
+				f.resolutionFailed(term, currentDomain, scope, qualifier, err)
+				continue
+			}
+			if err := f.checkDNSSEC(target, dns.TypeA); err != nil {
+				return err
+			}
+			addrTTL := minTTL(ttl, f.answerTTL(target, dns.TypeA))
+			for _, ip := range ips {
+				f.add(qualifier, ipMechanism(ip, term.IP4Prefix, term.IP6Prefix), addrTTL)
 			}
-			mxs, err := f.dns.LookupMX(ctx, domainToLookup)
+		case KindMX:
+			target := targetDomain(term, currentDomain)
+			mxs, err := f.dns.LookupMX(ctx, target)
 			if err != nil {
+				f.resolutionFailed(term, currentDomain, scope, qualifier, err)
 				continue
 			}
+			if err := f.checkDNSSEC(target, dns.TypeMX); err != nil {
+				return err
+			}
+			mxTTL := minTTL(ttl, f.answerTTL(target, dns.TypeMX))
 			for _, mx := range mxs {
 				ips, err := f.dns.LookupIP(ctx, mx.Host)
 				if err != nil {
+					f.resolutionFailed(term, currentDomain, scope, qualifier, fmt.Errorf("MX host %s: %v", mx.Host, err))
 					continue
 				}
+				if err := f.checkDNSSEC(mx.Host, dns.TypeA); err != nil {
+					return err
+				}
+				addrTTL := minTTL(mxTTL, f.answerTTL(mx.Host, dns.TypeA))
 				for _, ip := range ips {
-					if ip.To4() != nil {
-						f.flattenedIPs["ip4:"+ip.String()] = true
-					} else {
-						f.flattenedIPs["ip6:"+ip.String()] = true
-					}
+					f.add(qualifier, ipMechanism(ip, term.IP4Prefix, term.IP6Prefix), addrTTL)
 				}
 			}
-		} else if strings.HasPrefix(part, "ptr") {
-			// ptr mechanism is discouraged and not supported for flattening.
-			// A logger would be useful here to warn the user.
 		}
 	}
-	return nil
+
+	// No "all" mechanism was reached, so redirect= applies (RFC 7208 section 6.1): the
+	// target's record replaces this one, including for a/mx terms without a domain-spec.
+	redirect, ok := parsed.Redirect()
+	if !ok {
+		return nil
+	}
+	if redirect.HasMacros() {
+		return fmt.Errorf("cannot flatten %s in %s: the target depends on the sender", redirect, currentDomain)
+	}
+	redirectDomain := redirect.DomainSpec
+	redirectRecords, err := f.lookupTXT(ctx, redirectDomain)
+	if err != nil {
+		return fmt.Errorf("failed to lookup redirected SPF for %s: %v", redirectDomain, err)
+	}
+	if err := f.checkDNSSEC(redirectDomain, dns.TypeTXT); err != nil {
+		return err
+	}
+	rec := findSPFRecord(redirectRecords)
+	if rec == "" {
+		return fmt.Errorf("redirect target %s has no SPF record", redirectDomain)
+	}
+	return f.processMechanism(ctx, rec, redirectDomain, scope, depth+1, minTTL(ttl, f.answerTTL(redirectDomain, dns.TypeTXT)))
+}
+
+// FlattenOptions controls how FlattenSPFWithOptions flattens a domain's SPF record.
+type FlattenOptions struct {
+	Aggregate    bool   // Apply CIDR aggregation to the resolved addresses
+	ForceFlatten bool   // Flatten even when the record is within the RFC 7208 lookup limit
+	Policy       string // Overrides the all mechanism of the flattened record (e.g. "-all"); empty keeps the original
+
+	// Partial flattening (see planFlattening). Include domains refer to the includes of
+	// the domain's own record and of the records it redirects to.
+	MaxLookups    int      // Lookup budget for the published records; 0 flattens every include
+	KeepIncludes  []string // Include domains always kept as include: terms
+	AlwaysFlatten []string // Include domains always replaced by their addresses
+
+	// Handling of a/mx terms whose lookups fail (see ResolutionPolicy). Previous holds
+	// the currently published SPF records by name (the domain and its spfN records),
+	// whose addresses ResolutionKeepPrevious reuses for the failed terms. Sources maps
+	// address terms resolved by earlier runs, with their qualifier, to the terms of the
+	// domain's record they came from (comma-separated, as the state file records them),
+	// so only the failed terms' own addresses are reused.
+	Resolution ResolutionPolicy
+	Previous   map[string]string
+	Sources    map[string]string
+
+	// Retained lists resolved address terms, with their qualifier (e.g. "~ip4:192.0.2.1"),
+	// that stay published even if they no longer resolve: they disappeared within the
+	// domain's grace period. See FlattenResult.PendingRemoval.
+	Retained []string
+
+	// RequireDNSSEC lists domains whose answers, and those of their subdomains, must be
+	// validated as secure by the DNS provider (see DNSSECReporter). Flattening fails
+	// rather than publish addresses derived from insecure, bogus or unvalidated answers.
+	RequireDNSSEC []string
+
+	// Split configures how the flattened record is split into the published records,
+	// whose lookups count against MaxLookups.
+	Split SplitOptions
+}
+
+// FlattenResult describes the outcome of flattening a domain's SPF record.
+type FlattenResult struct {
+	Original       string            // The SPF record as found in DNS
+	Flattened      string            // The flattened record, or the original when flattening was not needed
+	LookupCount    int               // DNS lookups required by the original record, including the initial TXT lookup
+	Lookups        *LookupReport     // Breakdown of the original record's lookups against the RFC 7208 limits
+	WasFlattened   bool              // Whether flattening was performed
+	KeptTerms      []string          // Terms published verbatim: unresolvable terms and includes kept by the plan
+	Plan           *FlattenPlan      // Includes kept or flattened and the resulting lookup count; nil when not flattened
+	FailedTerms    []FailedTerm      // a/mx terms whose lookups failed, handled per FlattenOptions.Resolution
+	Resolved       []string          // Address terms resolved by this run, with their qualifier; recorded for retention
+	PendingRemoval []string          // FlattenOptions.Retained terms no longer resolved but still published
+	TermTTLs       map[string]uint32 // Lowest upstream TTL of each resolved address term, when reported (see RecordTTLs)
+	Warnings       []string          // Terms that could not be represented exactly in the flattened record
 }
 
 // FlattenSPF processes an SPF record for the given domain and returns both the original
 // and flattened versions.
 //
 // The flattening process resolves all include:, a, and mx mechanisms into concrete IP addresses,
-// creating a simplified SPF record that contains only ip4: and ip6: mechanisms plus the final
-// policy (typically ~all or -all).
+// creating a simplified SPF record that contains only ip4: and ip6: mechanisms plus the
+// original record's all mechanism. Each resolved term keeps the qualifier of the directive
+// it came from, so "-a:host" becomes "-ip4:..." and terms resolved through "?include:"
+// become "?ip4:..." terms.
 //
 // Parameters:
 //   - ctx: Context for cancellation and timeout control
@@ -554,181 +778,223 @@ func (f *flattener) processMechanism(ctx context.Context, mechanism string, curr
 // Example:
 //
 //	original, flattened, err := FlattenSPF(ctx, "example.com", &DefaultDNSProvider{})
-//	// original might be: "v=spf1 include:_spf.google.com ~all"
-//	// flattened might be: "v=spf1 ip4:209.85.128.0/17 ip4:64.233.160.0/19 ~all"
+//	// original might be: "v=spf1 include:_spf.google.com -all"
+//	// flattened might be: "v=spf1 ip4:209.85.128.0/17 ip4:64.233.160.0/19 -all"
 func FlattenSPF(ctx context.Context, domain string, dns DNSProvider, aggregate bool) (string, string, error) {
-	f := newFlattener(dns)
+	records, err := dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to retrieve original SPF records for %s: %v", domain, err)
+	}
 
-	var originalRecords []string
-	if cached, ok := f.dnsCache.Load(domain); ok {
-		originalRecords = cached.([]string)
-	} else {
-		recs, err := f.dns.LookupTXT(ctx, domain)
-		if err != nil {
-			return "", "", fmt.Errorf("failed to retrieve original SPF records for %s: %v", domain, err)
-		}
-		originalRecords = recs
-		f.dnsCache.Store(domain, recs)
+	originalSPF := findSPFRecord(records)
+	if originalSPF == "" {
+		return "", "", fmt.Errorf("no SPF record found for %s", domain)
 	}
 
-	var originalSPF string
-	for _, record := range originalRecords {
-		if strings.HasPrefix(record, "v=spf1") {
-			originalSPF = record
-			break
-		}
+	f, err := flattenRecord(ctx, domain, originalSPF, dns, FlattenOptions{Aggregate: aggregate}, nil)
+	if err != nil {
+		return originalSPF, "", err
 	}
+	return originalSPF, f.flattened, nil
+}
 
-	if originalSPF == "" {
-		return "", "", fmt.Errorf("no SPF record found for %s", domain)
+// flattenOutcome is the result of flattenRecord.
+type flattenOutcome struct {
+	flattened string
+	kept      []string
+	failed    []FailedTerm
+	resolved  []string
+	pending   []string
+	ttls      map[string]uint32
+	warnings  []string
+}
+
+// flattenRecord flattens originalSPF, the record published at domain, keeping the
+// includes of keepIncludes verbatim.
+func flattenRecord(ctx context.Context, domain, originalSPF string, dns DNSProvider, opts FlattenOptions, keepIncludes map[string]bool) (*flattenOutcome, error) {
+	if _, err := ParseRecord(originalSPF); err != nil {
+		return nil, fmt.Errorf("failed to parse SPF record for %s: %w", domain, err)
 	}
 
-	err := f.processMechanism(ctx, originalSPF, domain, 0)
+	f := newFlattener(domain, dns)
+	f.keepIncludes = keepIncludes
+	f.requireDNSSEC = opts.RequireDNSSEC
+	f.dnsCache.Store(domain, []string{originalSPF})
+	err := f.processMechanism(ctx, originalSPF, domain, includeScope{}, 0, 0)
 	if f.recursionErr != nil {
-		return originalSPF, "", f.recursionErr
+		return nil, f.recursionErr
 	}
 	if err != nil {
-		return originalSPF, "", fmt.Errorf("failed to process SPF mechanisms for domain %s: %w", domain, err)
+		return nil, fmt.Errorf("failed to process SPF mechanisms for domain %s: %w", domain, err)
 	}
+	all, err := f.allPolicy(opts.Policy)
+	if err != nil {
+		return nil, err
+	}
+	resolved := f.resolvedTerms()
+	if len(f.failed) > 0 {
+		switch opts.Resolution {
+		case ResolutionStrict:
+			return nil, resolutionError(f.failed)
+		case ResolutionKeepPrevious:
+			f.reusePrevious(opts.Previous, opts.Sources)
+		}
+	}
+
+	pending := f.retain(opts.Retained, resolved)
 
-	var sorted []string
-	for ip := range f.flattenedIPs {
-		sorted = append(sorted, ip)
+	outcome := &flattenOutcome{kept: f.keptTerms(), resolved: resolved, pending: pending, ttls: f.termTTLs(), warnings: f.warnings}
+	for _, t := range f.failed {
+		outcome.failed = append(outcome.failed, t.FailedTerm)
 	}
-	if len(sorted) == 0 {
+	if !f.resolved() {
 		// This can happen if the SPF record only contains mechanisms that don't resolve to IPs (e.g., modifiers).
 		// Return the original record as there's nothing to flatten.
-		return originalSPF, originalSPF, nil
+		outcome.flattened = originalSPF
+		return outcome, nil
 	}
-
-	// Apply CIDR aggregation if enabled
-	if aggregate {
-		sorted = AggregateCIDRs(sorted)
-	}
-
-	sort.Strings(sorted)
-	flattened := "v=spf1 " + strings.Join(sorted, " ") + " ~all"
-	return originalSPF, flattened, nil
+	// exp= is kept verbatim from the record evaluation ended in; redirect= has been followed.
+	outcome.flattened = f.render(opts.Aggregate, f.rootExp, all)
+	return outcome, nil
 }
 
-// FlattenSPFWithThreshold flattens an SPF record only if it exceeds the DNS lookup threshold.
-// This function checks if the SPF record requires more than 10 DNS lookups (RFC 7208 limit)
-// and only performs flattening if necessary, unless forceFlatten is true.
+// FlattenSPFWithOptions flattens a domain's SPF record if evaluating it exceeds an RFC 7208
+// processing limit (10 DNS lookups, 2 void lookups or 10 MX hosts per mx mechanism) or the
+// opts.MaxLookups budget, or unconditionally when opts.ForceFlatten is set.
 //
-// Parameters:
-//   - ctx: Context for cancellation and timeout control
-//   - domain: The domain name to process SPF records for
-//   - dns: DNS provider for performing lookups
-//   - aggregate: Whether to apply CIDR aggregation to the flattened IPs
-//   - forceFlatten: If true, always flatten regardless of DNS lookup count
+// With opts.MaxLookups, opts.KeepIncludes or opts.AlwaysFlatten set, only some of the
+// domain's includes are flattened; FlattenResult.Plan records the choice.
 //
-// Returns:
-//   - string: The original SPF record as found in DNS
-//   - string: The flattened SPF record (same as original if not flattened)
-//   - int: The total number of DNS lookups required by the original record
-//   - bool: Whether flattening was performed
-//   - error: Any error encountered during processing
-func FlattenSPFWithThreshold(ctx context.Context, domain string, dns DNSProvider, aggregate bool, forceFlatten bool) (string, string, int, bool, error) {
+// The flattened record ends in the original record's all mechanism unless opts.Policy
+// overrides it. Non-pass qualified includes are flattened into terms carrying the same
+// qualifier; if such an include's record itself contains non-pass terms the result could
+// not be reproduced faithfully and an error is returned. Non-pass terms inside pass
+// includes are dropped and reported in FlattenResult.Warnings. a/mx terms whose lookups
+// fail are reported in FlattenResult.FailedTerms and handled per opts.Resolution.
+//
+// When dns is a CachingDNSProvider, the include tree is first prefetched concurrently.
+func FlattenSPFWithOptions(ctx context.Context, domain string, dns DNSProvider, opts FlattenOptions) (*FlattenResult, error) {
+	// Resolve the include tree concurrently; the walks below are answered from the cache
+	if cache, ok := dns.(*CachingDNSProvider); ok {
+		cache.Prefetch(ctx, domain)
+	}
+
 	// First, count the DNS lookups required
-	lookupCount, err := CountDNSLookups(ctx, domain, dns)
+	lookups, err := AnalyzeDNSLookups(ctx, domain, dns)
 	if err != nil {
-		return "", "", 0, false, fmt.Errorf("failed to count DNS lookups: %v", err)
+		return nil, fmt.Errorf("failed to count DNS lookups: %v", err)
 	}
 
 	// Get the original SPF record
 	records, err := dns.LookupTXT(ctx, domain)
 	if err != nil {
-		return "", "", lookupCount, false, fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
-	}
-
-	var originalSPF string
-	for _, record := range records {
-		if strings.HasPrefix(record, "v=spf1") {
-			originalSPF = record
-			break
-		}
+		return nil, fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
 	}
 
+	originalSPF := findSPFRecord(records)
 	if originalSPF == "" {
-		return "", "", lookupCount, false, fmt.Errorf("no SPF record found for %s", domain)
+		return nil, fmt.Errorf("no SPF record found for %s", domain)
 	}
 
-	// Check if flattening is needed (more than 10 lookups) or forced
-	const maxDNSLookups = 10
-	shouldFlatten := lookupCount > maxDNSLookups || forceFlatten
+	result := &FlattenResult{
+		Original:    originalSPF,
+		Flattened:   originalSPF,
+		LookupCount: lookups.Total + 1,
+		Lookups:     lookups,
+	}
 
-	if !shouldFlatten {
+	// Check if flattening is needed (processing limits or the lookup budget exceeded) or forced
+	overBudget := opts.MaxLookups > 0 && lookups.Total > opts.MaxLookups
+	if !lookups.ExceedsLimits() && !overBudget && !opts.ForceFlatten {
 		// Return original record without flattening
-		return originalSPF, originalSPF, lookupCount, false, nil
+		return result, nil
 	}
 
-	// Perform flattening
-	_, flattened, err := FlattenSPF(ctx, domain, dns, aggregate)
+	outcome, plan, err := planFlattening(ctx, domain, originalSPF, dns, lookups, opts)
 	if err != nil {
-		return originalSPF, "", lookupCount, false, err
+		return nil, err
 	}
+	result.Flattened = outcome.flattened
+	result.WasFlattened = true
+	result.KeptTerms = outcome.kept
+	result.FailedTerms = outcome.failed
+	result.Resolved = outcome.resolved
+	result.PendingRemoval = outcome.pending
+	result.TermTTLs = outcome.ttls
+	result.Warnings = outcome.warnings
+	result.Plan = plan
+
+	// Kept terms still cost lookups when the published records are evaluated
+	if plan.Lookups > MaxDNSLookups {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("published records still require %d DNS lookups (limit %d)", plan.Lookups, MaxDNSLookups))
+	}
+	return result, nil
+}
 
-	return originalSPF, flattened, lookupCount, true, nil
+// FlattenSPFWithThreshold flattens an SPF record only if it exceeds the DNS lookup threshold.
+// This function checks if the SPF record exceeds the RFC 7208 processing limits (more than
+// 10 DNS lookups, see AnalyzeDNSLookups) and only performs flattening if necessary, unless
+// forceFlatten is true.
+//
+// Parameters:
+//   - ctx: Context for cancellation and timeout control
+//   - domain: The domain name to process SPF records for
+//   - dns: DNS provider for performing lookups
+//   - aggregate: Whether to apply CIDR aggregation to the flattened IPs
+//   - forceFlatten: If true, always flatten regardless of DNS lookup count
+//
+// Returns:
+//   - string: The original SPF record as found in DNS
+//   - string: The flattened SPF record (same as original if not flattened)
+//   - int: The total number of DNS lookups required by the original record
+//   - bool: Whether flattening was performed
+//   - error: Any error encountered during processing
+func FlattenSPFWithThreshold(ctx context.Context, domain string, dns DNSProvider, aggregate bool, forceFlatten bool) (string, string, int, bool, error) {
+	result, err := FlattenSPFWithOptions(ctx, domain, dns, FlattenOptions{Aggregate: aggregate, ForceFlatten: forceFlatten})
+	if err != nil {
+		return "", "", 0, false, err
+	}
+	return result.Original, result.Flattened, result.LookupCount, result.WasFlattened, nil
 }
 
-// FlattenSPFContent flattens an SPF record from raw TXT content by resolving all 'include', 'a', 'mx', and 'ptr' mechanisms.
+// FlattenSPFContent flattens an SPF record from raw TXT content by resolving its include mechanisms
+// with the supplied TXT lookup function. Mechanisms that require address lookups (a, mx) cannot be
+// resolved without a DNS provider and are skipped.
 func FlattenSPFContent(spfContent string, txtLookup TXTLookupFunc) (string, string, error) {
-	if !strings.HasPrefix(spfContent, "v=spf1") {
+	if !IsSPFRecord(spfContent) {
 		return "", "", fmt.Errorf("provided content is not a valid SPF record")
 	}
 
-	flattenedMechs := make(map[string]bool)
-	var recursionErr error
-	var processMechanism func(mechanism string, currentDomain string, depth int) error
-	processMechanism = func(mechanism string, currentDomain string, depth int) error {
-		const maxDepth = 10
-		if depth > maxDepth {
-			recursionErr = fmt.Errorf("recursion depth exceeded for %s", currentDomain)
-			return recursionErr
-		}
-		parts := strings.Fields(mechanism)
-		for _, part := range parts {
-			if strings.HasPrefix(part, "include:") {
-				includeDomain := strings.TrimPrefix(part, "include:")
-				includeRecords, err := txtLookup(includeDomain)
-				if err != nil {
-					return fmt.Errorf("failed to lookup included SPF for %s: %v", includeDomain, err)
-				}
-				for _, rec := range includeRecords {
-					if strings.HasPrefix(rec, "v=spf1") {
-						if err := processMechanism(rec, includeDomain, depth+1); err != nil {
-							return err
-						}
-					}
-				}
-			} else if strings.HasPrefix(part, "a") {
-				flattenedMechs["ip4:93.184.216.34"] = true
-			} else if strings.HasPrefix(part, "mx") {
-				flattenedMechs["ip4:93.184.216.34"] = true
-			} else if strings.HasPrefix(part, "ip4:") {
-				flattenedMechs[part] = true
-				flattenedMechs["ip4:93.184.216.34"] = true // Always add mock IP for tests
-			} else if strings.HasPrefix(part, "ip6:") {
-				flattenedMechs[part] = true
-				if part == "ip6::1" {
-					flattenedMechs["ip6:2001:db8::1"] = true
-				}
-			}
-		}
-		return nil
+	if _, err := ParseRecord(spfContent); err != nil {
+		return spfContent, "", fmt.Errorf("failed to parse SPF record: %w", err)
 	}
 
-	if err := processMechanism(spfContent, "", 0); err != nil {
-		if recursionErr != nil {
-			return spfContent, "", recursionErr
+	f := newFlattener("", txtLookupProvider(txtLookup))
+	if err := f.processMechanism(context.Background(), spfContent, "", includeScope{}, 0, 0); err != nil {
+		if f.recursionErr != nil {
+			return spfContent, "", f.recursionErr
 		}
 		return spfContent, "", err
 	}
+	return spfContent, f.render(false, f.rootExp, f.rootAll), nil
+}
 
-	var flattenedParts []string
-	for mech := range flattenedMechs {
-		flattenedParts = append(flattenedParts, mech)
-	}
-	flattenedSPF := "v=spf1 " + strings.Join(flattenedParts, " ") + " ~all"
-	return spfContent, flattenedSPF, nil
+// txtLookupProvider adapts a TXTLookupFunc to the DNSProvider interface. Address
+// and MX lookups are not available and always fail.
+type txtLookupProvider TXTLookupFunc
+
+func (p txtLookupProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	return p(domain)
+}
+
+func (p txtLookupProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	return nil, fmt.Errorf("address lookups are not supported for %s", domain)
+}
+
+func (p txtLookupProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return nil, fmt.Errorf("MX lookups are not supported for %s", domain)
+}
+
+func (p txtLookupProvider) Close() error {
+	return nil
 }
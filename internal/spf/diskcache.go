@@ -0,0 +1,268 @@
+package spf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultNegativeCacheTTL is how long DiskCacheDNSProvider remembers that a name does
+// not exist or has no records of the queried type.
+const DefaultNegativeCacheTTL = 5 * time.Minute
+
+// diskCacheFile is the file name used when the cache path is a directory.
+const diskCacheFile = "dns-cache.json"
+
+// DiskCacheDNSProvider wraps a DNSProvider with a cache persisted to a JSON file, so
+// answers survive between runs. Answers are served until their TTL expires (DefaultTTL
+// when the wrapped provider does not report one); names that do not exist or have no
+// records of the queried type are remembered for NegativeTTL. Other errors are not
+// cached, nor are answers the servers of a wrapped ConsensusDNSProvider disagreed on,
+// so every run compares them again and reports the disagreement. Close writes the
+// cache file.
+type DiskCacheDNSProvider struct {
+	DefaultTTL  time.Duration // Lifetime of answers without a reported TTL
+	NegativeTTL time.Duration // Lifetime of NXDOMAIN and empty answers
+
+	inner   DNSProvider
+	path    string
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]diskCacheEntry // "TXT example.com" -> entry
+}
+
+// diskCacheEntry is one cached answer as stored in the cache file.
+type diskCacheEntry struct {
+	Expires  time.Time     `json:"expires"`
+	NotFound bool          `json:"not_found,omitempty"` // The lookup failed with NXDOMAIN or NODATA
+	TXT      []string      `json:"txt,omitempty"`
+	IPs      []string      `json:"ips,omitempty"` // A and AAAA answers
+	MX       []diskCacheMX `json:"mx,omitempty"`
+	DNSSEC   DNSSECStatus  `json:"dnssec,omitempty"` // Validation status reported by the wrapped provider
+	TTL      bool          `json:"ttl,omitempty"`    // The wrapped provider reported the answer's TTL
+}
+
+type diskCacheMX struct {
+	Host string `json:"host"`
+	Pref uint16 `json:"pref"`
+}
+
+type diskCacheContents struct {
+	Entries map[string]diskCacheEntry `json:"entries"`
+}
+
+// NewDiskCacheDNSProvider returns a persistent cache in front of inner, loading the
+// cache file at path. When path is a directory the cache is kept in dns-cache.json
+// inside it. A missing file yields an empty cache that Close will create.
+func NewDiskCacheDNSProvider(inner DNSProvider, path string) (*DiskCacheDNSProvider, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, diskCacheFile)
+	}
+	c := &DiskCacheDNSProvider{
+		DefaultTTL:  DefaultCacheTTL,
+		NegativeTTL: DefaultNegativeCacheTTL,
+		inner:       inner,
+		path:        path,
+		now:         time.Now,
+		entries:     make(map[string]diskCacheEntry),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS cache %s: %w", path, err)
+	}
+	var contents diskCacheContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS cache %s: %w", path, err)
+	}
+	if contents.Entries != nil {
+		c.entries = contents.Entries
+	}
+	return c, nil
+}
+
+// Path returns the cache file.
+func (c *DiskCacheDNSProvider) Path() string {
+	return c.path
+}
+
+func (c *DiskCacheDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	entry, err := c.lookup(domain, dns.TypeTXT, func() (diskCacheEntry, error) {
+		records, err := c.inner.LookupTXT(ctx, domain)
+		return diskCacheEntry{TXT: records}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), entry.TXT...), nil
+}
+
+func (c *DiskCacheDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	entry, err := c.lookup(domain, dns.TypeA, func() (diskCacheEntry, error) {
+		ips, err := c.inner.LookupIP(ctx, domain)
+		var entry diskCacheEntry
+		for _, ip := range ips {
+			entry.IPs = append(entry.IPs, ip.String())
+		}
+		return entry, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, s := range entry.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func (c *DiskCacheDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	entry, err := c.lookup(domain, dns.TypeMX, func() (diskCacheEntry, error) {
+		mxs, err := c.inner.LookupMX(ctx, domain)
+		var entry diskCacheEntry
+		for _, mx := range mxs {
+			entry.MX = append(entry.MX, diskCacheMX{Host: mx.Host, Pref: mx.Pref})
+		}
+		return entry, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	for _, mx := range entry.MX {
+		mxs = append(mxs, &net.MX{Host: mx.Host, Pref: mx.Pref})
+	}
+	return mxs, nil
+}
+
+// LookupAddr passes PTR lookups through uncached; they depend on the connecting client.
+func (c *DiskCacheDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	resolver, ok := c.inner.(AddrLookupProvider)
+	if !ok {
+		return nil, errors.New("PTR lookups are not supported by the DNS provider")
+	}
+	return resolver.LookupAddr(ctx, addr)
+}
+
+// AnswerTTL implements TTLReporter: the time a cached answer has left, in seconds.
+// Answers cached for DefaultTTL because the wrapped provider reported no TTL report
+// none either.
+func (c *DiskCacheDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[newCacheKey(name, qtype).String()]
+	c.mu.Unlock()
+	if !ok || entry.NotFound || !entry.TTL {
+		return 0, false
+	}
+	remaining := entry.Expires.Sub(c.now())
+	if remaining <= 0 {
+		return 0, false
+	}
+	return uint32(remaining.Round(time.Second) / time.Second), true
+}
+
+// DNSSECStatus implements DNSSECReporter with the status stored with the cached answer,
+// or the wrapped provider's for answers that were not cached.
+func (c *DiskCacheDNSProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[newCacheKey(name, qtype).String()]
+	c.mu.Unlock()
+	if !ok {
+		return dnssecStatus(c.inner, name, qtype)
+	}
+	return entry.DNSSEC, entry.DNSSEC != ""
+}
+
+// Unwrap returns the wrapped provider.
+func (c *DiskCacheDNSProvider) Unwrap() DNSProvider {
+	return c.inner
+}
+
+// Close writes the cache file and closes the wrapped provider.
+func (c *DiskCacheDNSProvider) Close() error {
+	saveErr := c.Save()
+	if err := c.inner.Close(); err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// Save writes the unexpired entries to the cache file, replacing it atomically.
+func (c *DiskCacheDNSProvider) Save() error {
+	now := c.now()
+	c.mu.Lock()
+	contents := diskCacheContents{Entries: make(map[string]diskCacheEntry, len(c.entries))}
+	for key, entry := range c.entries {
+		if now.Before(entry.Expires) {
+			contents.Entries[key] = entry
+		}
+	}
+	c.mu.Unlock()
+
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode DNS cache: %w", err)
+	}
+	if err := writeFileAtomic(c.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write DNS cache %s: %w", c.path, err)
+	}
+	return nil
+}
+
+// lookup answers from the cache file's entries, or runs query and caches its answer.
+// Empty answers and void lookup errors are cached as negative entries.
+func (c *DiskCacheDNSProvider) lookup(name string, qtype uint16, query func() (diskCacheEntry, error)) (diskCacheEntry, error) {
+	key := newCacheKey(name, qtype)
+	c.mu.Lock()
+	entry, ok := c.entries[key.String()]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.Expires) {
+		if entry.NotFound {
+			return entry, notFoundError(key)
+		}
+		return entry, nil
+	}
+
+	entry, err := query()
+	if err != nil && !isVoidLookup(err) {
+		return entry, err
+	}
+	entry.NotFound = err != nil
+	if disputed(c.inner, name, qtype) {
+		return entry, err
+	}
+	entry.DNSSEC, _ = dnssecStatus(c.inner, name, qtype)
+	ttl := c.NegativeTTL
+	if !entry.NotFound && (len(entry.TXT) > 0 || len(entry.IPs) > 0 || len(entry.MX) > 0) {
+		ttl = c.DefaultTTL
+		var seconds uint32
+		if seconds, entry.TTL = answerTTL(c.inner, name, qtype); entry.TTL {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	if ttl > 0 {
+		entry.Expires = c.now().Add(ttl)
+		c.mu.Lock()
+		c.entries[key.String()] = entry
+		c.mu.Unlock()
+	}
+	return entry, err
+}
+
+// notFoundError is the error returned for a cached negative answer; like the system
+// resolver's, it counts as a void lookup.
+func notFoundError(key cacheKey) error {
+	return &net.DNSError{Err: "no such host (cached)", Name: key.name, IsNotFound: true}
+}
@@ -0,0 +1,145 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheDNSProvider_PersistsAnswers(t *testing.T) {
+	dir := t.TempDir()
+	newInner := func() *countingDNSProvider {
+		return &countingDNSProvider{
+			mockDNSProvider: mockDNSProvider{
+				Records: map[string][]string{"example.com": {"v=spf1 mx -all"}},
+				IPs:     map[string][]net.IP{"mx.example.com": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+				MXs:     map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+			},
+			TTLs:    map[string]uint32{"example.com": 3600},
+			Missing: map[string]bool{"missing.example.com": true},
+		}
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	// A directory path keeps the cache in dns-cache.json inside it
+	first, err := NewDiskCacheDNSProvider(newInner(), dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first.now = func() time.Time { return start }
+	if _, err := first.LookupTXT(ctx, "example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := first.LookupMX(ctx, "example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := first.LookupIP(ctx, "mx.example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := first.LookupTXT(ctx, "missing.example.com"); !isVoidLookup(err) {
+		t.Fatalf("Expected a void lookup, got %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if first.Path() != filepath.Join(dir, "dns-cache.json") {
+		t.Errorf("Unexpected cache path %s", first.Path())
+	}
+
+	testCases := []struct {
+		name          string
+		elapsed       time.Duration
+		expectQueries int
+	}{
+		{"served from the cache file", time.Minute, 0},
+		{"positive answers expire with their TTL", time.Hour, 4},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := newInner()
+			cache, err := NewDiskCacheDNSProvider(inner, first.Path())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			cache.now = func() time.Time { return start.Add(tc.elapsed) }
+
+			txt, err := cache.LookupTXT(ctx, "example.com")
+			if err != nil || !reflect.DeepEqual(txt, []string{"v=spf1 mx -all"}) {
+				t.Errorf("Unexpected TXT answer %v (%v)", txt, err)
+			}
+			mxs, err := cache.LookupMX(ctx, "example.com")
+			if err != nil || len(mxs) != 1 || mxs[0].Host != "mx.example.com." || mxs[0].Pref != 10 {
+				t.Errorf("Unexpected MX answer %v (%v)", mxs, err)
+			}
+			ips, err := cache.LookupIP(ctx, "mx.example.com")
+			if err != nil || len(ips) != 2 || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+				t.Errorf("Unexpected A/AAAA answer %v (%v)", ips, err)
+			}
+			if _, err := cache.LookupTXT(ctx, "missing.example.com"); !isVoidLookup(err) {
+				t.Errorf("Expected the cached NXDOMAIN to be a void lookup, got %v", err)
+			}
+
+			queries := inner.Queries("TXT", "example.com") + inner.Queries("MX", "example.com") +
+				inner.Queries("A", "mx.example.com") + inner.Queries("TXT", "missing.example.com")
+			if queries != tc.expectQueries {
+				t.Errorf("Expected %d queries, got %d", tc.expectQueries, queries)
+			}
+		})
+	}
+}
+
+func TestDiskCacheDNSProvider_SkipsDisputedAnswers(t *testing.T) {
+	server := func(record string) DNSProvider {
+		return &mockDNSProvider{Records: map[string][]string{
+			"disputed.example": {record},
+			"agreed.example":   {"v=spf1 -all"},
+		}}
+	}
+	newConsensus := func() *ConsensusDNSProvider {
+		c, err := NewConsensusDNSProvider(ConsensusUnion, []ConsensusServer{
+			{Name: "A", Provider: server("v=spf1 ip4:192.0.2.1 -all")},
+			{Name: "B", Provider: server("v=spf1 ip4:203.0.113.1 -all")},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return c
+	}
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	first, err := NewDiskCacheDNSProvider(newConsensus(), dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"disputed.example", "agreed.example"} {
+		if _, err := first.LookupTXT(ctx, name); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A later run compares the disputed answer again, recording the disagreement
+	consensus := newConsensus()
+	second, err := NewDiskCacheDNSProvider(consensus, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"disputed.example", "agreed.example"} {
+		if _, err := second.LookupTXT(ctx, name); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if d := consensus.Disagreements(); len(d) != 1 || d[0].Name != "disputed.example" {
+		t.Errorf("Expected the disputed answer to be compared again, got %+v", d)
+	}
+	if _, cached := second.entries["TXT agreed.example"]; !cached {
+		t.Error("Expected the agreed answer to be cached")
+	}
+}
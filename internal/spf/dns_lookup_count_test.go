@@ -2,6 +2,9 @@ package spf
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -57,6 +60,26 @@ func TestCountDNSLookups(t *testing.T) {
 			expectedCount: 1, // Only the initial TXT lookup
 			expectError:   false,
 		},
+		{
+			name: "Redirect is counted and followed",
+			mockRecords: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 include:_spf.google.com -all"},
+				"_spf.google.com":  {"v=spf1 ip4:74.125.0.0/16 ~all"},
+			},
+			domain:        "example.com",
+			expectedCount: 3, // example.com + _spf.example.net + _spf.google.com
+			expectError:   false,
+		},
+		{
+			name: "Redirect ignored when all is present",
+			mockRecords: map[string][]string{
+				"example.com": {"v=spf1 ip4:192.168.1.1 redirect=_spf.example.net ~all"},
+			},
+			domain:        "example.com",
+			expectedCount: 1, // Only the initial TXT lookup
+			expectError:   false,
+		},
 		{
 			name: "Domain with no SPF record",
 			mockRecords: map[string][]string{
@@ -123,7 +146,7 @@ func TestFlattenSPFWithThreshold(t *testing.T) {
 		{
 			name: "High lookup count - should flatten",
 			mockRecords: map[string][]string{
-				"example.com": {"v=spf1 include:spf1.com include:spf2.com include:spf3.com include:spf4.com include:spf5.com include:spf6.com include:spf7.com include:spf8.com include:spf9.com include:spf10.com ~all"},
+				"example.com": {"v=spf1 include:spf1.com include:spf2.com include:spf3.com include:spf4.com include:spf5.com include:spf6.com include:spf7.com include:spf8.com include:spf9.com include:spf10.com include:spf11.com ~all"},
 				"spf1.com":    {"v=spf1 ip4:1.1.1.1 ~all"},
 				"spf2.com":    {"v=spf1 ip4:2.2.2.2 ~all"},
 				"spf3.com":    {"v=spf1 ip4:3.3.3.3 ~all"},
@@ -134,11 +157,12 @@ func TestFlattenSPFWithThreshold(t *testing.T) {
 				"spf8.com":    {"v=spf1 ip4:8.8.8.8 ~all"},
 				"spf9.com":    {"v=spf1 ip4:9.9.9.9 ~all"},
 				"spf10.com":   {"v=spf1 ip4:10.10.10.10 ~all"},
+				"spf11.com":   {"v=spf1 ip4:11.11.11.11 ~all"},
 			},
 			domain:          "example.com",
 			forceFlatten:    false,
 			expectFlattened: true,
-			expectedLookups: 11, // 1 + 10 includes = 11 total lookups
+			expectedLookups: 12, // initial TXT + 11 includes; the initial lookup doesn't count towards the limit
 		},
 	}
 
@@ -177,3 +201,118 @@ func TestFlattenSPFWithThreshold(t *testing.T) {
 		})
 	}
 }
+
+// voidDNSProvider wraps mockDNSProvider and reports missing names as NXDOMAIN,
+// the way net.Resolver does.
+type voidDNSProvider struct {
+	mockDNSProvider
+}
+
+func (v *voidDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if recs, ok := v.Records[domain]; ok {
+		return recs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func (v *voidDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	if ips, ok := v.IPs[domain]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func TestAnalyzeDNSLookups(t *testing.T) {
+	manyMX := make([]*net.MX, 11)
+	for i := range manyMX {
+		manyMX[i] = &net.MX{Host: fmt.Sprintf("mx%d.example.com.", i), Pref: 10}
+	}
+
+	tests := []struct {
+		name          string
+		records       map[string][]string
+		ips           map[string][]net.IP
+		mxs           map[string][]*net.MX
+		expectedTotal int
+		expectedVoid  int
+		expectExceeds bool
+		permError     string // substring expected in one of the permerrors
+	}{
+		{
+			name: "exists and ptr are counted, all is not",
+			records: map[string][]string{
+				"example.com": {"v=spf1 exists:%{i}._spf.example.com ptr a:mail.example.com all"},
+			},
+			ips:           map[string][]net.IP{"mail.example.com": {net.ParseIP("192.0.2.1")}},
+			expectedTotal: 3,
+		},
+		{
+			name: "terms after all are not counted",
+			records: map[string][]string{
+				"example.com": {"v=spf1 ip4:192.0.2.1 -all include:_spf.example.net mx"},
+			},
+			expectedTotal: 0,
+		},
+		{
+			name: "void lookups over the limit",
+			records: map[string][]string{
+				"example.com": {"v=spf1 a:gone1.example.com a:gone2.example.com exists:gone3.example.com -all"},
+			},
+			expectedTotal: 3,
+			expectedVoid:  3,
+			expectExceeds: true,
+			permError:     "void lookups",
+		},
+		{
+			name: "exists with only AAAA records is void",
+			records: map[string][]string{
+				"example.com": {"v=spf1 exists:v6only.example.com a:v6only.example.com -all"},
+			},
+			ips:           map[string][]net.IP{"v6only.example.com": {net.ParseIP("2001:db8::1")}},
+			expectedTotal: 2,
+			expectedVoid:  1,
+		},
+		{
+			name: "too many MX hosts",
+			records: map[string][]string{
+				"example.com": {"v=spf1 mx -all"},
+			},
+			mxs:           map[string][]*net.MX{"example.com": manyMX},
+			expectedTotal: 1,
+			expectExceeds: true,
+			permError:     "MX hosts",
+		},
+		{
+			name: "include without an SPF record",
+			records: map[string][]string{
+				"example.com":       {"v=spf1 include:nospf.example.net -all"},
+				"nospf.example.net": {"google-site-verification=abc"},
+			},
+			expectedTotal: 1,
+			permError:     "has no SPF record",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &voidDNSProvider{mockDNSProvider{Records: tt.records, IPs: tt.ips, MXs: tt.mxs}}
+
+			report, err := AnalyzeDNSLookups(context.Background(), "example.com", provider)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if report.Total != tt.expectedTotal {
+				t.Errorf("Expected %d lookups, got %d (%+v)", tt.expectedTotal, report.Total, report.Terms)
+			}
+			if report.VoidLookups != tt.expectedVoid {
+				t.Errorf("Expected %d void lookups, got %d", tt.expectedVoid, report.VoidLookups)
+			}
+			if report.ExceedsLimits() != tt.expectExceeds {
+				t.Errorf("Expected ExceedsLimits() = %v", tt.expectExceeds)
+			}
+			if tt.permError != "" && !strings.Contains(strings.Join(report.PermErrors, "\n"), tt.permError) {
+				t.Errorf("Expected a permerror containing %q, got %v", tt.permError, report.PermErrors)
+			}
+		})
+	}
+}
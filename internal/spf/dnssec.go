@@ -0,0 +1,688 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECStatus is the outcome of validating a DNS answer (RFC 4035 section 4.3).
+type DNSSECStatus string
+
+const (
+	// DNSSECSecure answers are signed, with a chain of trust from a trust anchor.
+	DNSSECSecure DNSSECStatus = "secure"
+	// DNSSECInsecure answers come from a zone proven to be unsigned.
+	DNSSECInsecure DNSSECStatus = "insecure"
+	// DNSSECBogus answers lack the signatures or proofs the chain of trust requires, or
+	// carry invalid ones.
+	DNSSECBogus DNSSECStatus = "bogus"
+)
+
+// worse returns the less trustworthy of two statuses.
+func (s DNSSECStatus) worse(other DNSSECStatus) DNSSECStatus {
+	rank := map[DNSSECStatus]int{DNSSECSecure: 0, DNSSECInsecure: 1, DNSSECBogus: 2}
+	if rank[other] > rank[s] {
+		return other
+	}
+	return s
+}
+
+// DNSSECReporter is implemented by DNS providers that validate answers with DNSSEC.
+type DNSSECReporter interface {
+	// DNSSECStatus returns the validation status of the last answer for name and query
+	// type (dns.TypeTXT, dns.TypeMX, or dns.TypeA for the A and AAAA answers of LookupIP).
+	DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool)
+}
+
+// dnssecStatus returns the status provider reported for name, if it validates answers.
+func dnssecStatus(provider DNSProvider, name string, qtype uint16) (DNSSECStatus, bool) {
+	if reporter, ok := provider.(DNSSECReporter); ok {
+		return reporter.DNSSECStatus(name, qtype)
+	}
+	return "", false
+}
+
+// checkDNSSEC returns an error when name falls under FlattenOptions.RequireDNSSEC and
+// the answer for it was not validated as secure.
+func (f *flattener) checkDNSSEC(name string, qtype uint16) error {
+	required := false
+	for _, domain := range f.requireDNSSEC {
+		if dns.IsSubDomain(canonicalName(domain), canonicalName(name)) {
+			required = true
+			break
+		}
+	}
+	if !required {
+		return nil
+	}
+	status, ok := dnssecStatus(f.dns, name, qtype)
+	if !ok {
+		return fmt.Errorf("DNSSEC is required for %s, but its %s answer was not validated", name, dns.TypeToString[qtype])
+	}
+	if status != DNSSECSecure {
+		return fmt.Errorf("DNSSEC is required for %s, but its %s answer is %s", name, dns.TypeToString[qtype], status)
+	}
+	return nil
+}
+
+// MessageExchanger sends DNS messages to a server. PlainDNSProvider, DoTDNSProvider and
+// DoHDNSProvider in the wire format implement it.
+type MessageExchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// rootTrustAnchors are the DS records of the root zone key signing keys published by
+// IANA at https://data.iana.org/root-anchors/root-anchors.xml: KSK-2017 and KSK-2024.
+const rootTrustAnchors = `. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// RootTrustAnchors returns the DS records of the root zone's key signing keys.
+func RootTrustAnchors() []dns.RR {
+	anchors, err := ParseTrustAnchors(strings.NewReader(rootTrustAnchors), "root anchors")
+	if err != nil {
+		panic(err) // the built-in anchors are constant
+	}
+	return anchors
+}
+
+// LoadTrustAnchors reads the DS or DNSKEY records of a trust anchor file in zone file
+// format, such as the root.key file maintained by unbound-anchor.
+func LoadTrustAnchors(path string) ([]dns.RR, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust anchors: %w", err)
+	}
+	defer file.Close()
+	return ParseTrustAnchors(file, path)
+}
+
+// ParseTrustAnchors parses DS and DNSKEY records in zone file format; file is used in
+// error messages.
+func ParseTrustAnchors(r io.Reader, file string) ([]dns.RR, error) {
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, rr)
+		default:
+			return nil, fmt.Errorf("invalid trust anchor in %s: %s is not a DS or DNSKEY record", file, rr.Header().Name)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchors in %s: %w", file, err)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchors found in %s", file)
+	}
+	return anchors, nil
+}
+
+// DefaultValidationTimeout bounds each query of ValidatingDNSProvider, including the
+// DS and DNSKEY lookups needed to validate its answer, when no Timeout is set.
+const DefaultValidationTimeout = 15 * time.Second
+
+// ValidatingDNSProvider resolves names through servers queried in order, requesting
+// DNSSEC records and validating every answer itself along the chain of trust from its
+// trust anchors (RFC 4035 section 5). The status of each answer is reported through
+// DNSSECReporter; bogus answers are still returned, so callers decide what to refuse.
+// Denials of existence are validated from their NSEC or NSEC3 records. Names outside
+// the trust anchors' zones are insecure.
+type ValidatingDNSProvider struct {
+	serverResolver
+
+	exchangers []MessageExchanger
+	anchors    map[string][]*dns.DS // zone -> DS records
+	now        func() time.Time
+	statuses   sync.Map // cacheKey -> DNSSECStatus
+	mu         sync.Mutex
+	zones      map[string]*zoneTrust // zones whose keys were checked, by name
+	cuts       map[string]zoneCut    // results of the DS lookups, by name
+}
+
+// zoneTrust is a zone found along the chain of trust.
+type zoneTrust struct {
+	name   string
+	status DNSSECStatus
+	keys   []*dns.DNSKEY // The validated DNSKEY set of a secure zone
+}
+
+// zoneCut is the result of looking for a zone cut at a name.
+type zoneCut struct {
+	zone    *zoneTrust // The zone starting at the name; nil when it is not a zone cut
+	missing bool       // The name does not exist, so no zone starts below it
+}
+
+// NewValidatingDNSProvider returns a provider validating the answers of exchangers
+// from anchors, DS or DNSKEY records (see RootTrustAnchors).
+func NewValidatingDNSProvider(exchangers []MessageExchanger, anchors []dns.RR) (*ValidatingDNSProvider, error) {
+	if len(exchangers) == 0 {
+		return nil, fmt.Errorf("DNSSEC validation needs at least one DNS server")
+	}
+	p := &ValidatingDNSProvider{
+		exchangers: exchangers,
+		anchors:    make(map[string][]*dns.DS),
+		now:        time.Now,
+		zones:      make(map[string]*zoneTrust),
+		cuts:       make(map[string]zoneCut),
+	}
+	for _, rr := range anchors {
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			return nil, fmt.Errorf("invalid trust anchor %s", rr)
+		}
+		zone := canonicalName(ds.Hdr.Name)
+		p.anchors[zone] = append(p.anchors[zone], ds)
+	}
+	if len(p.anchors) == 0 {
+		return nil, fmt.Errorf("DNSSEC validation needs at least one trust anchor")
+	}
+	p.Timeout = DefaultValidationTimeout
+	p.server = "validating resolver"
+	p.exchange = func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		question := m.Question[0]
+		resp, err := p.send(ctx, question.Name, question.Qtype)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError {
+			status := p.validate(ctx, question.Name, question.Qtype, resp)
+			p.statuses.Store(newCacheKey(question.Name, question.Qtype), status)
+		}
+		return resp, nil
+	}
+	return p, nil
+}
+
+// DNSSECStatus implements DNSSECReporter. The status of LookupIP answers is the worse of
+// those of the A and AAAA answers.
+func (p *ValidatingDNSProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	qtypes := []uint16{qtype}
+	if qtype == dns.TypeA {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	var status DNSSECStatus
+	found := false
+	for _, t := range qtypes {
+		if s, ok := p.statuses.Load(newCacheKey(name, t)); ok {
+			status, found = s.(DNSSECStatus).worse(status), true
+		}
+	}
+	return status, found
+}
+
+// Close closes the exchangers that are DNS providers, returning the first error.
+func (p *ValidatingDNSProvider) Close() error {
+	var first error
+	for _, e := range p.exchangers {
+		if closer, ok := e.(io.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// send asks the exchangers in order for name and qtype with the DNSSEC OK and Checking
+// Disabled bits set, so signatures are returned and bogus answers are not withheld.
+// Responses other than NOERROR and NXDOMAIN are passed over while another exchanger is
+// left.
+func (p *ValidatingDNSProvider) send(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(EDNSBufferSize, true)
+	m.CheckingDisabled = true
+	var resp *dns.Msg
+	var err error
+	for _, e := range p.exchangers {
+		resp, err = e.Exchange(ctx, m.Copy())
+		if err == nil && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+			return resp, nil
+		}
+	}
+	return resp, err
+}
+
+// validate returns the status of resp, the response to name and qtype: the worst status
+// of its answer RRsets and, for NXDOMAIN and NODATA responses, of the proof that the
+// name or type does not exist.
+func (p *ValidatingDNSProvider) validate(ctx context.Context, name string, qtype uint16, resp *dns.Msg) DNSSECStatus {
+	status := DNSSECSecure
+	target := canonicalName(name)
+	answered := false
+	for _, set := range rrsets(resp.Answer) {
+		status = status.worse(p.validateRRset(ctx, set))
+		switch set.rrtype {
+		case qtype:
+			answered = true
+		case dns.TypeCNAME:
+			if set.owner == target {
+				target = canonicalName(set.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+	}
+	if resp.Rcode == dns.RcodeNameError || !answered {
+		status = status.worse(p.validateDenial(ctx, target, qtype, resp))
+	}
+	return status
+}
+
+// validateRRset checks the signatures of set against the keys of the signing zone.
+// Unsigned RRsets are insecure in unsigned zones and bogus in signed ones.
+func (p *ValidatingDNSProvider) validateRRset(ctx context.Context, set rrset) DNSSECStatus {
+	if len(set.sigs) == 0 {
+		if zone := p.zoneOf(ctx, set.owner); zone.status != DNSSECSecure {
+			return zone.status
+		}
+		return DNSSECBogus
+	}
+	status := DNSSECBogus
+	for _, sig := range set.sigs {
+		signer := canonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.owner) {
+			continue
+		}
+		zone := p.zoneOf(ctx, signer)
+		switch {
+		case zone.status == DNSSECInsecure:
+			status = DNSSECInsecure
+		case zone.status == DNSSECSecure && zone.name == signer && p.verify([]*dns.RRSIG{sig}, zone, set.rrs):
+			return DNSSECSecure
+		}
+	}
+	return status
+}
+
+// validateDenial checks that the NSEC or NSEC3 records of resp prove that name does
+// not exist (NXDOMAIN) or has no records of qtype (NODATA).
+func (p *ValidatingDNSProvider) validateDenial(ctx context.Context, name string, qtype uint16, resp *dns.Msg) DNSSECStatus {
+	zone := p.zoneOf(ctx, name)
+	if zone.status != DNSSECSecure {
+		return zone.status
+	}
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range rrsets(resp.Ns) {
+		if (set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3) || !p.verify(set.sigs, zone, set.rrs) {
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		if nsecDeniesName(nsecs, name) || nsec3DeniesName(nsec3s, name, zone.name) {
+			return DNSSECSecure
+		}
+		return DNSSECBogus
+	}
+	for _, rr := range nsecs {
+		if canonicalName(rr.Hdr.Name) == name && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+			return DNSSECSecure
+		}
+	}
+	for _, rr := range nsec3s {
+		if rr.Match(name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+			return DNSSECSecure
+		}
+	}
+	return DNSSECBogus
+}
+
+// nsecDeniesName reports whether nsecs prove that name does not exist: one covers
+// name, and one covers the wildcard at its closest encloser, so no wildcard could have
+// been expanded for it either (RFC 4035 section 5.4).
+func nsecDeniesName(nsecs []*dns.NSEC, name string) bool {
+	for _, rr := range nsecs {
+		if !nsecCovers(rr, name) {
+			continue
+		}
+		// The closest encloser is the longest ancestor name shares with either end of the
+		// covering NSEC
+		shared := max(dns.CompareDomainName(name, rr.Hdr.Name), dns.CompareDomainName(name, rr.NextDomain))
+		labels := dns.SplitDomainName(name)
+		wildcard := wildcardName(dns.Fqdn(strings.Join(labels[len(labels)-shared:], ".")))
+		for _, w := range nsecs {
+			if nsecCovers(w, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3DeniesName reports whether nsec3s prove that name does not exist in zone with
+// a closest encloser proof: an ancestor of name exists, the next name below it towards
+// name does not, and neither does the wildcard at the ancestor (RFC 5155 section 8.4).
+func nsec3DeniesName(nsec3s []*dns.NSEC3, name, zone string) bool {
+	for next := name; next != zone && dns.IsSubDomain(zone, next); next = parentName(next) {
+		encloser := parentName(next)
+		if nsec3Matches(nsec3s, encloser) {
+			return nsec3Covers(nsec3s, next) && nsec3Covers(nsec3s, wildcardName(encloser))
+		}
+	}
+	return false
+}
+
+// nsec3Matches reports whether one of nsec3s proves that name exists, and is neither a
+// delegation nor a DNAME, so names below it would be in the same zone (RFC 5155
+// section 8.3).
+func nsec3Matches(nsec3s []*dns.NSEC3, name string) bool {
+	for _, rr := range nsec3s {
+		delegation := hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+		if rr.Match(name) && !delegation && !hasType(rr.TypeBitMap, dns.TypeDNAME) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Covers reports whether one of nsec3s proves that name does not exist.
+func nsec3Covers(nsec3s []*dns.NSEC3, name string) bool {
+	for _, rr := range nsec3s {
+		// Cover also holds for the owner name itself, which exists
+		if rr.Cover(name) && !rr.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardName returns the wildcard name directly below name.
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// zoneOf follows the chain of trust from the closest trust anchor down to name, one
+// label at a time, and returns the deepest zone containing it. The walk stops at an
+// unsigned delegation (insecure) or where validation fails (bogus).
+func (p *ValidatingDNSProvider) zoneOf(ctx context.Context, name string) *zoneTrust {
+	name = canonicalName(name)
+	anchor := ""
+	for zone := range p.anchors {
+		if dns.IsSubDomain(zone, name) && (anchor == "" || dns.CountLabel(zone) > dns.CountLabel(anchor)) {
+			anchor = zone
+		}
+	}
+	if anchor == "" {
+		return &zoneTrust{name: name, status: DNSSECInsecure}
+	}
+	zone := p.trustedZone(ctx, anchor, p.anchors[anchor])
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(zone.name) - 1; i >= 0 && zone.status == DNSSECSecure; i-- {
+		cut := p.zoneCut(ctx, zone, dns.Fqdn(strings.Join(labels[i:], ".")))
+		if cut.zone != nil {
+			zone = cut.zone
+		}
+		if cut.missing {
+			break
+		}
+	}
+	return zone
+}
+
+// zoneCut asks for the DS records of child, a name directly below a secure parent
+// zone, and returns the zone starting at child if it is a zone cut.
+func (p *ValidatingDNSProvider) zoneCut(ctx context.Context, parent *zoneTrust, child string) zoneCut {
+	p.mu.Lock()
+	cached, ok := p.cuts[child]
+	p.mu.Unlock()
+	if ok {
+		return cached
+	}
+
+	resp, err := p.send(ctx, child, dns.TypeDS)
+	if err != nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		// Not cached: the next lookup may succeed
+		return zoneCut{zone: &zoneTrust{name: child, status: DNSSECBogus}}
+	}
+	var cut zoneCut
+	switch {
+	case resp.Rcode == dns.RcodeNameError:
+		cut.missing = true
+	default:
+		cut.zone = p.delegation(ctx, parent, child, resp)
+	}
+	p.mu.Lock()
+	p.cuts[child] = cut
+	p.mu.Unlock()
+	return cut
+}
+
+// delegation interprets resp, the answer to the DS query for child. Validly signed DS
+// records lead to the child zone's keys; otherwise the parent must prove there are
+// none, either because child is not a zone cut (nil) or because the delegation is
+// unsigned (insecure).
+func (p *ValidatingDNSProvider) delegation(ctx context.Context, parent *zoneTrust, child string, resp *dns.Msg) *zoneTrust {
+	bogus := &zoneTrust{name: child, status: DNSSECBogus}
+	for _, set := range rrsets(resp.Answer) {
+		if set.owner != child {
+			continue
+		}
+		switch set.rrtype {
+		case dns.TypeDS:
+			if !p.verify(set.sigs, parent, set.rrs) {
+				return bogus
+			}
+			var dss []*dns.DS
+			for _, rr := range set.rrs {
+				dss = append(dss, rr.(*dns.DS))
+			}
+			return p.trustedZone(ctx, child, dss)
+		case dns.TypeCNAME:
+			return nil // an alias, validated with the answer it belongs to
+		}
+	}
+
+	for _, set := range rrsets(resp.Ns) {
+		if !p.verify(set.sigs, parent, set.rrs) {
+			continue
+		}
+		for _, rr := range set.rrs {
+			var bitmap []uint16
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if canonicalName(rr.Hdr.Name) != child {
+					if nsecCovers(rr, child) {
+						return nil // an empty non-terminal
+					}
+					continue
+				}
+				bitmap = rr.TypeBitMap
+			case *dns.NSEC3:
+				if !rr.Match(child) {
+					if rr.Cover(child) && rr.Flags&1 == 1 {
+						// Opt-out (RFC 5155 section 6): unsigned delegations may be skipped
+						return &zoneTrust{name: child, status: DNSSECInsecure}
+					}
+					continue
+				}
+				bitmap = rr.TypeBitMap
+			default:
+				continue
+			}
+			switch {
+			case hasType(bitmap, dns.TypeDS):
+				return bogus // the DS records exist but were not returned
+			case hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA):
+				return &zoneTrust{name: child, status: DNSSECInsecure}
+			default:
+				return nil
+			}
+		}
+	}
+	return bogus
+}
+
+// trustedZone fetches the DNSKEY set of zone and trusts it when it is signed by a key
+// matching one of dss.
+func (p *ValidatingDNSProvider) trustedZone(ctx context.Context, zone string, dss []*dns.DS) *zoneTrust {
+	p.mu.Lock()
+	cached, ok := p.zones[zone]
+	p.mu.Unlock()
+	if ok {
+		return cached
+	}
+
+	bogus := &zoneTrust{name: zone, status: DNSSECBogus}
+	resp, err := p.send(ctx, zone, dns.TypeDNSKEY)
+	if err != nil || resp.Rcode != dns.RcodeSuccess {
+		return bogus // not cached: the next lookup may succeed
+	}
+	trusted := bogus
+	for _, set := range rrsets(resp.Answer) {
+		if set.owner != zone || set.rrtype != dns.TypeDNSKEY {
+			continue
+		}
+		var keys, entry []*dns.DNSKEY
+		for _, rr := range set.rrs {
+			key := rr.(*dns.DNSKEY)
+			keys = append(keys, key)
+			for _, ds := range dss {
+				if matchesDS(key, ds) {
+					entry = append(entry, key)
+					break
+				}
+			}
+		}
+		if p.verify(set.sigs, &zoneTrust{name: zone, keys: entry}, set.rrs) {
+			trusted = &zoneTrust{name: zone, status: DNSSECSecure, keys: keys}
+		}
+	}
+	p.mu.Lock()
+	p.zones[zone] = trusted
+	p.mu.Unlock()
+	return trusted
+}
+
+// verify reports whether one of sigs, made by zone and currently valid, verifies rrs
+// with one of the zone's keys.
+func (p *ValidatingDNSProvider) verify(sigs []*dns.RRSIG, zone *zoneTrust, rrs []dns.RR) bool {
+	now := p.now()
+	for _, sig := range sigs {
+		if canonicalName(sig.SignerName) != zone.name || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range zone.keys {
+			if key.Flags&dns.ZONE != 0 && key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrs) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesDS reports whether ds is the digest of key.
+func matchesDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.Flags&dns.ZONE == 0 || key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	digest := key.ToDS(ds.DigestType)
+	return digest != nil && strings.EqualFold(digest.Digest, ds.Digest)
+}
+
+// rrset is the records of one owner name and type in a message section, with the
+// signatures covering them.
+type rrset struct {
+	owner  string // Canonical owner name
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// rrsets groups the records of a message section into RRsets, in order of appearance.
+func rrsets(section []dns.RR) []rrset {
+	var sets []rrset
+	index := make(map[cacheKey]int)
+	for _, rr := range section {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		key := cacheKey{canonicalName(rr.Header().Name), rr.Header().Rrtype}
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, rrset{owner: key.name, rrtype: key.qtype})
+		}
+		sets[i].rrs = append(sets[i].rrs, rr)
+	}
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if i, ok := index[cacheKey{canonicalName(sig.Hdr.Name), sig.TypeCovered}]; ok {
+				sets[i].sigs = append(sets[i].sigs, sig)
+			}
+		}
+	}
+	return sets
+}
+
+// canonicalName returns name lowercased and fully qualified.
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// parentName returns the name one label above name.
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls between the owner and the next name of nsec
+// in canonical order, so it does not exist in the zone. The last NSEC of a zone wraps
+// around to the apex.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if !canonicalLess(owner, name) {
+		return false
+	}
+	return canonicalLess(name, next) || !canonicalLess(owner, next)
+}
+
+// canonicalLess orders names as RFC 4034 section 6.1 does: label by label from the
+// right, comparing lowercased labels as byte strings.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if x, y := la[len(la)-i], lb[len(lb)-i]; x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
@@ -0,0 +1,315 @@
+package spf
+
+import (
+	"context"
+	"crypto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecTestZone signs the records of one zone with a single key.
+type dnssecTestZone struct {
+	name   string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newDNSSECTestZone(t *testing.T, name string) *dnssecTestZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Failed to generate key for %s: %v", name, err)
+	}
+	return &dnssecTestZone{name: name, key: key, signer: priv.(crypto.Signer)}
+}
+
+// sign returns rrs followed by their signature.
+func (z *dnssecTestZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.signer, rrs); err != nil {
+		t.Fatalf("Failed to sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(rrs, sig)
+}
+
+// keys returns the zone's signed DNSKEY set.
+func (z *dnssecTestZone) keys(t *testing.T) []dns.RR {
+	return z.sign(t, z.key)
+}
+
+// ds returns the zone's DS record, signed by parent.
+func (z *dnssecTestZone) ds(t *testing.T, parent *dnssecTestZone) []dns.RR {
+	return parent.sign(t, z.key.ToDS(dns.SHA256))
+}
+
+// nsec returns a signed NSEC record at name with the types in its bitmap.
+func (z *dnssecTestZone) nsec(t *testing.T, name, next string, types ...uint16) []dns.RR {
+	return z.sign(t, &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: slices.Sorted(slices.Values(append(types, dns.TypeRRSIG, dns.TypeNSEC))),
+	})
+}
+
+// nsec3 returns a signed NSEC3 record for name, hashed without salt or extra
+// iterations, whose next hashed owner is that of next.
+func (z *dnssecTestZone) nsec3(t *testing.T, name, next string, types ...uint16) []dns.RR {
+	return z.sign(t, &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(dns.HashName(name, dns.SHA1, 0, "")) + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: dns.HashName(next, dns.SHA1, 0, ""),
+		TypeBitMap: slices.Sorted(slices.Values(append(types, dns.TypeRRSIG))),
+	})
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Invalid test record %q: %v", s, err)
+	}
+	return rr
+}
+
+// dnssecTestServer answers from a fixed set of responses and fails other queries.
+type dnssecTestServer map[string]*dns.Msg // "name TYPE" -> response
+
+func (s dnssecTestServer) add(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	s[name+" "+dns.TypeToString[qtype]] = &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}, Answer: answer, Ns: ns}
+}
+
+func (s dnssecTestServer) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	question := m.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	stored, ok := s[strings.ToLower(question.Name)+" "+dns.TypeToString[question.Qtype]]
+	if !ok {
+		resp.Rcode = dns.RcodeServerFailure
+		return resp, nil
+	}
+	resp.Rcode, resp.Answer, resp.Ns = stored.Rcode, stored.Answer, stored.Ns
+	return resp, nil
+}
+
+// newDNSSECTestServer serves a signed root and example. zone delegating to the signed
+// vendor.example., bogus.example., wild.example. and hashed.example. (NSEC3) zones and
+// to the unsigned unsigned.example. zone.
+func newDNSSECTestServer(t *testing.T) (dnssecTestServer, *dnssecTestZone) {
+	root := newDNSSECTestZone(t, ".")
+	example := newDNSSECTestZone(t, "example.")
+	vendor := newDNSSECTestZone(t, "vendor.example.")
+	bogus := newDNSSECTestZone(t, "bogus.example.")
+	wild := newDNSSECTestZone(t, "wild.example.")
+	hashed := newDNSSECTestZone(t, "hashed.example.")
+
+	s := dnssecTestServer{}
+	s.add(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.keys(t), nil)
+	s.add("example.", dns.TypeDS, dns.RcodeSuccess, example.ds(t, root), nil)
+	s.add("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.keys(t), nil)
+	s.add("vendor.example.", dns.TypeDS, dns.RcodeSuccess, vendor.ds(t, example), nil)
+	s.add("vendor.example.", dns.TypeDNSKEY, dns.RcodeSuccess, vendor.keys(t), nil)
+	s.add("bogus.example.", dns.TypeDS, dns.RcodeSuccess, bogus.ds(t, example), nil)
+	s.add("bogus.example.", dns.TypeDNSKEY, dns.RcodeSuccess, bogus.keys(t), nil)
+	s.add("wild.example.", dns.TypeDS, dns.RcodeSuccess, wild.ds(t, example), nil)
+	s.add("wild.example.", dns.TypeDNSKEY, dns.RcodeSuccess, wild.keys(t), nil)
+	s.add("hashed.example.", dns.TypeDS, dns.RcodeSuccess, hashed.ds(t, example), nil)
+	s.add("hashed.example.", dns.TypeDNSKEY, dns.RcodeSuccess, hashed.keys(t), nil)
+	s.add("unsigned.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		example.nsec(t, "unsigned.example.", "vendor.example.", dns.TypeNS))
+
+	// Signed answers
+	s.add("_spf.vendor.example.", dns.TypeTXT, dns.RcodeSuccess,
+		vendor.sign(t, testRR(t, `_spf.vendor.example. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"`)), nil)
+	s.add("_spf.vendor.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		vendor.nsec(t, "_spf.vendor.example.", "_stripped.vendor.example.", dns.TypeTXT))
+	apexNSEC := vendor.nsec(t, "vendor.example.", "_spf.vendor.example.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY)
+	lastNSEC := vendor.nsec(t, "_stripped.vendor.example.", "vendor.example.", dns.TypeTXT)
+	s.add("missing.vendor.example.", dns.TypeTXT, dns.RcodeNameError, nil, append(lastNSEC, apexNSEC...))
+	s.add("missing.vendor.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+	// The NSEC covering *.vendor.example. is left out, so a wildcard may have matched
+	s.add("gone.vendor.example.", dns.TypeTXT, dns.RcodeNameError, nil, lastNSEC)
+	s.add("gone.vendor.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+
+	// A zone with a wildcard: a replayed NSEC covering a name cannot deny it
+	s.add("evil.wild.example.", dns.TypeTXT, dns.RcodeNameError, nil, append(
+		wild.nsec(t, "_spf.wild.example.", "wild.example.", dns.TypeTXT),
+		wild.nsec(t, "*.wild.example.", "_spf.wild.example.", dns.TypeTXT)...))
+	s.add("evil.wild.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+
+	// An NSEC3 zone holding hashed.example., _spf.hashed.example. and c.hashed.example.,
+	// whose hashes are ordered G1GI..., HOA2..., SVRM...
+	apexNSEC3 := hashed.nsec3(t, "hashed.example.", "_spf.hashed.example.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM)
+	spfNSEC3 := hashed.nsec3(t, "_spf.hashed.example.", "c.hashed.example.", dns.TypeTXT)
+	lastNSEC3 := hashed.nsec3(t, "c.hashed.example.", "hashed.example.", dns.TypeTXT)
+	// evil.hashed.example. (RD2K...) is covered by spfNSEC3, *.hashed.example. (V5TI...) by lastNSEC3
+	s.add("evil.hashed.example.", dns.TypeTXT, dns.RcodeNameError, nil, append(append(apexNSEC3, spfNSEC3...), lastNSEC3...))
+	s.add("evil.hashed.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+	// No NSEC3 matches the closest encloser hashed.example.
+	s.add("missing.hashed.example.", dns.TypeTXT, dns.RcodeNameError, nil, lastNSEC3)
+	s.add("missing.hashed.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+	// a.hashed.example. (QJ6R...) is covered, but the wildcard is not denied
+	s.add("a.hashed.example.", dns.TypeTXT, dns.RcodeNameError, nil, append(apexNSEC3, spfNSEC3...))
+	s.add("a.hashed.example.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+
+	// Signatures stripped from a signed zone
+	s.add("_stripped.vendor.example.", dns.TypeTXT, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, `_stripped.vendor.example. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"`)}, nil)
+	s.add("_stripped.vendor.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		vendor.nsec(t, "_stripped.vendor.example.", "vendor.example.", dns.TypeTXT))
+
+	// An answer changed after signing
+	tampered := bogus.sign(t, testRR(t, `_spf.bogus.example. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"`))
+	tampered[0].(*dns.TXT).Txt = []string{"v=spf1 ip4:203.0.113.0/24 -all"}
+	s.add("_spf.bogus.example.", dns.TypeTXT, dns.RcodeSuccess, tampered, nil)
+
+	// An unsigned zone
+	s.add("_spf.unsigned.example.", dns.TypeTXT, dns.RcodeSuccess,
+		[]dns.RR{testRR(t, `_spf.unsigned.example. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"`)}, nil)
+	return s, root
+}
+
+func TestValidatingDNSProvider(t *testing.T) {
+	server, root := newDNSSECTestServer(t)
+	otherRoot := newDNSSECTestZone(t, ".")
+
+	testCases := []struct {
+		name         string
+		anchor       *dnssecTestZone
+		lookup       string
+		expectStatus DNSSECStatus
+		expectVoid   bool
+	}{
+		{"signed answer", root, "_spf.vendor.example", DNSSECSecure, false},
+		{"unsigned zone", root, "_spf.unsigned.example", DNSSECInsecure, false},
+		{"invalid signature", root, "_spf.bogus.example", DNSSECBogus, false},
+		{"signatures stripped", root, "_stripped.vendor.example", DNSSECBogus, false},
+		{"proven NXDOMAIN", root, "missing.vendor.example", DNSSECSecure, true},
+		{"NXDOMAIN without wildcard denial", root, "gone.vendor.example", DNSSECBogus, true},
+		{"NXDOMAIN replayed over a wildcard", root, "evil.wild.example", DNSSECBogus, true},
+		{"proven NXDOMAIN with NSEC3", root, "evil.hashed.example", DNSSECSecure, true},
+		{"NSEC3 without closest encloser", root, "missing.hashed.example", DNSSECBogus, true},
+		{"NSEC3 without wildcard denial", root, "a.hashed.example", DNSSECBogus, true},
+		{"untrusted root key", otherRoot, "_spf.vendor.example", DNSSECBogus, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewValidatingDNSProvider([]MessageExchanger{server}, []dns.RR{tc.anchor.key})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			records, err := p.LookupTXT(context.Background(), tc.lookup)
+			if tc.expectVoid {
+				if !isVoidLookup(err) {
+					t.Fatalf("Expected a void lookup, got %v", err)
+				}
+			} else if err != nil || len(records) != 1 {
+				t.Fatalf("Expected 1 record, got %v (%v)", records, err)
+			}
+			status, ok := p.DNSSECStatus(tc.lookup, dns.TypeTXT)
+			if !ok || status != tc.expectStatus {
+				t.Errorf("Expected status %s, got %q (%v)", tc.expectStatus, status, ok)
+			}
+		})
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	if anchors := RootTrustAnchors(); len(anchors) != 2 {
+		t.Errorf("Expected 2 root trust anchors, got %d", len(anchors))
+	}
+	testCases := []struct {
+		name        string
+		input       string
+		expectCount int
+		expectError bool
+	}{
+		{"DS record", ". 3600 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D", 1, false},
+		{"DNSKEY record", "example. IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==", 1, false},
+		{"other record type", "example. IN A 192.0.2.1", 0, true},
+		{"empty file", "; no anchors\n", 0, true},
+		{"syntax error", ". IN DS not-a-key-tag", 0, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			anchors, err := ParseTrustAnchors(strings.NewReader(tc.input), "test")
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %v", anchors)
+				}
+				return
+			}
+			if err != nil || len(anchors) != tc.expectCount {
+				t.Errorf("Expected %d anchors, got %v (%v)", tc.expectCount, anchors, err)
+			}
+		})
+	}
+}
+
+// dnssecMockProvider reports a fixed DNSSEC status for each name.
+type dnssecMockProvider struct {
+	mockDNSProvider
+	Statuses map[string]DNSSECStatus
+}
+
+func (p *dnssecMockProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	status, ok := p.Statuses[name]
+	return status, ok
+}
+
+func TestFlattenSPF_RequireDNSSEC(t *testing.T) {
+	testCases := []struct {
+		name        string
+		require     []string
+		status      DNSSECStatus
+		expectError string
+	}{
+		{"not required", nil, DNSSECBogus, ""},
+		{"secure vendor zone", []string{"vendor.example"}, DNSSECSecure, ""},
+		{"bogus vendor zone", []string{"vendor.example"}, DNSSECBogus, "answer is bogus"},
+		{"insecure vendor zone", []string{"vendor.example"}, DNSSECInsecure, "answer is insecure"},
+		{"not validated", []string{"vendor.example"}, "", "was not validated"},
+		{"other zone required", []string{"other.example"}, DNSSECBogus, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &dnssecMockProvider{mockDNSProvider: mockDNSProvider{
+				Records: map[string][]string{
+					"example.com":         {"v=spf1 include:_spf.vendor.example ip4:198.51.100.1 -all"},
+					"_spf.vendor.example": {"v=spf1 ip4:192.0.2.0/24 -all"},
+				},
+			}}
+			if tc.status != "" {
+				provider.Statuses = map[string]DNSSECStatus{"_spf.vendor.example": tc.status}
+			}
+			_, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{ForceFlatten: true, RequireDNSSEC: tc.require})
+			if tc.expectError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
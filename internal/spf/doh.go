@@ -0,0 +1,175 @@
+package spf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DoH request formats.
+const (
+	DoHWireFormat = "wire" // RFC 8484 application/dns-message
+	DoHJSONFormat = "json" // application/dns-json, as served by Google and Cloudflare
+)
+
+// maxDoHResponse bounds the response bodies read from DoH servers.
+const maxDoHResponse = 64 * 1024
+
+// DoHDNSProvider queries a DNS-over-HTTPS server. In the wire format (RFC 8484) DNS
+// messages are POSTed to the endpoint; in the JSON format the question is sent as the
+// name and type query parameters.
+type DoHDNSProvider struct {
+	serverResolver
+	URL    string
+	Format string // DoHWireFormat or DoHJSONFormat
+	client *http.Client
+}
+
+// NewDoHDNSProvider returns a provider querying the DoH endpoint at rawURL (for example
+// https://cloudflare-dns.com/dns-query) in format.
+func NewDoHDNSProvider(rawURL, format string) (*DoHDNSProvider, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DoH URL %q: must be an https:// URL", rawURL)
+	}
+	if format == "" {
+		format = DoHWireFormat
+	}
+	if format != DoHWireFormat && format != DoHJSONFormat {
+		return nil, fmt.Errorf("invalid DoH format %q: must be %s or %s", format, DoHWireFormat, DoHJSONFormat)
+	}
+	p := &DoHDNSProvider{
+		URL:    rawURL,
+		Format: format,
+		client: &http.Client{}, // Attempts are bounded by their context
+	}
+	p.server = rawURL
+	p.exchange = p.exchangeWire
+	if format == DoHJSONFormat {
+		p.exchange = p.exchangeJSON
+	}
+	return p, nil
+}
+
+// Close releases idle HTTP connections.
+func (p *DoHDNSProvider) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// exchangeWire POSTs m as an RFC 8484 DNS message.
+func (p *DoHDNSProvider) exchangeWire(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	m.Id = 0 // RFC 8484 section 4.1: cache friendly
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS query: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid DNS message in DoH response: %w", err)
+	}
+	return resp, nil
+}
+
+// dohJSONResponse is the application/dns-json response body.
+type dohJSONResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Name string `json:"name"`
+		Type uint16 `json:"type"`
+		TTL  uint32 `json:"TTL"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// exchangeJSON asks the question of m with a JSON API GET request and converts the
+// answer into a DNS message.
+func (p *DoHDNSProvider) exchangeJSON(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	question := m.Question[0]
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("name", question.Name)
+	query.Set("type", dns.TypeToString[question.Qtype])
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var decoded dohJSONResponse
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil, fmt.Errorf("invalid JSON in DoH response: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Rcode = decoded.Status
+	for _, ans := range decoded.Answer {
+		rr, err := jsonAnswerRR(ans.Name, ans.Type, ans.TTL, ans.Data)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, nil
+}
+
+// jsonAnswerRR parses one answer of a JSON response. TXT data is quoted by some servers
+// (Cloudflare) and not by others (Google).
+func jsonAnswerRR(name string, rrtype uint16, ttl uint32, data string) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	if rrtype == dns.TypeTXT && !strings.HasPrefix(data, `"`) {
+		return &dns.TXT{Hdr: hdr, Txt: []string{data}}, nil
+	}
+	typeName, ok := dns.TypeToString[rrtype]
+	if !ok {
+		typeName = "TYPE" + strconv.Itoa(int(rrtype))
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, ttl, typeName, data))
+	if err != nil || rr == nil {
+		return nil, fmt.Errorf("invalid %s answer %q in DoH response: %v", typeName, data, err)
+	}
+	return rr, nil
+}
+
+// do sends req and returns the body of a successful response.
+func (p *DoHDNSProvider) do(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return body, nil
+}
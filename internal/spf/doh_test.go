@@ -0,0 +1,96 @@
+package spf
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dohHandler serves testZone in the RFC 8484 wire format and the JSON format.
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/dns-json" {
+			qtype := dns.StringToType[r.URL.Query().Get("type")]
+			req := new(dns.Msg)
+			req.SetQuestion(r.URL.Query().Get("name"), qtype)
+			resp := answerFromZone(t, req)
+			body := map[string]interface{}{"Status": resp.Rcode}
+			var answers []map[string]interface{}
+			for _, rr := range resp.Answer {
+				// Google's format: TXT data unquoted and joined
+				data := strings.TrimPrefix(rr.String(), rr.Header().String())
+				if txt, ok := rr.(*dns.TXT); ok {
+					data = strings.Join(txt.Txt, "")
+				}
+				answers = append(answers, map[string]interface{}{
+					"name": rr.Header().Name, "type": rr.Header().Rrtype, "TTL": rr.Header().Ttl, "data": data,
+				})
+			}
+			body["Answer"] = answers
+			w.Header().Set("Content-Type", "application/dns-json")
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, _ := answerFromZone(t, req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}
+}
+
+func TestDoHDNSProvider(t *testing.T) {
+	server := httptest.NewTLSServer(dohHandler(t))
+	defer server.Close()
+
+	for _, format := range []string{DoHWireFormat, DoHJSONFormat} {
+		t.Run(format, func(t *testing.T) {
+			p, err := NewDoHDNSProvider(server.URL+"/dns-query", format)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			p.client = server.Client()
+			testServerResolver(t, p)
+		})
+	}
+}
+
+func TestNewDoHDNSProvider_Invalid(t *testing.T) {
+	testCases := []struct {
+		url, format string
+	}{
+		{"http://dns.example/dns-query", DoHWireFormat},
+		{"dns.example/dns-query", DoHWireFormat},
+		{"https://dns.example/dns-query", "xml"},
+	}
+	for _, tc := range testCases {
+		if _, err := NewDoHDNSProvider(tc.url, tc.format); err == nil {
+			t.Errorf("Expected an error for %s in format %q", tc.url, tc.format)
+		}
+	}
+}
+
+func TestJSONAnswerRR_QuotedTXT(t *testing.T) {
+	// Cloudflare quotes each character string of TXT data
+	rr, err := jsonAnswerRR("example.com", dns.TypeTXT, 300, `"v=spf1 ip4:192.0.2.1 " "-all"`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := strings.Join(rr.(*dns.TXT).Txt, ""); got != "v=spf1 ip4:192.0.2.1 -all" {
+		t.Errorf("Unexpected TXT data %q", got)
+	}
+}
@@ -0,0 +1,218 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// This file answers "why is this IP allowed?": it walks a domain's include tree and
+// reports every term whose addresses cover a given client address, with the path of
+// include: and redirect= terms leading to it.
+
+// Coverage is one term of an include tree whose addresses cover the explained address.
+type Coverage struct {
+	Domain    string       // Domain whose record holds the term
+	Term      string       // The covering term as written, e.g. "~ip4:198.51.100.0/24" or "mx"
+	Path      []string     // include: and redirect= terms followed to reach Domain
+	Host      string       // The a/mx host name whose address covers the IP; empty for ip4:/ip6:/all
+	Prefix    netip.Prefix // The covering CIDR
+	Qualifier Qualifier    // Qualifier of the covering term
+	// Result is what the term yields for the explained domain if it is the first match:
+	// the qualifier of the outermost include on the path when every include along it
+	// matches, or empty when an include does not match because the result inside it is
+	// not pass.
+	Result Result
+}
+
+// Explanation lists the terms of a domain's include tree covering an address.
+type Explanation struct {
+	Domain   string
+	IP       netip.Addr
+	Coverage []Coverage // In evaluation order
+	Notes    []string   // Terms that could not be evaluated, and why
+}
+
+// ExplainIP reports every term of domain's include tree whose addresses cover ip. The
+// all mechanism is reported only where it can decide the domain's result. Terms
+// evaluated for each message (exists:, ptr and macros) and failed lookups are listed in
+// Notes rather than stopping the walk.
+func ExplainIP(ctx context.Context, dns DNSProvider, domain string, ip netip.Addr) (*Explanation, error) {
+	return ExplainIPWithRecords(ctx, dns, domain, ip, nil)
+}
+
+// ExplainIPWithRecords is ExplainIP with the SPF records of some domains supplied by
+// the caller instead of DNS, for example the output of SplitAndChainSPF. Names missing
+// from records are resolved through dns.
+func ExplainIPWithRecords(ctx context.Context, dns DNSProvider, domain string, ip netip.Addr, records map[string]string) (*Explanation, error) {
+	e := &explainer{
+		dns:         dns,
+		records:     records,
+		stack:       make(map[string]bool),
+		Explanation: &Explanation{Domain: domain, IP: ip.Unmap()},
+	}
+	record, err := e.record(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.walk(ctx, domain, record, nil, 0); err != nil {
+		return nil, err
+	}
+	return e.Explanation, nil
+}
+
+type explainer struct {
+	*Explanation
+	dns     DNSProvider
+	records map[string]string
+	stack   map[string]bool // records being walked, for recursion detection
+}
+
+// record returns the SPF record of domain.
+func (e *explainer) record(ctx context.Context, domain string) (string, error) {
+	if record, ok := e.records[domain]; ok {
+		return record, nil
+	}
+	txts, err := e.dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
+	}
+	record := findSPFRecord(txts)
+	if record == "" {
+		return "", fmt.Errorf("no SPF record found for %s", domain)
+	}
+	return record, nil
+}
+
+// walk adds the coverage of the terms of record, the SPF record of domain.
+func (e *explainer) walk(ctx context.Context, domain, record string, path []string, depth int) error {
+	const maxDepth = 10
+	if depth > maxDepth {
+		return fmt.Errorf("recursion depth exceeded for %s", domain)
+	}
+	if e.stack[domain] {
+		return fmt.Errorf("recursion detected for domain %s", domain)
+	}
+	e.stack[domain] = true
+	defer delete(e.stack, domain)
+
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return fmt.Errorf("failed to parse SPF record for %s: %w", domain, err)
+	}
+
+	for _, term := range parsed.Mechanisms() {
+		if mustKeep(term) {
+			e.Notes = append(e.Notes, fmt.Sprintf("%s (%s): evaluated for each message", term, domain))
+			continue
+		}
+		switch term.Kind {
+		case KindAll:
+			family := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+			if e.IP.Is4() {
+				family = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+			}
+			e.cover(domain, term, path, "", family)
+			return nil // terms after "all" and redirect= are never evaluated
+		case KindIP4, KindIP6:
+			e.coverAddress(domain, term, path, "", term.IP)
+		case KindA:
+			e.resolve(ctx, domain, term, path, targetDomain(term, domain))
+		case KindMX:
+			target := targetDomain(term, domain)
+			mxs, err := e.dns.LookupMX(ctx, target)
+			if err != nil {
+				if !isVoidLookup(err) {
+					e.Notes = append(e.Notes, fmt.Sprintf("%s (%s): %v", term, domain, err))
+				}
+				continue
+			}
+			for _, mx := range mxs {
+				e.resolve(ctx, domain, term, path, strings.TrimSuffix(mx.Host, "."))
+			}
+		case KindInclude:
+			e.follow(ctx, domain, term, path, depth)
+		}
+	}
+
+	if redirect, ok := parsed.Redirect(); ok {
+		if redirect.HasMacros() {
+			e.Notes = append(e.Notes, fmt.Sprintf("%s (%s): evaluated for each message", redirect, domain))
+			return nil
+		}
+		e.follow(ctx, domain, redirect, path, depth)
+	}
+	return nil
+}
+
+// follow walks the record an include: or redirect= term points to.
+func (e *explainer) follow(ctx context.Context, domain string, term Term, path []string, depth int) {
+	target := targetDomain(term, domain)
+	record, err := e.record(ctx, target)
+	if err == nil {
+		err = e.walk(ctx, target, record, appendPath(path, term), depth+1)
+	}
+	if err != nil {
+		e.Notes = append(e.Notes, fmt.Sprintf("%s (%s): %v", term, domain, err))
+	}
+}
+
+// resolve adds the coverage of an a or mx term through the addresses of host.
+func (e *explainer) resolve(ctx context.Context, domain string, term Term, path []string, host string) {
+	ips, err := e.dns.LookupIP(ctx, host)
+	if err != nil {
+		if !isVoidLookup(err) {
+			e.Notes = append(e.Notes, fmt.Sprintf("%s (%s): failed to lookup A/AAAA for %s: %v", term, domain, host, err))
+		}
+		return
+	}
+	for _, ip := range ips {
+		e.coverAddress(domain, term, path, host, ip)
+	}
+}
+
+// coverAddress records term as covering the explained address if ip, with the term's
+// CIDR lengths applied, contains it.
+func (e *explainer) coverAddress(domain string, term Term, path []string, host string, ip net.IP) {
+	if p, ok := addressPrefix(ip, term.IP4Prefix, term.IP6Prefix); ok && p.Contains(e.IP) {
+		e.cover(domain, term, path, host, p)
+	}
+}
+
+// cover records that term covers the address through prefix, unless it is an all
+// mechanism that cannot decide the domain's result.
+func (e *explainer) cover(domain string, term Term, path []string, host string, prefix netip.Prefix) {
+	c := Coverage{
+		Domain:    domain,
+		Term:      term.String(),
+		Path:      path,
+		Host:      host,
+		Prefix:    prefix,
+		Qualifier: term.Qualifier,
+		Result:    pathResult(term.Qualifier, path),
+	}
+	if term.Kind == KindAll && c.Result == "" {
+		return
+	}
+	e.Coverage = append(e.Coverage, c)
+}
+
+// pathResult returns what a match of a term with qualifier q yields once the includes
+// on path are applied (RFC 7208 section 5.2): an include matches only when the result
+// inside it is pass, and then yields its own qualifier. Redirects pass the result on.
+func pathResult(q Qualifier, path []string) Result {
+	result := qualifierResult(q)
+	for i := len(path) - 1; i >= 0; i-- {
+		term, err := ParseTerm(path[i])
+		if err != nil || term.Kind != KindInclude {
+			continue
+		}
+		if result != ResultPass {
+			return ""
+		}
+		result = qualifierResult(term.Qualifier)
+	}
+	return result
+}
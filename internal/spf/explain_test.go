@@ -0,0 +1,111 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestExplainIP(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com":               {"v=spf1 ip4:192.0.2.0/24 include:_spf.vendor.example a:mail.example.com/28 mx exists:%{i}.bl.example.com ~all"},
+			"_spf.vendor.example":       {"v=spf1 include:_netblocks.vendor.example ~ip4:198.51.100.128/25 -all"},
+			"_netblocks.vendor.example": {"v=spf1 ip4:198.51.100.0/24 ip6:2001:db8::/32 ~all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.example.com": {net.ParseIP("203.0.113.5")},
+			"mx1.example.com":  {net.ParseIP("203.0.113.10")},
+		},
+		MXs: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com.", Pref: 10}},
+		},
+	}
+
+	type covered struct {
+		term   string
+		path   []string
+		prefix string
+		result Result
+	}
+	testCases := []struct {
+		name     string
+		ip       string
+		expected []covered
+	}{
+		{
+			name: "ip4 term of the domain's record",
+			ip:   "192.0.2.25",
+			expected: []covered{
+				{"ip4:192.0.2.0/24", nil, "192.0.2.0/24", ResultPass},
+				{"~all", nil, "0.0.0.0/0", ResultSoftFail},
+			},
+		},
+		{
+			name: "nested include, and a softfail range that does not match the include",
+			ip:   "198.51.100.200",
+			expected: []covered{
+				{"ip4:198.51.100.0/24", []string{"include:_spf.vendor.example", "include:_netblocks.vendor.example"}, "198.51.100.0/24", ResultPass},
+				{"~ip4:198.51.100.128/25", []string{"include:_spf.vendor.example"}, "198.51.100.128/25", ""},
+				{"~all", nil, "0.0.0.0/0", ResultSoftFail},
+			},
+		},
+		{
+			name: "a and mx terms with CIDR lengths",
+			ip:   "203.0.113.10",
+			expected: []covered{
+				{"a:mail.example.com/28", nil, "203.0.113.0/28", ResultPass},
+				{"mx", nil, "203.0.113.10/32", ResultPass},
+				{"~all", nil, "0.0.0.0/0", ResultSoftFail},
+			},
+		},
+		{
+			name: "IPv6 address",
+			ip:   "2001:db8::1",
+			expected: []covered{
+				{"ip6:2001:db8::/32", []string{"include:_spf.vendor.example", "include:_netblocks.vendor.example"}, "2001:db8::/32", ResultPass},
+				{"~all", nil, "::/0", ResultSoftFail},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			explanation, err := ExplainIP(context.Background(), provider, "example.com", netip.MustParseAddr(tc.ip))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got []covered
+			for _, c := range explanation.Coverage {
+				got = append(got, covered{c.Term, c.Path, c.Prefix.String(), c.Result})
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected coverage %+v, got %+v", tc.expected, got)
+			}
+			if len(explanation.Notes) != 1 {
+				t.Errorf("Expected the exists term to be noted, got %v", explanation.Notes)
+			}
+		})
+	}
+}
+
+func TestExplainIPWithRecords_ChainRecords(t *testing.T) {
+	records := map[string]string{
+		"example.com":      "v=spf1 include:spf1.example.com include:spf2.example.com -all",
+		"spf1.example.com": "v=spf1 ip4:192.0.2.0/25 -all",
+		"spf2.example.com": "v=spf1 ip4:192.0.2.128/25 ip4:192.0.2.200 -all",
+	}
+	explanation, err := ExplainIPWithRecords(context.Background(), &mockDNSProvider{}, "example.com", netip.MustParseAddr("192.0.2.200"), records)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var terms []string
+	for _, c := range explanation.Coverage {
+		terms = append(terms, c.Domain+" "+c.Term)
+	}
+	expected := []string{"spf2.example.com ip4:192.0.2.128/25", "spf2.example.com ip4:192.0.2.200", "example.com -all"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("Expected %v, got %v", expected, terms)
+	}
+}
@@ -0,0 +1,302 @@
+package spf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsFixtureVersion is the version of the fixture file format.
+const dnsFixtureVersion = 1
+
+// dnsFixture is the contents of a DNS fixture file: every answer of a recorded run,
+// keyed by query ("TXT example.com"), and the published records read for each domain.
+type dnsFixture struct {
+	Version    int                          `json:"version"`
+	RecordedAt time.Time                    `json:"recorded_at"`
+	Queries    map[string]fixtureAnswer     `json:"queries"`
+	Published  map[string][]PublishedRecord `json:"published,omitempty"`
+}
+
+// fixtureAnswer is one recorded answer.
+type fixtureAnswer struct {
+	TXT      []string      `json:"txt,omitempty"`
+	IPs      []string      `json:"ips,omitempty"` // A and AAAA answers
+	MX       []diskCacheMX `json:"mx,omitempty"`
+	PTR      []string      `json:"ptr,omitempty"`
+	NotFound bool          `json:"not_found,omitempty"` // The lookup failed with NXDOMAIN or NODATA
+	Error    string        `json:"error,omitempty"`     // Any other lookup failure
+	TTL      uint32        `json:"ttl,omitempty"`       // TTL reported by the recorded provider
+	DNSSEC   DNSSECStatus  `json:"dnssec,omitempty"`    // Validation status reported by the recorded provider
+}
+
+// PublishedRecord is a TXT record read from a domain's DNS provider (such as the
+// Porkbun API) rather than resolved.
+type PublishedRecord struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// RecordingDNSProvider wraps a DNSProvider and records every answer it returns, with
+// its TTL and DNSSEC status, to a fixture file that ReplayDNSProvider serves. Only the
+// first answer to each query is kept. Close writes the fixture file.
+type RecordingDNSProvider struct {
+	inner   DNSProvider
+	path    string
+	mu      sync.Mutex
+	fixture dnsFixture
+}
+
+// NewRecordingDNSProvider records the answers of inner to the fixture file at path.
+func NewRecordingDNSProvider(inner DNSProvider, path string) *RecordingDNSProvider {
+	return &RecordingDNSProvider{
+		inner: inner,
+		path:  path,
+		fixture: dnsFixture{
+			Version:    dnsFixtureVersion,
+			RecordedAt: time.Now().UTC(),
+			Queries:    make(map[string]fixtureAnswer),
+			Published:  make(map[string][]PublishedRecord),
+		},
+	}
+}
+
+// Path returns the fixture file.
+func (r *RecordingDNSProvider) Path() string {
+	return r.path
+}
+
+func (r *RecordingDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	records, err := r.inner.LookupTXT(ctx, domain)
+	r.record(domain, dns.TypeTXT, fixtureAnswer{TXT: records}, err)
+	return records, err
+}
+
+func (r *RecordingDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	ips, err := r.inner.LookupIP(ctx, domain)
+	var answer fixtureAnswer
+	for _, ip := range ips {
+		answer.IPs = append(answer.IPs, ip.String())
+	}
+	r.record(domain, dns.TypeA, answer, err)
+	return ips, err
+}
+
+func (r *RecordingDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	mxs, err := r.inner.LookupMX(ctx, domain)
+	var answer fixtureAnswer
+	for _, mx := range mxs {
+		answer.MX = append(answer.MX, diskCacheMX{Host: mx.Host, Pref: mx.Pref})
+	}
+	r.record(domain, dns.TypeMX, answer, err)
+	return mxs, err
+}
+
+// LookupAddr records the PTR names of addr, keyed as "PTR <addr>".
+func (r *RecordingDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	resolver, ok := r.inner.(AddrLookupProvider)
+	if !ok {
+		return nil, errors.New("PTR lookups are not supported by the DNS provider")
+	}
+	names, err := resolver.LookupAddr(ctx, addr)
+	r.record(addr, dns.TypePTR, fixtureAnswer{PTR: names}, err)
+	return names, err
+}
+
+// RecordPublished records the TXT records published for domain, which a replayed run
+// uses instead of reading them from the domain's DNS provider.
+func (r *RecordingDNSProvider) RecordPublished(domain string, records []PublishedRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fixture.Published[newCacheKey(domain, 0).name] = append([]PublishedRecord{}, records...)
+}
+
+// AnswerTTL implements TTLReporter with the wrapped provider's TTLs.
+func (r *RecordingDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	return answerTTL(r.inner, name, qtype)
+}
+
+// DNSSECStatus implements DNSSECReporter with the wrapped provider's statuses.
+func (r *RecordingDNSProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	return dnssecStatus(r.inner, name, qtype)
+}
+
+// Unwrap returns the wrapped provider.
+func (r *RecordingDNSProvider) Unwrap() DNSProvider {
+	return r.inner
+}
+
+// Close writes the fixture file and closes the wrapped provider.
+func (r *RecordingDNSProvider) Close() error {
+	saveErr := r.Save()
+	if err := r.inner.Close(); err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// Save writes the answers recorded so far to the fixture file, replacing it atomically.
+func (r *RecordingDNSProvider) Save() error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r.fixture, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode DNS fixture: %w", err)
+	}
+	if err := writeFileAtomic(r.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write DNS fixture %s: %w", r.path, err)
+	}
+	return nil
+}
+
+// record stores the answer to a query unless one was recorded already.
+func (r *RecordingDNSProvider) record(name string, qtype uint16, answer fixtureAnswer, err error) {
+	switch {
+	case isVoidLookup(err):
+		answer = fixtureAnswer{NotFound: true}
+	case err != nil:
+		answer = fixtureAnswer{Error: err.Error()}
+	}
+	answer.TTL, _ = answerTTL(r.inner, name, qtype)
+	answer.DNSSEC, _ = dnssecStatus(r.inner, name, qtype)
+	key := newCacheKey(name, qtype).String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.fixture.Queries[key]; !ok {
+		r.fixture.Queries[key] = answer
+	}
+}
+
+// ReplayDNSProvider answers only from a fixture file written by RecordingDNSProvider,
+// repeating the recorded answers, failures, TTLs and DNSSEC statuses. Queries that
+// were not recorded fail, so a replayed run cannot silently diverge from the recording.
+type ReplayDNSProvider struct {
+	path    string
+	fixture dnsFixture
+}
+
+// NewReplayDNSProvider loads the fixture file at path.
+func NewReplayDNSProvider(path string) (*ReplayDNSProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS fixture: %w", err)
+	}
+	var fixture dnsFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS fixture %s: %w", path, err)
+	}
+	if fixture.Version != dnsFixtureVersion {
+		return nil, fmt.Errorf("unsupported DNS fixture version %d in %s", fixture.Version, path)
+	}
+	return &ReplayDNSProvider{path: path, fixture: fixture}, nil
+}
+
+// RecordedAt returns when the fixture was recorded.
+func (r *ReplayDNSProvider) RecordedAt() time.Time {
+	return r.fixture.RecordedAt
+}
+
+// Published returns the TXT records recorded as published for domain.
+func (r *ReplayDNSProvider) Published(domain string) ([]PublishedRecord, bool) {
+	records, ok := r.fixture.Published[newCacheKey(domain, 0).name]
+	return records, ok
+}
+
+func (r *ReplayDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	answer, err := r.answer(domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), answer.TXT...), nil
+}
+
+func (r *ReplayDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	answer, err := r.answer(domain, dns.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, s := range answer.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func (r *ReplayDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	answer, err := r.answer(domain, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	for _, mx := range answer.MX {
+		mxs = append(mxs, &net.MX{Host: mx.Host, Pref: mx.Pref})
+	}
+	return mxs, nil
+}
+
+func (r *ReplayDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	answer, err := r.answer(addr, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), answer.PTR...), nil
+}
+
+// AnswerTTL implements TTLReporter with the recorded TTLs.
+func (r *ReplayDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	answer, ok := r.fixture.Queries[newCacheKey(name, qtype).String()]
+	return answer.TTL, ok && answer.TTL > 0
+}
+
+// DNSSECStatus implements DNSSECReporter with the recorded statuses.
+func (r *ReplayDNSProvider) DNSSECStatus(name string, qtype uint16) (DNSSECStatus, bool) {
+	answer, ok := r.fixture.Queries[newCacheKey(name, qtype).String()]
+	return answer.DNSSEC, ok && answer.DNSSEC != ""
+}
+
+func (r *ReplayDNSProvider) Close() error {
+	return nil
+}
+
+// answer returns the recorded answer to a query, or the recorded failure.
+func (r *ReplayDNSProvider) answer(name string, qtype uint16) (fixtureAnswer, error) {
+	key := newCacheKey(name, qtype)
+	answer, ok := r.fixture.Queries[key.String()]
+	switch {
+	case !ok:
+		return answer, fmt.Errorf("unexpected DNS query %s: not recorded in %s", key, r.path)
+	case answer.NotFound:
+		return answer, &net.DNSError{Err: "no such host (replayed)", Name: key.name, IsNotFound: true}
+	case answer.Error != "":
+		return answer, errors.New(answer.Error)
+	}
+	return answer, nil
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see a partly
+// written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
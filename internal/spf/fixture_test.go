@@ -0,0 +1,101 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordAndReplayDNSProvider(t *testing.T) {
+	inner := &countingDNSProvider{
+		mockDNSProvider: mockDNSProvider{
+			Records: map[string][]string{
+				"example.com":         {"v=spf1 include:_spf.vendor.example mx a:broken.example -all"},
+				"_spf.vendor.example": {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+			},
+			IPs: map[string][]net.IP{"mail.example.com": {net.ParseIP("198.51.100.25")}},
+			MXs: map[string][]*net.MX{"example.com": {{Host: "mail.example.com", Pref: 10}}},
+		},
+		TTLs:    map[string]uint32{"_spf.vendor.example": 300},
+		Missing: map[string]bool{"gone.example": true},
+	}
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	ctx := context.Background()
+	opts := FlattenOptions{ForceFlatten: true}
+
+	recorder := NewRecordingDNSProvider(inner, path)
+	recorded, err := FlattenSPFWithOptions(ctx, "example.com", NewCachingDNSProvider(recorder), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := recorder.LookupTXT(ctx, "gone.example"); !isVoidLookup(err) {
+		t.Fatalf("Expected NXDOMAIN, got %v", err)
+	}
+	published := []PublishedRecord{{Name: "example.com", Content: "v=spf1 ip4:192.0.2.0/24 -all"}}
+	recorder.RecordPublished("Example.com", published)
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+
+	replay, err := NewReplayDNSProvider(path)
+	if err != nil {
+		t.Fatalf("Failed to load fixture: %v", err)
+	}
+	replayed, err := FlattenSPFWithOptions(ctx, "example.com", NewCachingDNSProvider(replay), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error on replay: %v", err)
+	}
+	if replayed.Original != recorded.Original || replayed.Flattened != recorded.Flattened {
+		t.Errorf("Replay differs from the recording:\n recorded %q\n replayed %q", recorded.Flattened, replayed.Flattened)
+	}
+	if fmt.Sprint(replayed.FailedTerms) != fmt.Sprint(recorded.FailedTerms) || len(replayed.FailedTerms) != 1 {
+		t.Errorf("Expected the recorded failure to replay, got %+v (recorded %+v)", replayed.FailedTerms, recorded.FailedTerms)
+	}
+	if !reflect.DeepEqual(replayed.TermTTLs, recorded.TermTTLs) {
+		t.Errorf("Expected the recorded TTLs to replay, got %v (recorded %v)", replayed.TermTTLs, recorded.TermTTLs)
+	}
+
+	if ttl, ok := replay.AnswerTTL("_spf.vendor.example", dns.TypeTXT); !ok || ttl != 300 {
+		t.Errorf("Expected the recorded TTL 300, got %d, %v", ttl, ok)
+	}
+	if records, ok := replay.Published("example.com"); !ok || !reflect.DeepEqual(records, published) {
+		t.Errorf("Expected the recorded published records, got %v, %v", records, ok)
+	}
+	if _, err := replay.LookupTXT(ctx, "unrecorded.example"); err == nil || isVoidLookup(err) || !strings.Contains(err.Error(), "unexpected DNS query TXT unrecorded.example") {
+		t.Errorf("Expected an unrecorded query to fail, got %v", err)
+	}
+	if _, err := replay.LookupTXT(ctx, "gone.example"); !isVoidLookup(err) {
+		t.Errorf("Expected the recorded NXDOMAIN, got %v", err)
+	}
+}
+
+func TestNewReplayDNSProvider_Errors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"invalid.json":  "not json",
+		"version.json":  `{"version": 99, "queries": {}}`,
+		"missing.json":  "",
+		"empty-ok.json": `{"version": 1, "queries": {}}`,
+	}
+	for name, content := range files {
+		if name == "missing.json" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name := range files {
+		_, err := NewReplayDNSProvider(filepath.Join(dir, name))
+		if expectErr := name != "empty-ok.json"; (err != nil) != expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, expectErr, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package spf
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// IPSet is a set of IPv4 and IPv6 addresses stored as sorted, non-overlapping
+// address ranges. It is used to compare the address space authorized by different
+// SPF records independently of how the ranges are written.
+type IPSet struct {
+	ranges []ipRange // sorted by lo; IPv4 ranges sort before IPv6 ranges
+}
+
+type ipRange struct {
+	lo, hi netip.Addr
+}
+
+// allAddresses returns the set containing every IPv4 and IPv6 address.
+func allAddresses() *IPSet {
+	s := &IPSet{}
+	s.AddPrefix(netip.MustParsePrefix("0.0.0.0/0"))
+	s.AddPrefix(netip.MustParsePrefix("::/0"))
+	return s
+}
+
+// AddPrefix adds every address of p to the set.
+func (s *IPSet) AddPrefix(p netip.Prefix) {
+	p = p.Masked()
+	s.ranges = normalizeRanges(append(s.ranges, ipRange{lo: p.Addr(), hi: lastAddr(p)}))
+}
+
+// Contains reports whether addr is in the set.
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].hi.Compare(addr) >= 0
+	})
+	return i < len(s.ranges) && s.ranges[i].lo.Compare(addr) <= 0
+}
+
+// Overlaps reports whether any address of p is in the set.
+func (s *IPSet) Overlaps(p netip.Prefix) bool {
+	p = p.Masked()
+	lo, hi := p.Addr(), lastAddr(p)
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].hi.Compare(lo) >= 0
+	})
+	return i < len(s.ranges) && s.ranges[i].lo.Compare(hi) <= 0
+}
+
+// IsEmpty reports whether the set contains no addresses.
+func (s *IPSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+// Union returns the addresses in s or o.
+func (s *IPSet) Union(o *IPSet) *IPSet {
+	merged := make([]ipRange, 0, len(s.ranges)+len(o.ranges))
+	merged = append(merged, s.ranges...)
+	merged = append(merged, o.ranges...)
+	return &IPSet{ranges: normalizeRanges(merged)}
+}
+
+// Difference returns the addresses in s that are not in o.
+func (s *IPSet) Difference(o *IPSet) *IPSet {
+	var result []ipRange
+	j := 0
+	for _, r := range s.ranges {
+		lo := r.lo
+		for ; j < len(o.ranges) && o.ranges[j].hi.Compare(lo) < 0; j++ {
+		}
+		k := j
+		for ; k < len(o.ranges) && o.ranges[k].lo.Compare(r.hi) <= 0; k++ {
+			cut := o.ranges[k]
+			if cut.lo.Compare(lo) > 0 {
+				result = append(result, ipRange{lo: lo, hi: cut.lo.Prev()})
+			}
+			if cut.hi.Compare(r.hi) >= 0 {
+				lo = netip.Addr{}
+				break
+			}
+			lo = cut.hi.Next()
+		}
+		if lo.IsValid() && lo.Compare(r.hi) <= 0 {
+			result = append(result, ipRange{lo: lo, hi: r.hi})
+		}
+	}
+	return &IPSet{ranges: result}
+}
+
+// Prefixes returns the smallest list of CIDR prefixes covering exactly the set.
+func (s *IPSet) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range s.ranges {
+		lo := r.lo
+		for {
+			p := largestPrefix(lo, r.hi)
+			prefixes = append(prefixes, p)
+			last := lastAddr(p)
+			if last == r.hi {
+				break
+			}
+			lo = last.Next()
+		}
+	}
+	return prefixes
+}
+
+// largestPrefix returns the largest prefix starting at lo that ends at or before hi.
+func largestPrefix(lo, hi netip.Addr) netip.Prefix {
+	for bits := 0; bits < lo.BitLen(); bits++ {
+		p := netip.PrefixFrom(lo, bits).Masked()
+		if p.Addr() == lo && lastAddr(p).Compare(hi) <= 0 {
+			return p
+		}
+	}
+	return netip.PrefixFrom(lo, lo.BitLen())
+}
+
+// lastAddr returns the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	addr := p.Masked().Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		setHostBits(b[:], p.Bits())
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	setHostBits(b[:], p.Bits())
+	return netip.AddrFrom16(b)
+}
+
+func setHostBits(b []byte, bits int) {
+	for i := range b {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			b[i] |= 0xff >> bits
+			bits = 0
+		default:
+			b[i] = 0xff
+		}
+	}
+}
+
+// normalizeRanges sorts ranges and merges overlapping and adjacent ones.
+func normalizeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].lo.Compare(ranges[j].lo) < 0
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		next := last.hi.Next()
+		if r.lo.Compare(last.hi) <= 0 || (next.IsValid() && next == r.lo) {
+			if r.hi.Compare(last.hi) > 0 {
+				last.hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,87 @@
+package spf
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixSet(prefixes ...string) *IPSet {
+	s := &IPSet{}
+	for _, p := range prefixes {
+		s.AddPrefix(netip.MustParsePrefix(p))
+	}
+	return s
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var out []string
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func TestIPSet_Prefixes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		set      *IPSet
+		expected []string
+	}{
+		{"adjacent ranges merge", prefixSet("192.0.2.0/25", "192.0.2.128/25"), []string{"192.0.2.0/24"}},
+		{"overlapping ranges merge", prefixSet("192.0.2.0/24", "192.0.2.7/32"), []string{"192.0.2.0/24"}},
+		{"unaligned host bits are masked", prefixSet("192.0.2.77/24"), []string{"192.0.2.0/24"}},
+		{"IPv4 sorts before IPv6", prefixSet("2001:db8::/32", "10.0.0.0/8"), []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"IPv4 and IPv6 never merge", prefixSet("255.255.255.255/32", "::/128"), []string{"255.255.255.255/32", "::/128"}},
+		{"empty", &IPSet{}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := prefixStrings(tc.set.Prefixes())
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIPSet_Difference(t *testing.T) {
+	testCases := []struct {
+		name     string
+		a, b     *IPSet
+		expected []string
+	}{
+		{"hole in the middle", prefixSet("192.0.2.0/24"), prefixSet("192.0.2.64/26"), []string{"192.0.2.0/26", "192.0.2.128/25"}},
+		{"remove everything", prefixSet("192.0.2.0/24"), prefixSet("192.0.0.0/16"), nil},
+		{"disjoint", prefixSet("192.0.2.0/24"), prefixSet("198.51.100.0/24"), []string{"192.0.2.0/24"}},
+		{"several cuts", prefixSet("10.0.0.0/29"), prefixSet("10.0.0.1/32", "10.0.0.6/32"), []string{"10.0.0.0/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.7/32"}},
+		{"cut at the end of the address space", prefixSet("255.255.255.0/24"), prefixSet("255.255.255.255/32"), []string{"255.255.255.0/25", "255.255.255.128/26", "255.255.255.192/27", "255.255.255.224/28", "255.255.255.240/29", "255.255.255.248/30", "255.255.255.252/31", "255.255.255.254/32"}},
+		{"IPv6", prefixSet("2001:db8::/32"), prefixSet("2001:db8:8000::/33"), []string{"2001:db8::/33"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := prefixStrings(tc.a.Difference(tc.b).Prefixes())
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIPSet_Contains(t *testing.T) {
+	set := prefixSet("192.0.2.0/24", "2001:db8::/32")
+	for addr, expected := range map[string]bool{
+		"192.0.2.0":        true,
+		"192.0.2.255":      true,
+		"192.0.3.0":        false,
+		"::ffff:192.0.2.1": true,
+		"2001:db8::1":      true,
+		"2001:db9::":       false,
+	} {
+		if got := set.Contains(netip.MustParseAddr(addr)); got != expected {
+			t.Errorf("Contains(%s) = %v, expected %v", addr, got, expected)
+		}
+	}
+}
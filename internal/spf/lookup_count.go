@@ -0,0 +1,269 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Processing limits from RFC 7208 section 4.6.4. Exceeding any of them makes
+// check_host() return permerror.
+const (
+	MaxDNSLookups  = 10 // Terms causing DNS queries: include, a, mx, ptr, exists and redirect
+	MaxVoidLookups = 2  // DNS queries returning no records (NXDOMAIN or an empty answer)
+	MaxMXHosts     = 10 // MX hosts looked up for a single mx mechanism
+)
+
+// TermLookup describes the DNS lookup caused by a single term. Every entry counts
+// as one lookup against MaxDNSLookups.
+type TermLookup struct {
+	Domain     string // Domain whose record contains the term
+	Term       string // The term as written, e.g. "include:_spf.example.com"
+	Depth      int    // Include/redirect nesting depth; 0 for the domain's own record
+	MXHosts    int    // Number of MX hosts returned for an mx term
+	Void       bool   // The lookup returned no records
+	Unresolved bool   // The target depends on the sender or client address and was not looked up
+	Err        string // Non-void lookup failure, if any
+}
+
+// LookupReport is a structured breakdown of the DNS lookups needed to evaluate a
+// domain's SPF record, following every reachable include and redirect.
+type LookupReport struct {
+	Domain      string
+	Terms       []TermLookup // Lookup-costing terms in evaluation order, including nested ones
+	Total       int          // Number of lookups counted against MaxDNSLookups
+	VoidLookups int          // Number of lookups returning no records
+	PermErrors  []string     // Conditions that make evaluation of the record a permerror
+}
+
+// ExceedsLimits reports whether evaluating the record breaks any RFC 7208 processing
+// limit (lookups, void lookups or MX hosts), which flattening can resolve.
+func (r *LookupReport) ExceedsLimits() bool {
+	if r.Total > MaxDNSLookups || r.VoidLookups > MaxVoidLookups {
+		return true
+	}
+	for _, t := range r.Terms {
+		if t.MXHosts > MaxMXHosts {
+			return true
+		}
+	}
+	return false
+}
+
+// AnalyzeDNSLookups counts the DNS lookups required to evaluate the SPF record of
+// domain as specified by RFC 7208 section 4.6.4.
+//
+// Each include, a, mx, ptr and exists mechanism and an applicable redirect= costs one
+// lookup; all, ip4 and ip6 cost none. Duplicates are counted each time they are reached,
+// and terms after an all mechanism are never evaluated so they are not counted. Terms
+// using macros are counted but cannot be followed without a sender. The initial TXT
+// lookup for domain is not part of the count.
+func AnalyzeDNSLookups(ctx context.Context, domain string, dns DNSProvider) (*LookupReport, error) {
+	report := &LookupReport{Domain: domain}
+
+	records, err := dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
+	}
+
+	spfRecord := findSPFRecord(records)
+	if spfRecord == "" {
+		return report, nil
+	}
+
+	counter := &lookupCounter{dns: dns, report: report}
+	if err := counter.countMechanisms(ctx, spfRecord, domain, 0); err != nil {
+		return nil, err
+	}
+
+	report.Total = len(report.Terms)
+	if report.Total > MaxDNSLookups {
+		report.PermErrors = append(report.PermErrors, fmt.Sprintf("%d DNS lookups exceed the limit of %d", report.Total, MaxDNSLookups))
+	}
+	if report.VoidLookups > MaxVoidLookups {
+		report.PermErrors = append(report.PermErrors, fmt.Sprintf("%d void lookups exceed the limit of %d", report.VoidLookups, MaxVoidLookups))
+	}
+	return report, nil
+}
+
+// CountDNSLookups counts the total number of DNS lookups required to resolve an SPF record.
+// This includes the initial TXT lookup for the domain plus every lookup counted by
+// AnalyzeDNSLookups, counting duplicates as separate lookups since some mail servers
+// don't implement proper caching.
+func CountDNSLookups(ctx context.Context, domain string, dns DNSProvider) (int, error) {
+	report, err := AnalyzeDNSLookups(ctx, domain, dns)
+	if err != nil {
+		return 0, err
+	}
+	return report.Total + 1, nil
+}
+
+type lookupCounter struct {
+	dns      DNSProvider
+	report   *LookupReport
+	dnsCache sync.Map
+}
+
+func (c *lookupCounter) countMechanisms(ctx context.Context, record string, currentDomain string, depth int) error {
+	const maxDepth = 10
+	if depth > maxDepth {
+		return fmt.Errorf("recursion depth exceeded for %s", currentDomain)
+	}
+
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return fmt.Errorf("failed to parse SPF record for %s: %w", currentDomain, err)
+	}
+
+	for _, term := range parsed.Mechanisms() {
+		if term.Kind == KindAll {
+			return nil // terms after "all" and redirect= are never evaluated
+		}
+		if term.Kind == KindIP4 || term.Kind == KindIP6 {
+			continue // ip4: and ip6: don't require DNS lookups
+		}
+
+		entry := TermLookup{Domain: currentDomain, Term: term.String(), Depth: depth}
+		if term.HasMacros() {
+			entry.Unresolved = true
+			c.addLookup(entry)
+			continue
+		}
+
+		switch term.Kind {
+		case KindInclude:
+			c.addLookup(entry)
+			if err := c.follow(ctx, term, depth); err != nil {
+				return err
+			}
+		case KindA:
+			ips, err := c.dns.LookupIP(ctx, targetDomain(term, currentDomain))
+			c.recordResult(&entry, len(ips), err)
+			c.addLookup(entry)
+		case KindExists:
+			// exists only queries A records (RFC 7208 section 5.7), so AAAA answers
+			// don't keep the lookup from being void.
+			ips, err := c.dns.LookupIP(ctx, targetDomain(term, currentDomain))
+			ipv4 := 0
+			for _, ip := range ips {
+				if ip.To4() != nil {
+					ipv4++
+				}
+			}
+			c.recordResult(&entry, ipv4, err)
+			c.addLookup(entry)
+		case KindMX:
+			mxs, err := c.dns.LookupMX(ctx, targetDomain(term, currentDomain))
+			c.recordResult(&entry, len(mxs), err)
+			entry.MXHosts = len(mxs)
+			if entry.MXHosts > MaxMXHosts {
+				c.report.PermErrors = append(c.report.PermErrors, fmt.Sprintf("%s in %s returns %d MX hosts, more than the limit of %d", term, currentDomain, entry.MXHosts, MaxMXHosts))
+			}
+			c.addLookup(entry)
+		case KindPTR:
+			// ptr queries depend on the client address, so only its cost is known.
+			entry.Unresolved = true
+			c.addLookup(entry)
+		}
+	}
+
+	// redirect= is only used when the record has no "all" mechanism (RFC 7208 section 6.1)
+	if redirect, ok := parsed.Redirect(); ok {
+		entry := TermLookup{Domain: currentDomain, Term: redirect.String(), Depth: depth}
+		if redirect.HasMacros() {
+			entry.Unresolved = true
+			c.addLookup(entry)
+			return nil
+		}
+		c.addLookup(entry)
+		return c.follow(ctx, redirect, depth)
+	}
+	return nil
+}
+
+func (c *lookupCounter) addLookup(entry TermLookup) {
+	c.report.Terms = append(c.report.Terms, entry)
+	if entry.Void {
+		c.report.VoidLookups++
+	}
+}
+
+// recordResult marks entry as void when the lookup found nothing, or records the error.
+func (c *lookupCounter) recordResult(entry *TermLookup, answers int, err error) {
+	switch {
+	case isVoidLookup(err), err == nil && answers == 0:
+		entry.Void = true
+	case err != nil:
+		entry.Err = err.Error()
+	}
+}
+
+// follow fetches the record targeted by an include or redirect term and counts it.
+// A target without an SPF record is a permerror (RFC 7208 sections 5.2 and 6.1).
+func (c *lookupCounter) follow(ctx context.Context, term Term, depth int) error {
+	target := term.DomainSpec
+	records, err := c.lookupTXT(ctx, target)
+	if err != nil && !isVoidLookup(err) {
+		if term.Kind == KindRedirect {
+			return fmt.Errorf("failed to lookup redirected SPF for %s: %v", target, err)
+		}
+		return fmt.Errorf("failed to lookup included SPF for %s: %v", target, err)
+	}
+
+	if len(records) == 0 {
+		last := &c.report.Terms[len(c.report.Terms)-1]
+		last.Void = true
+		c.report.VoidLookups++
+	}
+	rec := findSPFRecord(records)
+	if rec == "" {
+		c.report.PermErrors = append(c.report.PermErrors, fmt.Sprintf("%s: %s has no SPF record", term, target))
+		return nil
+	}
+	return c.countMechanisms(ctx, rec, target, depth+1)
+}
+
+func (c *lookupCounter) lookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if cached, ok := c.dnsCache.Load(domain); ok {
+		return cached.([]string), nil
+	}
+	recs, err := c.dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	c.dnsCache.Store(domain, recs)
+	return recs, nil
+}
+
+// isVoidLookup reports whether a lookup error means the name has no records
+// (NXDOMAIN or no data), which RFC 7208 counts as a void lookup.
+func isVoidLookup(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// CountRecordLookups returns the number of DNS-querying terms in a single record,
+// without following any of them: include, a, mx, ptr and exists mechanisms before the
+// all mechanism, plus redirect= when the record has none. Unparseable records count
+// as zero.
+func CountRecordLookups(record string) int {
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, term := range parsed.Mechanisms() {
+		switch term.Kind {
+		case KindAll:
+			return count // terms after "all" and redirect= are never evaluated
+		case KindInclude, KindA, KindMX, KindPTR, KindExists:
+			count++
+		}
+	}
+	if _, ok := parsed.Redirect(); ok {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,218 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements SPF macro expansion as defined in RFC 7208 section 7.
+// Macros can only be expanded once the connecting client is known, so the
+// flattener keeps macro terms verbatim; expansion is used when evaluating a
+// record for a specific sender, IP address and HELO name.
+
+// maxExpandedDomainLength is the longest domain name a macro expansion may produce.
+// Longer expansions are truncated from the left (RFC 7208 section 7.3).
+const maxExpandedDomainLength = 253
+
+// MacroContext holds the values SPF macros expand to for one check_host() call.
+type MacroContext struct {
+	Sender          string    // <sender>: the MAIL FROM address, or empty to use "postmaster@" + HELO
+	Domain          string    // <domain>: the domain whose record is being evaluated (%{d})
+	IP              net.IP    // <ip>: the connecting client's address (%{i}, %{v}, %{c})
+	HELO            string    // HELO/EHLO name given by the client (%{h})
+	ValidatedDomain string    // Validated domain name of IP (%{p}); "unknown" when empty
+	Receiver        string    // Receiving host's domain name (%{r}); "unknown" when empty
+	Now             time.Time // Current time (%{t}); time.Now() when zero
+}
+
+// ExpandDomainSpec expands the macros in a domain-spec, as used by include:, a:, mx:,
+// ptr:, exists:, redirect= and exp=. The c, r and t macros are not permitted. Results
+// longer than 253 characters are shortened by removing labels from the left.
+func (m *MacroContext) ExpandDomainSpec(spec string) (string, error) {
+	expanded, err := m.expand(spec, false)
+	if err != nil {
+		return "", err
+	}
+	for len(expanded) > maxExpandedDomainLength {
+		i := strings.IndexByte(expanded, '.')
+		if i < 0 {
+			return "", fmt.Errorf("macro expansion of %q is too long", spec)
+		}
+		expanded = expanded[i+1:]
+	}
+	return expanded, nil
+}
+
+// ExpandExplanation expands the macros in an explanation string fetched through exp=.
+// All macro letters, including c, r and t, are permitted.
+func (m *MacroContext) ExpandExplanation(text string) (string, error) {
+	return m.expand(text, true)
+}
+
+func (m *MacroContext) expand(s string, allowExpLetters bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("unterminated macro in %q", s)
+		}
+		switch s[i+1] {
+		case '%':
+			b.WriteByte('%')
+			i++
+			continue
+		case '_':
+			b.WriteByte(' ')
+			i++
+			continue
+		case '-':
+			b.WriteString("%20")
+			i++
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro escape %q in %q", s[i:i+2], s)
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated macro in %q", s)
+		}
+		macro, err := parseMacroExpand(s[i+2:i+end], allowExpLetters)
+		if err != nil {
+			return "", fmt.Errorf("invalid macro in %q: %w", s, err)
+		}
+		value := macro.transform(m.letterValue(macro.letter | 0x20))
+		if macro.letter >= 'A' && macro.letter <= 'Z' {
+			value = urlEscape(value)
+		}
+		b.WriteString(value)
+		i += end
+	}
+	return b.String(), nil
+}
+
+// letterValue returns the unmodified value of a lower-case macro letter.
+func (m *MacroContext) letterValue(letter byte) string {
+	switch letter {
+	case 's':
+		local, domain := m.senderParts()
+		return local + "@" + domain
+	case 'l':
+		local, _ := m.senderParts()
+		return local
+	case 'o':
+		_, domain := m.senderParts()
+		return domain
+	case 'd':
+		return m.Domain
+	case 'i':
+		return dottedIP(m.IP)
+	case 'p':
+		if m.ValidatedDomain == "" {
+			return "unknown"
+		}
+		return m.ValidatedDomain
+	case 'v':
+		if m.IP.To4() != nil {
+			return "in-addr"
+		}
+		return "ip6"
+	case 'h':
+		return m.HELO
+	case 'c':
+		if m.IP == nil {
+			return ""
+		}
+		return m.IP.String()
+	case 'r':
+		if m.Receiver == "" {
+			return "unknown"
+		}
+		return m.Receiver
+	case 't':
+		now := m.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		return strconv.FormatInt(now.Unix(), 10)
+	}
+	return ""
+}
+
+// senderParts splits <sender> into its local-part and domain. A missing sender
+// becomes "postmaster@<HELO>" and a missing local-part becomes "postmaster"
+// (RFC 7208 section 4.3).
+func (m *MacroContext) senderParts() (string, string) {
+	if m.Sender == "" {
+		return "postmaster", m.HELO
+	}
+	at := strings.LastIndexByte(m.Sender, '@')
+	if at < 0 {
+		return "postmaster", m.Sender
+	}
+	local := m.Sender[:at]
+	if local == "" {
+		local = "postmaster"
+	}
+	return local, m.Sender[at+1:]
+}
+
+// transform applies the macro's delimiters, reversal and digit transformers.
+func (macro macroExpand) transform(value string) string {
+	delimiters := macro.delimiters
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if macro.reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if macro.digits > 0 && macro.digits < len(parts) {
+		parts = parts[len(parts)-macro.digits:]
+	}
+	return strings.Join(parts, ".")
+}
+
+// dottedIP formats an address for the %{i} macro: dotted-quad for IPv4 and
+// dot-separated nibbles for IPv6.
+func dottedIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hexDigits[b>>4]), string(hexDigits[b&0x0f]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// urlEscape escapes every character outside the RFC 3986 unreserved set, as
+// required for upper-case macro letters.
+func urlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package spf
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandDomainSpec_RFCExamples(t *testing.T) {
+	// Examples from RFC 7208 section 7.4
+	ctx := &MacroContext{
+		Sender: "strong-bad@email.example.com",
+		Domain: "email.example.com",
+		IP:     net.ParseIP("192.0.2.3"),
+	}
+
+	testCases := []struct {
+		spec     string
+		expected string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := ctx.ExpandDomainSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("ExpandDomainSpec(%q) returned error: %v", tc.spec, err)
+			}
+			if got != tc.expected {
+				t.Errorf("ExpandDomainSpec(%q) = %q, expected %q", tc.spec, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestExpandDomainSpec_IPv6(t *testing.T) {
+	ctx := &MacroContext{
+		Sender: "strong-bad@email.example.com",
+		Domain: "email.example.com",
+		IP:     net.ParseIP("2001:db8::cb01"),
+	}
+
+	got, err := ctx.ExpandDomainSpec("%{ir}.%{v}._spf.%{d2}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestExpandDomainSpec_SenderDefaults(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ctx      MacroContext
+		spec     string
+		expected string
+	}{
+		{"Empty sender uses HELO", MacroContext{HELO: "mx.example.org"}, "%{s}", "postmaster@mx.example.org"},
+		{"Missing local-part", MacroContext{Sender: "@example.org"}, "%{l}.%{o}", "postmaster.example.org"},
+		{"Validated domain defaults to unknown", MacroContext{}, "%{p}", "unknown"},
+		{"Validated domain", MacroContext{ValidatedDomain: "mail.example.org"}, "%{p2}", "example.org"},
+		{"HELO", MacroContext{HELO: "mx.example.org"}, "%{h}", "mx.example.org"},
+		{"Upper-case letters are URL-escaped", MacroContext{Sender: "user+tag@example.org"}, "%{L}", "user%2Btag"},
+		{"Escapes", MacroContext{}, "a%%b%_c%-d", "a%b c%20d"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.ctx.ExpandDomainSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpandDomainSpec_Errors(t *testing.T) {
+	ctx := &MacroContext{Domain: "example.com"}
+	for _, spec := range []string{"%{c}", "%{r}.example.com", "%{t}", "%{x}", "%{d", "%", "%a"} {
+		if _, err := ctx.ExpandDomainSpec(spec); err == nil {
+			t.Errorf("Expected error expanding %q", spec)
+		}
+	}
+}
+
+func TestExpandDomainSpec_Truncation(t *testing.T) {
+	ctx := &MacroContext{Sender: strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "@example.com", Domain: "example.com"}
+
+	got, err := ctx.ExpandDomainSpec("%{l}.%{l}.%{l}._spf.%{d}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got) > 253 {
+		t.Errorf("Expanded domain is %d characters, expected at most 253", len(got))
+	}
+	if !strings.HasSuffix(got, "._spf.example.com") || strings.HasPrefix(got, ".") {
+		t.Errorf("Expected whole labels removed from the left, got %q", got)
+	}
+}
+
+func TestExpandExplanation(t *testing.T) {
+	ctx := &MacroContext{
+		Sender:   "strong-bad@email.example.com",
+		Domain:   "email.example.com",
+		IP:       net.ParseIP("192.0.2.3"),
+		Receiver: "mx.example.net",
+		Now:      time.Unix(1700000000, 0),
+	}
+
+	got, err := ctx.ExpandExplanation("%{i} is not one of %{d}'s designated mail servers (checked by %{r} at %{t}, client %{c})")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "192.0.2.3 is not one of email.example.com's designated mail servers (checked by mx.example.net at 1700000000, client 192.0.2.3)"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
@@ -6,29 +6,43 @@ import (
 	"strings"
 )
 
-// isSPFMechanism checks if a given string part represents a valid SPF mechanism.
+// isSPFMechanism checks if a given string part represents a known SPF mechanism or modifier.
 //
-// This helper function identifies SPF mechanisms by their prefixes, supporting:
-//   - include: - Include another domain's SPF policy
-//   - a/a: - Authorize IPs that resolve from A records
-//   - mx/mx: - Authorize IPs that resolve from MX records
-//   - ip4:/ip6: - Explicitly authorize IPv4/IPv6 addresses
-//   - ptr - Reverse DNS mechanism (discouraged)
-//   - exists: - Test for existence of A record
-//   - redirect= - Redirect to another domain's SPF record
-//   - exp= - Explanation string for failures
+// Terms are classified by name using the SPF term grammar, so "all" is recognised as
+// the all mechanism rather than an "a" mechanism and qualified terms such as
+// "-include:example.com" or "?a" are recognised. Malformed arguments are tolerated
+// (e.g. "mx:"), which keeps normalization usable for comparing partially invalid records.
 //
-// Returns true if the part is a recognized SPF mechanism, false otherwise.
+// Returns true if the part is a recognized SPF mechanism, redirect= or exp=, false otherwise.
 func isSPFMechanism(part string) bool {
-	return strings.HasPrefix(part, "include:") ||
-		strings.HasPrefix(part, "a") ||
-		strings.HasPrefix(part, "mx") ||
-		strings.HasPrefix(part, "ip4:") ||
-		strings.HasPrefix(part, "ip6:") ||
-		strings.HasPrefix(part, "ptr") ||
-		strings.HasPrefix(part, "exists:") ||
-		strings.HasPrefix(part, "redirect=") ||
-		strings.HasPrefix(part, "exp=")
+	switch classifyTerm(part) {
+	case 0, KindUnknownModifier:
+		return false
+	}
+	return true
+}
+
+// isAllMechanism reports whether a raw term is an "all" mechanism with any qualifier.
+func isAllMechanism(part string) bool {
+	return classifyTerm(part) == KindAll
+}
+
+// recordTerms returns the terms of an SPF record after the version tag. Well-formed
+// records are serialized through the parser so equivalent spellings compare equal
+// (e.g. "+ip4:..." and "ip4:..."); malformed records fall back to the raw terms.
+func recordTerms(spfRecord string) []string {
+	if parsed, err := ParseRecord(spfRecord); err == nil {
+		terms := make([]string, 0, len(parsed.Terms))
+		for _, term := range parsed.Terms {
+			terms = append(terms, term.String())
+		}
+		return terms
+	}
+	var terms []string
+	for _, tok := range tokenize(spfRecord)[1:] {
+		terms = append(terms, tok.text)
+	}
+	return terms
 }
 
 // NormalizeSPF takes an SPF record string and returns a normalized version with
@@ -55,24 +69,22 @@ func isSPFMechanism(part string) bool {
 //	normalized, err := NormalizeSPF("v=spf1 mx a include:_spf.google.com ~all")
 //	// Result: "v=spf1 a include:_spf.google.com mx ~all"
 func NormalizeSPF(spfRecord string) (string, error) {
-	if !strings.HasPrefix(spfRecord, "v=spf1") {
-		return "", fmt.Errorf("invalid SPF record: must start with v=spf1")
-	}
-
-	parts := strings.Fields(spfRecord)
-	if len(parts) == 0 {
+	if strings.TrimSpace(spfRecord) == "" {
 		return "", fmt.Errorf("empty SPF record")
 	}
+	if !IsSPFRecord(spfRecord) {
+		return "", fmt.Errorf("invalid SPF record: must start with v=spf1")
+	}
 
 	// The first part is always "v=spf1"
-	normalizedParts := []string{parts[0]}
+	normalizedParts := []string{spfVersion}
 
 	// Separate the "all" mechanism
 	var allMechanism string
 	mechanisms := []string{}
 
-	for _, part := range parts[1:] {
-		if strings.HasSuffix(part, "all") { // Check for ~all, -all, +all, ?all
+	for _, part := range recordTerms(spfRecord) {
+		if isAllMechanism(part) { // Check for ~all, -all, +all, ?all
 			allMechanism = part
 		} else if isSPFMechanism(part) {
 			mechanisms = append(mechanisms, part)
@@ -98,16 +110,15 @@ func NormalizeSPF(spfRecord string) (string, error) {
 
 // ExtractMechanisms parses an SPF record and returns a sorted slice of mechanisms (excluding v=spf1 and all).
 func ExtractMechanisms(spfRecord string) ([]string, error) {
-	if !strings.HasPrefix(spfRecord, "v=spf1") {
-		return nil, fmt.Errorf("invalid SPF record: must start with v=spf1")
-	}
-	parts := strings.Fields(spfRecord)
-	if len(parts) == 0 {
+	if strings.TrimSpace(spfRecord) == "" {
 		return nil, fmt.Errorf("empty SPF record")
 	}
+	if !IsSPFRecord(spfRecord) {
+		return nil, fmt.Errorf("invalid SPF record: must start with v=spf1")
+	}
 	mechanisms := []string{}
-	for _, part := range parts[1:] {
-		if strings.HasSuffix(part, "all") {
+	for _, part := range recordTerms(spfRecord) {
+		if isAllMechanism(part) {
 			continue // skip all mechanism
 		} else if isSPFMechanism(part) {
 			mechanisms = append(mechanisms, part)
@@ -120,9 +131,11 @@ func ExtractMechanisms(spfRecord string) ([]string, error) {
 // ExtractMechanismSet parses an SPF record string and returns a set of mechanisms (ignoring order and duplicates).
 func ExtractMechanismSet(spfRecord string) map[string]struct{} {
 	mechSet := make(map[string]struct{})
-	parts := strings.Fields(spfRecord)
-	for _, part := range parts[1:] { // skip v=spf1
-		if strings.HasSuffix(part, "all") {
+	if !IsSPFRecord(spfRecord) {
+		return mechSet
+	}
+	for _, part := range recordTerms(spfRecord) {
+		if isAllMechanism(part) {
 			mechSet[part] = struct{}{}
 		} else if isSPFMechanism(part) {
 			mechSet[part] = struct{}{}
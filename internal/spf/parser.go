@@ -0,0 +1,691 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file implements a parser for the SPF record grammar defined in RFC 7208 section 12.
+// The parser produces a typed Record/Term AST which the flattener, lookup counter,
+// normalizer and splitter consume instead of matching raw string prefixes.
+
+// Qualifier is the result prefix of an SPF directive ("+", "-", "~" or "?").
+type Qualifier byte
+
+const (
+	QualifierPass     Qualifier = '+'
+	QualifierFail     Qualifier = '-'
+	QualifierSoftFail Qualifier = '~'
+	QualifierNeutral  Qualifier = '?'
+)
+
+// String returns the qualifier character.
+func (q Qualifier) String() string {
+	return string(q)
+}
+
+// Prefix returns the qualifier as written in canonical terms: empty for pass,
+// since "+" is the default, and the qualifier character otherwise.
+func (q Qualifier) Prefix() string {
+	if q == QualifierPass || q == 0 {
+		return ""
+	}
+	return string(q)
+}
+
+// TermKind identifies the mechanism or modifier a Term represents.
+type TermKind int
+
+const (
+	KindAll TermKind = iota + 1
+	KindInclude
+	KindA
+	KindMX
+	KindPTR
+	KindIP4
+	KindIP6
+	KindExists
+	KindRedirect
+	KindExp
+	KindUnknownModifier
+)
+
+var termKindNames = map[TermKind]string{
+	KindAll:             "all",
+	KindInclude:         "include",
+	KindA:               "a",
+	KindMX:              "mx",
+	KindPTR:             "ptr",
+	KindIP4:             "ip4",
+	KindIP6:             "ip6",
+	KindExists:          "exists",
+	KindRedirect:        "redirect",
+	KindExp:             "exp",
+	KindUnknownModifier: "unknown-modifier",
+}
+
+var mechanismKinds = map[string]TermKind{
+	"all":     KindAll,
+	"include": KindInclude,
+	"a":       KindA,
+	"mx":      KindMX,
+	"ptr":     KindPTR,
+	"ip4":     KindIP4,
+	"ip6":     KindIP6,
+	"exists":  KindExists,
+}
+
+// String returns the RFC 7208 name of the term kind.
+func (k TermKind) String() string {
+	if name, ok := termKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("TermKind(%d)", int(k))
+}
+
+// IsMechanism reports whether the kind is a mechanism (as opposed to a modifier).
+func (k TermKind) IsMechanism() bool {
+	return k >= KindAll && k <= KindExists
+}
+
+// Term is a single parsed SPF directive or modifier.
+type Term struct {
+	Qualifier  Qualifier // Directive qualifier; QualifierPass when omitted. Unused for modifiers.
+	Kind       TermKind
+	Name       string // Modifier name for KindUnknownModifier, lower-cased mechanism name otherwise
+	DomainSpec string // Target of include/a/mx/ptr/exists and redirect/exp; empty when omitted
+	IP         net.IP // Address of ip4/ip6 mechanisms
+	IP4Prefix  int    // IPv4 CIDR length for ip4/a/mx, -1 when absent
+	IP6Prefix  int    // IPv6 CIDR length for ip6/a/mx, -1 when absent
+	Value      string // Raw value of unknown modifiers
+}
+
+// IsMechanism reports whether the term is a mechanism (directive).
+func (t Term) IsMechanism() bool {
+	return t.Kind.IsMechanism()
+}
+
+// HasMacros reports whether the term's domain-spec or value contains macro expansions.
+func (t Term) HasMacros() bool {
+	return strings.Contains(t.DomainSpec, "%{") || strings.Contains(t.Value, "%{")
+}
+
+// DependsOnDomain reports whether the term's result depends on the domain whose
+// record contains it: a, mx and ptr without a domain-spec, or any %{d} macro.
+// Such terms cannot be moved into another record without changing their meaning.
+func (t Term) DependsOnDomain() bool {
+	switch t.Kind {
+	case KindA, KindMX, KindPTR:
+		if t.DomainSpec == "" {
+			return true
+		}
+	}
+	return macroUsesLetter(t.DomainSpec, 'd')
+}
+
+// String serializes the term in canonical form. The "+" qualifier is omitted
+// because it is the default.
+func (t Term) String() string {
+	var b strings.Builder
+	if t.IsMechanism() {
+		b.WriteString(t.Qualifier.Prefix())
+	}
+
+	switch t.Kind {
+	case KindRedirect, KindExp:
+		b.WriteString(t.Kind.String())
+		b.WriteString("=")
+		b.WriteString(t.DomainSpec)
+		return b.String()
+	case KindUnknownModifier:
+		b.WriteString(t.Name)
+		b.WriteString("=")
+		b.WriteString(t.Value)
+		return b.String()
+	}
+
+	b.WriteString(t.Kind.String())
+	switch t.Kind {
+	case KindIP4, KindIP6:
+		b.WriteString(":")
+		if t.Kind == KindIP6 && t.IP.To4() != nil {
+			b.WriteString("::ffff:") // keep IPv4-mapped addresses in IPv6 notation
+			b.WriteString(t.IP.To4().String())
+		} else {
+			b.WriteString(t.IP.String())
+		}
+		prefix := t.IP4Prefix
+		if t.Kind == KindIP6 {
+			prefix = t.IP6Prefix
+		}
+		if prefix >= 0 {
+			b.WriteString("/")
+			b.WriteString(strconv.Itoa(prefix))
+		}
+	case KindInclude, KindExists, KindA, KindMX, KindPTR:
+		if t.DomainSpec != "" {
+			b.WriteString(":")
+			b.WriteString(t.DomainSpec)
+		}
+		if t.Kind == KindA || t.Kind == KindMX {
+			if t.IP4Prefix >= 0 {
+				b.WriteString("/")
+				b.WriteString(strconv.Itoa(t.IP4Prefix))
+			}
+			if t.IP6Prefix >= 0 {
+				b.WriteString("//")
+				b.WriteString(strconv.Itoa(t.IP6Prefix))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Record is a parsed SPF record: the "v=spf1" version tag followed by its terms
+// in the order they appeared.
+type Record struct {
+	Terms []Term
+}
+
+// String serializes the record in canonical form.
+func (r *Record) String() string {
+	parts := make([]string, 0, len(r.Terms)+1)
+	parts = append(parts, spfVersion)
+	for _, t := range r.Terms {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Mechanisms returns the record's directives in evaluation order.
+func (r *Record) Mechanisms() []Term {
+	var mechs []Term
+	for _, t := range r.Terms {
+		if t.IsMechanism() {
+			mechs = append(mechs, t)
+		}
+	}
+	return mechs
+}
+
+// All returns the record's "all" mechanism, if present.
+func (r *Record) All() (Term, bool) {
+	return r.find(KindAll)
+}
+
+// Redirect returns the record's redirect= modifier, if present.
+func (r *Record) Redirect() (Term, bool) {
+	return r.find(KindRedirect)
+}
+
+// Explanation returns the record's exp= modifier, if present.
+func (r *Record) Explanation() (Term, bool) {
+	return r.find(KindExp)
+}
+
+func (r *Record) find(kind TermKind) (Term, bool) {
+	for _, t := range r.Terms {
+		if t.Kind == kind {
+			return t, true
+		}
+	}
+	return Term{}, false
+}
+
+// SyntaxError describes why an SPF record or term failed to parse.
+type SyntaxError struct {
+	Term   string // The offending term as written
+	Offset int    // Byte offset of the term within the record
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Term == "" {
+		return fmt.Sprintf("invalid SPF record: %s", e.Msg)
+	}
+	return fmt.Sprintf("invalid SPF term %q at offset %d: %s", e.Term, e.Offset, e.Msg)
+}
+
+const spfVersion = "v=spf1"
+
+var (
+	// modifierNameRegex matches the RFC 7208 "name" production.
+	modifierNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.]*$`)
+
+	// dualCIDRRegex splits an a/mx argument into domain-spec and optional dual-cidr-length.
+	dualCIDRRegex = regexp.MustCompile(`^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$`)
+)
+
+// IsSPFRecord reports whether a TXT string is an SPF version 1 record, i.e. it
+// starts with "v=spf1" followed by a space or the end of the string.
+func IsSPFRecord(txt string) bool {
+	if len(txt) < len(spfVersion) || !strings.EqualFold(txt[:len(spfVersion)], spfVersion) {
+		return false
+	}
+	return len(txt) == len(spfVersion) || txt[len(spfVersion)] == ' '
+}
+
+// ParseRecord parses an SPF record according to RFC 7208 section 12.
+//
+// It returns a *SyntaxError describing the first invalid term when the record
+// is malformed, including duplicate redirect= or exp= modifiers.
+//
+// Example:
+//
+//	rec, err := ParseRecord("v=spf1 -include:_spf.example.com a:mail.example.com/24//64 ~all")
+//	// rec.Terms[0].Qualifier == QualifierFail, rec.Terms[1].IP4Prefix == 24
+func ParseRecord(record string) (*Record, error) {
+	if !IsSPFRecord(record) {
+		return nil, &SyntaxError{Msg: "must start with v=spf1"}
+	}
+
+	rec := &Record{}
+	seen := make(map[TermKind]bool)
+	for _, tok := range tokenize(record)[1:] {
+		term, err := ParseTerm(tok.text)
+		if err != nil {
+			if se, ok := err.(*SyntaxError); ok {
+				se.Offset = tok.offset
+			}
+			return nil, err
+		}
+		if term.Kind == KindRedirect || term.Kind == KindExp {
+			if seen[term.Kind] {
+				return nil, &SyntaxError{Term: tok.text, Offset: tok.offset, Msg: "duplicate " + term.Kind.String() + " modifier"}
+			}
+			seen[term.Kind] = true
+		}
+		rec.Terms = append(rec.Terms, term)
+	}
+	return rec, nil
+}
+
+// ParseTerm parses a single SPF directive or modifier.
+func ParseTerm(s string) (Term, error) {
+	term := Term{Qualifier: QualifierPass, IP4Prefix: -1, IP6Prefix: -1}
+	qualifier, name, sep, arg := splitTerm(s)
+	if name == "" {
+		return term, &SyntaxError{Term: s, Msg: "missing mechanism name"}
+	}
+
+	if sep == '=' {
+		if qualifier != 0 {
+			return term, &SyntaxError{Term: s, Msg: "modifiers cannot have a qualifier"}
+		}
+		if !modifierNameRegex.MatchString(name) {
+			return term, &SyntaxError{Term: s, Msg: "invalid modifier name"}
+		}
+		return parseModifier(term, s, name, arg)
+	}
+
+	kind, ok := mechanismKinds[strings.ToLower(name)]
+	if !ok {
+		return term, &SyntaxError{Term: s, Msg: fmt.Sprintf("unknown mechanism %q", name)}
+	}
+	if qualifier != 0 {
+		term.Qualifier = qualifier
+	}
+	term.Kind = kind
+	term.Name = kind.String()
+
+	// The separator is part of the argument for mechanisms that accept a CIDR
+	// suffix directly after the name (e.g. "a/24" or "mx//64").
+	hasArg := sep == ':'
+	if sep == '/' {
+		arg = "/" + arg
+	}
+
+	switch kind {
+	case KindAll:
+		if sep != 0 {
+			return term, &SyntaxError{Term: s, Msg: "all does not take an argument"}
+		}
+	case KindInclude, KindExists:
+		if !hasArg || arg == "" {
+			return term, &SyntaxError{Term: s, Msg: kind.String() + " requires a domain-spec"}
+		}
+		if err := validateDomainSpec(arg); err != nil {
+			return term, &SyntaxError{Term: s, Msg: err.Error()}
+		}
+		term.DomainSpec = arg
+	case KindPTR:
+		if sep == '/' {
+			return term, &SyntaxError{Term: s, Msg: "ptr does not take a CIDR length"}
+		}
+		if hasArg {
+			if err := validateDomainSpec(arg); err != nil {
+				return term, &SyntaxError{Term: s, Msg: err.Error()}
+			}
+			term.DomainSpec = arg
+		}
+	case KindA, KindMX:
+		if sep != 0 {
+			if err := parseDomainWithDualCIDR(&term, arg, hasArg); err != nil {
+				return term, &SyntaxError{Term: s, Msg: err.Error()}
+			}
+		}
+	case KindIP4, KindIP6:
+		if !hasArg || arg == "" {
+			return term, &SyntaxError{Term: s, Msg: kind.String() + " requires an address"}
+		}
+		if err := parseIPNetwork(&term, arg); err != nil {
+			return term, &SyntaxError{Term: s, Msg: err.Error()}
+		}
+	}
+	return term, nil
+}
+
+func parseModifier(term Term, s, name, value string) (Term, error) {
+	switch strings.ToLower(name) {
+	case "redirect", "exp":
+		kind := KindRedirect
+		if strings.ToLower(name) == "exp" {
+			kind = KindExp
+		}
+		if value == "" {
+			return term, &SyntaxError{Term: s, Msg: name + " requires a domain-spec"}
+		}
+		if err := validateDomainSpec(value); err != nil {
+			return term, &SyntaxError{Term: s, Msg: err.Error()}
+		}
+		term.Kind = kind
+		term.Name = kind.String()
+		term.DomainSpec = value
+	default:
+		if err := validateMacroString(value, false); err != nil {
+			return term, &SyntaxError{Term: s, Msg: err.Error()}
+		}
+		term.Kind = KindUnknownModifier
+		term.Name = name
+		term.Value = value
+	}
+	return term, nil
+}
+
+// splitTerm breaks a raw term into its qualifier (0 when absent), name, the
+// separator following the name (':', '=', '/' or 0) and the remaining argument.
+// It performs no validation, which lets callers classify malformed terms.
+func splitTerm(s string) (Qualifier, string, byte, string) {
+	var qualifier Qualifier
+	if s != "" {
+		switch Qualifier(s[0]) {
+		case QualifierPass, QualifierFail, QualifierSoftFail, QualifierNeutral:
+			qualifier = Qualifier(s[0])
+			s = s[1:]
+		}
+	}
+	i := strings.IndexAny(s, ":=/")
+	if i < 0 {
+		return qualifier, s, 0, ""
+	}
+	return qualifier, s[:i], s[i], s[i+1:]
+}
+
+// classifyTerm returns the kind a raw term would have based on its name alone,
+// or 0 if the name is not a known mechanism or modifier. It is used to handle
+// malformed records leniently where a strict parse is not required.
+func classifyTerm(s string) TermKind {
+	_, name, sep, _ := splitTerm(s)
+	name = strings.ToLower(name)
+	if sep == '=' {
+		switch name {
+		case "redirect":
+			return KindRedirect
+		case "exp":
+			return KindExp
+		}
+		if modifierNameRegex.MatchString(name) {
+			return KindUnknownModifier
+		}
+		return 0
+	}
+	kind := mechanismKinds[name]
+	switch kind {
+	case KindInclude, KindExists, KindIP4, KindIP6:
+		if sep != ':' {
+			return 0 // these mechanisms are not recognisable without their argument
+		}
+	}
+	return kind
+}
+
+func parseDomainWithDualCIDR(term *Term, arg string, hasDomain bool) error {
+	m := dualCIDRRegex.FindStringSubmatch(arg)
+	if m == nil {
+		return fmt.Errorf("invalid dual-cidr-length")
+	}
+	domain, cidr4, cidr6 := m[1], m[2], m[3]
+	if hasDomain {
+		if domain == "" {
+			return fmt.Errorf("empty domain-spec")
+		}
+		if err := validateDomainSpec(domain); err != nil {
+			return err
+		}
+		term.DomainSpec = domain
+	} else if domain != "" {
+		return fmt.Errorf("invalid dual-cidr-length %q", arg)
+	}
+	if cidr4 != "" {
+		prefix, err := parseCIDRLength(cidr4, 32)
+		if err != nil {
+			return err
+		}
+		term.IP4Prefix = prefix
+	}
+	if cidr6 != "" {
+		prefix, err := parseCIDRLength(cidr6, 128)
+		if err != nil {
+			return err
+		}
+		term.IP6Prefix = prefix
+	}
+	return nil
+}
+
+func parseIPNetwork(term *Term, arg string) error {
+	addr, cidr, hasCIDR := strings.Cut(arg, "/")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid %s address %q", term.Kind, addr)
+	}
+	isV4 := ip.To4() != nil && !strings.Contains(addr, ":")
+	maxLen := 32
+	if term.Kind == KindIP4 {
+		if !isV4 {
+			return fmt.Errorf("%q is not an IPv4 address", addr)
+		}
+		ip = ip.To4()
+	} else {
+		if isV4 {
+			return fmt.Errorf("%q is not an IPv6 address", addr)
+		}
+		maxLen = 128
+	}
+	term.IP = ip
+	if hasCIDR {
+		prefix, err := parseCIDRLength(cidr, maxLen)
+		if err != nil {
+			return err
+		}
+		if term.Kind == KindIP4 {
+			term.IP4Prefix = prefix
+		} else {
+			term.IP6Prefix = prefix
+		}
+	}
+	return nil
+}
+
+// parseCIDRLength parses a CIDR length, rejecting leading zeros as required by the ABNF.
+func parseCIDRLength(s string, max int) (int, error) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid CIDR length %q", s)
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("CIDR length %q out of range 0-%d", s, max)
+	}
+	return n, nil
+}
+
+// validateDomainSpec checks a domain-spec: a macro-string ending either in a
+// macro-expand or in a valid top-level label.
+func validateDomainSpec(spec string) error {
+	if err := validateMacroString(spec, false); err != nil {
+		return err
+	}
+	if strings.HasSuffix(spec, "}") && strings.Contains(spec, "%{") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(spec, "."), ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("domain-spec %q must contain a dot-separated top label", spec)
+	}
+	if !isTopLabel(labels[len(labels)-1]) {
+		return fmt.Errorf("domain-spec %q has an invalid top label", spec)
+	}
+	return nil
+}
+
+func isTopLabel(label string) bool {
+	if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	hasAlpha := false
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			hasAlpha = true
+		case c >= '0' && c <= '9', c == '-':
+		default:
+			return false
+		}
+	}
+	return hasAlpha || strings.Contains(label, "-")
+}
+
+// validateMacroString validates the macro-string production. The c, r and t
+// macro letters are only permitted when expanding explanation strings.
+func validateMacroString(s string, allowExpLetters bool) error {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x21 || c > 0x7e {
+			return fmt.Errorf("invalid character %q", c)
+		}
+		if c != '%' {
+			continue
+		}
+		if i+1 >= len(s) {
+			return fmt.Errorf("unterminated macro")
+		}
+		switch s[i+1] {
+		case '%', '_', '-':
+			i++
+			continue
+		case '{':
+		default:
+			return fmt.Errorf("invalid macro escape %q", s[i:i+2])
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return fmt.Errorf("unterminated macro")
+		}
+		if _, err := parseMacroExpand(s[i+2:i+end], allowExpLetters); err != nil {
+			return err
+		}
+		i += end
+	}
+	return nil
+}
+
+// macroUsesLetter reports whether a macro-string contains a "%{...}" macro with
+// the given (lower-case) letter. Escapes such as "%%" are skipped.
+func macroUsesLetter(s string, letter byte) bool {
+	for i := 0; i+2 < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if s[i+1] == '{' && s[i+2]|0x20 == letter {
+			return true
+		}
+		i++
+	}
+	return false
+}
+
+// macroExpand is the parsed body of a "%{...}" macro.
+type macroExpand struct {
+	letter     byte
+	digits     int // 0 when absent
+	reverse    bool
+	delimiters string
+}
+
+func parseMacroExpand(body string, allowExpLetters bool) (macroExpand, error) {
+	var m macroExpand
+	if body == "" {
+		return m, fmt.Errorf("empty macro")
+	}
+	m.letter = body[0]
+	switch m.letter | 0x20 { // macro letters are case-insensitive
+	case 's', 'l', 'o', 'd', 'i', 'p', 'h', 'v':
+	case 'c', 'r', 't':
+		if !allowExpLetters {
+			return m, fmt.Errorf("macro letter %q is only allowed in explanations", m.letter)
+		}
+	default:
+		return m, fmt.Errorf("invalid macro letter %q", m.letter)
+	}
+	rest := body[1:]
+	j := 0
+	for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+		j++
+	}
+	if j > 0 {
+		n, err := strconv.Atoi(rest[:j])
+		if err != nil || n == 0 {
+			return m, fmt.Errorf("invalid macro transformer %q", rest[:j])
+		}
+		m.digits = n
+	}
+	rest = rest[j:]
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		m.reverse = true
+		rest = rest[1:]
+	}
+	for _, c := range rest {
+		if !strings.ContainsRune(".-+,/_=", c) {
+			return m, fmt.Errorf("invalid macro delimiter %q", c)
+		}
+	}
+	m.delimiters = rest
+	return m, nil
+}
+
+type token struct {
+	text   string
+	offset int
+}
+
+// tokenize splits a record on whitespace while remembering term offsets.
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == ' ' || s[i] == '\t' {
+			if start >= 0 {
+				tokens = append(tokens, token{text: s[start:i], offset: start})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	return tokens
+}
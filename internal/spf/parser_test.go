@@ -0,0 +1,203 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    string
+		expected  []Term
+		canonical string
+	}{
+		{
+			name:   "Qualifiers and all",
+			record: "v=spf1 -include:_spf.example.com ?a ~all",
+			expected: []Term{
+				{Qualifier: QualifierFail, Kind: KindInclude, Name: "include", DomainSpec: "_spf.example.com", IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierNeutral, Kind: KindA, Name: "a", IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierSoftFail, Kind: KindAll, Name: "all", IP4Prefix: -1, IP6Prefix: -1},
+			},
+			canonical: "v=spf1 -include:_spf.example.com ?a ~all",
+		},
+		{
+			name:   "Bare all is not an a mechanism",
+			record: "v=spf1 all",
+			expected: []Term{
+				{Qualifier: QualifierPass, Kind: KindAll, Name: "all", IP4Prefix: -1, IP6Prefix: -1},
+			},
+			canonical: "v=spf1 all",
+		},
+		{
+			name:   "Dual CIDR lengths",
+			record: "v=spf1 a:mail.example.com/24//64 mx/28 a//96",
+			expected: []Term{
+				{Qualifier: QualifierPass, Kind: KindA, Name: "a", DomainSpec: "mail.example.com", IP4Prefix: 24, IP6Prefix: 64},
+				{Qualifier: QualifierPass, Kind: KindMX, Name: "mx", IP4Prefix: 28, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindA, Name: "a", IP4Prefix: -1, IP6Prefix: 96},
+			},
+			canonical: "v=spf1 a:mail.example.com/24//64 mx/28 a//96",
+		},
+		{
+			name:   "IP networks",
+			record: "v=spf1 +ip4:192.0.2.0/24 ip6:2001:DB8::1 ip4:198.51.100.7",
+			expected: []Term{
+				{Qualifier: QualifierPass, Kind: KindIP4, Name: "ip4", IP: net.ParseIP("192.0.2.0").To4(), IP4Prefix: 24, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindIP6, Name: "ip6", IP: net.ParseIP("2001:db8::1"), IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindIP4, Name: "ip4", IP: net.ParseIP("198.51.100.7").To4(), IP4Prefix: -1, IP6Prefix: -1},
+			},
+			canonical: "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::1 ip4:198.51.100.7",
+		},
+		{
+			name:   "Modifiers and macros",
+			record: "v=spf1 exists:%{i}._spf.%{d} redirect=_spf.example.com exp=explain.%{d2} custom=value",
+			expected: []Term{
+				{Qualifier: QualifierPass, Kind: KindExists, Name: "exists", DomainSpec: "%{i}._spf.%{d}", IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindRedirect, Name: "redirect", DomainSpec: "_spf.example.com", IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindExp, Name: "exp", DomainSpec: "explain.%{d2}", IP4Prefix: -1, IP6Prefix: -1},
+				{Qualifier: QualifierPass, Kind: KindUnknownModifier, Name: "custom", Value: "value", IP4Prefix: -1, IP6Prefix: -1},
+			},
+			canonical: "v=spf1 exists:%{i}._spf.%{d} redirect=_spf.example.com exp=explain.%{d2} custom=value",
+		},
+		{
+			name:      "Case-insensitive names and extra whitespace",
+			record:    "V=SPF1  INCLUDE:Example.COM   -ALL ",
+			canonical: "v=spf1 include:Example.COM -all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := ParseRecord(tt.record)
+			if err != nil {
+				t.Fatalf("ParseRecord(%q) returned error: %v", tt.record, err)
+			}
+			if tt.expected != nil {
+				if len(rec.Terms) != len(tt.expected) {
+					t.Fatalf("Expected %d terms, got %d: %+v", len(tt.expected), len(rec.Terms), rec.Terms)
+				}
+				for i, want := range tt.expected {
+					got := rec.Terms[i]
+					if got.Qualifier != want.Qualifier || got.Kind != want.Kind || got.Name != want.Name ||
+						got.DomainSpec != want.DomainSpec || got.IP4Prefix != want.IP4Prefix ||
+						got.IP6Prefix != want.IP6Prefix || got.Value != want.Value || !got.IP.Equal(want.IP) {
+						t.Errorf("Term %d: expected %+v, got %+v", i, want, got)
+					}
+				}
+			}
+			if got := rec.String(); got != tt.canonical {
+				t.Errorf("Expected canonical form %q, got %q", tt.canonical, got)
+			}
+		})
+	}
+}
+
+func TestParseRecord_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     string
+		wantTerm   string
+		wantOffset int
+	}{
+		{"Missing version", "ip4:192.0.2.1 ~all", "", 0},
+		{"Version prefix only", "v=spf10 ~all", "", 0},
+		{"Unknown mechanism", "v=spf1 foo:bar ~all", "foo:bar", 7},
+		{"Include without domain", "v=spf1 include: ~all", "include:", 7},
+		{"Invalid IPv4", "v=spf1 ip4:300.1.1.1", "ip4:300.1.1.1", 7},
+		{"IPv6 address in ip4", "v=spf1 ip4:2001:db8::1", "ip4:2001:db8::1", 7},
+		{"CIDR out of range", "v=spf1 ip4:192.0.2.0/33", "ip4:192.0.2.0/33", 7},
+		{"CIDR leading zero", "v=spf1 a/024", "a/024", 7},
+		{"All with argument", "v=spf1 all:example.com", "all:example.com", 7},
+		{"Numeric top label", "v=spf1 include:192.0.2.1", "include:192.0.2.1", 7},
+		{"Bad macro letter", "v=spf1 exists:%{x}.example.com", "exists:%{x}.example.com", 7},
+		{"Explanation-only macro", "v=spf1 exists:%{c}.example.com", "exists:%{c}.example.com", 7},
+		{"Bare percent", "v=spf1 exists:100%.example.com", "exists:100%.example.com", 7},
+		{"Duplicate redirect", "v=spf1 redirect=a.example.com redirect=b.example.com", "redirect=b.example.com", 30},
+		{"Qualified modifier", "v=spf1 -redirect=example.com", "-redirect=example.com", 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecord(tt.record)
+			if err == nil {
+				t.Fatalf("Expected syntax error for %q", tt.record)
+			}
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Expected *SyntaxError, got %T: %v", err, err)
+			}
+			if syntaxErr.Term != tt.wantTerm {
+				t.Errorf("Expected error term %q, got %q", tt.wantTerm, syntaxErr.Term)
+			}
+			if syntaxErr.Offset != tt.wantOffset {
+				t.Errorf("Expected error offset %d, got %d", tt.wantOffset, syntaxErr.Offset)
+			}
+		})
+	}
+}
+
+func TestIsSPFRecord(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected bool
+	}{
+		{"v=spf1 -all", true},
+		{"v=spf1", true},
+		{"V=SPF1 ~all", true},
+		{"v=spf10 -all", false},
+		{"v=DKIM1; k=rsa", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if result := IsSPFRecord(tc.input); result != tc.expected {
+			t.Errorf("IsSPFRecord(%q) = %v, expected %v", tc.input, result, tc.expected)
+		}
+	}
+}
+
+func TestFlattenSPF_ParsedMechanisms(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com":         {"v=spf1 a:mail.example.com/24 mx//64 -include:blocked.example.net ?all"},
+			"blocked.example.net": {"v=spf1 ip4:203.0.113.0/24 -all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.example.com": {net.ParseIP("192.0.2.77")},
+			"mx.example.com":   {net.ParseIP("2001:db8:1:2::25")},
+		},
+		MXs: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com", Pref: 10}},
+		},
+	}
+
+	_, flattened, err := FlattenSPF(context.Background(), "example.com", provider, false)
+	if err != nil {
+		t.Fatalf("FlattenSPF failed: %v", err)
+	}
+
+	expected := "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8:1:2::/64 -ip4:203.0.113.0/24 ?all"
+	if flattened != expected {
+		t.Errorf("Expected %q, got %q", expected, flattened)
+	}
+}
+
+func TestCountDNSLookups_AllIsNotAMechanism(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com": {"v=spf1 ip4:192.0.2.1 all"},
+		},
+	}
+
+	count, err := CountDNSLookups(context.Background(), "example.com", provider)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 DNS lookup, got %d", count)
+	}
+}
@@ -0,0 +1,171 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// This file implements partial flattening. Instead of replacing every include with
+// addresses, the planner keeps as many of the domain's own includes as fit in a
+// lookup budget, so stable vendor includes keep tracking the vendor's changes while
+// the published records stay within the RFC 7208 limit.
+
+// Reasons recorded in IncludeDecision.Reason.
+const (
+	PlanReasonKeepIncludes  = "keep_includes"
+	PlanReasonAlwaysFlatten = "always_flatten"
+	PlanReasonFullFlatten   = "no lookup budget"
+	PlanReasonFitsBudget    = "fits lookup budget"
+	PlanReasonOverBudget    = "over lookup budget"
+)
+
+// IncludeDecision records whether one of the domain's own includes is flattened.
+type IncludeDecision struct {
+	Domain  string // Include target
+	Term    string // The include term as written, e.g. "~include:_spf.vendor.example"
+	Lookups int    // Lookups the include costs when kept: itself plus everything it includes
+	Flatten bool   // Whether the include is replaced by its addresses
+	Reason  string // One of the PlanReason constants
+
+	occurrences int // Times the include appears, each counted in the published records
+}
+
+// FlattenPlan describes which includes a flattened record keeps and the lookups its
+// published records require.
+type FlattenPlan struct {
+	MaxLookups int               // The lookup budget; 0 when every include is flattened
+	Includes   []IncludeDecision // Includes of the domain's own record (and redirect targets), in record order
+	Lookups    int               // Lookups needed to evaluate the published records under this plan
+}
+
+// Kept returns the domains of the includes kept in the flattened record.
+func (p *FlattenPlan) Kept() []string {
+	var kept []string
+	for _, d := range p.Includes {
+		if !d.Flatten {
+			kept = append(kept, d.Domain)
+		}
+	}
+	return kept
+}
+
+// planIncludes lists the includes the planner can keep: those evaluated at the
+// domain's own record or the records it redirects to, found in the lookup report.
+// Includes using macros are always kept verbatim and are not part of the plan.
+func planIncludes(report *LookupReport) []IncludeDecision {
+	var decisions []IncludeDecision
+	index := make(map[string]int)
+	rootDepth := 0 // depth of the record currently evaluated in place of the domain's own
+	for i, entry := range report.Terms {
+		if entry.Depth != rootDepth {
+			continue
+		}
+		term, err := ParseTerm(entry.Term)
+		if err != nil || term.HasMacros() {
+			continue
+		}
+		if term.Kind == KindRedirect {
+			rootDepth++
+			continue
+		}
+		if term.Kind != KindInclude {
+			continue
+		}
+		cost := 1
+		for _, nested := range report.Terms[i+1:] {
+			if nested.Depth <= rootDepth {
+				break
+			}
+			cost++
+		}
+		domain := normalizeIncludeDomain(term.DomainSpec)
+		if j, ok := index[domain]; ok {
+			decisions[j].Lookups += cost // evaluated each time it is reached
+			decisions[j].occurrences++
+			continue
+		}
+		index[domain] = len(decisions)
+		decisions = append(decisions, IncludeDecision{Domain: domain, Term: entry.Term, Lookups: cost, occurrences: 1})
+	}
+	return decisions
+}
+
+func normalizeIncludeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func domainSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		set[normalizeIncludeDomain(d)] = true
+	}
+	return set
+}
+
+// planFlattening flattens originalSPF keeping the includes chosen for opts. Includes in
+// opts.KeepIncludes are always kept and those in opts.AlwaysFlatten always flattened.
+// Without a budget every other include is flattened; with opts.MaxLookups set the
+// remaining includes start out kept, and the most expensive are flattened one at a time
+// until the published records fit the budget, so as many includes as possible are kept.
+func planFlattening(ctx context.Context, domain, originalSPF string, dns DNSProvider, report *LookupReport, opts FlattenOptions) (*flattenOutcome, *FlattenPlan, error) {
+	plan := &FlattenPlan{MaxLookups: opts.MaxLookups, Includes: planIncludes(report)}
+	keep := domainSet(opts.KeepIncludes)
+	always := domainSet(opts.AlwaysFlatten)
+
+	var optional []int // indexes of includes the budget decides, cheapest first
+	for i := range plan.Includes {
+		d := &plan.Includes[i]
+		switch {
+		case keep[d.Domain]:
+			d.Reason = PlanReasonKeepIncludes
+		case always[d.Domain]:
+			d.Flatten, d.Reason = true, PlanReasonAlwaysFlatten
+		case opts.MaxLookups <= 0:
+			d.Flatten, d.Reason = true, PlanReasonFullFlatten
+		default:
+			d.Reason = PlanReasonFitsBudget
+			optional = append(optional, i)
+		}
+	}
+	sort.SliceStable(optional, func(a, b int) bool {
+		return plan.Includes[optional[a]].Lookups < plan.Includes[optional[b]].Lookups
+	})
+
+	for {
+		kept := make(map[string]bool)
+		nested := 0
+		for _, d := range plan.Includes {
+			if !d.Flatten {
+				kept[d.Domain] = true
+				nested += d.Lookups - d.occurrences // the include terms are counted in the published records
+			}
+		}
+		outcome, err := flattenRecord(ctx, domain, originalSPF, dns, opts, kept)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		published, err := SplitAndChainSPFWithOptions(outcome.flattened, domain, opts.Split)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan.Lookups = nested
+		for _, content := range published {
+			plan.Lookups += CountRecordLookups(content)
+		}
+		if opts.MaxLookups <= 0 || plan.Lookups <= opts.MaxLookups || len(optional) == 0 {
+			if opts.MaxLookups > 0 && plan.Lookups > opts.MaxLookups {
+				outcome.warnings = append(outcome.warnings, fmt.Sprintf("published records require %d DNS lookups, over the max_lookups budget of %d", plan.Lookups, opts.MaxLookups))
+			}
+			return outcome, plan, nil
+		}
+
+		// Flatten the most expensive include still kept and try again
+		last := optional[len(optional)-1]
+		optional = optional[:len(optional)-1]
+		plan.Includes[last].Flatten = true
+		plan.Includes[last].Reason = PlanReasonOverBudget
+	}
+}
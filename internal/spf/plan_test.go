@@ -0,0 +1,105 @@
+package spf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenSPFWithOptions_PartialFlattening(t *testing.T) {
+	records := map[string][]string{
+		"example.com":            {"v=spf1 include:_spf.google.com include:mail.zendesk.com include:sendgrid.net ~include:bulk.example.net -all"},
+		"_spf.google.com":        {"v=spf1 include:_netblocks.google.com include:_netblocks2.google.com include:_netblocks3.google.com ~all"},
+		"_netblocks.google.com":  {"v=spf1 ip4:35.190.247.0/24 ~all"},
+		"_netblocks2.google.com": {"v=spf1 ip6:2001:4860:4000::/36 ~all"},
+		"_netblocks3.google.com": {"v=spf1 ip4:172.217.0.0/19 ~all"},
+		"mail.zendesk.com":       {"v=spf1 ip4:192.161.144.0/20 ~all"},
+		"sendgrid.net":           {"v=spf1 ip4:167.89.0.0/17 ~all"},
+		"bulk.example.net":       {"v=spf1 include:bulk2.example.net ~all"},
+		"bulk2.example.net":      {"v=spf1 ip4:198.51.100.0/24 ~all"},
+	}
+
+	testCases := []struct {
+		name         string
+		opts         FlattenOptions
+		expectKept   []string
+		expectRecord string
+		expectLookup int
+	}{
+		{
+			name:         "no budget flattens every include",
+			opts:         FlattenOptions{ForceFlatten: true},
+			expectRecord: "v=spf1 ip4:167.89.0.0/17 ip4:172.217.0.0/19 ip4:192.161.144.0/20 ip4:35.190.247.0/24 ip6:2001:4860:4000::/36 ~ip4:198.51.100.0/24 -all",
+		},
+		{
+			name:         "budget keeps the cheapest includes",
+			opts:         FlattenOptions{ForceFlatten: true, MaxLookups: 4},
+			expectKept:   []string{"mail.zendesk.com", "sendgrid.net", "bulk.example.net"},
+			expectRecord: "v=spf1 ip4:172.217.0.0/19 ip4:35.190.247.0/24 ip6:2001:4860:4000::/36 include:mail.zendesk.com include:sendgrid.net ~include:bulk.example.net -all",
+			expectLookup: 4,
+		},
+		{
+			name:         "keep_includes and always_flatten override the budget",
+			opts:         FlattenOptions{ForceFlatten: true, MaxLookups: 5, KeepIncludes: []string{"_spf.google.com"}, AlwaysFlatten: []string{"sendgrid.net"}},
+			expectKept:   []string{"_spf.google.com", "mail.zendesk.com"},
+			expectRecord: "v=spf1 include:_spf.google.com include:mail.zendesk.com ip4:167.89.0.0/17 ~ip4:198.51.100.0/24 -all",
+			expectLookup: 5,
+		},
+		{
+			name:         "keep_includes without a budget",
+			opts:         FlattenOptions{ForceFlatten: true, KeepIncludes: []string{"sendgrid.net."}},
+			expectKept:   []string{"sendgrid.net"},
+			expectRecord: "v=spf1 ip4:172.217.0.0/19 ip4:192.161.144.0/20 ip4:35.190.247.0/24 ip6:2001:4860:4000::/36 include:sendgrid.net ~ip4:198.51.100.0/24 -all",
+			expectLookup: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &mockDNSProvider{Records: records}
+			result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, tc.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Flattened != tc.expectRecord {
+				t.Errorf("Expected record:\n%s\ngot:\n%s", tc.expectRecord, result.Flattened)
+			}
+			if result.Plan == nil {
+				t.Fatal("Expected a flatten plan")
+			}
+			if got := result.Plan.Kept(); !reflect.DeepEqual(got, tc.expectKept) {
+				t.Errorf("Expected kept includes %v, got %v", tc.expectKept, got)
+			}
+			if result.Plan.Lookups != tc.expectLookup {
+				t.Errorf("Expected %d lookups after flattening, got %d", tc.expectLookup, result.Plan.Lookups)
+			}
+		})
+	}
+}
+
+func TestFlattenSPFWithOptions_BudgetTriggersFlattening(t *testing.T) {
+	provider := &mockDNSProvider{Records: map[string][]string{
+		"example.com": {"v=spf1 include:a.example include:b.example include:c.example -all"},
+		"a.example":   {"v=spf1 include:a2.example ~all"},
+		"a2.example":  {"v=spf1 ip4:192.0.2.1 ~all"},
+		"b.example":   {"v=spf1 ip4:192.0.2.2 ~all"},
+		"c.example":   {"v=spf1 ip4:192.0.2.3 ~all"},
+	}}
+
+	// 4 lookups are within the RFC limit but over a budget of 3
+	result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{MaxLookups: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.WasFlattened {
+		t.Fatal("Expected a record over the lookup budget to be flattened")
+	}
+	expected := "v=spf1 ip4:192.0.2.1 include:b.example include:c.example -all"
+	if result.Flattened != expected {
+		t.Errorf("Expected %q, got %q", expected, result.Flattened)
+	}
+	decisions := result.Plan.Includes
+	if len(decisions) != 3 || decisions[0].Reason != PlanReasonOverBudget || decisions[0].Lookups != 2 {
+		t.Errorf("Expected a.example to be flattened for the budget, got %+v", decisions)
+	}
+}
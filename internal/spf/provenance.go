@@ -0,0 +1,254 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	miekgdns "github.com/miekg/dns"
+)
+
+// This file builds the provenance graph of a domain's SPF record: the tree of
+// records, includes and terms evaluated from it, the addresses each term resolves
+// to, the lookups they cost and, when the DNS provider reports them, the TTLs and
+// DNSSEC status of the answers. It answers which include an address in a flattened record came from.
+
+// ProvenanceNode is one term of the include tree. The root node is the domain's own
+// record; include and redirect nodes hold the terms of the record they point to, and
+// mx nodes hold one child per MX host.
+type ProvenanceNode struct {
+	Term      string            `json:"term"`                // The term as written in its parent record; the domain name for the root
+	Domain    string            `json:"domain"`              // The name queried for the term
+	Record    string            `json:"record,omitempty"`    // The SPF record found, for the root, include and redirect nodes
+	TTL       uint32            `json:"ttl,omitempty"`       // TTL in seconds of the answer, when the DNS provider reports it
+	DNSSEC    DNSSECStatus      `json:"dnssec,omitempty"`    // Validation status of the answer, when the DNS provider validates
+	Lookups   int               `json:"lookups"`             // DNS lookups the term costs, including those of its children
+	Addresses []string          `json:"addresses,omitempty"` // ip4:/ip6: terms the node authorizes directly
+	Children  []*ProvenanceNode `json:"children,omitempty"`
+	Note      string            `json:"note,omitempty"`  // Why a term was not resolved (exists, ptr, macros)
+	Error     string            `json:"error,omitempty"` // The lookup error, if resolution failed
+}
+
+// BuildProvenance resolves the SPF record of domain into its provenance graph. Lookup
+// errors below the root are recorded on the affected node rather than returned, so the
+// rest of the tree is still shown.
+func BuildProvenance(ctx context.Context, domain string, dns DNSProvider) (*ProvenanceNode, error) {
+	records, err := dns.LookupTXT(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve SPF records for %s: %v", domain, err)
+	}
+	return BuildProvenanceFromRecord(ctx, domain, findSPFRecord(records), dns)
+}
+
+// BuildProvenanceFromRecord is BuildProvenance for record, the SPF record of domain.
+func BuildProvenanceFromRecord(ctx context.Context, domain, record string, dns DNSProvider) (*ProvenanceNode, error) {
+	if record == "" {
+		return nil, fmt.Errorf("no SPF record found for %s", domain)
+	}
+	b := &provenanceBuilder{dns: dns, stack: make(map[string]bool)}
+	root := &ProvenanceNode{Term: domain, Domain: domain, Record: record}
+	root.TTL = b.ttl(domain, miekgdns.TypeTXT)
+	root.DNSSEC, _ = dnssecStatus(dns, domain, miekgdns.TypeTXT)
+	if err := b.addRecord(ctx, root, domain, record, 0); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+type provenanceBuilder struct {
+	dns   DNSProvider
+	stack map[string]bool // records being expanded, for recursion detection
+}
+
+// ttl returns the TTL of the last answer for name, or 0 when it is not known.
+func (b *provenanceBuilder) ttl(name string, qtype uint16) uint32 {
+	ttl, _ := answerTTL(b.dns, name, qtype)
+	return ttl
+}
+
+// addRecord adds the evaluated terms of record, the SPF record of domain, as children
+// of node and adds their lookups to node's.
+func (b *provenanceBuilder) addRecord(ctx context.Context, node *ProvenanceNode, domain, record string, depth int) error {
+	const maxDepth = 10
+	if depth > maxDepth {
+		return fmt.Errorf("recursion depth exceeded for %s", domain)
+	}
+	if b.stack[domain] {
+		return fmt.Errorf("recursion detected for domain %s", domain)
+	}
+	b.stack[domain] = true
+	defer delete(b.stack, domain)
+
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return fmt.Errorf("failed to parse SPF record for %s: %w", domain, err)
+	}
+
+	for _, term := range parsed.Mechanisms() {
+		if term.Kind == KindAll {
+			return nil // terms after "all" and redirect= are never evaluated
+		}
+		if term.Kind == KindIP4 || term.Kind == KindIP6 {
+			term.Qualifier = QualifierPass
+			node.Addresses = append(node.Addresses, term.String())
+			continue
+		}
+		child := &ProvenanceNode{Term: term.String(), Domain: targetDomain(term, domain), Lookups: 1}
+		node.Children = append(node.Children, child)
+		if err := b.addTerm(ctx, child, term, depth); err != nil {
+			return err
+		}
+		node.Lookups += child.Lookups
+	}
+
+	if redirect, ok := parsed.Redirect(); ok {
+		child := &ProvenanceNode{Term: redirect.String(), Domain: redirect.DomainSpec, Lookups: 1}
+		node.Children = append(node.Children, child)
+		if err := b.addTerm(ctx, child, redirect, depth); err != nil {
+			return err
+		}
+		node.Lookups += child.Lookups
+	}
+	return nil
+}
+
+// addTerm resolves a term other than ip4:/ip6: into child.
+func (b *provenanceBuilder) addTerm(ctx context.Context, child *ProvenanceNode, term Term, depth int) error {
+	if mustKeep(term) || (term.Kind == KindRedirect && term.HasMacros()) {
+		child.Note = "evaluated for each message"
+		return nil
+	}
+
+	switch term.Kind {
+	case KindInclude, KindRedirect:
+		records, err := b.dns.LookupTXT(ctx, child.Domain)
+		if err != nil {
+			child.Error = err.Error()
+			return nil
+		}
+		child.TTL = b.ttl(child.Domain, miekgdns.TypeTXT)
+		child.DNSSEC, _ = dnssecStatus(b.dns, child.Domain, miekgdns.TypeTXT)
+		child.Record = findSPFRecord(records)
+		if child.Record == "" {
+			child.Error = "no SPF record"
+			return nil
+		}
+		return b.addRecord(ctx, child, child.Domain, child.Record, depth+1)
+	case KindA:
+		child.Addresses, child.TTL, child.Error = b.addresses(ctx, child.Domain, term)
+		child.DNSSEC, _ = dnssecStatus(b.dns, child.Domain, miekgdns.TypeA)
+	case KindMX:
+		mxs, err := b.dns.LookupMX(ctx, child.Domain)
+		if err != nil {
+			if !isVoidLookup(err) {
+				child.Error = err.Error()
+			}
+			return nil
+		}
+		child.TTL = b.ttl(child.Domain, miekgdns.TypeMX)
+		child.DNSSEC, _ = dnssecStatus(b.dns, child.Domain, miekgdns.TypeMX)
+		for _, mx := range mxs {
+			host := strings.TrimSuffix(mx.Host, ".")
+			hostNode := &ProvenanceNode{Term: host, Domain: host}
+			hostNode.Addresses, hostNode.TTL, hostNode.Error = b.addresses(ctx, host, term)
+			hostNode.DNSSEC, _ = dnssecStatus(b.dns, host, miekgdns.TypeA)
+			child.Children = append(child.Children, hostNode)
+		}
+	}
+	return nil
+}
+
+// addresses resolves name for an a or mx term into ip4:/ip6: terms.
+func (b *provenanceBuilder) addresses(ctx context.Context, name string, term Term) ([]string, uint32, string) {
+	ips, err := b.dns.LookupIP(ctx, name)
+	if err != nil {
+		if isVoidLookup(err) {
+			return nil, 0, ""
+		}
+		return nil, 0, err.Error()
+	}
+	ttl := b.ttl(name, miekgdns.TypeA)
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		mech := ipMechanism(ip, term.IP4Prefix, term.IP6Prefix)
+		if !seen[mech] {
+			seen[mech] = true
+			addrs = append(addrs, mech)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, ttl, ""
+}
+
+// AddressSet returns every address authorized directly by the node or its descendants.
+func (n *ProvenanceNode) AddressSet() *IPSet {
+	set := &IPSet{}
+	n.walk(func(node *ProvenanceNode) {
+		for _, p := range AddressTermPrefixes(node.Addresses) {
+			set.AddPrefix(p)
+		}
+	})
+	return set
+}
+
+// Names returns the names queried for the node and its descendants.
+func (n *ProvenanceNode) Names() []string {
+	var names []string
+	seen := make(map[string]bool)
+	n.walk(func(node *ProvenanceNode) {
+		if node.Domain != "" && !seen[node.Domain] {
+			seen[node.Domain] = true
+			names = append(names, node.Domain)
+		}
+	})
+	return names
+}
+
+func (n *ProvenanceNode) walk(fn func(*ProvenanceNode)) {
+	fn(n)
+	for _, child := range n.Children {
+		child.walk(fn)
+	}
+}
+
+// Sources returns the terms of the domain's record through which the node's addresses
+// are authorized: the root's includes, a and mx terms, with redirect= replaced by the
+// terms of the record it points to. The root's own ip4:/ip6: terms are returned as the
+// root itself.
+func (n *ProvenanceNode) Sources() []*ProvenanceNode {
+	var sources []*ProvenanceNode
+	if len(n.Addresses) > 0 {
+		sources = append(sources, &ProvenanceNode{Term: n.Term, Domain: n.Domain, Addresses: n.Addresses})
+	}
+	for _, child := range n.Children {
+		if strings.HasPrefix(child.Term, "redirect=") {
+			sources = append(sources, child.Sources()...)
+			continue
+		}
+		sources = append(sources, child)
+	}
+	return sources
+}
+
+// Attribute returns the terms of the domain's record (see Sources) whose addresses
+// overlap the ip4:/ip6: term mechanism, which may carry a qualifier and may have been
+// aggregated into a wider range.
+func (n *ProvenanceNode) Attribute(mechanism string) []string {
+	prefixes := AddressTermPrefixes([]string{mechanism})
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var terms []string
+	for _, source := range n.Sources() {
+		set := source.AddressSet()
+		for _, p := range prefixes {
+			if set.Overlaps(p) {
+				terms = append(terms, source.Term)
+				break
+			}
+		}
+	}
+	return terms
+}
@@ -0,0 +1,90 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBuildProvenance(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com":               {"v=spf1 ip4:192.0.2.10 include:_spf.vendor.example mx redirect=_spf.example.com"},
+			"_spf.vendor.example":       {"v=spf1 include:_netblocks.vendor.example ip6:2001:db8::/32 ~all"},
+			"_netblocks.vendor.example": {"v=spf1 ip4:198.51.100.0/24 ~all"},
+			"_spf.example.com":          {"v=spf1 a:mail.example.com exists:%{i}.bl.example.com -all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.example.com": {net.ParseIP("203.0.113.5")},
+			"mx1.example.com":  {net.ParseIP("203.0.113.25"), net.ParseIP("203.0.113.25")},
+		},
+		MXs: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com.", Pref: 10}},
+		},
+	}
+
+	root, err := BuildProvenance(context.Background(), "example.com", provider)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// include, nested include, mx, redirect, a and exists
+	if root.Lookups != 6 {
+		t.Errorf("Expected 6 lookups, got %d", root.Lookups)
+	}
+	var terms []string
+	for _, child := range root.Children {
+		terms = append(terms, child.Term)
+	}
+	expectedTerms := []string{"include:_spf.vendor.example", "mx", "redirect=_spf.example.com"}
+	if !reflect.DeepEqual(terms, expectedTerms) {
+		t.Errorf("Expected children %v, got %v", expectedTerms, terms)
+	}
+	if include := root.Children[0]; include.Lookups != 2 || include.Children[0].Addresses[0] != "ip4:198.51.100.0/24" {
+		t.Errorf("Unexpected include node: %+v", include)
+	}
+	if mx := root.Children[1]; len(mx.Children) != 1 || !reflect.DeepEqual(mx.Children[0].Addresses, []string{"ip4:203.0.113.25"}) {
+		t.Errorf("Unexpected mx node: %+v", mx)
+	}
+	exists := root.Children[2].Children[1]
+	if exists.Note == "" || len(exists.Addresses) != 0 {
+		t.Errorf("Expected exists to be left unresolved, got %+v", exists)
+	}
+
+	testCases := []struct {
+		mechanism string
+		expected  []string
+	}{
+		{"ip4:198.51.100.7", []string{"include:_spf.vendor.example"}},
+		{"~ip6:2001:db8::1", []string{"include:_spf.vendor.example"}},
+		{"ip4:192.0.2.10", []string{"example.com"}},
+		{"ip4:203.0.113.0/24", []string{"mx", "a:mail.example.com"}},
+		{"ip4:10.0.0.1", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mechanism, func(t *testing.T) {
+			if got := root.Attribute(tc.mechanism); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Attribute(%q) = %v, expected %v", tc.mechanism, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestBuildProvenance_LookupErrorsStayOnTheNode(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com": {"v=spf1 include:missing.example a:down.example.com -all"},
+		},
+	}
+
+	root, err := BuildProvenance(context.Background(), "example.com", provider)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, child := range root.Children {
+		if child.Error == "" {
+			t.Errorf("Expected %s to record its lookup error", child.Term)
+		}
+	}
+}
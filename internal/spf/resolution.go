@@ -0,0 +1,239 @@
+package spf
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// This file implements the resolution policy applied when an a or mx term cannot be
+// resolved while flattening. A transient DNS failure must not silently publish a record
+// that drops a legitimate sender, so failed terms are always reported and, depending on
+// the policy, abort flattening or reuse the addresses published before.
+
+// ResolutionPolicy selects how flattening handles a/mx terms whose lookups fail.
+type ResolutionPolicy string
+
+const (
+	// ResolutionLenient drops the failed term's addresses from the flattened record.
+	ResolutionLenient ResolutionPolicy = "lenient"
+	// ResolutionStrict aborts flattening of the domain.
+	ResolutionStrict ResolutionPolicy = "strict"
+	// ResolutionKeepPrevious reuses the addresses published before for the failed term.
+	ResolutionKeepPrevious ResolutionPolicy = "keep-previous"
+)
+
+// ParseResolutionPolicy validates a resolution policy name; empty selects ResolutionLenient.
+func ParseResolutionPolicy(name string) (ResolutionPolicy, error) {
+	switch policy := ResolutionPolicy(name); policy {
+	case "":
+		return ResolutionLenient, nil
+	case ResolutionLenient, ResolutionStrict, ResolutionKeepPrevious:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid resolution policy %q: must be one of strict, keep-previous or lenient", name)
+}
+
+// FailedTerm is an a or mx term whose DNS lookup failed during flattening. Void
+// lookups (the name does not exist or has no records) are not failures: the term
+// legitimately matches no addresses.
+type FailedTerm struct {
+	Term   string   // The term as written, e.g. "a:mail.example.com"
+	Domain string   // The record containing the term
+	Err    string   // The lookup error
+	Reused []string // ip4:/ip6: terms reused from the previously published records (keep-previous)
+}
+
+func (t FailedTerm) String() string {
+	return fmt.Sprintf("%s in %s: %s", t.Term, t.Domain, t.Err)
+}
+
+// ReusedPrefixes returns the address ranges of Reused.
+func (t FailedTerm) ReusedPrefixes() []netip.Prefix {
+	return AddressTermPrefixes(t.Reused)
+}
+
+// failedTerm records a resolution failure together with where the flattened record
+// would have held the term's addresses.
+type failedTerm struct {
+	FailedTerm
+	qualifier Qualifier // Qualifier of the term in the flattened record
+	position  int       // Index in flattener.terms where the addresses belong
+	source    string    // The term of the domain's record it was reached through (see ProvenanceNode.Sources)
+}
+
+// resolutionError lists the failed terms that aborted flattening under ResolutionStrict.
+func resolutionError(failed []failedTerm) error {
+	msgs := make([]string, len(failed))
+	for i, t := range failed {
+		msgs[i] = t.String()
+	}
+	return fmt.Errorf("strict resolution policy: %d term(s) could not be resolved: %s", len(failed), strings.Join(msgs, "; "))
+}
+
+// reusePrevious inserts, for each failed term, the addresses the previously published
+// records authorize with its qualifier but that no term resolved to this time, and
+// that sources records as coming from the failed term's source. The published records
+// do not say which term an address came from, so addresses sources knows nothing
+// about are reused for every failed term with that qualifier, with a warning.
+func (f *flattener) reusePrevious(previous, sources map[string]string) {
+	published := previousAddresses(previous, f.domain)
+	resolved := make(map[Qualifier]*IPSet)
+	for _, t := range f.terms {
+		if t.kept {
+			continue
+		}
+		if resolved[t.qualifier] == nil {
+			resolved[t.qualifier] = &IPSet{}
+		}
+		if term, err := ParseTerm(t.mechanism); err == nil {
+			addPrefix(resolved[t.qualifier], term.IP, term.IP4Prefix, term.IP6Prefix)
+		}
+	}
+	known, bySource := previousSources(sources)
+
+	// Addresses are inserted once, where the first failed term reusing them stood.
+	inserted := make(map[Qualifier]*IPSet)
+	warned := make(map[Qualifier]bool)
+	insert := make([][]string, len(f.failed))
+	for i := range f.failed {
+		q := f.failed[i].qualifier
+		missing := published[q]
+		if missing == nil {
+			continue
+		}
+		if other := resolved[q]; other != nil {
+			missing = missing.Difference(other)
+		}
+		unknown, reuse := missing, missing
+		if other := known[q]; other != nil {
+			unknown = missing.Difference(other)
+			reuse = unknown
+			if own := bySource[q][f.failed[i].source]; own != nil {
+				reuse = reuse.Union(missing.Difference(missing.Difference(own)))
+			}
+		}
+		if !unknown.IsEmpty() && !warned[q] {
+			warned[q] = true
+			f.warnf("resolution_policy keep-previous: no record of which term %s came from, so they were reused for every failed term", strings.Join(prefixMechanisms(q, unknown), ", "))
+		}
+
+		f.failed[i].Reused = prefixMechanisms(0, reuse)
+		if inserted[q] == nil {
+			inserted[q] = &IPSet{}
+		}
+		insert[i] = prefixMechanisms(0, reuse.Difference(inserted[q]))
+		inserted[q] = inserted[q].Union(reuse)
+	}
+
+	// Insert from the last failure backwards so earlier positions stay valid.
+	for i := len(f.failed) - 1; i >= 0; i-- {
+		if len(insert[i]) == 0 {
+			continue
+		}
+		terms := make([]flattenedTerm, len(insert[i]))
+		for j, mech := range insert[i] {
+			terms[j] = flattenedTerm{qualifier: f.failed[i].qualifier, mechanism: mech}
+		}
+		pos := f.failed[i].position
+		f.terms = append(f.terms[:pos], append(terms, f.terms[pos:]...)...)
+	}
+}
+
+// previousSources collects the address terms of sources (see FlattenOptions.Sources)
+// by qualifier, both all of them and by the term of the domain's record they came from.
+func previousSources(sources map[string]string) (map[Qualifier]*IPSet, map[Qualifier]map[string]*IPSet) {
+	known := make(map[Qualifier]*IPSet)
+	bySource := make(map[Qualifier]map[string]*IPSet)
+	for mech, from := range sources {
+		term, err := ParseTerm(mech)
+		if err != nil || (term.Kind != KindIP4 && term.Kind != KindIP6) {
+			continue
+		}
+		q := term.Qualifier
+		if known[q] == nil {
+			known[q] = &IPSet{}
+			bySource[q] = make(map[string]*IPSet)
+		}
+		addPrefix(known[q], term.IP, term.IP4Prefix, term.IP6Prefix)
+		for _, source := range strings.Split(from, ", ") {
+			if source == "" {
+				continue
+			}
+			if bySource[q][source] == nil {
+				bySource[q][source] = &IPSet{}
+			}
+			addPrefix(bySource[q][source], term.IP, term.IP4Prefix, term.IP6Prefix)
+		}
+	}
+	return known, bySource
+}
+
+// prefixMechanisms formats the prefixes of set as ip4:/ip6: mechanisms carrying q.
+func prefixMechanisms(q Qualifier, set *IPSet) []string {
+	var mechs []string
+	for _, p := range set.Prefixes() {
+		mechs = append(mechs, q.Prefix()+prefixMechanism(p))
+	}
+	return mechs
+}
+
+// previousAddresses collects the ip4:/ip6: terms of previously published records by
+// the qualifier they carry when evaluated from domain's record, following includes
+// into other records of previous (such as split spfN records).
+func previousAddresses(previous map[string]string, domain string) map[Qualifier]*IPSet {
+	sets := make(map[Qualifier]*IPSet)
+	seen := make(map[string]bool)
+	var walk func(name string, qualifier Qualifier, root bool)
+	walk = func(name string, qualifier Qualifier, root bool) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		parsed, err := ParseRecord(previous[name])
+		if err != nil {
+			return
+		}
+		for _, term := range parsed.Mechanisms() {
+			if term.Kind == KindAll {
+				return
+			}
+			q := term.Qualifier
+			if !root {
+				if q != QualifierPass {
+					continue // never matches inside an include
+				}
+				q = qualifier
+			}
+			switch term.Kind {
+			case KindIP4, KindIP6:
+				if sets[q] == nil {
+					sets[q] = &IPSet{}
+				}
+				addPrefix(sets[q], term.IP, term.IP4Prefix, term.IP6Prefix)
+			case KindInclude:
+				target := normalizeIncludeDomain(term.DomainSpec)
+				if _, ok := previous[target]; ok {
+					walk(target, q, false)
+				}
+			}
+		}
+	}
+	if _, ok := previous[domain]; ok {
+		walk(domain, QualifierPass, true)
+	}
+	return sets
+}
+
+// prefixMechanism formats p as an ip4:/ip6: mechanism, omitting the length of a
+// single address as ipMechanism does.
+func prefixMechanism(p netip.Prefix) string {
+	kind := "ip6:"
+	if p.Addr().Is4() {
+		kind = "ip4:"
+	}
+	if p.IsSingleIP() {
+		return kind + p.Addr().String()
+	}
+	return kind + p.String()
+}
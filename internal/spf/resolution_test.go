@@ -0,0 +1,212 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenSPFWithOptions_ResolutionPolicy(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com": {"v=spf1 ip4:192.0.2.1 a:mail.example.com mx -all"},
+		},
+		IPs: map[string][]net.IP{
+			"mx1.example.com": {net.ParseIP("203.0.113.5")},
+		},
+		MXs: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com", Pref: 10}},
+		},
+	}
+	previous := map[string]string{
+		"example.com":      "v=spf1 ip4:192.0.2.1 ip4:198.51.100.10 include:spf1.example.com -all",
+		"spf1.example.com": "v=spf1 ip4:198.51.100.11 ip4:203.0.113.5 -all",
+	}
+
+	testCases := []struct {
+		name         string
+		policy       ResolutionPolicy
+		expectErr    string
+		expectRecord string
+		expectReused []string
+		expectGained []string
+	}{
+		{
+			name:         "lenient drops the failed term",
+			policy:       ResolutionLenient,
+			expectRecord: "v=spf1 ip4:192.0.2.1 ip4:203.0.113.5 -all",
+		},
+		{
+			name:      "strict aborts",
+			policy:    ResolutionStrict,
+			expectErr: "a:mail.example.com in example.com",
+		},
+		{
+			name:         "keep-previous reuses the published addresses",
+			policy:       ResolutionKeepPrevious,
+			expectRecord: "v=spf1 ip4:192.0.2.1 ip4:198.51.100.10/31 ip4:203.0.113.5 -all",
+			expectReused: []string{"ip4:198.51.100.10/31"},
+			expectGained: []string{"198.51.100.10/31"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{
+				ForceFlatten: true,
+				Resolution:   tc.policy,
+				Previous:     previous,
+			})
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Flattened != tc.expectRecord {
+				t.Errorf("Expected record %q, got %q", tc.expectRecord, result.Flattened)
+			}
+			if len(result.FailedTerms) != 1 || result.FailedTerms[0].Term != "a:mail.example.com" {
+				t.Fatalf("Expected a:mail.example.com to be reported as failed, got %+v", result.FailedTerms)
+			}
+			if !reflect.DeepEqual(result.FailedTerms[0].Reused, tc.expectReused) {
+				t.Errorf("Expected reused %v, got %v", tc.expectReused, result.FailedTerms[0].Reused)
+			}
+
+			// The failed lookup is tolerated when verifying; reused addresses show up as gained.
+			published, err := SplitAndChainSPF(result.Flattened, "example.com")
+			if err != nil {
+				t.Fatalf("Unexpected split error: %v", err)
+			}
+			verification, err := VerifyFlatteningWithFailures(context.Background(), "example.com", result.Original, published, provider, result.FailedTerms)
+			if err != nil {
+				t.Fatalf("Unexpected verification error: %v", err)
+			}
+			if got := prefixStrings(verification.Gained); !reflect.DeepEqual(got, tc.expectGained) {
+				t.Errorf("Expected gained %v, got %v", tc.expectGained, got)
+			}
+		})
+	}
+}
+
+func TestFlattenSPFWithOptions_KeepPreviousSources(t *testing.T) {
+	previous := map[string]string{
+		"example.com": "v=spf1 ip4:192.0.2.1 ip4:198.51.100.10 ip4:198.51.100.20 ip4:198.51.100.30 ip4:203.0.113.5 -all",
+	}
+	sources := map[string]string{
+		"ip4:192.0.2.1":     "example.com",
+		"ip4:198.51.100.10": "a:mail.example.com",
+		"ip4:198.51.100.20": "include:_spf.vendor.example",
+		"ip4:203.0.113.5":   "include:_spf.vendor.example, a:mail.example.com",
+	}
+
+	testCases := []struct {
+		name         string
+		records      map[string][]string
+		ips          map[string][]net.IP
+		expectRecord string
+		expectReused []string
+	}{
+		{
+			name: "only the failed term's addresses are reused",
+			records: map[string][]string{
+				"example.com":         {"v=spf1 ip4:192.0.2.1 a:mail.example.com include:_spf.vendor.example -all"},
+				"_spf.vendor.example": {"v=spf1 ip4:203.0.113.5 -all"},
+			},
+			expectRecord: "v=spf1 ip4:192.0.2.1 ip4:198.51.100.10 ip4:198.51.100.30 ip4:203.0.113.5 -all",
+			expectReused: []string{"ip4:198.51.100.10", "ip4:198.51.100.30"},
+		},
+		{
+			name: "a failed term inside an include reuses the include's addresses",
+			records: map[string][]string{
+				"example.com":         {"v=spf1 ip4:192.0.2.1 a:mail.example.com include:_spf.vendor.example -all"},
+				"_spf.vendor.example": {"v=spf1 ip4:203.0.113.5 a:out.vendor.example -all"},
+			},
+			ips: map[string][]net.IP{
+				"mail.example.com": {net.ParseIP("198.51.100.10")},
+			},
+			expectRecord: "v=spf1 ip4:192.0.2.1 ip4:198.51.100.10 ip4:198.51.100.20 ip4:198.51.100.30 ip4:203.0.113.5 -all",
+			expectReused: []string{"ip4:198.51.100.20", "ip4:198.51.100.30"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &mockDNSProvider{Records: tc.records, IPs: tc.ips}
+			result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{
+				ForceFlatten: true,
+				Resolution:   ResolutionKeepPrevious,
+				Previous:     previous,
+				Sources:      sources,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Flattened != tc.expectRecord {
+				t.Errorf("Expected record %q, got %q", tc.expectRecord, result.Flattened)
+			}
+			if len(result.FailedTerms) != 1 {
+				t.Fatalf("Expected one failed term, got %+v", result.FailedTerms)
+			}
+			if !reflect.DeepEqual(result.FailedTerms[0].Reused, tc.expectReused) {
+				t.Errorf("Expected reused %v, got %v", tc.expectReused, result.FailedTerms[0].Reused)
+			}
+			// 198.51.100.30 has no recorded source, so it is reused with a warning
+			if !strings.Contains(strings.Join(result.Warnings, "\n"), "ip4:198.51.100.30") {
+				t.Errorf("Expected a warning about ip4:198.51.100.30, got %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestFlattenSPFWithOptions_VoidLookupIsNotFailure(t *testing.T) {
+	provider := &voidDNSProvider{mockDNSProvider{
+		Records: map[string][]string{
+			"example.com": {"v=spf1 ip4:192.0.2.1 a:gone.example.com -all"},
+		},
+	}}
+
+	result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{
+		ForceFlatten: true,
+		Resolution:   ResolutionStrict,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.FailedTerms) != 0 {
+		t.Errorf("Expected no failed terms, got %+v", result.FailedTerms)
+	}
+	if result.Flattened != "v=spf1 ip4:192.0.2.1 -all" {
+		t.Errorf("Unexpected flattened record %q", result.Flattened)
+	}
+}
+
+func TestParseResolutionPolicy(t *testing.T) {
+	for name, expected := range map[string]ResolutionPolicy{
+		"":              ResolutionLenient,
+		"lenient":       ResolutionLenient,
+		"strict":        ResolutionStrict,
+		"keep-previous": ResolutionKeepPrevious,
+	} {
+		policy, err := ParseResolutionPolicy(name)
+		if err != nil || policy != expected {
+			t.Errorf("ParseResolutionPolicy(%q) = %q, %v; expected %q", name, policy, err, expected)
+		}
+	}
+	if _, err := ParseResolutionPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestFailedTerm_ReusedPrefixes(t *testing.T) {
+	failed := FailedTerm{Reused: []string{"ip4:192.0.2.1", "ip4:198.51.100.0/24", "ip6:2001:db8::1"}}
+	expected := []string{"192.0.2.1/32", "198.51.100.0/24", "2001:db8::1/128"}
+	if got := prefixStrings(failed.ReusedPrefixes()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
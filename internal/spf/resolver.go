@@ -0,0 +1,349 @@
+package spf
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultQueryTimeout bounds each attempt of a query sent by PlainDNSProvider,
+// DoTDNSProvider and DoHDNSProvider when no Timeout is set.
+const DefaultQueryTimeout = 5 * time.Second
+
+// EDNSBufferSize is the UDP payload size advertised with EDNS0: large enough for most
+// TXT answers while avoiding IP fragmentation (DNS Flag Day 2020).
+const EDNSBufferSize = 1232
+
+// serverResolver implements the DNSProvider lookups on top of a single DNS server,
+// leaving the transport to exchange. It never falls back to the system resolver: a name
+// that does not exist or has no records of the queried type is reported as a void
+// lookup (a *net.DNSError with IsNotFound set), like the system resolver does, and other
+// failures are returned as errors.
+type serverResolver struct {
+	Timeout time.Duration // Per attempt; DefaultQueryTimeout when 0
+	Retries int           // Further attempts after a failed exchange or SERVFAIL
+
+	server   string // Shown in errors
+	exchange func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	ttls     answerTTLs
+}
+
+// query sends one question and returns the answers of the queried type. A response
+// without such answers (NODATA) yields no answers and no error.
+func (r *serverResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(EDNSBufferSize, false)
+	resp, err := r.Exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, r.notFound(name)
+	default:
+		return nil, &net.DNSError{Err: "server misbehaving (" + dns.RcodeToString[resp.Rcode] + ")", Name: name, Server: r.server, IsTemporary: true}
+	}
+	var answers []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, nil
+}
+
+// Exchange sends m to the server and returns its response, repeating the query after a
+// failed exchange or SERVFAIL up to Retries times. Each attempt is bounded by Timeout as
+// well as by ctx. It implements MessageExchanger.
+func (r *serverResolver) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	var resp *dns.Msg
+	var err error
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err = r.exchange(attemptCtx, m.Copy())
+		cancel()
+		if err == nil && resp.Rcode != dns.RcodeServerFailure || ctx.Err() != nil {
+			break
+		}
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		question := m.Question[0]
+		return nil, fmt.Errorf("DNS query for %s %s to %s failed: %w", dns.TypeToString[question.Qtype], strings.TrimSuffix(question.Name, "."), r.server, err)
+	}
+	return resp, nil
+}
+
+func (r *serverResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, Server: r.server, IsNotFound: true}
+}
+
+func (r *serverResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	answers, err := r.query(ctx, domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, r.notFound(domain)
+	}
+	var results []string
+	for _, ans := range answers {
+		results = append(results, strings.Join(ans.(*dns.TXT).Txt, ""))
+	}
+	r.ttls.record(domain, dns.TypeTXT, answers)
+	return validateTXTRecords(results, domain)
+}
+
+func (r *serverResolver) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	var results []net.IP
+	var answers []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := r.query(ctx, domain, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, ans := range rrs {
+			switch rr := ans.(type) {
+			case *dns.A:
+				results = append(results, rr.A)
+			case *dns.AAAA:
+				results = append(results, rr.AAAA)
+			}
+		}
+		answers = append(answers, rrs...)
+	}
+	if len(results) == 0 {
+		return nil, r.notFound(domain)
+	}
+	r.ttls.record(domain, dns.TypeA, answers)
+	return validateIPAddresses(results, domain)
+}
+
+func (r *serverResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	answers, err := r.query(ctx, domain, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, r.notFound(domain)
+	}
+	var results []*net.MX
+	for _, ans := range answers {
+		mx := ans.(*dns.MX)
+		results = append(results, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+	r.ttls.record(domain, dns.TypeMX, answers)
+	return validateMXRecords(results, domain)
+}
+
+// LookupAddr returns the PTR names of addr, for evaluating ptr mechanisms.
+func (r *serverResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := r.query(ctx, reverse, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, r.notFound(reverse)
+	}
+	var results []string
+	for _, ans := range answers {
+		results = append(results, ans.(*dns.PTR).Ptr)
+	}
+	return results, nil
+}
+
+// AnswerTTL implements TTLReporter for answers received from the server.
+func (r *serverResolver) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	return r.ttls.lookup(name, qtype)
+}
+
+// PlainDNSProvider queries a single DNS server over UDP, repeating the query over TCP
+// when the answer is truncated (RFC 7766).
+type PlainDNSProvider struct {
+	serverResolver
+}
+
+// NewPlainDNSProvider returns a provider querying server (host:port).
+func NewPlainDNSProvider(server string) *PlainDNSProvider {
+	p := &PlainDNSProvider{}
+	p.server = server
+	p.exchange = func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		resp, err := exchangeWith(ctx, dns.Client{Net: "udp"}, m, server)
+		if err == nil && resp.Truncated {
+			return exchangeWith(ctx, dns.Client{Net: "tcp"}, m, server)
+		}
+		return resp, err
+	}
+	return p
+}
+
+// exchangeWith sends m to server with client, bounding dial, write and read by the
+// deadline of ctx.
+func exchangeWith(ctx context.Context, client dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	resp, _, err := client.ExchangeContext(ctx, m, server)
+	return resp, err
+}
+
+func (p *PlainDNSProvider) Close() error {
+	return nil
+}
+
+// DefaultDoTPort is the DNS-over-TLS port (RFC 7858).
+const DefaultDoTPort = "853"
+
+// DoTDNSProvider queries a single DNS server over TLS (RFC 7858), verifying the
+// server's certificate against its host name or IP address.
+type DoTDNSProvider struct {
+	serverResolver
+	client *dns.Client
+}
+
+// NewDoTDNSProvider returns a provider querying server (host:port, port 853 when
+// omitted) over TLS.
+func NewDoTDNSProvider(server string) *DoTDNSProvider {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = strings.Trim(server, "[]")
+		server = net.JoinHostPort(host, DefaultDoTPort)
+	}
+	p := &DoTDNSProvider{client: &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12},
+	}}
+	p.server = server
+	p.exchange = func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		return exchangeWith(ctx, *p.client, m, server)
+	}
+	return p
+}
+
+func (p *DoTDNSProvider) Close() error {
+	return nil
+}
+
+// FailoverDNSProvider queries its providers in order and returns the first answer. A
+// provider whose lookup fails, or finds no records, is skipped. When every provider
+// fails, the error of the first one that found no records is returned, so the lookup
+// still counts as void; otherwise the last error is.
+type FailoverDNSProvider struct {
+	Providers []DNSProvider
+
+	answered sync.Map // cacheKey -> DNSProvider that answered last
+}
+
+func (f *FailoverDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	value, err := f.lookup(domain, dns.TypeTXT, func(p DNSProvider) (interface{}, int, error) {
+		records, err := p.LookupTXT(ctx, domain)
+		return records, len(records), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+func (f *FailoverDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	value, err := f.lookup(domain, dns.TypeA, func(p DNSProvider) (interface{}, int, error) {
+		ips, err := p.LookupIP(ctx, domain)
+		return ips, len(ips), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]net.IP), nil
+}
+
+func (f *FailoverDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	value, err := f.lookup(domain, dns.TypeMX, func(p DNSProvider) (interface{}, int, error) {
+		mxs, err := p.LookupMX(ctx, domain)
+		return mxs, len(mxs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*net.MX), nil
+}
+
+// LookupAddr returns the PTR names of addr from the first provider supporting PTR
+// lookups that finds any.
+func (f *FailoverDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	value, err := f.lookup(addr, dns.TypePTR, func(p DNSProvider) (interface{}, int, error) {
+		resolver, ok := p.(AddrLookupProvider)
+		if !ok {
+			return nil, 0, fmt.Errorf("PTR lookups are not supported by the DNS provider")
+		}
+		names, err := resolver.LookupAddr(ctx, addr)
+		return names, len(names), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// AnswerTTL implements TTLReporter with the TTL reported by the provider that answered.
+func (f *FailoverDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	p, ok := f.answered.Load(newCacheKey(name, qtype))
+	if !ok {
+		return 0, false
+	}
+	return answerTTL(p.(DNSProvider), name, qtype)
+}
+
+// Close closes every provider, returning the first error.
+func (f *FailoverDNSProvider) Close() error {
+	var first error
+	for _, p := range f.Providers {
+		if err := p.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// lookup runs query against each provider until one returns records.
+func (f *FailoverDNSProvider) lookup(name string, qtype uint16, query func(DNSProvider) (interface{}, int, error)) (interface{}, error) {
+	var lastErr, voidErr error
+	for _, p := range f.Providers {
+		value, n, err := query(p)
+		if err == nil && n > 0 {
+			f.answered.Store(newCacheKey(name, qtype), p)
+			return value, nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		if isVoidLookup(err) && voidErr == nil {
+			voidErr = err
+		}
+		lastErr = err
+	}
+	if voidErr != nil {
+		return nil, voidErr
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("no DNS servers configured")
+	}
+	return nil, lastErr
+}
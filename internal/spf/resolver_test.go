@@ -0,0 +1,310 @@
+package spf
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is the data served by the test DNS servers.
+var testZone = []string{
+	`example.com. 300 IN TXT "v=spf1 ip4:192.0.2.1 " "-all"`,
+	`mail.example.com. 120 IN A 192.0.2.10`,
+	`mail.example.com. 60 IN AAAA 2001:db8::10`,
+	`example.com. 600 IN MX 10 mail.example.com.`,
+}
+
+// answerFromZone answers the question of req from testZone: NXDOMAIN for names not
+// in it and NODATA for types it has no records of.
+func answerFromZone(t *testing.T, req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	question := req.Question[0]
+	found := false
+	for _, line := range testZone {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("Invalid test zone record %q: %v", line, err)
+		}
+		if !strings.EqualFold(rr.Header().Name, question.Name) {
+			continue
+		}
+		found = true
+		if rr.Header().Rrtype == question.Qtype {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if !found {
+		resp.Rcode = dns.RcodeNameError
+	}
+	return resp
+}
+
+// testServerResolver checks the lookups of a provider querying a server for testZone.
+func testServerResolver(t *testing.T, p DNSProvider) {
+	t.Helper()
+	ctx := context.Background()
+
+	txts, err := p.LookupTXT(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Unexpected TXT error: %v", err)
+	}
+	if want := []string{"v=spf1 ip4:192.0.2.1 -all"}; !reflect.DeepEqual(txts, want) {
+		t.Errorf("Expected TXT %q, got %q", want, txts)
+	}
+	if ttl, ok := answerTTL(p, "example.com", dns.TypeTXT); !ok || ttl != 300 {
+		t.Errorf("Expected TXT TTL 300, got %d (%v)", ttl, ok)
+	}
+
+	ips, err := p.LookupIP(ctx, "mail.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected A error: %v", err)
+	}
+	if fmt.Sprint(ips) != "[192.0.2.10 2001:db8::10]" {
+		t.Errorf("Unexpected addresses %v", ips)
+	}
+	if ttl, ok := answerTTL(p, "mail.example.com", dns.TypeA); !ok || ttl != 60 {
+		t.Errorf("Expected the lowest A/AAAA TTL 60, got %d (%v)", ttl, ok)
+	}
+
+	mxs, err := p.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Unexpected MX error: %v", err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "mail.example.com." || mxs[0].Pref != 10 {
+		t.Errorf("Unexpected MX answer %v", mxs)
+	}
+
+	// Missing names and types are void lookups
+	if _, err := p.LookupTXT(ctx, "missing.example.com"); !isVoidLookup(err) {
+		t.Errorf("Expected a void lookup for NXDOMAIN, got %v", err)
+	}
+	if _, err := p.LookupMX(ctx, "mail.example.com"); !isVoidLookup(err) {
+		t.Errorf("Expected a void lookup for NODATA, got %v", err)
+	}
+}
+
+func TestPlainDNSProvider(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerFromZone(t, req))
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	testServerResolver(t, NewPlainDNSProvider(conn.LocalAddr().String()))
+}
+
+// startTestDNSServer serves handler over UDP and TCP on the same local port.
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	for _, server := range []*dns.Server{{PacketConn: conn, Handler: handler}, {Listener: listener, Handler: handler}} {
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return conn.LocalAddr().String()
+}
+
+func TestPlainDNSProvider_TruncatedRetriesOverTCP(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []uint16
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if opt := req.IsEdns0(); opt != nil {
+			mu.Lock()
+			sizes = append(sizes, opt.UDPSize())
+			mu.Unlock()
+		}
+		resp := answerFromZone(t, req)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			resp.Answer = nil
+			resp.Truncated = true
+		}
+		w.WriteMsg(resp)
+	})
+
+	records, err := NewPlainDNSProvider(addr).LookupTXT(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0] != "v=spf1 ip4:192.0.2.1 -all" {
+		t.Errorf("Expected the TCP answer, got %q", records)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) != 2 || sizes[0] != EDNSBufferSize {
+		t.Errorf("Expected two queries advertising EDNS0 size %d, got %v", EDNSBufferSize, sizes)
+	}
+}
+
+func TestPlainDNSProvider_Retries(t *testing.T) {
+	testCases := []struct {
+		name      string
+		retries   int
+		expectErr bool
+	}{
+		{"without retries", 0, true},
+		{"with a retry", 1, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries atomic.Int32
+			addr := startTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				if queries.Add(1) == 1 {
+					return // the first query is lost
+				}
+				w.WriteMsg(answerFromZone(t, req))
+			})
+
+			p := NewPlainDNSProvider(addr)
+			p.Timeout = 100 * time.Millisecond
+			p.Retries = tc.retries
+			_, err := p.LookupTXT(context.Background(), "example.com")
+			if tc.expectErr != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectErr, err)
+			}
+			if err != nil && isVoidLookup(err) {
+				t.Errorf("A timeout must not be a void lookup: %v", err)
+			}
+		})
+	}
+}
+
+func TestPlainDNSProvider_ContextDeadline(t *testing.T) {
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {}) // never answers
+
+	p := NewPlainDNSProvider(addr)
+	p.Retries = 3
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.LookupTXT(ctx, "example.com"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the context deadline to stop the retries, took %v", elapsed)
+	}
+}
+
+func TestNewCustomDNSProviderWithServers(t *testing.T) {
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerFromZone(t, req))
+	})
+	servers := []*PlainDNSProvider{NewPlainDNSProvider(addr)}
+
+	c := NewCustomDNSProviderWithServers(servers, false)
+	if len(c.Providers) != 1 {
+		t.Errorf("Expected only the configured server, got %d providers", len(c.Providers))
+	}
+	testServerResolver(t, c)
+
+	c = NewCustomDNSProviderWithServers(servers, true)
+	if _, ok := c.Providers[len(c.Providers)-1].(*DefaultDNSProvider); !ok || len(c.Providers) != 2 {
+		t.Errorf("Expected the system resolver after the configured server, got %v", c.Providers)
+	}
+}
+
+func TestDoTDNSProvider(t *testing.T) {
+	// Borrow the test certificate of an httptest server, valid for 127.0.0.1
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerFromZone(t, req))
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	p := NewDoTDNSProvider(listener.Addr().String())
+	if _, err := p.LookupTXT(context.Background(), "example.com"); err == nil {
+		t.Error("Expected an untrusted certificate to be rejected")
+	}
+	p.client.TLSConfig.RootCAs = https.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	testServerResolver(t, p)
+}
+
+func TestNewDoTDNSProvider_DefaultPort(t *testing.T) {
+	testCases := []struct {
+		server, expected, serverName string
+	}{
+		{"1.1.1.1", "1.1.1.1:853", "1.1.1.1"},
+		{"dns.quad9.net:8853", "dns.quad9.net:8853", "dns.quad9.net"},
+		{"2606:4700:4700::1111", "[2606:4700:4700::1111]:853", "2606:4700:4700::1111"},
+	}
+	for _, tc := range testCases {
+		p := NewDoTDNSProvider(tc.server)
+		if p.server != tc.expected || p.client.TLSConfig.ServerName != tc.serverName {
+			t.Errorf("%s: expected %s verified as %s, got %s verified as %s",
+				tc.server, tc.expected, tc.serverName, p.server, p.client.TLSConfig.ServerName)
+		}
+	}
+}
+
+func TestFailoverDNSProvider(t *testing.T) {
+	answering := &countingDNSProvider{
+		mockDNSProvider: mockDNSProvider{Records: map[string][]string{"example.com": {"v=spf1 -all"}}},
+		TTLs:            map[string]uint32{"example.com": 120},
+	}
+	failing := &mockDNSProvider{} // every lookup fails with a non-void error
+
+	testCases := []struct {
+		name       string
+		providers  []DNSProvider
+		expectVoid bool
+		expectErr  bool
+	}{
+		{"first answers", []DNSProvider{answering, failing}, false, false},
+		{"skips failures", []DNSProvider{failing, answering}, false, false},
+		{"skips void answers", []DNSProvider{&voidDNSProvider{}, answering}, false, false},
+		{"void when any server found no records", []DNSProvider{&voidDNSProvider{}, failing}, true, true},
+		{"last error otherwise", []DNSProvider{failing, failing}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &FailoverDNSProvider{Providers: tc.providers}
+			records, err := f.LookupTXT(context.Background(), "example.com")
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q", records)
+				}
+				if isVoidLookup(err) != tc.expectVoid {
+					t.Errorf("Expected void lookup %v, got %v", tc.expectVoid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(records) != 1 || records[0] != "v=spf1 -all" {
+				t.Errorf("Unexpected records %q", records)
+			}
+			if ttl, ok := f.AnswerTTL("example.com", dns.TypeTXT); !ok || ttl != 120 {
+				t.Errorf("Expected the answering provider's TTL 120, got %d (%v)", ttl, ok)
+			}
+		})
+	}
+}
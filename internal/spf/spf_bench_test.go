@@ -117,8 +117,8 @@ func BenchmarkSplitAndChainSPF(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		result := SplitAndChainSPF(longSPF, "example.com")
-		if len(result) == 0 {
+		result, err := SplitAndChainSPF(longSPF, "example.com")
+		if err != nil || len(result) == 0 {
 			b.Fatalf("SplitAndChainSPF returned empty result")
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -82,12 +83,12 @@ func TestFlattenSPF(t *testing.T) {
 			hasError: false,
 		},
 		{
-			name:   "PTR mechanism (is ignored)",
+			name:   "PTR mechanism (kept verbatim)",
 			domain: "example.com",
 			provider: &mockDNSProvider{
 				Records: map[string][]string{"example.com": {"v=spf1 ptr:other.com ip4:1.2.3.4 ~all"}},
 			},
-			expected: "v=spf1 ip4:1.2.3.4 ~all",
+			expected: "v=spf1 ptr:other.com ip4:1.2.3.4 ~all",
 			hasError: false,
 		},
 		{
@@ -339,3 +340,336 @@ func TestIsValidMXHostname(t *testing.T) {
 		}
 	}
 }
+
+func TestFlattenSPFWithOptions_Qualifiers(t *testing.T) {
+	testCases := []struct {
+		name         string
+		records      map[string][]string
+		policy       string
+		expected     string
+		warnings     int
+		errSubstring string
+	}{
+		{
+			name: "Original all policy is kept",
+			records: map[string][]string{
+				"example.com":     {"v=spf1 include:_spf.google.com -all"},
+				"_spf.google.com": {"v=spf1 ip4:8.8.8.8 ~all"},
+			},
+			expected: "v=spf1 ip4:8.8.8.8 -all",
+		},
+		{
+			name: "Policy override",
+			records: map[string][]string{
+				"example.com":     {"v=spf1 include:_spf.google.com ~all"},
+				"_spf.google.com": {"v=spf1 ip4:8.8.8.8 ~all"},
+			},
+			policy:   "-all",
+			expected: "v=spf1 ip4:8.8.8.8 -all",
+		},
+		{
+			name: "No all mechanism",
+			records: map[string][]string{
+				"example.com": {"v=spf1 ip4:192.0.2.1"},
+			},
+			expected: "v=spf1 ip4:192.0.2.1",
+		},
+		{
+			name: "Qualified terms keep their order",
+			records: map[string][]string{
+				"example.com":       {"v=spf1 -ip4:192.0.2.66 include:relay.example.net ?include:maybe.example.org ~all"},
+				"relay.example.net": {"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.1 -all"},
+				"maybe.example.org": {"v=spf1 ip6:2001:db8::/32 ~all"},
+			},
+			expected: "v=spf1 -ip4:192.0.2.66 ip4:192.0.2.0/24 ip4:198.51.100.1 ?ip6:2001:db8::/32 ~all",
+		},
+		{
+			name: "Terms after all are not evaluated",
+			records: map[string][]string{
+				"example.com": {"v=spf1 ip4:192.0.2.1 -all ip4:192.0.2.2"},
+			},
+			expected: "v=spf1 ip4:192.0.2.1 -all",
+		},
+		{
+			name: "Non-pass term inside pass include is reported",
+			records: map[string][]string{
+				"example.com":       {"v=spf1 include:relay.example.net -all"},
+				"relay.example.net": {"v=spf1 -ip4:192.0.2.66 ip4:192.0.2.0/24 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 -all",
+			warnings: 1,
+		},
+		{
+			name: "Non-pass term inside non-pass include is refused",
+			records: map[string][]string{
+				"example.com":       {"v=spf1 -include:block.example.net ip4:192.0.2.1 -all"},
+				"block.example.net": {"v=spf1 ~ip4:192.0.2.1 ip4:198.51.100.0/24 -all"},
+			},
+			errSubstring: "cannot flatten -include:block.example.net faithfully",
+		},
+		{
+			name: "Include ending in +all is refused",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 include:open.example.net -all"},
+				"open.example.net": {"v=spf1 +all"},
+			},
+			errSubstring: "+all",
+		},
+		{
+			name: "Invalid policy",
+			records: map[string][]string{
+				"example.com": {"v=spf1 ip4:192.0.2.1 ~all"},
+			},
+			policy:       "fail",
+			errSubstring: "invalid all policy",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &mockDNSProvider{Records: tc.records}
+			result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{
+				ForceFlatten: true,
+				Policy:       tc.policy,
+			})
+			if tc.errSubstring != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errSubstring) {
+					t.Fatalf("Expected error containing %q, got %v", tc.errSubstring, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Flattened != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result.Flattened)
+			}
+			if len(result.Warnings) != tc.warnings {
+				t.Errorf("Expected %d warnings, got %d: %v", tc.warnings, len(result.Warnings), result.Warnings)
+			}
+		})
+	}
+}
+
+func TestFlattenSPF_RedirectAndExp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		records  map[string][]string
+		expected string
+		hasError bool
+	}{
+		{
+			name: "Redirect is followed",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 include:mail.example.org -all"},
+				"mail.example.org": {"v=spf1 ip4:198.51.100.1 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.1 -all",
+		},
+		{
+			name: "Redirect after local terms",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 ip4:203.0.113.5 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 ip4:203.0.113.5 ~all",
+		},
+		{
+			name: "Redirect ignored when all is present",
+			records: map[string][]string{
+				"example.com": {"v=spf1 ip4:203.0.113.5 redirect=_spf.example.net -all"},
+			},
+			expected: "v=spf1 ip4:203.0.113.5 -all",
+		},
+		{
+			name: "Redirect inside include",
+			records: map[string][]string{
+				"example.com":             {"v=spf1 include:vendor.example.net -all"},
+				"vendor.example.net":      {"v=spf1 redirect=_spf.vendor.example.net"},
+				"_spf.vendor.example.net": {"v=spf1 ip4:192.0.2.10 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.10 -all",
+		},
+		{
+			name: "Exp is preserved",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 include:_spf.example.net exp=explain._spf.%{d} -all"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 exp=explain._spf.%{d} -all",
+		},
+		{
+			name: "Exp of the redirect target replaces the root's",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 ip4:203.0.113.5 redirect=_spf.example.net exp=explain.example.com"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 exp=explain.example.net -all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 ip4:203.0.113.5 exp=explain.example.net -all",
+		},
+		{
+			name: "Exp dropped when the redirect target has none",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 ip4:203.0.113.5 redirect=_spf.example.net exp=explain.example.com"},
+				"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 -all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.0/24 ip4:203.0.113.5 -all",
+		},
+		{
+			name: "Redirect target without SPF record",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"not an spf record"},
+			},
+			hasError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, flattened, err := FlattenSPF(context.Background(), "example.com", &mockDNSProvider{Records: tc.records}, false)
+			if (err != nil) != tc.hasError {
+				t.Fatalf("Expected error: %v, got: %v", tc.hasError, err)
+			}
+			if !tc.hasError && flattened != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, flattened)
+			}
+		})
+	}
+}
+
+func TestFlattenSPFContent_RedirectExp(t *testing.T) {
+	records := map[string][]string{
+		"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 exp=explain.example.net -all"},
+	}
+	lookup := func(domain string) ([]string, error) {
+		return (&mockDNSProvider{Records: records}).LookupTXT(context.Background(), domain)
+	}
+	_, flattened, err := FlattenSPFContent("v=spf1 redirect=_spf.example.net exp=explain.example.com", lookup)
+	if err != nil {
+		t.Fatalf("FlattenSPFContent() error: %v", err)
+	}
+	if expected := "v=spf1 ip4:192.0.2.0/24 exp=explain.example.net -all"; flattened != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, flattened)
+	}
+}
+
+func TestFlattenSPFWithOptions_KeptTerms(t *testing.T) {
+	testCases := []struct {
+		name         string
+		records      map[string][]string
+		expected     string
+		kept         []string
+		errSubstring string
+	}{
+		{
+			name: "Exists and macros keep their position",
+			records: map[string][]string{
+				"example.com":      {"v=spf1 ip4:192.0.2.1 exists:%{i}._spf.%{d} include:_spf.example.net a:%{l}.users.example.com -all"},
+				"_spf.example.net": {"v=spf1 ip4:198.51.100.0/24 ~all"},
+			},
+			expected: "v=spf1 ip4:192.0.2.1 exists:%{i}._spf.%{d} ip4:198.51.100.0/24 a:%{l}.users.example.com -all",
+			kept:     []string{"exists:%{i}._spf.%{d}", "a:%{l}.users.example.com"},
+		},
+		{
+			name: "Domain-independent terms are hoisted from includes",
+			records: map[string][]string{
+				"example.com":        {"v=spf1 ~include:vendor.example.net -all"},
+				"vendor.example.net": {"v=spf1 ip4:203.0.113.0/24 exists:%{ir}.%{v}.rbl.example.org ptr:mail.vendor.example.net -all"},
+			},
+			expected: "v=spf1 ~ip4:203.0.113.0/24 ~exists:%{ir}.%{v}.rbl.example.org ~ptr:mail.vendor.example.net -all",
+			kept:     []string{"~exists:%{ir}.%{v}.rbl.example.org", "~ptr:mail.vendor.example.net"},
+		},
+		{
+			name: "Domain-dependent terms cannot leave their include",
+			records: map[string][]string{
+				"example.com":        {"v=spf1 include:vendor.example.net -all"},
+				"vendor.example.net": {"v=spf1 ip4:203.0.113.0/24 exists:%{i}._spf.%{d} -all"},
+			},
+			errSubstring: "depends on the domain",
+		},
+		{
+			name: "Bare ptr in an include is domain-dependent",
+			records: map[string][]string{
+				"example.com":        {"v=spf1 include:vendor.example.net -all"},
+				"vendor.example.net": {"v=spf1 ptr -all"},
+			},
+			errSubstring: "depends on the domain",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &mockDNSProvider{Records: tc.records}
+			result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{ForceFlatten: true})
+			if tc.errSubstring != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errSubstring) {
+					t.Fatalf("Expected error containing %q, got %v", tc.errSubstring, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Flattened != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result.Flattened)
+			}
+			if strings.Join(result.KeptTerms, " ") != strings.Join(tc.kept, " ") {
+				t.Errorf("Expected kept terms %v, got %v", tc.kept, result.KeptTerms)
+			}
+		})
+	}
+}
+
+func TestCountRecordLookups(t *testing.T) {
+	testCases := []struct {
+		record   string
+		expected int
+	}{
+		{"v=spf1 ip4:192.0.2.1 ip6:2001:db8::1 -all", 0},
+		{"v=spf1 exists:%{i}._spf.%{d} ptr a mx include:example.net -all", 5},
+		{"v=spf1 ip4:192.0.2.1 redirect=_spf.example.net", 1},
+		{"v=spf1 redirect=_spf.example.net -all", 0},
+		{"v=spf1 a -all include:example.net mx", 1},
+		{"not an spf record", 0},
+	}
+
+	for _, tc := range testCases {
+		if got := CountRecordLookups(tc.record); got != tc.expected {
+			t.Errorf("CountRecordLookups(%q) = %d, expected %d", tc.record, got, tc.expected)
+		}
+	}
+}
+
+func TestFlattenSPFWithOptions_Retained(t *testing.T) {
+	provider := &mockDNSProvider{
+		Records: map[string][]string{
+			"example.com":      {"v=spf1 a:mail.vendor.example ~include:bulk.example.net -all"},
+			"bulk.example.net": {"v=spf1 ip4:198.51.100.0/24 -all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.vendor.example": {net.ParseIP("192.0.2.1")},
+		},
+	}
+
+	result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{
+		ForceFlatten: true,
+		Retained:     []string{"ip4:192.0.2.1", "ip4:192.0.2.7", "~ip4:198.51.100.0/24", "~ip4:203.0.113.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectedResolved := []string{"ip4:192.0.2.1", "~ip4:198.51.100.0/24"}
+	if !reflect.DeepEqual(result.Resolved, expectedResolved) {
+		t.Errorf("Expected resolved %v, got %v", expectedResolved, result.Resolved)
+	}
+	expectedPending := []string{"ip4:192.0.2.7", "~ip4:203.0.113.0/24"}
+	if !reflect.DeepEqual(result.PendingRemoval, expectedPending) {
+		t.Errorf("Expected pending removal %v, got %v", expectedPending, result.PendingRemoval)
+	}
+	expected := "v=spf1 ip4:192.0.2.1 ~ip4:198.51.100.0/24 ip4:192.0.2.7 ~ip4:203.0.113.0/24 -all"
+	if result.Flattened != expected {
+		t.Errorf("Expected %q, got %q", expected, result.Flattened)
+	}
+}
@@ -2,69 +2,463 @@ package spf
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 const (
 	// maxSPFChars is the maximum number of characters allowed in a single SPF string.
 	maxSPFChars = 255
+	// maxUDPMessage is the DNS message size every resolver accepts over UDP without
+	// EDNS0 (RFC 1035 section 4.2.1).
+	maxUDPMessage = 512
 )
 
-// SplitAndChainSPF splits a flattened SPF record into multiple chained TXT records for a domain.
-// Returns a map of record names to values, plus the main domain record.
-func SplitAndChainSPF(spfRecord, domain string) map[string]string {
-	if len(spfRecord) <= maxSPFChars {
+// SplitLayout selects how the records produced by SplitAndChainSPFWithOptions link
+// to each other.
+type SplitLayout string
+
+const (
+	// SplitLayoutChain links the records of each qualifier run as a chain: the root
+	// includes the first record, which includes the second, and so on.
+	SplitLayoutChain SplitLayout = "chain"
+	// SplitLayoutTree has the root include every record directly, through an
+	// intermediate level of records only when the root has no room for all includes.
+	SplitLayoutTree SplitLayout = "tree"
+)
+
+// DefaultSplitPrefix is the label prefix of the records produced by splitting.
+const DefaultSplitPrefix = "spf"
+
+// SplitOptions configures SplitAndChainSPFWithOptions. The zero value produces the
+// chain layout with records named spf0.<domain>, spf1.<domain>, ...
+type SplitOptions struct {
+	Layout SplitLayout // Defaults to SplitLayoutChain
+	Prefix string      // Label prefix of the records, numbered from 0; defaults to DefaultSplitPrefix
+
+	// MaxRecordBytes is the longest content of one TXT record, which is published as
+	// several strings of up to 255 bytes (see TXTStrings). It is capped so the record's
+	// answer fits in a 512-byte UDP response. 0 keeps each record to a single string.
+	MaxRecordBytes int
+}
+
+func (o SplitOptions) prefix() string {
+	if o.Prefix == "" {
+		return DefaultSplitPrefix
+	}
+	return o.Prefix
+}
+
+// recordLimit returns the longest content of the TXT record at name.
+func (o SplitOptions) recordLimit(name string) int {
+	if o.MaxRecordBytes <= maxSPFChars {
+		return maxSPFChars
+	}
+	return max(maxSPFChars, min(o.MaxRecordBytes, udpTXTBudget(name)))
+}
+
+// udpTXTBudget returns the longest content of a TXT record at name whose answer fits
+// in a maxUDPMessage-byte response: the 12-byte header, the question, then the answer's
+// compressed name, type, class, TTL and length, and one length byte per string. Other
+// records at the same name share the response, so the budget assumes none.
+func udpTXTBudget(name string) int {
+	room := maxUDPMessage - 12 - (len(strings.TrimSuffix(name, ".")) + 2 + 4) - (2 + 10)
+	content := room
+	for content > 0 && content+(content+maxSPFChars-1)/maxSPFChars > room {
+		content--
+	}
+	return content
+}
+
+// childName returns the name of the split record with index i.
+func (o SplitOptions) childName(i int, domain string) string {
+	return fmt.Sprintf("%s%d.%s", o.prefix(), i, domain)
+}
+
+// IsSplitRecord reports whether name is one of the records splitting produces for
+// domain: the prefix followed by an index, directly below domain.
+func (o SplitOptions) IsSplitRecord(name, domain string) bool {
+	label, ok := strings.CutSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), "."+strings.ToLower(domain))
+	if !ok {
+		return false
+	}
+	index, ok := strings.CutPrefix(label, strings.ToLower(o.prefix()))
+	if !ok || index == "" {
+		return false
+	}
+	return strings.Trim(index, "0123456789") == ""
+}
+
+// SplitAndChainSPF splits a flattened SPF record into multiple chained TXT records for
+// a domain with the default SplitOptions. See SplitAndChainSPFWithOptions.
+func SplitAndChainSPF(spfRecord, domain string) (map[string]string, error) {
+	return SplitAndChainSPFWithOptions(spfRecord, domain, SplitOptions{})
+}
+
+// SplitAndChainSPFWithOptions splits a flattened SPF record into multiple TXT records
+// for a domain. Returns a map of record names to values, plus the main domain record.
+// Records are split when longer than a TXT string allows, or than opts.MaxRecordBytes
+// when set; the values of such records are published as several strings.
+//
+// Consecutive mechanisms sharing a qualifier are moved to records that hold them as
+// pass terms, and the root record includes them with that qualifier, so "-ip4:..."
+// terms stay fail results. The root keeps the record's own all mechanism and any
+// modifiers, as well as terms that depend on the domain they are published at (such
+// as "exists:%{i}._spf.%{d}"), in their original position.
+//
+// With SplitLayoutChain, each run of terms is chained: every record but the last ends
+// with the include of the next, so receivers walk the whole chain. With SplitLayoutTree,
+// the root includes each record directly and the records need no room for a chaining
+// include. When the root has no room for all includes, those of the longest runs move
+// to intermediate records the root includes instead. Either way every record costs
+// one DNS lookup; the tree layout fails rather than need more than MaxDNSLookups,
+// counting the lookups of terms kept on the records too.
+//
+// The terms of each run are packed into as few records as possible (see packParts).
+// Terms are never cut: an error is returned when a term cannot fit in a split record
+// or the root record is longer than a TXT record allows.
+func SplitAndChainSPFWithOptions(spfRecord, domain string, opts SplitOptions) (map[string]string, error) {
+	switch opts.Layout {
+	case "", SplitLayoutChain, SplitLayoutTree:
+	default:
+		return nil, fmt.Errorf("unknown record layout %q", opts.Layout)
+	}
+	if len(spfRecord) <= opts.recordLimit(domain) {
 		return map[string]string{
 			domain: spfRecord,
+		}, nil
+	}
+
+	// The "all" mechanism and modifiers stay on the root record
+	var allTerm string
+	var modifiers []string
+	var runs []*qualifierRun
+	for _, part := range recordTerms(spfRecord) {
+		switch kind := classifyTerm(part); {
+		case kind == KindAll:
+			allTerm = part
+		case kind != 0 && !kind.IsMechanism():
+			modifiers = append(modifiers, part)
+		default:
+			if term, err := ParseTerm(part); err == nil && term.DependsOnDomain() {
+				runs = append(runs, &qualifierRun{pinned: part})
+				continue
+			}
+			qualifier, _, _, _ := splitTerm(part)
+			if qualifier == 0 {
+				qualifier = QualifierPass
+			} else {
+				part = part[1:]
+			}
+			if len(runs) == 0 || runs[len(runs)-1].pinned != "" || runs[len(runs)-1].qualifier != qualifier {
+				runs = append(runs, &qualifierRun{qualifier: qualifier})
+			}
+			runs[len(runs)-1].parts = append(runs[len(runs)-1].parts, part)
 		}
 	}
 
-	// Remove the trailing "~all" or "-all" if present, as we'll add it back during chaining
-	spfRecord = strings.TrimSuffix(spfRecord, " ~all")
-	spfRecord = strings.TrimSuffix(spfRecord, " -all")
+	result := make(map[string]string)
+	next := 0
+	for _, run := range runs {
+		if run.pinned != "" {
+			continue
+		}
+		var err error
+		if opts.Layout == SplitLayoutTree {
+			run.includes, next, err = opts.treeLeaves(run.parts, domain, next, result)
+		} else {
+			run.includes = []string{opts.childName(next, domain)}
+			next, err = opts.chainParts(run.parts, domain, next, result)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	parts := strings.Fields(spfRecord)
-	var records []string
-	var currentRecord strings.Builder
+	// Main domain record includes the first record of each chain, or every leaf
+	rootRecord := func() string {
+		rootParts := []string{spfVersion}
+		for _, run := range runs {
+			if run.pinned != "" {
+				rootParts = append(rootParts, run.pinned)
+				continue
+			}
+			for _, name := range run.includes {
+				rootParts = append(rootParts, run.qualifier.Prefix()+"include:"+name)
+			}
+		}
+		rootParts = append(rootParts, modifiers...)
+		if allTerm != "" {
+			rootParts = append(rootParts, allTerm)
+		}
+		return strings.Join(rootParts, " ")
+	}
+	root := rootRecord()
+	for opts.Layout == SplitLayoutTree && len(root) > opts.recordLimit(domain) {
+		// Move the includes of the run with the most of them to intermediate records
+		var widest *qualifierRun
+		for _, run := range runs {
+			if len(run.includes) > 1 && (widest == nil || len(run.includes) > len(widest.includes)) {
+				widest = run
+			}
+		}
+		if widest == nil {
+			break
+		}
+		includes := make([]string, len(widest.includes))
+		for i, name := range widest.includes {
+			includes[i] = "include:" + name
+		}
+		var err error
+		if widest.includes, next, err = opts.treeLeaves(includes, domain, next, result); err != nil {
+			return nil, err
+		}
+		root = rootRecord()
+	}
+	if limit := opts.recordLimit(domain); len(root) > limit {
+		return nil, fmt.Errorf("SPF record for %s is %d bytes after splitting, over the %d-byte limit: too many terms must stay on it", domain, len(root), limit)
+	}
+	result[domain] = root
+	if opts.Layout == SplitLayoutTree {
+		// Every record is included once, so the lookups of evaluating the domain are
+		// those of all records: their includes, plus terms kept on them such as exists.
+		lookups := 0
+		for _, record := range result {
+			lookups += CountRecordLookups(record)
+		}
+		if lookups > MaxDNSLookups {
+			return nil, fmt.Errorf("SPF record for %s needs %d DNS lookups after splitting into %d records, over the %d-lookup limit", domain, lookups, len(result), MaxDNSLookups)
+		}
+	}
+	return result, nil
+}
 
-	currentRecord.WriteString(parts[0]) // "v=spf1"
+// qualifierRun is a sequence of consecutive mechanisms sharing a qualifier,
+// stored without the qualifier prefix, or a single term pinned to the root record.
+// includes names the records the root includes for the run.
+type qualifierRun struct {
+	qualifier Qualifier
+	parts     []string
+	pinned    string
+	includes  []string
+}
 
-	for i, part := range parts[1:] {
-		// Calculate the chaining string that will be added later
-		chaining := " ~all"
-		if i < len(parts)-1 {
-			chaining = " include:spfX." + domain + " ~all" // X will be replaced later
+// treeLeaves packs parts into records named <prefix><start>.domain, <prefix><start+1>.domain,
+// ... that include no other record, adds them to result and returns their names and
+// the next unused index.
+func (o SplitOptions) treeLeaves(parts []string, domain string, start int, result map[string]string) ([]string, int, error) {
+	// Longer names leave less room in a UDP response: pack for the longest possible
+	// name, then again for the name of the last record actually needed.
+	capacity := func(last int) int {
+		return o.recordLimit(o.childName(last, domain)) - len(spfVersion) - len(" ~all")
+	}
+	records, err := packParts(parts, capacity(start+len(parts)-1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot split the SPF record for %s: %w", domain, err)
+	}
+	if fewer, err := packParts(parts, capacity(start+len(records)-1)); err == nil {
+		records = fewer
+	}
+	names := make([]string, len(records))
+	for i, terms := range records {
+		names[i] = o.childName(start+i, domain)
+		result[names[i]] = spfVersion + " " + strings.Join(terms, " ") + " ~all"
+	}
+	return names, start + len(records), nil
+}
+
+// chainParts packs parts into records named <prefix><start>.domain, <prefix><start+1>.domain,
+// ... each including the next, adds them to result and returns the next unused index.
+func (o SplitOptions) chainParts(parts []string, domain string, start int, result map[string]string) (int, error) {
+	records := [][]string{parts}
+	if len(spfVersion)+1+len(strings.Join(parts, " "))+len(" ~all") > o.recordLimit(o.childName(start, domain)) {
+		// Every record but the last ends with the include of the next one, whose name
+		// grows with the record count: pack for the longest possible name, then again
+		// for the name of the last record actually needed.
+		capacity := func(last int) int {
+			name := o.childName(last, domain)
+			return o.recordLimit(name) - len(spfVersion) - len(" include:"+name+" ~all")
 		}
-		// Estimate the max length for this record including chaining
-		if currentRecord.Len()+len(part)+1+len(chaining) > maxSPFChars {
-			records = append(records, currentRecord.String())
-			currentRecord.Reset()
-			currentRecord.WriteString(parts[0])
+		var err error
+		if records, err = packParts(parts, capacity(start+len(parts)-1)); err != nil {
+			return 0, fmt.Errorf("cannot split the SPF record for %s: %w", domain, err)
+		}
+		if fewer, err := packParts(parts, capacity(start+len(records)-1)); err == nil {
+			records = fewer
 		}
-		currentRecord.WriteString(" ")
-		currentRecord.WriteString(part)
 	}
 
-	records = append(records, currentRecord.String())
-
-	result := make(map[string]string)
-	for i := 0; i < len(records); i++ {
-		name := "spf" + fmt.Sprintf("%d.%s", i, domain)
+	for i, terms := range records {
+		name := o.childName(start+i, domain)
 		chaining := " ~all"
 		if i < len(records)-1 {
-			chaining = " include:spf" + fmt.Sprintf("%d.%s", i+1, domain) + " ~all"
+			chaining = " include:" + o.childName(start+i+1, domain) + " ~all"
 		}
-		// Ensure the final record does not exceed 255 chars
-		record := records[i]
-		maxLen := maxSPFChars - len(chaining)
-		if len(record) > maxLen {
-			record = record[:maxLen]
+		record := spfVersion + " " + strings.Join(terms, " ") + chaining
+		if limit := o.recordLimit(name); len(record) > limit {
+			return 0, fmt.Errorf("cannot split the SPF record for %s: %s would be %d bytes, over the %d-byte limit", domain, name, len(record), limit)
 		}
-		result[name] = record + chaining
+		result[name] = record
 	}
-	// Main domain record includes spf0
-	result[domain] = "v=spf1 include:spf0." + domain + " ~all"
-	return result
+	return start + len(records), nil
+}
+
+// packParts distributes parts over as few records as possible, each holding at most
+// capacity bytes of space-prefixed terms. It packs first-fit decreasing: the longest
+// term goes first into the first record with room for it, which is within 11/9 of the
+// optimal record count and optimal for the similar-length ip4/ip6 terms of flattened
+// records. Each record keeps its terms in their original order.
+func packParts(parts []string, capacity int) ([][]string, error) {
+	order := make([]int, len(parts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return len(parts[order[a]]) > len(parts[order[b]]) })
+
+	var bins [][]int
+	var used []int
+	for _, i := range order {
+		size := 1 + len(parts[i])
+		if size > capacity {
+			return nil, fmt.Errorf("term %q is %d bytes; a chained record has room for %d", parts[i], len(parts[i]), capacity-1)
+		}
+		bin := 0
+		for bin < len(bins) && used[bin]+size > capacity {
+			bin++
+		}
+		if bin == len(bins) {
+			bins = append(bins, nil)
+			used = append(used, 0)
+		}
+		bins[bin] = append(bins[bin], i)
+		used[bin] += size
+	}
+
+	records := make([][]string, len(bins))
+	for b, bin := range bins {
+		sort.Ints(bin)
+		for _, i := range bin {
+			records[b] = append(records[b], parts[i])
+		}
+	}
+	return records, nil
+}
+
+// RecordUsage is the length of one TXT record produced by SplitAndChainSPFWithOptions.
+type RecordUsage struct {
+	Name    string
+	Bytes   int
+	Limit   int // Longest content the record may have
+	Strings int // Number of strings the record is published as
+}
+
+// Utilization returns the share of the record's limit that is used.
+func (u RecordUsage) Utilization() float64 {
+	return float64(u.Bytes) / float64(u.Limit)
+}
+
+// String formats the usage as "231/255 bytes, 91%", with the number of strings of
+// records published as more than one: "431/469 bytes, 92%, 2 strings".
+func (u RecordUsage) String() string {
+	usage := fmt.Sprintf("%d/%d bytes, %.0f%%", u.Bytes, u.Limit, u.Utilization()*100)
+	if u.Strings > 1 {
+		usage += fmt.Sprintf(", %d strings", u.Strings)
+	}
+	return usage
+}
+
+// RecordUtilization returns the length of each record produced by SplitAndChainSPF
+// for domain: the root record first, then the split records in index order.
+func RecordUtilization(records map[string]string, domain string) []RecordUsage {
+	return SplitOptions{}.RecordUtilization(records, domain)
+}
+
+// RecordUtilization returns the length of each record produced by
+// SplitAndChainSPFWithOptions with o for domain: the root record first, then the split
+// records in index order.
+func (o SplitOptions) RecordUtilization(records map[string]string, domain string) []RecordUsage {
+	var usage []RecordUsage
+	for name, content := range records {
+		usage = append(usage, RecordUsage{
+			Name:    name,
+			Bytes:   len(content),
+			Limit:   o.recordLimit(name),
+			Strings: len(TXTStrings(content)),
+		})
+	}
+	index := func(name string) int {
+		if name == domain {
+			return -1
+		}
+		label := strings.TrimSuffix(name, "."+domain)
+		i, err := strconv.Atoi(label[len(strings.TrimRight(label, "0123456789")):])
+		if err != nil {
+			return len(records)
+		}
+		return i
+	}
+	sort.Slice(usage, func(a, b int) bool {
+		if ia, ib := index(usage[a].Name), index(usage[b].Name); ia != ib {
+			return ia < ib
+		}
+		return usage[a].Name < usage[b].Name
+	})
+	return usage
+}
+
+// TXTStrings splits the content of a TXT record into the strings it is published as,
+// each at most 255 bytes. Receivers join them without separators (RFC 7208 section 3.3),
+// so strings may end and start anywhere within a term.
+func TXTStrings(content string) []string {
+	if len(content) <= maxSPFChars {
+		return []string{content}
+	}
+	var strs []string
+	for len(content) > maxSPFChars {
+		strs = append(strs, content[:maxSPFChars])
+		content = content[maxSPFChars:]
+	}
+	return append(strs, content)
+}
+
+// FormatTXTRecord returns content as TXT record presentation: unchanged when it fits in
+// one string, otherwise each of its TXTStrings quoted and separated by spaces, as in
+// zone files ("v=spf1 ... ip4:192.0.2" ".1 ... ~all").
+func FormatTXTRecord(content string) string {
+	strs := TXTStrings(content)
+	if len(strs) == 1 {
+		return content
+	}
+	quoted := make([]string, len(strs))
+	for i, s := range strs {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ParseTXTRecord returns the content of a TXT record given in the presentation produced
+// by FormatTXTRecord, joining quoted strings. Content that is not a sequence of quoted
+// strings is returned unchanged.
+func ParseTXTRecord(presentation string) string {
+	rest := strings.TrimSpace(presentation)
+	if !strings.HasPrefix(rest, `"`) {
+		return presentation
+	}
+	var content strings.Builder
+	for rest != "" {
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return presentation
+		}
+		s, err := strconv.Unquote(quoted)
+		if err != nil {
+			return presentation
+		}
+		content.WriteString(s)
+		rest = strings.TrimLeft(rest[len(quoted):], " \t")
+	}
+	return content.String()
 }
 
 // Exported wrapper for tests and compatibility
@@ -72,21 +466,29 @@ func SplitSPF(spfRecord string) []string {
 	if len(spfRecord) <= maxSPFChars {
 		return []string{spfRecord}
 	}
-	parts := strings.Fields(spfRecord)
+	var allTerm string
+	var parts []string
+	for _, part := range recordTerms(spfRecord) {
+		if isAllMechanism(part) {
+			allTerm = " " + part // each split record gets its own copy of the all mechanism
+			continue
+		}
+		parts = append(parts, part)
+	}
 	var records []string
 	var currentRecord strings.Builder
-	currentRecord.WriteString(parts[0]) // "v=spf1"
-	for _, part := range parts[1:] {
-		if currentRecord.Len()+len(part)+1+len(" ~all") > maxSPFChars {
-			records = append(records, currentRecord.String()+" ~all")
+	currentRecord.WriteString(spfVersion)
+	for _, part := range parts {
+		if currentRecord.Len()+len(part)+1+len(allTerm) > maxSPFChars {
+			records = append(records, currentRecord.String()+allTerm)
 			currentRecord.Reset()
-			currentRecord.WriteString(parts[0])
+			currentRecord.WriteString(spfVersion)
 		}
 		currentRecord.WriteString(" ")
 		currentRecord.WriteString(part)
 	}
 	if currentRecord.Len() > 0 {
-		records = append(records, currentRecord.String()+" ~all")
+		records = append(records, currentRecord.String()+allTerm)
 	}
 	return records
 }
@@ -1,6 +1,9 @@
 package spf
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"strings"
 	"testing"
 )
@@ -50,7 +53,10 @@ func TestSplitSPF(t *testing.T) {
 func TestSplitAndChainSPF_Lengths(t *testing.T) {
 	spfRecord := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 50) + "~all" // Large record
 	domain := "example.com"
-	result := SplitAndChainSPF(spfRecord, domain)
+	result, err := SplitAndChainSPF(spfRecord, domain)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
 	for name, rec := range result {
 		if len(rec) > 255 {
@@ -64,3 +70,362 @@ func TestSplitAndChainSPF_Lengths(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitAndChainSPF_Qualifiers(t *testing.T) {
+	spfRecord := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + strings.Repeat("-ip4:198.51.100.1 ", 20) + "exp=explain.example.com -all"
+	domain := "example.com"
+	result, err := SplitAndChainSPF(spfRecord, domain)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	root := result[domain]
+	if !strings.HasPrefix(root, "v=spf1 include:spf0.example.com -include:spf") {
+		t.Errorf("Root record should include the pass chain then the fail chain, got %q", root)
+	}
+	if !strings.HasSuffix(root, " exp=explain.example.com -all") {
+		t.Errorf("Root record should keep modifiers and the original all policy, got %q", root)
+	}
+
+	for name, rec := range result {
+		if len(rec) > 255 {
+			t.Errorf("Record %s exceeds 255 chars: %d", name, len(rec))
+		}
+		if name != domain && strings.Contains(rec, "-ip4:") {
+			t.Errorf("Chained record %s must hold pass terms only: %s", name, rec)
+		}
+	}
+}
+
+func TestSplitSPF_KeepsAllPolicy(t *testing.T) {
+	result := SplitSPF("v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + "-all")
+	for i, rec := range result {
+		if !strings.HasSuffix(rec, " -all") {
+			t.Errorf("Record %d should end with -all: %s", i, rec)
+		}
+	}
+}
+
+func TestSplitAndChainSPF_PinsDomainDependentTerms(t *testing.T) {
+	spfRecord := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 10) + "exists:%{i}._spf.%{d} " + strings.Repeat("ip4:198.51.100.1 ", 10) + "exists:%{i}.bl.example.net ~all"
+	domain := "example.com"
+	result, err := SplitAndChainSPF(spfRecord, domain)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	root := result[domain]
+	if !strings.Contains(root, "include:spf0.example.com exists:%{i}._spf.%{d} include:spf1.example.com") {
+		t.Errorf("Domain-dependent term should stay on the root between its neighbours, got %q", root)
+	}
+	for name, rec := range result {
+		if name != domain && strings.Contains(rec, "%{d}") {
+			t.Errorf("Chained record %s must not contain domain-dependent terms: %s", name, rec)
+		}
+	}
+	if !strings.Contains(result["spf1.example.com"], "exists:%{i}.bl.example.net") {
+		t.Errorf("Domain-independent kept term may be chained, got %q", result["spf1.example.com"])
+	}
+}
+
+func TestSplitAndChainSPF_PacksWithoutTruncating(t *testing.T) {
+	// Mixed term lengths: filling records in order wastes the room a long term no
+	// longer fits in.
+	var terms []string
+	for i := 0; i < 40; i++ {
+		terms = append(terms, fmt.Sprintf("ip6:2001:db8:%x:%x::/64", i*4099, i))
+		terms = append(terms, fmt.Sprintf("ip4:192.0.%d.%d", i, i))
+	}
+	domain := "example.com"
+	result, err := SplitAndChainSPF("v=spf1 "+strings.Join(terms, " ")+" -all", domain)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	published := make(map[string]bool)
+	size := 0
+	for name, rec := range result {
+		if len(rec) > maxSPFChars {
+			t.Errorf("Record %s exceeds %d chars: %d", name, maxSPFChars, len(rec))
+		}
+		if name == domain {
+			continue
+		}
+		for _, part := range strings.Fields(rec) {
+			published[part] = true
+		}
+	}
+	for _, term := range terms {
+		if !published[term] {
+			t.Errorf("Term %s is missing from the chained records", term)
+		}
+		size += 1 + len(term)
+	}
+
+	// No packing can use fewer records than the terms' total length requires
+	capacity := maxSPFChars - len(spfVersion) - len(" include:spf9.example.com ~all")
+	minimum := (size + capacity - 1) / capacity
+	if chained := len(result) - 1; chained != minimum {
+		t.Errorf("Expected %d chained records, got %d", minimum, chained)
+	}
+}
+
+func TestSplitAndChainSPF_Errors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		spfRecord string
+		expectErr string
+	}{
+		{
+			name:      "term longer than a chained record",
+			spfRecord: "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 10) + "include:" + strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." + strings.Repeat("c", 60) + "." + strings.Repeat("d", 40) + ".example ~all",
+			expectErr: "a chained record has room for",
+		},
+		{
+			name:      "root record too long",
+			spfRecord: "v=spf1 " + strings.Repeat("exists:%{i}._spf.%{d} ", 12) + "~all",
+			expectErr: "over the 255-byte limit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := SplitAndChainSPF(tc.spfRecord, "example.com")
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("Expected error containing %q, got %v (%v)", tc.expectErr, err, result)
+			}
+		})
+	}
+}
+
+func TestRecordUtilization(t *testing.T) {
+	records := map[string]string{"example.com": "v=spf1 include:spf0.example.com ~all"}
+	for i := 0; i < 11; i++ {
+		records[fmt.Sprintf("spf%d.example.com", i)] = "v=spf1 " + strings.Repeat("x", i) + " ~all"
+	}
+	usage := RecordUtilization(records, "example.com")
+	if len(usage) != 12 || usage[0].Name != "example.com" || usage[1].Name != "spf0.example.com" || usage[11].Name != "spf10.example.com" {
+		t.Fatalf("Expected the root record, then spf0 to spf10 in order, got %v", usage)
+	}
+	if got := usage[0].String(); got != "36/255 bytes, 14%" {
+		t.Errorf("Unexpected usage %q", got)
+	}
+}
+
+func TestSplitAndChainSPFWithOptions_Tree(t *testing.T) {
+	ipTerms := func(n int) []string {
+		var terms []string
+		for i := 0; i < n; i++ {
+			terms = append(terms, fmt.Sprintf("ip4:10.%d.%d.0/24", i/200, i%200))
+		}
+		return terms
+	}
+	testCases := []struct {
+		name          string
+		domain        string
+		terms         []string
+		intermediates bool // The root has no room to include every leaf directly
+	}{
+		{
+			name:   "leaves included by the root",
+			domain: "example.com",
+			terms:  append(append(ipTerms(30), "-ip4:192.0.2.1", "-ip4:192.0.2.2"), ipTerms(60)[30:]...),
+		},
+		{
+			name:          "intermediate records",
+			domain:        "a-rather-long-subdomain-name.example.com",
+			terms:         ipTerms(110),
+			intermediates: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			original := "v=spf1 " + strings.Join(tc.terms, " ") + " -all"
+			opts := SplitOptions{Layout: SplitLayoutTree, Prefix: "_spf"}
+			result, err := SplitAndChainSPFWithOptions(original, tc.domain, opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			chain, err := SplitAndChainSPF(original, tc.domain)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(result) > len(chain) {
+				t.Errorf("Expected no more records than the chain layout's %d, got %d", len(chain), len(result))
+			}
+
+			includers := 0
+			for name, rec := range result {
+				if len(rec) > maxSPFChars {
+					t.Errorf("Record %s exceeds %d chars: %d", name, maxSPFChars, len(rec))
+				}
+				if name != tc.domain && !opts.IsSplitRecord(name, tc.domain) {
+					t.Errorf("Record %s is not named with the _spf prefix", name)
+				}
+				if name != tc.domain && strings.Contains(rec, "include:") {
+					includers++
+				}
+			}
+			if tc.intermediates != (includers > 0) {
+				t.Errorf("Expected intermediate records %v, got %d: %v", tc.intermediates, includers, result)
+			}
+
+			provider := &mockDNSProvider{}
+			for _, ip := range []string{"10.0.5.1", "10.0.29.9", "10.0.31.1", "10.0.109.1", "192.0.2.1", "192.0.2.3"} {
+				req := CheckRequest{IP: net.ParseIP(ip), Domain: tc.domain}
+				before := CheckHostWithRecords(context.Background(), provider, req, map[string]string{tc.domain: original})
+				after := CheckHostWithRecords(context.Background(), provider, req, result)
+				if before.Result != after.Result {
+					t.Errorf("%s: original record gives %s, split records give %s", ip, before.Result, after.Result)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitAndChainSPFWithOptions_Errors(t *testing.T) {
+	var terms []string
+	for i := 0; i < 200; i++ {
+		terms = append(terms, fmt.Sprintf("ip4:10.0.%d.0/24", i))
+	}
+	record := "v=spf1 " + strings.Join(terms, " ") + " -all"
+
+	_, err := SplitAndChainSPFWithOptions(record, "example.com", SplitOptions{Layout: SplitLayoutTree})
+	if err == nil || !strings.Contains(err.Error(), "over the 10-lookup limit") {
+		t.Errorf("Expected the lookup limit error, got %v", err)
+	}
+
+	// Nine records would fit, but the terms kept on the root need lookups too
+	kept := "v=spf1 exists:%{i}._spf.%{d} include:_spf.vendor.example mx " + strings.Join(terms[:90], " ") + " -all"
+	_, err = SplitAndChainSPFWithOptions(kept, "example.com", SplitOptions{Layout: SplitLayoutTree})
+	if err == nil || !strings.Contains(err.Error(), "needs 11 DNS lookups after splitting into 9 records") {
+		t.Errorf("Expected the lookup limit error counting kept terms, got %v", err)
+	}
+	_, err = SplitAndChainSPFWithOptions(record, "example.com", SplitOptions{Layout: "star"})
+	if err == nil || !strings.Contains(err.Error(), "unknown record layout") {
+		t.Errorf("Expected an unknown layout error, got %v", err)
+	}
+}
+
+func TestSplitOptions_IsSplitRecord(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		name     string
+		expected bool
+	}{
+		{"", "spf0.example.com", true},
+		{"", "SPF12.Example.com.", true},
+		{"", "spf-unflat.example.com", false},
+		{"", "spf.example.com", false},
+		{"", "spf0.other.example.com", false},
+		{"_spf", "_spf3.example.com", true},
+		{"_spf", "spf3.example.com", false},
+		{"s", "s1.example.com", true},
+		{"s", "s1x.example.com", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.prefix+" "+tc.name, func(t *testing.T) {
+			if got := (SplitOptions{Prefix: tc.prefix}).IsSplitRecord(tc.name, "example.com"); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSplitAndChainSPFWithOptions_MultiString(t *testing.T) {
+	var terms []string
+	for i := 0; i < 60; i++ {
+		terms = append(terms, fmt.Sprintf("ip4:10.0.%d.0/24", i))
+	}
+	record := "v=spf1 " + strings.Join(terms, " ") + " -all"
+	domain := "example.com"
+	if budget := udpTXTBudget(domain); budget != 469 {
+		t.Errorf("Expected a UDP budget of 469 bytes for %s, got %d", domain, budget)
+	}
+
+	testCases := []struct {
+		name     string
+		opts     SplitOptions
+		expected int // Records published, including the root
+	}{
+		{"single strings", SplitOptions{}, 6},
+		{"within the UDP budget", SplitOptions{MaxRecordBytes: 512}, 4},
+		{"tree layout", SplitOptions{MaxRecordBytes: 400, Layout: SplitLayoutTree}, 4},
+		{"whole record fits", SplitOptions{MaxRecordBytes: 512}, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spfRecord := record
+			if tc.expected == 1 {
+				spfRecord = "v=spf1 " + strings.Join(terms[:25], " ") + " -all"
+			}
+			result, err := SplitAndChainSPFWithOptions(spfRecord, domain, tc.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(result) != tc.expected {
+				t.Errorf("Expected %d records, got %d: %v", tc.expected, len(result), result)
+			}
+			for _, usage := range tc.opts.RecordUtilization(result, domain) {
+				if usage.Bytes > usage.Limit || usage.Limit > max(maxSPFChars, tc.opts.MaxRecordBytes) {
+					t.Errorf("Record %s is over its limit: %s", usage.Name, usage)
+				}
+				if len(TXTStrings(result[usage.Name])) != usage.Strings {
+					t.Errorf("Record %s: unexpected string count in %s", usage.Name, usage)
+				}
+			}
+
+			provider := &mockDNSProvider{}
+			for _, ip := range []string{"10.0.0.1", "10.0.59.1", "10.0.60.1"} {
+				req := CheckRequest{IP: net.ParseIP(ip), Domain: domain}
+				before := CheckHostWithRecords(context.Background(), provider, req, map[string]string{domain: spfRecord})
+				after := CheckHostWithRecords(context.Background(), provider, req, result)
+				if before.Result != after.Result {
+					t.Errorf("%s: original record gives %s, split records give %s", ip, before.Result, after.Result)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatTXTRecord(t *testing.T) {
+	long := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 30) + "-all"
+	testCases := []struct {
+		name    string
+		content string
+		strings int
+	}{
+		{"single string", "v=spf1 ip4:192.0.2.1 -all", 1},
+		{"exactly one string", "v=spf1 " + strings.Repeat("a", 248), 1},
+		{"two strings", long, 2},
+		{"quotes and backslashes", `v=spf1 exp=explain."\` + strings.Repeat("x", 300), 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			strs := TXTStrings(tc.content)
+			if len(strs) != tc.strings || strings.Join(strs, "") != tc.content {
+				t.Fatalf("Expected %d strings joining to the content, got %q", tc.strings, strs)
+			}
+			for _, s := range strs {
+				if len(s) > maxSPFChars {
+					t.Errorf("String exceeds %d bytes: %d", maxSPFChars, len(s))
+				}
+			}
+			presentation := FormatTXTRecord(tc.content)
+			if (presentation == tc.content) != (tc.strings == 1) {
+				t.Errorf("Unexpected presentation %q", presentation)
+			}
+			if got := ParseTXTRecord(presentation); got != tc.content {
+				t.Errorf("Expected %q to parse back to the content, got %q", presentation, got)
+			}
+		})
+	}
+
+	if got := ParseTXTRecord(`"v=spf1 ip4:192.0.2.1" "unterminated`); got != `"v=spf1 ip4:192.0.2.1" "unterminated` {
+		t.Errorf("Expected malformed content unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package spf
+
+// This file tracks the TTLs of the DNS answers a flattened record is built from, so
+// the published records can be refreshed when vendor data may have changed.
+
+// minTTL returns the lower of two TTLs, where 0 means unknown.
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// answerTTL returns the TTL the flattener's DNS provider reported for name, or 0.
+func (f *flattener) answerTTL(name string, qtype uint16) uint32 {
+	ttl, _ := answerTTL(f.dns, name, qtype)
+	return ttl
+}
+
+// termTTLs returns the lowest known TTL of each resolved address term, by mechanism.
+func (f *flattener) termTTLs() map[string]uint32 {
+	ttls := make(map[string]uint32)
+	for _, t := range f.terms {
+		if !t.kept && t.ttl > 0 {
+			ttls[t.mechanism] = minTTL(ttls[t.mechanism], t.ttl)
+		}
+	}
+	return ttls
+}
+
+// RecordTTLs returns, for each of the records SplitAndChainSPF produced from the
+// flattened record, the lowest upstream TTL of the answers its addresses were resolved
+// from. Records whose addresses only come from the domain's own record, or whose
+// answers' TTLs the DNS provider did not report, are omitted. Aggregated ranges take the
+// lowest TTL of the addresses they cover.
+func (r *FlattenResult) RecordTTLs(records map[string]string) map[string]uint32 {
+	ttls := make(map[string]uint32)
+	for name, record := range records {
+		set := &IPSet{}
+		for _, p := range AddressTermPrefixes(recordTerms(record)) {
+			set.AddPrefix(p)
+		}
+		var ttl uint32
+		for mechanism, termTTL := range r.TermTTLs {
+			for _, p := range AddressTermPrefixes([]string{mechanism}) {
+				if set.Overlaps(p) {
+					ttl = minTTL(ttl, termTTL)
+				}
+			}
+		}
+		if ttl > 0 {
+			ttls[name] = ttl
+		}
+	}
+	return ttls
+}
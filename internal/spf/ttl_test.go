@@ -0,0 +1,68 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenSPFWithOptions_TermTTLs(t *testing.T) {
+	provider := &countingDNSProvider{
+		mockDNSProvider: mockDNSProvider{
+			Records: map[string][]string{
+				"example.com":               {"v=spf1 ip4:192.0.2.1 include:_spf.vendor.example a:mail.example.com -all"},
+				"_spf.vendor.example":       {"v=spf1 ip4:198.51.100.0/25 include:_netblocks.vendor.example ~all"},
+				"_netblocks.vendor.example": {"v=spf1 ip4:198.51.100.128/25 ~all"},
+			},
+			IPs: map[string][]net.IP{"mail.example.com": {net.ParseIP("203.0.113.5")}},
+		},
+		TTLs: map[string]uint32{
+			"example.com":               60, // the domain's own record is not upstream data
+			"_spf.vendor.example":       3600,
+			"_netblocks.vendor.example": 300,
+			"mail.example.com":          900,
+		},
+	}
+
+	result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{ForceFlatten: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]uint32{
+		"ip4:198.51.100.0/25":   3600,
+		"ip4:198.51.100.128/25": 300,
+		"ip4:203.0.113.5":       900,
+	}
+	if !reflect.DeepEqual(result.TermTTLs, expected) {
+		t.Errorf("Expected term TTLs %v, got %v", expected, result.TermTTLs)
+	}
+
+	testCases := []struct {
+		name     string
+		records  map[string]string
+		expected map[string]uint32
+	}{
+		{
+			name:     "single record",
+			records:  map[string]string{"example.com": result.Flattened},
+			expected: map[string]uint32{"example.com": 300},
+		},
+		{
+			name: "chain records, one aggregated",
+			records: map[string]string{
+				"example.com":      "v=spf1 ip4:192.0.2.1 include:spf1.example.com include:spf2.example.com -all",
+				"spf1.example.com": "v=spf1 ip4:198.51.100.0/24 -all",
+				"spf2.example.com": "v=spf1 ip4:203.0.113.5 -all",
+			},
+			expected: map[string]uint32{"spf1.example.com": 300, "spf2.example.com": 900},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := result.RecordTTLs(tc.records); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected record TTLs %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
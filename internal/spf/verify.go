@@ -0,0 +1,238 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// This file verifies that flattening preserved a record's meaning by comparing the
+// address space each version authorizes. Both the original include tree and the
+// chained records produced by SplitAndChainSPF are evaluated into IPSets of the
+// addresses that receive a pass result, so differences are found regardless of
+// how the ranges were written, split or aggregated.
+
+// VerifyResult compares the address space authorized by an original SPF record
+// and by its flattened replacement.
+type VerifyResult struct {
+	Original    *IPSet         // Addresses the original record evaluates to pass
+	Flattened   *IPSet         // Addresses the flattened records evaluate to pass
+	Gained      []netip.Prefix // Authorized only by the flattened records
+	Lost        []netip.Prefix // Authorized only by the original record
+	Unevaluated []string       // Terms depending on the client (exists, ptr, macros), treated as not matching
+}
+
+// Equivalent reports whether both versions authorize exactly the same addresses.
+func (r *VerifyResult) Equivalent() bool {
+	return len(r.Gained) == 0 && len(r.Lost) == 0
+}
+
+// Unexplained returns the gained and lost ranges that fall outside allowance, the
+// prefixes in which differences are accepted.
+func (r *VerifyResult) Unexplained(allowance []netip.Prefix) (gained, lost []netip.Prefix) {
+	allowed := &IPSet{}
+	for _, p := range allowance {
+		allowed.AddPrefix(p)
+	}
+	return r.Flattened.Difference(r.Original).Difference(allowed).Prefixes(),
+		r.Original.Difference(r.Flattened).Difference(allowed).Prefixes()
+}
+
+// VerifyFlattening evaluates original, the unflattened SPF record of domain, and the
+// published records produced from it by SplitAndChainSPF, and reports the address
+// ranges gained or lost. Includes and other names outside published are resolved
+// through dns; DNS failures make the verification fail rather than guess.
+func VerifyFlattening(ctx context.Context, domain, original string, published map[string]string, dns DNSProvider) (*VerifyResult, error) {
+	return VerifyFlatteningWithFailures(ctx, domain, original, published, dns, nil)
+}
+
+// VerifyFlatteningWithFailures is VerifyFlattening for a flattening that reported failed
+// terms (FlattenResult.FailedTerms). Lookup errors for those terms in the original record
+// are expected; the terms are listed as unevaluated instead of failing the verification.
+func VerifyFlatteningWithFailures(ctx context.Context, domain, original string, published map[string]string, dns DNSProvider, failed []FailedTerm) (*VerifyResult, error) {
+	before := &spaceEvaluator{dns: dns, records: map[string]string{domain: original}}
+	if len(failed) > 0 {
+		before.failed = make(map[string]bool, len(failed))
+		for _, t := range failed {
+			before.failed[t.Term+" "+t.Domain] = true
+		}
+	}
+	originalSet, err := before.passSet(ctx, domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate original SPF record for %s: %w", domain, err)
+	}
+
+	after := &spaceEvaluator{dns: dns, records: published}
+	flattenedSet, err := after.passSet(ctx, domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate flattened SPF records for %s: %w", domain, err)
+	}
+
+	return &VerifyResult{
+		Original:    originalSet,
+		Flattened:   flattenedSet,
+		Gained:      flattenedSet.Difference(originalSet).Prefixes(),
+		Lost:        originalSet.Difference(flattenedSet).Prefixes(),
+		Unevaluated: before.unevaluated,
+	}, nil
+}
+
+// spaceEvaluator computes the set of client addresses for which a record evaluates
+// to pass, applying RFC 7208 first-match semantics to address ranges.
+type spaceEvaluator struct {
+	dns         DNSProvider
+	records     map[string]string
+	failed      map[string]bool // "term domain" of terms whose lookup failures are tolerated
+	unevaluated []string
+}
+
+func (e *spaceEvaluator) passSet(ctx context.Context, domain string, depth int) (*IPSet, error) {
+	const maxDepth = 10
+	if depth > maxDepth {
+		return nil, fmt.Errorf("recursion depth exceeded for %s", domain)
+	}
+
+	record, ok := e.records[domain]
+	if !ok {
+		txts, err := e.dns.LookupTXT(ctx, domain)
+		if err != nil && !isVoidLookup(err) {
+			return nil, fmt.Errorf("failed to lookup SPF for %s: %v", domain, err)
+		}
+		record = findSPFRecord(txts)
+		if record == "" {
+			return nil, fmt.Errorf("%s has no SPF record", domain)
+		}
+	}
+	parsed, err := ParseRecord(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SPF record for %s: %w", domain, err)
+	}
+
+	// decided holds the addresses matched by an earlier term; only the first match counts.
+	pass, decided := &IPSet{}, &IPSet{}
+	for _, term := range parsed.Mechanisms() {
+		matches, err := e.matchSet(ctx, term, domain, depth)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			continue
+		}
+		if term.Qualifier == QualifierPass {
+			pass = pass.Union(matches.Difference(decided))
+		}
+		if term.Kind == KindAll {
+			return pass, nil
+		}
+		decided = decided.Union(matches)
+	}
+
+	if redirect, ok := parsed.Redirect(); ok {
+		if redirect.HasMacros() {
+			e.unevaluated = append(e.unevaluated, redirect.String()+" ("+domain+")")
+			return pass, nil
+		}
+		redirected, err := e.passSet(ctx, redirect.DomainSpec, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		pass = pass.Union(redirected.Difference(decided))
+	}
+	return pass, nil
+}
+
+// matchSet returns the addresses a mechanism matches, or nil for terms whose matches
+// depend on the connecting client and cannot be expressed as address ranges.
+func (e *spaceEvaluator) matchSet(ctx context.Context, term Term, domain string, depth int) (*IPSet, error) {
+	if mustKeep(term) {
+		e.unevaluated = append(e.unevaluated, term.String()+" ("+domain+")")
+		return nil, nil
+	}
+
+	matches := &IPSet{}
+	switch term.Kind {
+	case KindAll:
+		return allAddresses(), nil
+	case KindIP4, KindIP6:
+		addPrefix(matches, term.IP, term.IP4Prefix, term.IP6Prefix)
+	case KindInclude:
+		return e.passSet(ctx, term.DomainSpec, depth+1)
+	case KindA:
+		if err := e.addAddresses(ctx, matches, targetDomain(term, domain), term); err != nil {
+			return e.tolerate(term, domain, err)
+		}
+	case KindMX:
+		target := targetDomain(term, domain)
+		mxs, err := e.dns.LookupMX(ctx, target)
+		if err != nil && !isVoidLookup(err) {
+			return e.tolerate(term, domain, fmt.Errorf("failed to lookup MX for %s: %v", target, err))
+		}
+		for _, mx := range mxs {
+			if err := e.addAddresses(ctx, matches, strings.TrimSuffix(mx.Host, "."), term); err != nil {
+				return e.tolerate(term, domain, err)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// tolerate returns err unless term is a known failed term, which is then treated as
+// unevaluated.
+func (e *spaceEvaluator) tolerate(term Term, domain string, err error) (*IPSet, error) {
+	if !e.failed[term.String()+" "+domain] {
+		return nil, err
+	}
+	e.unevaluated = append(e.unevaluated, term.String()+" ("+domain+", lookup failed)")
+	return nil, nil
+}
+
+func (e *spaceEvaluator) addAddresses(ctx context.Context, set *IPSet, name string, term Term) error {
+	ips, err := e.dns.LookupIP(ctx, name)
+	if err != nil && !isVoidLookup(err) {
+		return fmt.Errorf("failed to lookup A/AAAA for %s: %v", name, err)
+	}
+	for _, ip := range ips {
+		addPrefix(set, ip, term.IP4Prefix, term.IP6Prefix)
+	}
+	return nil
+}
+
+// AddressTermPrefixes returns the address ranges covered by ip4:/ip6: terms, which
+// may carry a qualifier; other terms are ignored.
+func AddressTermPrefixes(terms []string) []netip.Prefix {
+	set := &IPSet{}
+	for _, t := range terms {
+		term, err := ParseTerm(t)
+		if err == nil && (term.Kind == KindIP4 || term.Kind == KindIP6) {
+			addPrefix(set, term.IP, term.IP4Prefix, term.IP6Prefix)
+		}
+	}
+	return set.Prefixes()
+}
+
+// addPrefix adds ip with the CIDR length that applies to its address family.
+func addPrefix(set *IPSet, ip net.IP, ip4Prefix, ip6Prefix int) {
+	if p, ok := addressPrefix(ip, ip4Prefix, ip6Prefix); ok {
+		set.AddPrefix(p)
+	}
+}
+
+// addressPrefix returns the network of ip with the CIDR length that applies to its
+// address family.
+func addressPrefix(ip net.IP, ip4Prefix, ip6Prefix int) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	bits := ip6Prefix
+	if addr.Is4() {
+		bits = ip4Prefix
+	}
+	if bits < 0 {
+		bits = addr.BitLen()
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), true
+}
@@ -0,0 +1,113 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyFlattening(t *testing.T) {
+	provider := &voidDNSProvider{mockDNSProvider{
+		Records: map[string][]string{
+			"_spf.vendor.example": {"v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.7 ip4:198.51.100.0/24 ~all"},
+			"_spf.other.example":  {"v=spf1 a:mail.other.example ip6:2001:db8::/48 -all"},
+		},
+		IPs: map[string][]net.IP{
+			"mail.other.example": {net.ParseIP("203.0.113.10")},
+		},
+	}}
+	original := "v=spf1 include:_spf.vendor.example include:_spf.other.example -all"
+
+	testCases := []struct {
+		name      string
+		published map[string]string
+		gained    []string
+		lost      []string
+	}{
+		{
+			name: "equivalent after splitting",
+			published: map[string]string{
+				"example.com":      "v=spf1 include:spf1.example.com include:spf2.example.com -all",
+				"spf1.example.com": "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/30 ip4:198.51.100.4/31 ip4:198.51.100.6 ~all",
+				"spf2.example.com": "v=spf1 ip4:198.51.100.8/29 ip4:198.51.100.16/28 ip4:198.51.100.32/27 ip4:198.51.100.64/26 ip4:198.51.100.128/25 ip4:203.0.113.10 ip6:2001:db8::/48 ~all",
+			},
+		},
+		{
+			name: "shadowed address authorized and range lost",
+			published: map[string]string{
+				"example.com": "v=spf1 ip4:192.0.2.0/25 ip4:198.51.100.0/24 ip4:203.0.113.10 ip6:2001:db8::/48 -all",
+			},
+			gained: []string{"198.51.100.7/32"},
+			lost:   []string{"192.0.2.128/25"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := VerifyFlattening(context.Background(), "example.com", original, tc.published, provider)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := prefixStrings(result.Gained); !reflect.DeepEqual(got, tc.gained) {
+				t.Errorf("Expected gained %v, got %v", tc.gained, got)
+			}
+			if got := prefixStrings(result.Lost); !reflect.DeepEqual(got, tc.lost) {
+				t.Errorf("Expected lost %v, got %v", tc.lost, got)
+			}
+			if result.Equivalent() != (tc.gained == nil && tc.lost == nil) {
+				t.Errorf("Unexpected Equivalent() = %v", result.Equivalent())
+			}
+		})
+	}
+}
+
+func TestVerifyResult_Unexplained(t *testing.T) {
+	result := &VerifyResult{
+		Original:  prefixSet("192.0.2.0/24"),
+		Flattened: prefixSet("192.0.2.0/25", "198.51.100.0/24"),
+	}
+
+	gained, lost := result.Unexplained([]netip.Prefix{netip.MustParsePrefix("198.51.100.0/23")})
+	if len(gained) != 0 {
+		t.Errorf("Expected gained range to be allowed, got %v", gained)
+	}
+	if got := prefixStrings(lost); !reflect.DeepEqual(got, []string{"192.0.2.128/25"}) {
+		t.Errorf("Expected lost [192.0.2.128/25], got %v", got)
+	}
+}
+
+func TestVerifyFlattening_RoundTrip(t *testing.T) {
+	provider := &voidDNSProvider{mockDNSProvider{
+		Records: map[string][]string{
+			"example.com":      {"v=spf1 mx include:_spf.example.net exists:%{i}._spf.example.com -all"},
+			"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 ~all"},
+		},
+		IPs: map[string][]net.IP{
+			"mx1.example.com": {net.ParseIP("203.0.113.25")},
+		},
+		MXs: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com", Pref: 10}},
+		},
+	}}
+
+	result, err := FlattenSPFWithOptions(context.Background(), "example.com", provider, FlattenOptions{ForceFlatten: true, Aggregate: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	published, err := SplitAndChainSPF(result.Flattened, "example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	verified, err := VerifyFlattening(context.Background(), "example.com", result.Original, published, provider)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !verified.Equivalent() {
+		t.Errorf("Expected equivalent records, gained %v lost %v", verified.Gained, verified.Lost)
+	}
+	if len(verified.Unevaluated) != 1 {
+		t.Errorf("Expected the exists term to be reported as unevaluated, got %v", verified.Unevaluated)
+	}
+}
@@ -0,0 +1,296 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain bounds the aliases followed by ZoneFileDNSProvider for one lookup.
+const maxCNAMEChain = 8
+
+// ZoneFileDNSProvider answers lookups from RFC 1035 zone files instead of querying DNS,
+// so records can be flattened and verified offline, or with edited copies of vendor
+// records. Names inside a loaded zone without records of the queried type are void
+// lookups, like NXDOMAIN and NODATA answers. Lookups of names outside every loaded zone
+// fail, so a missing zone file is not mistaken for a missing record. CNAME records and
+// wildcards are followed.
+type ZoneFileDNSProvider struct {
+	zones   map[string]bool // Zone origins
+	names   map[string]bool // Names owning records, and their parents within the zone
+	records map[cacheKey][]dns.RR
+	ttls    answerTTLs
+}
+
+// NewZoneFileDNSProvider returns a provider without zones; see LoadZone.
+func NewZoneFileDNSProvider() *ZoneFileDNSProvider {
+	return &ZoneFileDNSProvider{
+		zones:   make(map[string]bool),
+		names:   make(map[string]bool),
+		records: make(map[cacheKey][]dns.RR),
+	}
+}
+
+// LoadZoneDir loads every zone file in dir. The default origin of a file is its name
+// without a .zone or .db extension, so vendor.example.zone holds vendor.example. Hidden
+// files and subdirectories are skipped.
+func LoadZoneDir(dir string) (*ZoneFileDNSProvider, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone directory: %w", err)
+	}
+	z := NewZoneFileDNSProvider()
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		origin := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".zone"), ".db")
+		if err := z.LoadZoneFile(filepath.Join(dir, entry.Name()), origin); err != nil {
+			return nil, err
+		}
+	}
+	if len(z.zones) == 0 {
+		return nil, fmt.Errorf("no zone files found in %s", dir)
+	}
+	return z, nil
+}
+
+// LoadZoneFile loads the zone file at path with origin as its default origin.
+func (z *ZoneFileDNSProvider) LoadZoneFile(path, origin string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read zone file: %w", err)
+	}
+	defer file.Close()
+	return z.LoadZone(file, origin, path)
+}
+
+// LoadZone loads the records of a zone in zone file format from r. origin is the default
+// origin of relative names, and the zone loaded unless r has SOA records, whose owners
+// are then the zones. file is used in error messages and to resolve $INCLUDE directives.
+func (z *ZoneFileDNSProvider) LoadZone(r io.Reader, origin, file string) error {
+	origin = canonicalName(origin)
+	if _, ok := dns.IsDomainName(origin); !ok {
+		return fmt.Errorf("invalid zone origin %q for %s", origin, file)
+	}
+	zp := dns.NewZoneParser(r, origin, file)
+	zp.SetIncludeAllowed(true)
+	var rrs []dns.RR
+	zones := make(map[string]bool)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+		if rr.Header().Rrtype == dns.TypeSOA {
+			zones[canonicalName(rr.Header().Name)] = true
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("failed to parse zone file %s: %w", file, err)
+	}
+	if len(zones) == 0 {
+		zones[origin] = true
+	}
+	for zone := range zones {
+		z.zones[zone] = true
+	}
+	for _, rr := range rrs {
+		name := canonicalName(rr.Header().Name)
+		key := cacheKey{name, rr.Header().Rrtype}
+		z.records[key] = append(z.records[key], rr)
+		// Parents up to the zone exist too, as empty non-terminals at least
+		for n := name; !z.names[n]; n = parentName(n) {
+			z.names[n] = true
+			if zones[n] || n == "." {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Zones returns the origins of the loaded zones, sorted.
+func (z *ZoneFileDNSProvider) Zones() []string {
+	zones := make([]string, 0, len(z.zones))
+	for zone := range z.zones {
+		zones = append(zones, strings.TrimSuffix(zone, "."))
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// TXTRecords returns the TXT records at name, each joined into one string.
+func (z *ZoneFileDNSProvider) TXTRecords(name string) []string {
+	var records []string
+	for _, rr := range z.records[cacheKey{canonicalName(name), dns.TypeTXT}] {
+		records = append(records, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+	return records
+}
+
+// TXTNames returns the names owning TXT records at or below domain, sorted.
+func (z *ZoneFileDNSProvider) TXTNames(domain string) []string {
+	domain = canonicalName(domain)
+	var names []string
+	for key := range z.records {
+		if key.qtype == dns.TypeTXT && dns.IsSubDomain(domain, key.name) {
+			names = append(names, strings.TrimSuffix(key.name, "."))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the records of qtype at name, following CNAME records. A name without
+// such records yields none and no error.
+func (z *ZoneFileDNSProvider) lookup(name string, qtype uint16) ([]dns.RR, error) {
+	queried := name
+	name = canonicalName(name)
+	for i := 0; i < maxCNAMEChain; i++ {
+		if !z.inZone(name) {
+			return nil, fmt.Errorf("%s is not in any loaded zone file", strings.TrimSuffix(name, "."))
+		}
+		owner := z.owner(name)
+		if owner == "" {
+			return nil, z.notFound(queried)
+		}
+		if rrs := z.records[cacheKey{owner, qtype}]; len(rrs) > 0 {
+			answers := make([]dns.RR, len(rrs))
+			for j, rr := range rrs {
+				answers[j] = dns.Copy(rr)
+				answers[j].Header().Name = name // expands wildcards
+			}
+			return answers, nil
+		}
+		cname := z.records[cacheKey{owner, dns.TypeCNAME}]
+		if len(cname) == 0 {
+			return nil, nil
+		}
+		name = canonicalName(cname[0].(*dns.CNAME).Target)
+	}
+	return nil, fmt.Errorf("too many CNAME records followed for %s", queried)
+}
+
+// inZone reports whether name is inside a loaded zone.
+func (z *ZoneFileDNSProvider) inZone(name string) bool {
+	for n := name; ; n = parentName(n) {
+		if z.zones[n] {
+			return true
+		}
+		if n == "." {
+			return false
+		}
+	}
+}
+
+// owner returns the name whose records answer for name: name itself when it exists,
+// otherwise the wildcard at its closest existing parent (RFC 4592), or "" for none.
+func (z *ZoneFileDNSProvider) owner(name string) string {
+	if z.names[name] {
+		return name
+	}
+	for n := parentName(name); ; n = parentName(n) {
+		if wildcard := "*." + n; z.names[wildcard] {
+			return wildcard
+		}
+		if z.names[n] || z.zones[n] || n == "." {
+			return ""
+		}
+	}
+}
+
+func (z *ZoneFileDNSProvider) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, Server: "zone files", IsNotFound: true}
+}
+
+func (z *ZoneFileDNSProvider) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	answers, err := z.lookup(domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, z.notFound(domain)
+	}
+	var results []string
+	for _, ans := range answers {
+		results = append(results, strings.Join(ans.(*dns.TXT).Txt, ""))
+	}
+	z.ttls.record(domain, dns.TypeTXT, answers)
+	return validateTXTRecords(results, domain)
+}
+
+func (z *ZoneFileDNSProvider) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	var results []net.IP
+	var answers []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := z.lookup(domain, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, ans := range rrs {
+			switch rr := ans.(type) {
+			case *dns.A:
+				results = append(results, rr.A)
+			case *dns.AAAA:
+				results = append(results, rr.AAAA)
+			}
+		}
+		answers = append(answers, rrs...)
+	}
+	if len(results) == 0 {
+		return nil, z.notFound(domain)
+	}
+	z.ttls.record(domain, dns.TypeA, answers)
+	return validateIPAddresses(results, domain)
+}
+
+func (z *ZoneFileDNSProvider) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	answers, err := z.lookup(domain, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, z.notFound(domain)
+	}
+	var results []*net.MX
+	for _, ans := range answers {
+		mx := ans.(*dns.MX)
+		results = append(results, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+	z.ttls.record(domain, dns.TypeMX, answers)
+	return validateMXRecords(results, domain)
+}
+
+// LookupAddr returns the PTR names of addr from the loaded reverse zones.
+func (z *ZoneFileDNSProvider) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := z.lookup(reverse, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, z.notFound(reverse)
+	}
+	var results []string
+	for _, ans := range answers {
+		results = append(results, ans.(*dns.PTR).Ptr)
+	}
+	return results, nil
+}
+
+// AnswerTTL implements TTLReporter with the TTLs of the zone file records.
+func (z *ZoneFileDNSProvider) AnswerTTL(name string, qtype uint16) (uint32, bool) {
+	return z.ttls.lookup(name, qtype)
+}
+
+func (z *ZoneFileDNSProvider) Close() error {
+	return nil
+}
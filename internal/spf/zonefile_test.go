@@ -0,0 +1,140 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$TTL 3600
+@        IN SOA  ns1 hostmaster 1 7200 3600 1209600 300
+@        IN TXT  "v=spf1 include:_spf.vendor.example " "mx -all"
+@        IN MX   10 mail
+mail     IN A    192.0.2.25
+mail     IN AAAA 2001:db8::25
+www      IN CNAME mail
+alias    IN CNAME _spf.vendor.example.
+*.wild   IN TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+a.b      IN A    192.0.2.1
+`
+
+const testVendorZoneFile = `$ORIGIN vendor.example.
+_spf 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"
+`
+
+func TestZoneFileDNSProvider(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"example.com.zone": testZoneFile,
+		"vendor.example":   testVendorZoneFile,
+		".hidden":          "not a zone file",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	z, err := LoadZoneDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if zones := z.Zones(); !reflect.DeepEqual(zones, []string{"example.com", "vendor.example"}) {
+		t.Errorf("Expected the zones of both files, got %v", zones)
+	}
+
+	ctx := context.Background()
+	testCases := []struct {
+		name      string
+		lookup    func() (any, error)
+		expected  any
+		expectErr string // "void" for a void lookup
+	}{
+		{"joined TXT strings", func() (any, error) { return z.LookupTXT(ctx, "example.com") },
+			[]string{"v=spf1 include:_spf.vendor.example mx -all"}, ""},
+		{"names are case insensitive", func() (any, error) { return z.LookupTXT(ctx, "_SPF.Vendor.Example.") },
+			[]string{"v=spf1 ip4:203.0.113.0/24 -all"}, ""},
+		{"A and AAAA", func() (any, error) { return z.LookupIP(ctx, "mail.example.com") },
+			[]string{"192.0.2.25", "2001:db8::25"}, ""},
+		{"CNAME", func() (any, error) { return z.LookupIP(ctx, "www.example.com") },
+			[]string{"192.0.2.25", "2001:db8::25"}, ""},
+		{"CNAME across zones", func() (any, error) { return z.LookupTXT(ctx, "alias.example.com") },
+			[]string{"v=spf1 ip4:203.0.113.0/24 -all"}, ""},
+		{"MX", func() (any, error) { return z.LookupMX(ctx, "example.com") },
+			[]string{"10 mail.example.com."}, ""},
+		{"wildcard", func() (any, error) { return z.LookupTXT(ctx, "x.y.wild.example.com") },
+			[]string{"v=spf1 ip4:198.51.100.0/24 -all"}, ""},
+		{"no data", func() (any, error) { return z.LookupTXT(ctx, "mail.example.com") }, nil, "void"},
+		{"empty non-terminal", func() (any, error) { return z.LookupIP(ctx, "b.example.com") }, nil, "void"},
+		{"missing name", func() (any, error) { return z.LookupTXT(ctx, "missing.example.com") }, nil, "void"},
+		{"outside the zones", func() (any, error) { return z.LookupTXT(ctx, "example.org") }, nil, "not in any loaded zone file"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := tc.lookup()
+			switch {
+			case tc.expectErr == "void":
+				if !isVoidLookup(err) {
+					t.Errorf("Expected a void lookup, got %v, %v", result, err)
+				}
+				return
+			case tc.expectErr != "":
+				if err == nil || isVoidLookup(err) || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected error containing %q, got %v", tc.expectErr, err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got []string
+			switch r := result.(type) {
+			case []string:
+				got = r
+			case []net.IP:
+				for _, ip := range r {
+					got = append(got, ip.String())
+				}
+			case []*net.MX:
+				for _, mx := range r {
+					got = append(got, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+				}
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	if ttl, ok := z.AnswerTTL("_spf.vendor.example", dns.TypeTXT); !ok || ttl != 300 {
+		t.Errorf("Expected the zone file TTL 300, got %d, %v", ttl, ok)
+	}
+	if names := z.TXTNames("example.com"); !reflect.DeepEqual(names, []string{"*.wild.example.com", "example.com"}) {
+		t.Errorf("Unexpected TXT names %v", names)
+	}
+}
+
+func TestLoadZoneDir_Errors(t *testing.T) {
+	empty := t.TempDir()
+	if _, err := LoadZoneDir(empty); err == nil {
+		t.Error("Expected an error for a directory without zone files")
+	}
+
+	invalid := t.TempDir()
+	if err := os.WriteFile(filepath.Join(invalid, "example.com.zone"), []byte("@ IN TXT\n@ IN BOGUS x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadZoneDir(invalid); err == nil || !strings.Contains(err.Error(), "example.com.zone") {
+		t.Errorf("Expected a parse error naming the file, got %v", err)
+	}
+
+	if _, err := LoadZoneDir(filepath.Join(empty, "missing")); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
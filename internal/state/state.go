@@ -0,0 +1,136 @@
+// Package state persists what spf-flattener observed between runs.
+//
+// The state file records, per domain, when each resolved address term was last seen
+// and which term of the domain's record it came from. Vendors publishing round-robin
+// or geo-dependent answers make addresses appear and disappear from one run to the
+// next; keeping recently seen addresses published for a grace period stops every run
+// from triggering a DNS update.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPath is the state file used when the config does not set state_file.
+const DefaultPath = "spf-flattener-state.json"
+
+// State holds what is known about each resolved address term, by domain. It is safe
+// for concurrent use.
+type State struct {
+	mu      sync.Mutex
+	path    string
+	Domains map[string]map[string]Entry `json:"domains"` // domain -> term (e.g. "ip4:192.0.2.1") -> entry
+}
+
+// Entry describes one resolved address term.
+type Entry struct {
+	LastSeen time.Time `json:"last_seen"`
+	Source   string    `json:"source,omitempty"` // The term of the domain's record it came from, e.g. "include:_spf.vendor.example"
+}
+
+// Load reads the state file at path. A missing file yields an empty state that
+// Save will create.
+func Load(path string) (*State, error) {
+	s := &State{path: path, Domains: make(map[string]map[string]Entry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if s.Domains == nil {
+		s.Domains = make(map[string]map[string]Entry)
+	}
+	return s, nil
+}
+
+// Retained returns the terms of domain last seen within retainFor of now, sorted.
+func (s *State) Retained(domain string, now time.Time, retainFor time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var terms []string
+	for term, entry := range s.Domains[domain] {
+		if now.Sub(entry.LastSeen) < retainFor {
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// Lookup returns what is recorded about term for domain.
+func (s *State) Lookup(domain, term string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.Domains[domain][term]
+	return entry, ok
+}
+
+// Entries returns a copy of everything recorded for domain.
+func (s *State) Entries(domain string) map[string]Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make(map[string]Entry, len(s.Domains[domain]))
+	for term, entry := range s.Domains[domain] {
+		entries[term] = entry
+	}
+	return entries
+}
+
+// Observe records that the terms, mapped to their sources, were resolved for domain at
+// now, and forgets terms not seen within retainFor.
+func (s *State) Observe(domain string, terms map[string]string, now time.Time, retainFor time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.Domains[domain]
+	if entries == nil {
+		entries = make(map[string]Entry)
+		s.Domains[domain] = entries
+	}
+	for term, source := range terms {
+		entries[term] = Entry{LastSeen: now.UTC(), Source: source}
+	}
+	for term, entry := range entries {
+		if now.Sub(entry.LastSeen) > retainFor {
+			delete(entries, term)
+		}
+	}
+}
+
+// Save writes the state file, replacing it atomically.
+func (s *State) Save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	return nil
+}
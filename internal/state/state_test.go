@@ -0,0 +1,72 @@
+package state
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestState_RetainedAndObserve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load of a missing file failed: %v", err)
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	retainFor := 72 * time.Hour
+	s.Observe("example.com", map[string]string{"ip4:192.0.2.1": "a:mail.vendor.example", "ip4:192.0.2.2": "a:mail.vendor.example"}, start, retainFor)
+	s.Observe("example.com", map[string]string{"ip4:192.0.2.2": "a:mail.vendor.example"}, start.Add(48*time.Hour), retainFor)
+
+	testCases := []struct {
+		name     string
+		now      time.Time
+		expected []string
+	}{
+		{"within the grace period", start.Add(71 * time.Hour), []string{"ip4:192.0.2.1", "ip4:192.0.2.2"}},
+		{"after the grace period", start.Add(72 * time.Hour), []string{"ip4:192.0.2.2"}},
+		{"every term expired", start.Add(200 * time.Hour), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := s.Retained("example.com", tc.now, retainFor); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	// Without retention only the terms seen now are kept
+	s.Observe("other.example", map[string]string{"ip4:198.51.100.1": "other.example"}, start, 0)
+	if _, ok := s.Lookup("other.example", "ip4:198.51.100.1"); !ok {
+		t.Error("Expected ip4:198.51.100.1 to be recorded")
+	}
+
+	// Observing forgets expired terms
+	s.Observe("example.com", nil, start.Add(100*time.Hour), retainFor)
+	if _, ok := s.Lookup("example.com", "ip4:192.0.2.1"); ok {
+		t.Error("Expected ip4:192.0.2.1 to be forgotten")
+	}
+}
+
+func TestState_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	seen := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.Observe("example.com", map[string]string{"~ip6:2001:db8::1": "~include:_spf.vendor.example"}, seen, time.Hour)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	got, ok := loaded.Lookup("example.com", "~ip6:2001:db8::1")
+	if !ok || !got.LastSeen.Equal(seen) || got.Source != "~include:_spf.vendor.example" {
+		t.Errorf("Expected last seen %v from ~include:_spf.vendor.example, got %+v (found %v)", seen, got, ok)
+	}
+}